@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stackPointer is the value of SP at a command: Base plus Offset, Base
+// being LCL in a function and "" for the address itself in the code
+// before the first function, which runs with SP at the stack base.
+type stackPointer struct {
+	Base   string
+	Offset int
+}
+
+func (sp stackPointer) plus(n int) stackPointer {
+	return stackPointer{sp.Base, sp.Offset + n}
+}
+
+// in resolves the base of sp when frame holds its address.
+func (sp stackPointer) in(frame map[string]int) stackPointer {
+	if addr, ok := frame[sp.Base]; ok {
+		return stackPointer{Offset: addr + sp.Offset}
+	}
+	return sp
+}
+
+func (sp stackPointer) String() string {
+	switch {
+	case sp.Base == "":
+		return fmt.Sprint(sp.Offset)
+	case sp.Offset == 0:
+		return sp.Base
+	case sp.Offset < 0:
+		return fmt.Sprintf("%s%d", sp.Base, sp.Offset)
+	}
+	return fmt.Sprintf("%s+%d", sp.Base, sp.Offset)
+}
+
+// commandHeights is the height of the working stack before every command
+// of g, by index in the program, following its paths from the entry.
+// Commands not reached, or of a function whose paths disagree on the
+// height, are left out.
+func commandHeights(instructions []*Instruction, g *functionCFG) map[int]int {
+	heights := map[int]int{}
+	if len(g.Blocks) == 0 {
+		return heights
+	}
+	start := map[int]int{0: 0}
+	work := []int{0}
+	for len(work) > 0 {
+		id := work[0]
+		work = work[1:]
+		b := g.Blocks[id]
+		h := start[id]
+		for i := b.Start; i < b.End; i++ {
+			heights[i] = h
+			if instructions[i].CommandType == CommandTypeReturn {
+				break
+			}
+			pops, pushes := stackEffect(instructions[i])
+			h += pushes - pops
+		}
+		for _, s := range b.Succs {
+			old, ok := start[s]
+			switch {
+			case !ok:
+				start[s] = h
+				work = append(work, s)
+			case old != h:
+				return map[int]int{}
+			}
+		}
+	}
+	return heights
+}
+
+// stackAnnotations describes what every command of a translation does to
+// the stack and the RAM, "" for the commands with nothing to say: the VM
+// stack pointer before and after it, relative to LCL in a function, and
+// the words of the segments it reads and writes. Static variables are at
+// their addresses in symbols, and named when they have none. The frame of
+// the entry function the bootstrap code calls, and of nothing else, is at
+// known addresses, as is the stack of the code before the first function.
+func stackAnnotations(tr *translation, symbols map[string]int) []string {
+	notes := make([]string, len(tr.Instructions))
+	locals := map[string]int{}
+	called := map[string]bool{}
+	for _, inst := range tr.Instructions {
+		switch inst.CommandType {
+		case CommandTypeFunction:
+			locals[inst.Arg1] = inst.Arg2Val
+		case CommandTypeCall:
+			called[inst.Arg1] = true
+		}
+	}
+	for _, g := range buildCFGs(tr.Instructions) {
+		base := stackPointer{Base: "LCL", Offset: locals[g.Function]}
+		frame := map[string]int{}
+		switch {
+		case g.Function == "":
+			base = stackPointer{Offset: layout.Stack}
+		case g.Function == tr.Bootstrap && !called[g.Function]:
+			frame["ARG"] = layout.Stack
+			frame["LCL"] = layout.Stack + tr.EntryNArgs + callFrameSize
+		}
+		heights := commandHeights(tr.Instructions, g)
+		for i := g.Start; i < g.End; i++ {
+			inst := tr.Instructions[i]
+			if inst.CommandType == CommandTypeLabel || inst.CommandType == CommandTypeStaticInit {
+				continue
+			}
+			parts := []string{}
+			h, known := heights[i]
+			before := base.plus(h)
+			pops, pushes := stackEffect(inst)
+			after := before.plus(pushes - pops)
+			switch inst.CommandType {
+			case CommandTypeFunction:
+				before = stackPointer{Base: "LCL"}.in(frame)
+				if inst.Arg2Val > 0 {
+					parts = append(parts, "clears "+ramWords(before, inst.Arg2Val))
+				}
+			case CommandTypeCall:
+				parts = append(parts, "saves the frame in "+ramWords(before.in(frame), callFrameSize))
+			case CommandTypeReturn:
+				after = stackPointer{Base: "ARG", Offset: 1}
+				parts = append(parts, "writes "+ramWords(stackPointer{Base: "ARG"}.in(frame), 1), "restores the frame from "+ramWords(stackPointer{Base: "LCL", Offset: -callFrameSize}.in(frame), callFrameSize))
+			case CommandTypePush, CommandTypePop:
+				if cell := segmentCell(inst, symbols, frame); cell != "" {
+					access := "reads "
+					if inst.CommandType == CommandTypePop {
+						access = "writes "
+					}
+					parts = append(parts, access+cell)
+				}
+			}
+			if known {
+				before, after = before.in(frame), after.in(frame)
+				sp := "SP: " + before.String()
+				if after != before {
+					sp += "->" + after.String()
+				}
+				parts = append([]string{sp}, parts...)
+			}
+			notes[i] = strings.Join(parts, ", ")
+		}
+	}
+	return notes
+}
+
+// ramWords names the n words from sp.
+func ramWords(sp stackPointer, n int) string {
+	if n == 1 {
+		return fmt.Sprintf("RAM[%s]", sp)
+	}
+	return fmt.Sprintf("RAM[%s..%s]", sp, sp.plus(n-1))
+}
+
+// segmentCell is the word a push or pop of a segment other than constant
+// uses, "" for the others.
+func segmentCell(inst *Instruction, symbols map[string]int, frame map[string]int) string {
+	n := inst.Arg2Val
+	switch inst.SegmentType {
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		return ramWords(stackPointer{Base: inst.SegmentType.ID(), Offset: n}.in(frame), 1)
+	case SegmentTypeTemp:
+		return fmt.Sprintf("RAM[%d]", layout.Temp+n)
+	case SegmentTypePointer:
+		return fmt.Sprintf("RAM[%d]", 3+n)
+	case SegmentTypeStatic:
+		sym, _ := staticSymbol(inst)
+		if addr, ok := symbols[sym]; ok {
+			return fmt.Sprintf("RAM[%d]", addr)
+		}
+		return fmt.Sprintf("RAM[%s]", sym)
+	}
+	return ""
+}
+
+// annotateStack adds the stackAnnotations of a translation to its code,
+// as a comment after the one naming each command.
+func annotateStack(tr *translation) {
+	symbols := map[string]int{}
+	if prog, err := assembleHack(tr.Lines); err == nil {
+		symbols = prog.Symbols
+	}
+	notes := stackAnnotations(tr, symbols)
+	lines, origin := []string{}, []int{}
+	for k, line := range tr.Lines {
+		lines, origin = append(lines, line), append(origin, tr.Origin[k])
+		cmd := tr.Origin[k]
+		if cmd >= 0 && (k == 0 || tr.Origin[k-1] != cmd) && notes[cmd] != "" {
+			lines, origin = append(lines, "// "+notes[cmd]), append(origin, cmd)
+		}
+	}
+	tr.Lines, tr.Origin = lines, origin
+}
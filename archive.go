@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveExts are the archive formats accepted as sources, longest first so
+// that .tar.gz is not taken for .gz.
+var archiveExts = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+// archiveExt returns the archive extension of name, "" when it is not an
+// archive.
+func archiveExt(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return name[len(name)-len(ext):]
+		}
+	}
+	return ""
+}
+
+func isArchive(name string) bool {
+	return archiveExt(name) != ""
+}
+
+// vmArchive is an archive of sources read in place: its files are read
+// through FS, nothing is extracted to disk.
+type vmArchive struct {
+	fs.FS
+	// Files are the .vm files in the archive, slash separated, in the order
+	// they are stored
+	Files []string
+	close func() error
+}
+
+func (a *vmArchive) Close() error {
+	if a.close == nil {
+		return nil
+	}
+	return a.close()
+}
+
+// archiveSource reports whether an archive member is a VM source. The
+// metadata archivers add next to the files (__MACOSX/, ._Main.vm) is not.
+func archiveSource(name string) bool {
+	if path.Ext(name) != ".vm" || strings.HasPrefix(path.Base(name), "._") {
+		return false
+	}
+	return !strings.HasPrefix(name, "__MACOSX/") && !strings.Contains(name, "/__MACOSX/")
+}
+
+// openArchive opens a zip, tar or gzipped tar archive.
+func openArchive(name string) (*vmArchive, error) {
+	if strings.EqualFold(archiveExt(name), ".zip") {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		a := &vmArchive{FS: &zr.Reader, close: zr.Close}
+		for _, f := range zr.File {
+			if !f.FileInfo().IsDir() && archiveSource(f.Name) {
+				a.Files = append(a.Files, f.Name)
+			}
+		}
+		return a, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if ext := strings.ToLower(archiveExt(name)); ext == ".tar.gz" || ext == ".tgz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tfs := memFS{}
+	a := &vmArchive{FS: tfs}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		member := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if hdr.Typeflag != tar.TypeReg || !fs.ValidPath(member) || !archiveSource(member) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", name, member, err)
+		}
+		if _, ok := tfs[member]; !ok {
+			a.Files = append(a.Files, member)
+		}
+		tfs[member] = data
+	}
+	return a, nil
+}
+
+// memFS is a flat file system held in memory, by slash separated path:
+// the sources of a tar archive, which unlike a zip archive cannot be read
+// at random, or the Inputs of a translation.
+type memFS map[string][]byte
+
+func (m memFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	data, ok := m[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{bytes.NewReader(data), memFileInfo{path.Base(name), int64(len(data))}}, nil
+}
+
+// add stores a source of the memory file system under name, returning it.
+// A name that is not a valid path (/abs/Main.vm, ../Main.vm) is stored
+// under its base name.
+func (m memFS) add(name string, data []byte) vmSource {
+	p := strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+	if !fs.ValidPath(p) {
+		p = path.Base(p)
+	}
+	m[p] = data
+	return vmSource{FS: m, Path: p, Name: name}
+}
+
+type memFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
+
+// splitArchivePath splits the path of a file inside an archive, as listed
+// by resolveSources (submission.zip/Project/Main.vm), into the archive and
+// the member.
+func splitArchivePath(name string) (archive, member string, ok bool) {
+	for dir := filepath.Dir(name); dir != "." && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if !isArchive(dir) {
+			continue
+		}
+		if st, err := os.Stat(dir); err == nil && st.Mode().IsRegular() {
+			rel, err := filepath.Rel(dir, name)
+			return dir, filepath.ToSlash(rel), err == nil
+		}
+	}
+	return "", "", false
+}
+
+// sourceFiles opens source files by path, the files inside an archive
+// being read from the archive, opened once for all of them.
+type sourceFiles struct {
+	archives map[string]*vmArchive
+}
+
+func newSourceFiles() *sourceFiles {
+	return &sourceFiles{archives: map[string]*vmArchive{}}
+}
+
+func (sf *sourceFiles) open(name string) (vmSource, error) {
+	archive, member, ok := splitArchivePath(name)
+	if !ok {
+		return diskSource(name), nil
+	}
+	a, ok := sf.archives[archive]
+	if !ok {
+		var err error
+		if a, err = openArchive(archive); err != nil {
+			return vmSource{}, err
+		}
+		sf.archives[archive] = a
+	}
+	return vmSource{FS: a, Path: member, Name: name}, nil
+}
+
+func (sf *sourceFiles) Close() {
+	for _, a := range sf.archives {
+		a.Close()
+	}
+}
+
+// archiveFiles lists the paths of the sources inside an archive, as
+// opened by sourceFiles.
+func archiveFiles(name string) ([]string, error) {
+	a, err := openArchive(name)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	paths := make([]string, 0, len(a.Files))
+	for _, f := range a.Files {
+		paths = append(paths, filepath.Join(name, filepath.FromSlash(f)))
+	}
+	return paths, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// checkGeneratedAsm validates the assembly of a translation right after
+// codegen, so that a bug of the generator is reported with the VM command
+// it comes from instead of by the assembler: every instruction must be
+// valid Hack, every label defined once and every symbol a predefined one,
+// a label, a static variable or a function called. A goto to a label the
+// source does not define is an error of the source. The code of plugins
+// and templates may use variables of its own, and is only checked as Hack.
+func checkGeneratedAsm(tr *translation) error {
+	_, err := assembleHack(tr.Lines)
+	undefined := false
+	if err == nil {
+		err, undefined = undefinedSymbol(tr), true
+	}
+	if err == nil {
+		return nil
+	}
+	line := -1
+	if ae := (*hackAsmError)(nil); errors.As(err, &ae) {
+		line = ae.Line
+	}
+	if line < 0 || tr.Origin[line] < 0 {
+		return failf(exitInternal, "Error in the assembly generated for the bootstrap and runtime code: %s", err)
+	}
+	cmd := tr.Origin[line]
+	sl, inst := tr.Commands[cmd], tr.Instructions[cmd]
+	switch {
+	case undefined && (inst.CommandType == CommandTypeGOTO || inst.CommandType == CommandTypeIf):
+		// a bug of the source rather than of the generator
+		return failAt(exitSemantic, sl, nil, "Error %s: undefined label %s", sl.Pos(), inst.Arg1)
+	case inst.CommandType == CommandTypePlugin:
+		return failAt(exitSemantic, sl, nil, "Error in the assembly plugin %s generated %s for %s: %s", pluginCommand, sl.Pos(), inst.Line, err)
+	}
+	return failAt(exitInternal, sl, nil, "Error in the assembly generated %s for %s: %s", sl.Pos(), inst.Line, err)
+}
+
+// undefinedSymbol finds the first symbol of the translation's assembly
+// that is not defined, which the assembler would silently allocate as a
+// variable. The runtime subroutines keep their variables under __VM.
+func undefinedSymbol(tr *translation) error {
+	defined := newHackSymbols()
+	for _, line := range tr.Lines {
+		if label, ok := strings.CutPrefix(strings.TrimSpace(line), "("); ok {
+			defined[strings.TrimSuffix(label, ")")] = 0
+		}
+	}
+	for _, inst := range tr.Instructions {
+		if sym, ok := staticSymbol(inst); ok {
+			defined[sym] = 0
+		}
+		if inst.CommandType == CommandTypeCall {
+			// a function of a file translated on its own
+			defined[inst.Arg1] = 0
+		}
+	}
+	for k, line := range tr.Lines {
+		if cmd := tr.Origin[k]; cmd >= 0 && tr.Instructions[cmd].ownsVariables() {
+			continue
+		}
+		if c := strings.Index(line, "//"); c >= 0 {
+			line = line[:c]
+		}
+		sym, ok := strings.CutPrefix(strings.TrimSpace(line), "@")
+		if !ok {
+			continue
+		}
+		if _, err := strconv.Atoi(sym); err == nil {
+			continue
+		}
+		if _, ok := defined[sym]; !ok && !strings.HasPrefix(sym, "__VM") {
+			return &hackAsmError{k, "undefined symbol " + sym}
+		}
+	}
+	return nil
+}
+
+// ownsVariables reports whether the code of a command comes from a plugin
+// or a codegen template, which may allocate variables.
+func (i *Instruction) ownsVariables() bool {
+	if i.CommandType == CommandTypePlugin {
+		return true
+	}
+	return optLevel == optNone && codegenTemplates[i.templateKey()] != nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// asmLine is a line of assembly kept by a normalization, with the 1-based
+// line number it comes from.
+type asmLine struct {
+	Text string
+	Line int
+}
+
+// stripAsm drops the comments, blank lines and spaces of assembly, keeping
+// the instructions and labels.
+func stripAsm(lines []string) []asmLine {
+	out := []asmLine{}
+	for k, line := range lines {
+		if c := strings.Index(line, "//"); c >= 0 {
+			line = line[:c]
+		}
+		line = strings.Join(strings.Fields(line), "")
+		if line != "" {
+			out = append(out, asmLine{line, k + 1})
+		}
+	}
+	return out
+}
+
+// numberAsmLines keeps every line as is, numbering them.
+func numberAsmLines(lines []string) []asmLine {
+	out := make([]asmLine, len(lines))
+	for k, line := range lines {
+		out[k] = asmLine{line, k + 1}
+	}
+	return out
+}
+
+// numberedLabelRe splits a label into its base and trailing number, like
+// the return addresses Main.main$ret$3 or the comparison labels
+// Main.main$EQ_TRUE$2.
+var numberedLabelRe = regexp.MustCompile(`^(.*?)(\d+)$`)
+
+// normalizeAsm strips assembly (see stripAsm) and rewrites it in a
+// canonical form: destinations in ADM order, commutative computations in
+// one spelling and, with renumber, the numbers ending the labels defined
+// in the file replaced by their order of first appearance among the
+// labels of the same base. Two translations numbering their generated
+// labels differently then compare equal.
+func normalizeAsm(lines []string, renumber bool) []asmLine {
+	out := stripAsm(lines)
+	labels := map[string]bool{}
+	for _, l := range out {
+		if strings.HasPrefix(l.Text, "(") && strings.HasSuffix(l.Text, ")") {
+			labels[l.Text[1:len(l.Text)-1]] = true
+		}
+	}
+	renamed := map[string]string{}
+	counts := map[string]int{}
+	rename := func(sym string) string {
+		if !renumber || !labels[sym] {
+			return sym
+		}
+		if r, ok := renamed[sym]; ok {
+			return r
+		}
+		r := sym
+		if m := numberedLabelRe.FindStringSubmatch(sym); m != nil && m[1] != "" {
+			counts[m[1]]++
+			r = m[1] + "#" + strconv.Itoa(counts[m[1]])
+		}
+		renamed[sym] = r
+		return r
+	}
+	for k, l := range out {
+		text := l.Text
+		switch {
+		case strings.HasPrefix(text, "(") && strings.HasSuffix(text, ")"):
+			text = "(" + rename(text[1:len(text)-1]) + ")"
+		case strings.HasPrefix(text, "@"):
+			text = "@" + rename(text[1:])
+		default:
+			comp, jump, hasJump := strings.Cut(text, ";")
+			dest, c, hasDest := strings.Cut(comp, "=")
+			if !hasDest {
+				dest, c = "", comp
+			}
+			if alias, ok := hackCompAliases[c]; ok {
+				c = alias
+			}
+			text = c
+			if hasDest {
+				sorted := ""
+				for _, r := range "ADM" {
+					if strings.ContainsRune(dest, r) {
+						sorted += string(r)
+					}
+				}
+				text = sorted + "=" + c
+			}
+			if hasJump {
+				text += ";" + jump
+			}
+		}
+		out[k].Text = text
+	}
+	return out
+}
+
+// asmTexts returns the text of the lines.
+func asmTexts(lines []asmLine) []string {
+	texts := make([]string, len(lines))
+	for k, l := range lines {
+		texts[k] = l.Text
+	}
+	return texts
+}
+
+// asmChange is a run of lines replaced between two assembly listings.
+type asmChange struct {
+	// ALine and BLine are the source line numbers the change starts at,
+	// or follows when it removes or adds nothing on that side
+	ALine, BLine int
+	Removed      []string
+	Added        []string
+}
+
+// asmChanges compares normalized assembly, grouping the edits into runs.
+func asmChanges(a, b []asmLine) []asmChange {
+	lineAt := func(lines []asmLine, k int) int {
+		if k < len(lines) {
+			return lines[k].Line
+		}
+		if len(lines) > 0 {
+			return lines[len(lines)-1].Line
+		}
+		return 0
+	}
+	changes := []asmChange{}
+	var cur *asmChange
+	for _, op := range diffLines(asmTexts(a), asmTexts(b)) {
+		if op.Kind == ' ' {
+			cur = nil
+			continue
+		}
+		if cur == nil {
+			changes = append(changes, asmChange{ALine: lineAt(a, op.A), BLine: lineAt(b, op.B)})
+			cur = &changes[len(changes)-1]
+		}
+		if op.Kind == '-' {
+			cur.Removed = append(cur.Removed, op.Text)
+		} else {
+			cur.Added = append(cur.Added, op.Text)
+		}
+	}
+	return changes
+}
+
+// runDiff implements the diff subcommand, comparing two assembly files
+// after normalizing them. Like diff(1) it exits with status 1 when they
+// differ and 2 on errors.
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	renumber := fs.Bool("labels", true, "renumber generated labels (ending with a number) by order of appearance")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: diff [-labels=false] a.asm b.asm")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	files := [2][]asmLine{}
+	for k, path := range fs.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Println("Error reading assembly file", err)
+			os.Exit(2)
+		}
+		files[k] = normalizeAsm(splitLines(data), *renumber)
+	}
+
+	aName, bName := fs.Arg(0), fs.Arg(1)
+	changes := asmChanges(files[0], files[1])
+	for _, c := range changes {
+		fmt.Printf("%s:%d %s:%d\n", aName, c.ALine, bName, c.BLine)
+		for _, t := range c.Removed {
+			fmt.Println("-", t)
+		}
+		for _, t := range c.Added {
+			fmt.Println("+", t)
+		}
+	}
+	if len(changes) > 0 {
+		fmt.Printf("Files differ: %s, %s\n", plural(len(changes), "change"), summarizeCounts(files[0], files[1]))
+		os.Exit(1)
+	}
+	fmt.Printf("No differences: %s\n", summarizeCounts(files[0], files[1]))
+}
+
+// summarizeCounts compares the instruction counts of two listings.
+func summarizeCounts(a, b []asmLine) string {
+	count := func(lines []asmLine) int {
+		n := 0
+		for _, l := range lines {
+			if !strings.HasPrefix(l.Text, "(") {
+				n++
+			}
+		}
+		return n
+	}
+	return fmt.Sprintf("%d and %d instructions", count(a), count(b))
+}
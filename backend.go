@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// backend generates the program of a --target from a translation.
+type backend interface {
+	// Ext is the extension of the files it writes, like .asm
+	Ext() string
+	// Comment returns text as a line comment of the target language.
+	Comment(text string) string
+	// Generate returns the lines of the program.
+	Generate(tr *translation) ([]string, error)
+}
+
+// backends are the targets of --target, by name.
+var backends = map[string]backend{
+	"hack":    hackBackend{},
+	"c":       cBackend{},
+	"llvm":    llvmBackend{},
+	"riscv32": riscvBackend{},
+}
+
+// backendNames lists the targets for the messages, hack first.
+func backendNames() string {
+	names := []string{}
+	for name := range backends {
+		if name != "hack" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return strings.Join(append([]string{"hack"}, names...), ", ")
+}
+
+// hackBackend is the Hack assembly translate generates.
+type hackBackend struct{}
+
+func (hackBackend) Ext() string { return ".asm" }
+
+func (hackBackend) Comment(text string) string { return "// " + text }
+
+func (hackBackend) Generate(tr *translation) ([]string, error) { return tr.Lines, nil }
+
+// programLabels numbers the labels and functions of a program for the
+// backends naming them by number. Only the labels jumped to and the
+// functions called are numbered, the others need no name, and the end
+// loops halt rather than jump. The jumps and calls to targets the program
+// does not define are left out, for the backends to fail when they run,
+// as the bundled OS calls Sys.error whether or not it is linked.
+type programLabels struct {
+	Labels    map[string]int
+	Functions map[string]int
+}
+
+func newProgramLabels(tr *translation) *programLabels {
+	pl := &programLabels{Labels: map[string]int{}, Functions: map[string]int{}}
+	defined := map[string]bool{}
+	functions := map[string]bool{}
+	for _, inst := range tr.Instructions {
+		switch inst.CommandType {
+		case CommandTypeLabel:
+			defined[inst.labelSymbol()] = true
+		case CommandTypeFunction:
+			functions[inst.Arg1] = true
+		}
+	}
+	if tr.Bootstrap != "" {
+		pl.Functions[tr.Bootstrap] = 0
+	}
+	for k, inst := range tr.Instructions {
+		switch inst.CommandType {
+		case CommandTypeGOTO, CommandTypeIf:
+			if _, ok := pl.Labels[inst.labelSymbol()]; !ok && defined[inst.labelSymbol()] && !endLoop(tr.Instructions, k) {
+				pl.Labels[inst.labelSymbol()] = len(pl.Labels)
+			}
+		case CommandTypeCall:
+			if _, ok := pl.Functions[inst.Arg1]; !ok && functions[inst.Arg1] {
+				pl.Functions[inst.Arg1] = len(pl.Functions)
+			}
+		}
+	}
+	return pl
+}
+
+// endLoop reports whether the jump k is the end loop of a VM program, a
+// goto to the label right before it, where the emulator would spin.
+func endLoop(instructions []*Instruction, k int) bool {
+	inst := instructions[k]
+	return inst.CommandType == CommandTypeGOTO && k > 0 &&
+		instructions[k-1].CommandType == CommandTypeLabel && instructions[k-1].labelSymbol() == inst.labelSymbol()
+}
+
+// staticAddresses returns the RAM address of every static variable, the
+// one the Hack assembler gives it, so that the programs of the other
+// targets lay out the RAM like the assembly.
+func staticAddresses(tr *translation) (map[string]int, error) {
+	prog, err := assembleHack(tr.Lines)
+	if err != nil {
+		return nil, fmt.Errorf("assembling the translation: %w", err)
+	}
+	addrs := map[string]int{}
+	for _, inst := range tr.Instructions {
+		if sym, ok := staticSymbol(inst); ok {
+			addrs[sym] = prog.Symbols[sym]
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchStatusNames name the exit statuses of a translation in the batch
+// summary.
+var batchStatusNames = map[int]string{
+	exitInternal: "internal error",
+	exitUsage:    "usage error",
+	exitIO:       "I/O error",
+	exitParse:    "parse error",
+	exitSemantic: "semantic error",
+}
+
+// batchResult is the outcome of translating one project of a batch.
+type batchResult struct {
+	Project      string
+	Output       string
+	Status       string // "ok" or what went wrong
+	Msg          string // the first error, or the first warning
+	Warnings     int
+	Instructions int
+	Elapsed      time.Duration
+	// Diagnostics are all the errors and warnings of the translation
+	Diagnostics []string
+	// Tests are the results of the test scripts of --tests
+	Tests []testResult
+}
+
+// findProjects returns the projects below root: every folder holding .vm
+// files, or .jack files with jack set, and every archive, in lexical order.
+// Hidden folders are skipped.
+func findProjects(root string, jack bool) ([]string, error) {
+	projects := []string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && (strings.HasPrefix(d.Name(), ".") || d.Name() == "__MACOSX") {
+				return filepath.SkipDir
+			}
+			files, err := filepath.Glob(filepath.Join(path, "*.vm"))
+			if jack && err == nil && len(files) == 0 {
+				files, err = filepath.Glob(filepath.Join(path, "*.jack"))
+			}
+			if err == nil && len(files) > 0 {
+				projects = append(projects, path)
+			}
+			return err
+		}
+		if isArchive(path) && d.Type().IsRegular() {
+			projects = append(projects, path)
+		}
+		return nil
+	})
+	return projects, err
+}
+
+// translateArgs are the flags of fs set on the command line among names,
+// the translation flags, passed on to the translations of a batch.
+func translateArgs(fs *flag.FlagSet, names map[string]bool) []string {
+	args := []string{}
+	fs.Visit(func(f *flag.Flag) {
+		if !names[f.Name] {
+			return
+		}
+		switch v := f.Value.(type) {
+		case *stringsFlag:
+			for _, item := range *v {
+				args = append(args, "--"+f.Name+"="+item)
+			}
+		case optLevelFlag:
+			// the last level given is the one in effect
+			if optLevel == string(v) {
+				args = append(args, "-"+f.Name)
+			}
+		default:
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
+
+// batchOutput is where a project of the batch is translated to: next to it
+// as -s would write it, or below outDir at its path relative to root.
+func batchOutput(root, project, outDir string) (string, error) {
+	if outDir == "" {
+		return defaultDstFile(project)
+	}
+	rel, err := filepath.Rel(root, project)
+	if err != nil || rel == "." {
+		rel = filepath.Base(project)
+	}
+	if ext := archiveExt(rel); ext != "" {
+		rel = strings.TrimSuffix(rel, ext)
+	}
+	return filepath.Join(outDir, rel+".asm"), nil
+}
+
+// translateProject translates a project in a translator process of its
+// own, which keeps the translations independent (the translator is not
+// safe to run concurrently in one process) and a submission crashing or
+// running away from affecting the others.
+// The output is written with --force, replacing an .asm file the
+// submission comes with, which --force still never does for a source.
+func translateProject(exe string, args []string, project, output string, timeout time.Duration) batchResult {
+	res := batchResult{Project: project, Output: output, Status: "ok"}
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		res.Status, res.Msg = batchStatusNames[exitIO], err.Error()
+		return res
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmdArgs := append([]string{"-s", project, "-o", output, "--force", "--log-format=json", "--log-level=warn", "--progress=off", "--color=never"}, args...)
+	cmd := exec.CommandContext(ctx, exe, cmdArgs...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	start := time.Now()
+	err := cmd.Run()
+	res.Elapsed = time.Since(start)
+
+	firstErr, text := "", []string{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var rec struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+			Err   string `json:"err"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+			text = append(text, scanner.Text())
+			res.Diagnostics = append(res.Diagnostics, scanner.Text())
+			continue
+		}
+		if rec.Err != "" {
+			rec.Msg += " " + rec.Err
+		}
+		res.Diagnostics = append(res.Diagnostics, rec.Msg)
+		switch rec.Level {
+		case "WARN":
+			res.Warnings++
+			if res.Msg == "" {
+				res.Msg = rec.Msg
+			}
+		case "ERROR":
+			if firstErr == "" {
+				firstErr = rec.Msg
+			}
+		}
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		res.Status, res.Msg = "timeout", fmt.Sprintf("no result within %s", timeout)
+		res.Diagnostics = append(res.Diagnostics, res.Msg)
+	case errors.As(err, &exitErr):
+		res.Status = batchStatusNames[exitErr.ExitCode()]
+		if res.Status == "" {
+			res.Status = batchStatusNames[exitInternal]
+		}
+		res.Msg = firstErr
+		if res.Msg == "" && len(text) > 0 {
+			// a panic or a message printed before the logger was set up
+			res.Msg = text[0]
+		}
+	case err != nil:
+		res.Status, res.Msg = batchStatusNames[exitInternal], err.Error()
+	default:
+		if data, err := os.ReadFile(output); err == nil {
+			for _, l := range stripAsm(splitLines(data)) {
+				if !strings.HasPrefix(l.Text, "(") {
+					res.Instructions++
+				}
+			}
+		}
+	}
+	return res
+}
+
+// runBatch implements the batch subcommand, translating every project
+// below a root in parallel and printing a summary table. With --tests it
+// also grades the translations.
+func runBatch(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	translateFlags := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) { translateFlags[f.Name] = true })
+	jobs := fs.Int("j", runtime.NumCPU(), "number of projects translated at the same time")
+	outDir := fs.String("outdir", "", "write the translations below this directory, at the paths of the projects relative to the root, instead of next to each project")
+	timeout := fs.Duration("timeout", time.Minute, "time a project may take to translate")
+	testsDir := fs.String("tests", "", "run the .tst scripts below this directory on the translations: those directly in it on every project, the others on the projects named after their folder")
+	reportFile := fs.String("report", "", "write the score of every student to this file: JSON when it ends with .json, JUnit XML with .xml, TAP with .tap and CSV otherwise (needs --tests)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: batch [flags] root")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 || len(opts.Sources) > 0 || *jobs < 1 || *reportFile != "" && *testsDir == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	root := fs.Arg(0)
+	projects, err := findProjects(root, opts.Frontend != "")
+	if err != nil {
+		fmt.Println("Error finding projects", err)
+		os.Exit(exitIO)
+	}
+	if len(projects) == 0 {
+		fmt.Println("No projects found in", root)
+		os.Exit(exitIO)
+	}
+	var tests []gradingTest
+	if *testsDir != "" {
+		if tests, err = findGradingTests(*testsDir); err != nil {
+			fmt.Println("Error finding tests", err)
+			os.Exit(exitIO)
+		}
+		if len(tests) == 0 {
+			fmt.Println("No test scripts found in", *testsDir)
+			os.Exit(exitIO)
+		}
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Println("Error finding the translator executable", err)
+		os.Exit(exitIO)
+	}
+
+	childArgs := translateArgs(fs, translateFlags)
+	start := time.Now()
+	results := make([]batchResult, len(projects))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range min(*jobs, len(projects)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				output, err := batchOutput(root, projects[k], *outDir)
+				if err != nil {
+					results[k] = batchResult{Project: projects[k], Status: batchStatusNames[exitIO], Msg: err.Error(), Diagnostics: []string{err.Error()}}
+				} else {
+					results[k] = translateProject(exe, childArgs, projects[k], output, *timeout)
+				}
+				if tests != nil {
+					results[k].Tests = gradeProject(tests, results[k])
+				}
+			}
+		}()
+	}
+	for k := range projects {
+		work <- k
+	}
+	close(work)
+	wg.Wait()
+
+	width := len("project")
+	for _, r := range results {
+		width = max(width, len(r.Project))
+	}
+	testsColumn := func(string) string { return "" }
+	if tests != nil {
+		testsColumn = func(s string) string { return fmt.Sprintf("  %5s", s) }
+	}
+	fmt.Printf("%-*s  %-14s  %12s%s  %8s  %s\n", width, "project", "result", "instructions", testsColumn("tests"), "time", "details")
+	failed, warned, passedTests, totalTests := 0, 0, 0, 0
+	for _, r := range results {
+		instructions := "-"
+		switch {
+		case r.Status != "ok":
+			failed++
+		case r.Warnings > 0:
+			warned++
+			r.Msg = fmt.Sprintf("%s: %s", plural(r.Warnings, "warning"), r.Msg)
+			fallthrough
+		default:
+			instructions = strconv.Itoa(r.Instructions)
+		}
+		passed := 0
+		for _, t := range r.Tests {
+			if t.Passed {
+				passed++
+			} else if r.Status == "ok" && r.Warnings == 0 && r.Msg == "" {
+				r.Msg = t.Test + " " + t.Detail
+			}
+		}
+		passedTests, totalTests = passedTests+passed, totalTests+len(r.Tests)
+		line := fmt.Sprintf("%-*s  %-14s  %12s%s  %8s  %s", width, r.Project, r.Status, instructions,
+			testsColumn(fmt.Sprintf("%d/%d", passed, len(r.Tests))), r.Elapsed.Round(time.Millisecond), r.Msg)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	summary := fmt.Sprintf("%d translated (%d with warnings), %d failed", len(results)-failed, warned, failed)
+	if tests != nil {
+		summary += fmt.Sprintf(", %d of %s passed", passedTests, plural(totalTests, "test"))
+	}
+	fmt.Printf("%s, in %s\n", summary, time.Since(start).Round(time.Millisecond))
+	if *reportFile != "" {
+		if err := writeGradeReport(*reportFile, gradeBatch(root, results)); err != nil {
+			fmt.Println("Error writing report", err)
+			os.Exit(exitIO)
+		}
+		fmt.Println("Wrote report", *reportFile)
+	}
+	if failed > 0 || passedTests < totalTests {
+		os.Exit(exitProjectsFailed)
+	}
+}
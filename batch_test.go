@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+)
+
+// TestTranslateArgs checks that a batch passes on exactly the translation
+// flags given on its command line.
+func TestTranslateArgs(t *testing.T) {
+	defer func(ext bool, level, prefix string) {
+		extendedMode, optLevel, staticPrefixMode = ext, level, prefix
+	}(extendedMode, optLevel, staticPrefixMode)
+	tests := []struct {
+		args, want []string
+	}{
+		{[]string{"root"}, []string{}},
+		{[]string{"-j", "2", "--outdir", "out", "root"}, []string{}},
+		{[]string{"--ext", "-O1", "-Osize", "root"}, []string{"-Osize", "--ext=true"}},
+		{[]string{"--exclude", "a*.vm", "--exclude", "b*.vm", "--static-prefix=path", "root"},
+			[]string{"--exclude=a*.vm", "--exclude=b*.vm", "--static-prefix=path"}},
+	}
+	for _, tt := range tests {
+		extendedMode, optLevel, staticPrefixMode = false, optNone, "file"
+		fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+		registerTranslateFlags(fs)
+		names := map[string]bool{}
+		fs.VisitAll(func(f *flag.Flag) { names[f.Name] = true })
+		fs.Int("j", 1, "")
+		fs.String("outdir", "", "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if got := translateArgs(fs, names); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"strings"
+	"time"
+)
+
+// benchRun is the measurement of one translation.
+type benchRun struct {
+	Elapsed  time.Duration
+	Bytes    uint64 // allocated
+	Allocs   uint64
+	PeakHeap uint64
+}
+
+// synthesizeCorpus writes random class files to dir until they hold at
+// least lines commands, the first one defining Sys.init.
+func synthesizeCorpus(dir string, lines int, seed uint64) (files int, err error) {
+	r := rand.New(rand.NewPCG(seed, 0))
+	for total := 0; total < lines; files++ {
+		class := fmt.Sprintf("Bench%d", files+1)
+		src := generateVMClass(r, false, class, files == 0)
+		total += len(src)
+		if err := os.WriteFile(filepath.Join(dir, class+".vm"), []byte(strings.Join(src, "\n")+"\n"), 0644); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// measureTranslation translates opts once, sampling the live heap while
+// it runs.
+func measureTranslation(opts *translateOptions) (*translation, benchRun, error) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	done := make(chan uint64)
+	stop := make(chan struct{})
+	go func() {
+		peak := uint64(0)
+		tick := time.NewTicker(time.Millisecond)
+		defer tick.Stop()
+		for {
+			metrics.Read(sample)
+			peak = max(peak, sample[0].Value.Uint64())
+			select {
+			case <-stop:
+				done <- peak
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	tr, err := translate(opts)
+	run := benchRun{Elapsed: time.Since(start)}
+	runtime.ReadMemStats(&after)
+	close(stop)
+	run.PeakHeap = <-done
+	run.Bytes = after.TotalAlloc - before.TotalAlloc
+	run.Allocs = after.Mallocs - before.Mallocs
+	return tr, run, err
+}
+
+// formatBytes prints a size in binary units.
+func formatBytes(b uint64) string {
+	switch {
+	case b >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(b)/(1<<30))
+	case b >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(b)/(1<<20))
+	case b >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(b)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", b)
+}
+
+// runBench implements the bench subcommand, timing translations of the
+// sources given, or of a synthesized corpus.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	runs := fs.Int("runs", 5, "number of translations to time")
+	lines := fs.Int("lines", 200_000, "size of the synthesized corpus in commands, used without -s")
+	seed := fs.Uint64("seed", 1, "seed of the synthesized corpus")
+	prof := registerProfileFlags(fs, false)
+	parseFlags(fs, args)
+	if *runs < 1 {
+		fmt.Println("Invalid number of runs", *runs)
+		os.Exit(1)
+	}
+
+	corpus := "given sources"
+	if len(opts.Sources) == 0 {
+		dir, err := os.MkdirTemp("", "bench")
+		if err != nil {
+			fmt.Println("Error creating temporary directory", err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+		files, err := synthesizeCorpus(dir, *lines, *seed)
+		if err != nil {
+			fmt.Println("Error writing corpus", err)
+			os.Exit(1)
+		}
+		opts.Sources = stringsFlag{dir}
+		corpus = fmt.Sprintf("synthesized corpus of %s", plural(files, "file"))
+	}
+	if err := opts.validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	stopProfiles := prof.start()
+	results := []benchRun{}
+	commands := 0
+	for k := range *runs {
+		tr, run, err := measureTranslation(opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitStatus(err))
+		}
+		if k == 0 {
+			commands = len(tr.Commands)
+			fmt.Printf("Translating %s (%s) %s\n", corpus, plural(commands, "command"), plural(*runs, "time"))
+		}
+		results = append(results, run)
+		fmt.Printf("run %d: %v, %.0f lines/s, %s in %d allocations, peak heap %s\n",
+			k+1, run.Elapsed.Round(time.Millisecond), float64(commands)/run.Elapsed.Seconds(),
+			formatBytes(run.Bytes), run.Allocs, formatBytes(run.PeakHeap))
+	}
+	stopProfiles()
+	if *runs > 1 {
+		slices.SortFunc(results, func(a, b benchRun) int { return int(a.Elapsed - b.Elapsed) })
+		best, median := results[0], results[len(results)/2]
+		fmt.Printf("best %v (%.0f lines/s), median %v (%.0f lines/s)\n",
+			best.Elapsed.Round(time.Millisecond), float64(commands)/best.Elapsed.Seconds(),
+			median.Elapsed.Round(time.Millisecond), float64(commands)/median.Elapsed.Seconds())
+	}
+}
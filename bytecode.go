@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The bytecode is a compact binary encoding of a parsed program:
+//
+//	"HVMB" version
+//	strings:  varint count, then for each a varint length and the bytes
+//	commands: varint count, then for each an opcode byte and its operands
+//
+// Operands are varints, strings being indexes in the string table. An
+// opFile command switches the file the following commands belong to,
+// which names their static variables. Numbers are signed varints, as
+// encoding/binary writes them.
+const (
+	bytecodeMagic   = "HVMB"
+	bytecodeVersion = 1
+)
+
+// Opcodes of the bytecode. The arithmetic commands are encoded as their
+// ALType; push and pop are followed by their segment byte.
+const (
+	opArithmetic byte = 0x00 // + ALType
+	opPush       byte = 0x10
+	opPop        byte = 0x11
+	opLabel      byte = 0x20
+	opGoto       byte = 0x21
+	opIfGoto     byte = 0x22
+	opFunction   byte = 0x23
+	opCall       byte = 0x24
+	opReturn     byte = 0x25
+	opStaticInit byte = 0x26
+	opPlugin     byte = 0x27 // the text of the command
+	opFile       byte = 0x30
+)
+
+var errBadBytecode = errors.New("invalid bytecode")
+
+// encodeBytecode encodes parsed commands, as returned by translate.
+func encodeBytecode(lines []sourceLine, instructions []*Instruction) []byte {
+	strs := []string{}
+	index := map[string]int{}
+	str := func(s string) int {
+		k, ok := index[s]
+		if !ok {
+			k = len(strs)
+			index[s] = k
+			strs = append(strs, s)
+		}
+		return k
+	}
+
+	code := []byte{}
+	num := func(v int) { code = binary.AppendVarint(code, int64(v)) }
+	file := ""
+	count := 0
+	for k, inst := range instructions {
+		if f := lines[k].File; f != file || k == 0 {
+			file = f
+			code = append(code, opFile)
+			num(str(f))
+			count++
+		}
+		count++
+		switch inst.CommandType {
+		case CommandTypeArithmetic:
+			code = append(code, opArithmetic+byte(inst.ALType))
+		case CommandTypePush, CommandTypePop:
+			op := opPush
+			if inst.CommandType == CommandTypePop {
+				op = opPop
+			}
+			code = append(code, op, byte(inst.SegmentType))
+			if inst.SegmentType == SegmentTypeString {
+				num(str(inst.Arg2))
+			} else {
+				num(inst.Arg2Val)
+			}
+		case CommandTypeLabel, CommandTypeGOTO, CommandTypeIf:
+			code = append(code, map[CommandType]byte{CommandTypeLabel: opLabel, CommandTypeGOTO: opGoto, CommandTypeIf: opIfGoto}[inst.CommandType])
+			num(str(inst.Arg1))
+		case CommandTypeFunction, CommandTypeCall:
+			op := opFunction
+			if inst.CommandType == CommandTypeCall {
+				op = opCall
+			}
+			code = append(code, op)
+			num(str(inst.Arg1))
+			num(inst.Arg2Val)
+		case CommandTypeReturn:
+			code = append(code, opReturn)
+		case CommandTypeStaticInit:
+			code = append(code, opStaticInit)
+			num(str(inst.Arg1))
+			num(inst.Arg2Val)
+		case CommandTypePlugin:
+			code = append(code, opPlugin)
+			num(str(inst.Line))
+		}
+	}
+
+	out := append([]byte(bytecodeMagic), bytecodeVersion)
+	out = binary.AppendVarint(out, int64(len(strs)))
+	for _, s := range strs {
+		out = binary.AppendVarint(out, int64(len(s)))
+		out = append(out, s...)
+	}
+	out = binary.AppendVarint(out, int64(count))
+	return append(out, code...)
+}
+
+// isBytecode reports whether data starts like bytecode.
+func isBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(bytecodeMagic))
+}
+
+// decodeBytecode decodes bytecode back to VM commands. The commands of
+// every file are numbered from line 1, in order.
+func decodeBytecode(data []byte) ([]sourceLine, error) {
+	if !isBytecode(data) || len(data) < len(bytecodeMagic)+1 {
+		return nil, fmt.Errorf("%w: missing %s header", errBadBytecode, bytecodeMagic)
+	}
+	if v := data[len(bytecodeMagic)]; v != bytecodeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d, expected %d", errBadBytecode, v, bytecodeVersion)
+	}
+	r := bytes.NewReader(data[len(bytecodeMagic)+1:])
+	num := func() (int, error) {
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return 0, fmt.Errorf("%w: truncated", errBadBytecode)
+		}
+		return int(v), nil
+	}
+	strs := []string{}
+	n, err := num()
+	if err != nil || n < 0 || n > r.Len() {
+		return nil, fmt.Errorf("%w: bad string table", errBadBytecode)
+	}
+	for range n {
+		size, err := num()
+		if err != nil || size < 0 || size > r.Len() {
+			return nil, fmt.Errorf("%w: bad string table", errBadBytecode)
+		}
+		b := make([]byte, size)
+		io.ReadFull(r, b)
+		strs = append(strs, string(b))
+	}
+	str := func() (string, error) {
+		k, err := num()
+		if err != nil {
+			return "", err
+		}
+		if k < 0 || k >= len(strs) {
+			return "", fmt.Errorf("%w: string %d out of range", errBadBytecode, k)
+		}
+		return strs[k], nil
+	}
+
+	count, err := num()
+	if err != nil || count < 0 || count > r.Len() {
+		return nil, fmt.Errorf("%w: bad command count", errBadBytecode)
+	}
+	lines := []sourceLine{}
+	file, line := "", 0
+	for c := range count {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: truncated", errBadBytecode)
+		}
+		text := ""
+		switch {
+		case op == opFile:
+			if file, err = str(); err != nil {
+				return nil, err
+			}
+			line = 0
+			continue
+		case op <= opArithmetic+byte(ALTypeMod):
+			text = ALType(op - opArithmetic).String()
+		case op == opPush || op == opPop:
+			seg, err := r.ReadByte()
+			if err != nil || seg > byte(SegmentTypeString) {
+				return nil, fmt.Errorf("%w: command %d: bad segment", errBadBytecode, c)
+			}
+			cmd := map[byte]string{opPush: "push", opPop: "pop"}[op]
+			if SegmentType(seg) == SegmentTypeString {
+				s, err := str()
+				if err != nil {
+					return nil, err
+				}
+				text = fmt.Sprintf("%s string \"%s\"", cmd, s)
+				break
+			}
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			text = fmt.Sprintf("%s %s %d", cmd, SegmentType(seg), v)
+		case op == opLabel || op == opGoto || op == opIfGoto:
+			name, err := str()
+			if err != nil {
+				return nil, err
+			}
+			text = map[byte]string{opLabel: "label", opGoto: "goto", opIfGoto: "if-goto"}[op] + " " + name
+		case op == opFunction || op == opCall || op == opStaticInit:
+			name, err := str()
+			if err != nil {
+				return nil, err
+			}
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			text = fmt.Sprintf("%s %s %d", map[byte]string{opFunction: "function", opCall: "call", opStaticInit: "static-init"}[op], name, v)
+		case op == opReturn:
+			text = "return"
+		case op == opPlugin:
+			if text, err = str(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: command %d: unknown opcode %#x", errBadBytecode, c, op)
+		}
+		line++
+		lines = append(lines, sourceLine{File: file, Line: line, Text: text})
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", errBadBytecode, r.Len())
+	}
+	return lines, nil
+}
+
+// isBytecodeSource reports whether a source is bytecode rather than VM code.
+func isBytecodeSource(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".vmb")
+}
+
+// readBytecodeSource adds the commands of a bytecode source, attributed
+// to the files they were encoded from.
+func (pp *preprocessor) readBytecodeSource(src vmSource, data []byte) error {
+	pp.included[sourceKey(src.Name)] = true
+	lines, err := decodeBytecode(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src.Name, err)
+	}
+	pp.lines = append(pp.lines, lines...)
+	return nil
+}
+
+// bytecodeDefinesFunction reports whether a bytecode source declares fn.
+func bytecodeDefinesFunction(src io.Reader, fn string) bool {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return false
+	}
+	lines, err := decodeBytecode(data)
+	if err != nil {
+		return false
+	}
+	for _, sl := range lines {
+		if definesFunction(sl.Text, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// runEncode implements the encode subcommand, translating the sources up
+// to the parsed commands and writing them as bytecode.
+func runEncode(args []string) {
+	fs := flag.NewFlagSet("encode", flag.ExitOnError)
+	opts := registerSourceFlags(fs)
+	// the bytecode holds the commands, without bootstrap code
+	opts.Bootstrap, opts.Entry = "off", "Sys.init"
+	dstFile := fs.String("o", "", "destination bytecode file (defaults to a name derived from the first source)")
+	parseFlags(fs, args)
+	if err := opts.validate(); err != nil {
+		fmt.Println(err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *dstFile == "" {
+		asm, err := defaultDstFile(opts.Sources[0])
+		if err != nil {
+			fmt.Println("Error getting source file status", err)
+			os.Exit(exitIO)
+		}
+		*dstFile = strings.TrimSuffix(asm, ".asm") + ".vmb"
+	}
+	tr, err := translate(opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitStatus(err))
+	}
+	for _, w := range tr.Warnings {
+		fmt.Println("Warning:", w)
+	}
+	if err := os.WriteFile(*dstFile, encodeBytecode(tr.Commands, tr.Instructions), 0644); err != nil {
+		fmt.Println("Error writing bytecode file", err)
+		os.Exit(exitIO)
+	}
+	fmt.Println("Successfully wrote bytecode file:", *dstFile)
+}
+
+// runDecode implements the decode subcommand, writing bytecode back as VM
+// code: to stdout or -o, with a comment heading the commands of every
+// file, or as one file per source into -dir.
+func runDecode(args []string) {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	dstFile := fs.String("o", "", "destination vm file (defaults to stdout)")
+	dir := fs.String("dir", "", "write the commands of every source file to a .vm file of the same name in this directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: decode [-o out.vm | -dir DIR] program.vmb")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Error reading bytecode file", err)
+		os.Exit(exitIO)
+	}
+	lines, err := decodeBytecode(data)
+	if err != nil {
+		fmt.Println("Error decoding", fs.Arg(0), err)
+		os.Exit(exitParse)
+	}
+
+	if *dir != "" {
+		files := map[string]*bytes.Buffer{}
+		order := []string{}
+		for _, sl := range lines {
+			name := filepath.Base(sl.File)
+			if files[name] == nil {
+				files[name] = &bytes.Buffer{}
+				order = append(order, name)
+			}
+			fmt.Fprintln(files[name], sl.Text)
+		}
+		for _, name := range order {
+			path := filepath.Join(*dir, name)
+			if err := os.WriteFile(path, files[name].Bytes(), 0644); err != nil {
+				fmt.Println("Error writing vm file", err)
+				os.Exit(exitIO)
+			}
+			fmt.Println("Successfully wrote vm file:", path)
+		}
+		return
+	}
+
+	var out bytes.Buffer
+	file := ""
+	for k, sl := range lines {
+		if sl.File != file || k == 0 {
+			file = sl.File
+			fmt.Fprintf(&out, "// %s\n", file)
+		}
+		fmt.Fprintln(&out, sl.Text)
+	}
+	if *dstFile == "" {
+		os.Stdout.Write(out.Bytes())
+		return
+	}
+	if err := os.WriteFile(*dstFile, out.Bytes(), 0644); err != nil {
+		fmt.Println("Error writing vm file", err)
+		os.Exit(exitIO)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// callEdge is every call from a function to another.
+type callEdge struct {
+	Caller, Callee string
+	Count          int
+	NArgs          []int // distinct argument counts passed, sorted
+}
+
+// callGraph records which functions call which.
+type callGraph struct {
+	// Functions are the functions defined by the program, in order
+	Functions []string
+	NLocals   map[string]int
+	Edges     []*callEdge
+}
+
+// Names used in the call graph for the callers that are not functions.
+const (
+	callerBootstrap = "(bootstrap)"
+	callerTopLevel  = "(top level)"
+)
+
+// buildCallGraph collects the calls of a translation, including the call
+// of the entry function by the bootstrap code.
+func buildCallGraph(tr *translation) *callGraph {
+	g := &callGraph{NLocals: map[string]int{}}
+	edges := map[[2]string]*callEdge{}
+	addCall := func(caller, callee string, nArgs int) {
+		e, ok := edges[[2]string{caller, callee}]
+		if !ok {
+			e = &callEdge{Caller: caller, Callee: callee}
+			edges[[2]string{caller, callee}] = e
+			g.Edges = append(g.Edges, e)
+		}
+		e.Count++
+		if !slices.Contains(e.NArgs, nArgs) {
+			e.NArgs = append(e.NArgs, nArgs)
+			sort.Ints(e.NArgs)
+		}
+	}
+
+	if tr.Bootstrap != "" {
+		addCall(callerBootstrap, tr.Bootstrap, tr.EntryNArgs)
+	}
+	fn := callerTopLevel
+	for _, inst := range tr.Instructions {
+		switch inst.CommandType {
+		case CommandTypeFunction:
+			fn = inst.Arg1
+			if _, ok := g.NLocals[fn]; !ok {
+				g.Functions = append(g.Functions, fn)
+			}
+			g.NLocals[fn] = inst.Arg2Val
+		case CommandTypeCall:
+			addCall(fn, inst.Arg1, inst.Arg2Val)
+		}
+	}
+	return g
+}
+
+// Defines reports whether fn is defined by the program.
+func (g *callGraph) Defines(fn string) bool {
+	_, ok := g.NLocals[fn]
+	return ok
+}
+
+// callGraphDOT renders the call graph of a translation in Graphviz DOT.
+// Edges are labelled with the number of calls and the arguments passed;
+// the functions called without being defined are dashed and calls passing
+// varying numbers of arguments are red.
+func callGraphDOT(tr *translation) string {
+	g := buildCallGraph(tr)
+	var b strings.Builder
+	b.WriteString("digraph callgraph {\n")
+	b.WriteString("\tnode [shape=box];\n")
+
+	declared := map[string]bool{}
+	declare := func(name, attrs string) {
+		if !declared[name] {
+			declared[name] = true
+			fmt.Fprintf(&b, "\t%q [%s];\n", name, attrs)
+		}
+	}
+	for _, fn := range g.Functions {
+		declare(fn, fmt.Sprintf("label=%q", fmt.Sprintf("%s\n%s", fn, plural(g.NLocals[fn], "local"))))
+	}
+	for _, e := range g.Edges {
+		for _, name := range []string{e.Caller, e.Callee} {
+			switch {
+			case name == callerBootstrap || name == callerTopLevel:
+				declare(name, "shape=ellipse")
+			case !g.Defines(name):
+				declare(name, "style=dashed")
+			}
+		}
+	}
+
+	for _, e := range g.Edges {
+		args := []string{}
+		for _, n := range e.NArgs {
+			args = append(args, fmt.Sprint(n))
+		}
+		label := fmt.Sprintf("%s, %s", plural(e.Count, "call"), strings.Join(args, "/"))
+		if len(e.NArgs) == 1 && e.NArgs[0] == 1 {
+			label += " arg"
+		} else {
+			label += " args"
+		}
+		attrs := fmt.Sprintf("label=%q", label)
+		if len(e.NArgs) > 1 {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(&b, "\t%q -> %q [%s];\n", e.Caller, e.Callee, attrs)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// unusedFunctions returns the functions of the program that no chain of
+// calls reaches, in order, from the bootstrap code, the commands before the
+// first function or the functions matching one of the keep patterns (the
+// entry function, an OS API...). calledBy holds the unused functions
+// calling each of them, none for the functions never called at all.
+func (g *callGraph) unusedFunctions(keep []string) (unused []string, calledBy map[string][]string) {
+	callees := map[string][]string{}
+	for _, e := range g.Edges {
+		callees[e.Caller] = append(callees[e.Caller], e.Callee)
+	}
+	used := map[string]bool{}
+	var visit func(fn string)
+	visit = func(fn string) {
+		if used[fn] {
+			return
+		}
+		used[fn] = true
+		for _, callee := range callees[fn] {
+			visit(callee)
+		}
+	}
+	visit(callerBootstrap)
+	visit(callerTopLevel)
+	for _, fn := range g.Functions {
+		if slices.ContainsFunc(keep, func(pattern string) bool {
+			ok, _ := path.Match(pattern, fn)
+			return ok
+		}) {
+			visit(fn)
+		}
+	}
+	calledBy = map[string][]string{}
+	for _, e := range g.Edges {
+		if !used[e.Callee] && !slices.Contains(calledBy[e.Callee], e.Caller) {
+			calledBy[e.Callee] = append(calledBy[e.Callee], e.Caller)
+		}
+	}
+	for _, fn := range g.Functions {
+		if !used[fn] {
+			unused = append(unused, fn)
+		}
+	}
+	return unused, calledBy
+}
+
+// unusedFunctionsReport lists the functions of a translation no call chain
+// reaches, see unusedFunctions, with where they are declared.
+func unusedFunctionsReport(tr *translation, keep []string) []string {
+	g := buildCallGraph(tr)
+	if tr.Bootstrap == "" && len(tr.Instructions) > 0 && tr.Instructions[0].CommandType == CommandTypeFunction {
+		// the program starts in the function it begins with
+		keep = append(slices.Clone(keep), tr.Instructions[0].Arg1)
+	}
+	unused, calledBy := g.unusedFunctions(keep)
+	declared := map[string]string{}
+	for k, inst := range tr.Instructions {
+		if _, ok := declared[inst.Arg1]; !ok && inst.CommandType == CommandTypeFunction {
+			declared[inst.Arg1] = tr.Commands[k].Pos()
+		}
+	}
+	report := []string{"Unused functions:"}
+	for _, fn := range unused {
+		why := "never called"
+		if len(calledBy[fn]) > 0 {
+			why = "only called by " + strings.Join(calledBy[fn], ", ")
+		}
+		report = append(report, fmt.Sprintf("  %s (%s): %s", fn, declared[fn], why))
+	}
+	if len(unused) == 0 {
+		report = append(report, "  none")
+	} else {
+		report = append(report, fmt.Sprintf("Total: %s of %d", plural(len(unused), "unused function"), len(g.Functions)))
+	}
+	return report
+}
+
+// plural formats a count of things, like "1 call" or "3 calls".
+func plural(n int, thing string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, thing)
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// cBackend generates portable C (C99) running the program: the RAM is an
+// array laid out like the Hack one, the stack, the frames and the static
+// variables at the same addresses, and the commands are statements of a
+// single function jumping with goto. The return addresses it pushes are
+// the numbers of its return points rather than ROM addresses.
+//
+// The program takes ADDR=VALUE arguments setting RAM words before it runs
+// and ADDR arguments naming the words it prints when it halts, the stack
+// when there are none. It halts when it runs off its end or reaches the
+// end loop of a VM program.
+type cBackend struct{}
+
+func (cBackend) Ext() string { return ".c" }
+
+func (cBackend) Comment(text string) string {
+	// a backslash ending a line comment would continue it on the next line
+	return "// " + strings.TrimRight(text, "\\")
+}
+
+// cPrelude declares the machine the program runs on.
+func cPrelude() []string {
+	return []string{
+		"#include <stdio.h>",
+		"#include <stdlib.h>",
+		"#include <string.h>",
+		"#include <stdint.h>",
+		"",
+		fmt.Sprintf("#define RAM_SIZE %d", layout.RAMSize()),
+		"#define SP 0",
+		"#define LCL 1",
+		"#define ARG 2",
+		"#define THIS 3",
+		"#define THAT 4",
+		"",
+		"static int16_t ram[RAM_SIZE];",
+		"",
+		"/* w wraps v to a 16-bit word. */",
+		"static inline int16_t w(long v) {",
+		"\tv &= 0xFFFF;",
+		"\treturn (int16_t)(v >= 0x8000 ? v - 0x10000 : v);",
+		"}",
+		"",
+		"/* m returns the RAM word at addr, stopping the program outside of it. */",
+		"static inline int16_t *m(long addr) {",
+		"\tif (addr < 0 || addr >= RAM_SIZE) {",
+		"\t\tfprintf(stderr, \"access to RAM[%ld] outside of memory\\n\", addr);",
+		"\t\texit(1);",
+		"\t}",
+		"\treturn &ram[addr];",
+		"}",
+		"",
+		"/* reg returns the address held by a pointer register. */",
+		"static inline long reg(int r) { return (uint16_t)ram[r]; }",
+		"",
+		"static inline void push(int16_t v) {",
+		"\t*m(reg(SP)) = v;",
+		"\tram[SP] = w(reg(SP) + 1);",
+		"}",
+		"",
+		"static inline int16_t pop(void) {",
+		"\tram[SP] = w(reg(SP) - 1);",
+		"\treturn *m(reg(SP));",
+		"}",
+	}
+}
+
+// cMain runs the program between the arguments setting and printing RAM.
+func cMain() []string {
+	return []string{
+		"static long parse_addr(const char *s) {",
+		"\tchar *end;",
+		"\tlong v = strtol(s, &end, 10);",
+		"\tif (end == s || (*end != '\\0' && *end != '=') || v < 0 || v >= RAM_SIZE) {",
+		"\t\tfprintf(stderr, \"usage: program [ADDR=VALUE...] [ADDR...]\\n\");",
+		"\t\texit(2);",
+		"\t}",
+		"\treturn v;",
+		"}",
+		"",
+		"int main(int argc, char **argv) {",
+		"\tint k, printed = 0;",
+		"\tlong a;",
+		"\tfor (k = 1; k < argc; k++) {",
+		"\t\tconst char *eq = strchr(argv[k], '=');",
+		"\t\ta = parse_addr(argv[k]);",
+		"\t\tif (eq != NULL) {",
+		"\t\t\tram[a] = w(strtol(eq + 1, NULL, 10));",
+		"\t\t}",
+		"\t}",
+		"\trun();",
+		"\tfor (k = 1; k < argc; k++) {",
+		"\t\tif (strchr(argv[k], '=') == NULL) {",
+		"\t\t\ta = parse_addr(argv[k]);",
+		"\t\t\tprintf(\"RAM[%ld] = %d\\n\", a, ram[a]);",
+		"\t\t\tprinted = 1;",
+		"\t\t}",
+		"\t}",
+		fmt.Sprintf("\tfor (a = %d; !printed && a < reg(SP); a++) {", layout.Stack),
+		"\t\tprintf(\"RAM[%ld] = %d\\n\", a, ram[a]);",
+		"\t}",
+		"\treturn 0;",
+		"}",
+	}
+}
+
+// cUnary and cBinary are the C expressions of the arithmetic commands, of
+// the top of the stack y and of the word x below it.
+var (
+	cUnary = map[ALType]string{
+		ALTypeNeg: "w(-(long)y)",
+		ALTypeNot: "~y",
+		ALTypeShl: "w((long)y * 2)",
+		ALTypeShr: "y < 0 ? ~(~y >> 1) : y >> 1",
+	}
+	cBinary = map[ALType]string{
+		ALTypeAdd:  "w((long)x + y)",
+		ALTypeSub:  "w((long)x - y)",
+		ALTypeAnd:  "x & y",
+		ALTypeOr:   "x | y",
+		ALTypeEq:   "x == y ? -1 : 0",
+		ALTypeGt:   "x > y ? -1 : 0",
+		ALTypeLt:   "x < y ? -1 : 0",
+		ALTypeMult: "w((long)x * y)",
+		// dividing by zero yields 0, like the runtime subroutine
+		ALTypeDiv: "y != 0 ? w((long)x / y) : 0",
+		ALTypeMod: "y != 0 ? w((long)x % y) : x",
+	}
+)
+
+func (be cBackend) Generate(tr *translation) ([]string, error) {
+	pl := newProgramLabels(tr)
+	statics, err := staticAddresses(tr)
+	if err != nil {
+		return nil, err
+	}
+	body := []string{}
+	emit := func(format string, args ...any) {
+		body = append(body, "\t"+fmt.Sprintf(format, args...))
+	}
+	label := func(format string, args ...any) {
+		body = append(body, fmt.Sprintf(format, args...)+":")
+	}
+	fail := func(format string, args ...any) {
+		emit("fprintf(stderr, \"%%s\\n\", %s); exit(1);", strconv.Quote(fmt.Sprintf(format, args...)))
+	}
+	returns := 0
+	// the lines of the return points, dropped when nothing returns
+	returnPoints := []int{}
+	call := func(fn string, nArgs int) {
+		if _, ok := pl.Functions[fn]; !ok {
+			fail("call of undefined function %s", fn)
+			return
+		}
+		emit("push(%d); push(ram[LCL]); push(ram[ARG]); push(ram[THIS]); push(ram[THAT]);", returns)
+		emit("ram[ARG] = w(reg(SP) - %d); ram[LCL] = ram[SP];", callFrameSize+nArgs)
+		emit("goto f%d;", pl.Functions[fn])
+		returnPoints = append(returnPoints, len(body))
+		label("r%d", returns)
+		returns++
+	}
+	var usesX, usesY, usesReturn bool
+
+	inits := map[string]bool{}
+	for _, inst := range tr.Instructions {
+		if inst.CommandType == CommandTypeStaticInit && !inits[inst.Arg1] {
+			inits[inst.Arg1] = true
+			emit("ram[%d] = %d; %s", statics[inst.Arg1], int16(inst.Arg2Val), be.Comment(inst.Line))
+		}
+	}
+	if tr.Bootstrap != "" {
+		emit("ram[SP] = %d;", layout.Stack)
+		for range tr.EntryNArgs {
+			emit("push(0);")
+		}
+		emit("%s", be.Comment(fmt.Sprintf("call %s %d", tr.Bootstrap, tr.EntryNArgs)))
+		call(tr.Bootstrap, tr.EntryNArgs)
+		emit("goto halt;")
+	}
+
+	for k, inst := range tr.Instructions {
+		if inst.CommandType == CommandTypeStaticInit {
+			continue
+		}
+		switch inst.CommandType {
+		case CommandTypeLabel:
+			if n, ok := pl.Labels[inst.labelSymbol()]; ok {
+				label("l%d", n)
+			}
+			continue
+		case CommandTypeFunction:
+			if n, ok := pl.Functions[inst.Arg1]; ok {
+				body = append(body, "", be.Comment(inst.Line))
+				label("f%d", n)
+			} else {
+				body = append(body, "", be.Comment(inst.Line+" (never called)"))
+			}
+			for range inst.Arg2Val {
+				emit("push(0);")
+			}
+			continue
+		}
+		emit("%s", be.Comment(inst.Line))
+		switch inst.CommandType {
+		case CommandTypeArithmetic:
+			usesY = true
+			if expr, ok := cUnary[inst.ALType]; ok {
+				emit("y = pop(); push(%s);", expr)
+				break
+			}
+			expr, ok := cBinary[inst.ALType]
+			if !ok {
+				return nil, fmt.Errorf("%s: %s is not supported by the c target", tr.Commands[k].Pos(), inst.ALType)
+			}
+			usesX = true
+			emit("y = pop(); x = pop(); push(%s);", expr)
+		case CommandTypePush, CommandTypePop:
+			word, err := cSegmentWord(inst, statics)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", tr.Commands[k].Pos(), err)
+			}
+			if inst.CommandType == CommandTypePush {
+				emit("push(%s);", word)
+			} else {
+				emit("%s = pop();", word)
+			}
+		case CommandTypeGOTO:
+			if endLoop(tr.Instructions, k) {
+				emit("goto halt;")
+				break
+			}
+			if n, ok := pl.Labels[inst.labelSymbol()]; ok {
+				emit("goto l%d;", n)
+			} else {
+				fail("jump to undefined label %s", inst.Arg1)
+			}
+		case CommandTypeIf:
+			if n, ok := pl.Labels[inst.labelSymbol()]; ok {
+				emit("if (pop() != 0) goto l%d;", n)
+			} else {
+				emit("if (pop() != 0) {")
+				fail("jump to undefined label %s", inst.Arg1)
+				emit("}")
+			}
+		case CommandTypeCall:
+			call(inst.Arg1, inst.Arg2Val)
+		case CommandTypeReturn:
+			usesReturn = true
+			emit("frame = reg(LCL);")
+			emit("ret = *m(frame - %d);", callFrameSize)
+			emit("*m(reg(ARG)) = pop();")
+			emit("ram[SP] = w(reg(ARG) + 1);")
+			emit("ram[THAT] = *m(frame - 1); ram[THIS] = *m(frame - 2); ram[ARG] = *m(frame - 3); ram[LCL] = *m(frame - 4);")
+			emit("goto dispatch;")
+		default:
+			return nil, fmt.Errorf("%s: %s is not supported by the c target", tr.Commands[k].Pos(), inst.CommandType)
+		}
+	}
+	emit("goto halt;")
+	if usesReturn {
+		body = append(body, "", "/* return jumps to the return point of the call */", "dispatch:")
+		emit("switch (ret) {")
+		for n := range returns {
+			emit("case %d: goto r%d;", n, n)
+		}
+		emit("}")
+		emit("fprintf(stderr, \"return to unknown address %%d\\n\", ret);")
+		emit("exit(1);")
+	}
+	if !usesReturn {
+		for _, k := range slices.Backward(returnPoints) {
+			body = slices.Delete(body, k, k+1)
+		}
+	}
+	body = append(body, "halt:", "\treturn;", "}")
+
+	lines := append([]string{be.Comment("Compile with cc -O2 -o program Program.c, run with ./program [ADDR=VALUE...] [ADDR...]"), ""}, cPrelude()...)
+	lines = append(lines, "", "static void run(void) {")
+	switch {
+	case usesX:
+		lines = append(lines, "\tint16_t x, y;")
+	case usesY:
+		lines = append(lines, "\tint16_t y;")
+	}
+	if usesReturn {
+		lines = append(lines, "\tlong frame;", "\tint ret;")
+	}
+	lines = append(lines, body...)
+	lines = append(lines, "")
+	lines = append(lines, cMain()...)
+	return lines, nil
+}
+
+// cSegmentWord returns the C lvalue of the word a push or pop reads or
+// writes, a constant for push constant.
+func cSegmentWord(inst *Instruction, statics map[string]int) (string, error) {
+	i := inst.Arg2Val
+	switch inst.SegmentType {
+	case SegmentTypeConstant:
+		if inst.CommandType == CommandTypePop {
+			return "", fmt.Errorf("pop constant")
+		}
+		return fmt.Sprint(int16(i)), nil
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		return fmt.Sprintf("*m(reg(%s) + %d)", inst.SegmentType.ID(), i), nil
+	case SegmentTypeTemp:
+		if i > 7 {
+			return "", fmt.Errorf("temp %d out of range", i)
+		}
+		return fmt.Sprintf("ram[%d]", layout.Temp+i), nil
+	case SegmentTypePointer:
+		if i > 1 {
+			return "", fmt.Errorf("pointer %d out of range", i)
+		}
+		return fmt.Sprintf("ram[%d]", 3+i), nil
+	case SegmentTypeStatic:
+		sym, _ := staticSymbol(inst)
+		return fmt.Sprintf("ram[%d]", statics[sym]), nil
+	}
+	return "", fmt.Errorf("push %s is not supported by the c target", inst.SegmentType)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// basicBlock is a run of commands always executed together: it starts at
+// a function declaration, a label or after a branch, and ends with a
+// goto, if-goto, call or return, or before the next label.
+type basicBlock struct {
+	ID         int
+	Start, End int    // commands of the block, End excluded
+	Label      string // label starting the block, if any
+	// Succs are the blocks of the same function control can go to next
+	Succs []int
+	// Cond is the block an if-goto jumps to, -1 otherwise
+	Cond int
+	// Jumps are the labels outside of the function the block jumps to
+	Jumps     []string
+	Calls     []string
+	Reachable bool
+}
+
+// functionCFG is the control flow graph of a function, or of the
+// commands before the first function declaration when Function is "".
+type functionCFG struct {
+	Function   string
+	Start, End int
+	Blocks     []*basicBlock
+	labels     map[string]int // label to block
+}
+
+// endsBlock reports whether a command ends its basic block.
+func endsBlock(ct CommandType) bool {
+	switch ct {
+	case CommandTypeGOTO, CommandTypeIf, CommandTypeCall, CommandTypeReturn:
+		return true
+	}
+	return false
+}
+
+// buildCFGs splits the program into functions and their basic blocks,
+// and marks the blocks reachable from the function entries. Labels are
+// global to the translation, so jumps to a label of another function are
+// followed too.
+func buildCFGs(instructions []*Instruction) []*functionCFG {
+	cfgs := []*functionCFG{}
+	var cur *functionCFG
+	for i, inst := range instructions {
+		if cur == nil || inst.CommandType == CommandTypeFunction {
+			if cur != nil {
+				cur.End = i
+			}
+			cur = &functionCFG{Start: i, labels: map[string]int{}}
+			if inst.CommandType == CommandTypeFunction {
+				cur.Function = inst.Arg1
+			}
+			cfgs = append(cfgs, cur)
+		}
+	}
+	if cur != nil {
+		cur.End = len(instructions)
+	}
+
+	for _, g := range cfgs {
+		var b *basicBlock
+		for i := g.Start; i < g.End; i++ {
+			inst := instructions[i]
+			if b == nil || inst.CommandType == CommandTypeLabel && b.End > b.Start {
+				b = &basicBlock{ID: len(g.Blocks), Start: i, Cond: -1}
+				g.Blocks = append(g.Blocks, b)
+			}
+			if inst.CommandType == CommandTypeLabel {
+				if b.Label == "" {
+					b.Label = inst.Arg1
+				}
+				g.labels[inst.Arg1] = b.ID
+			}
+			if inst.CommandType == CommandTypeCall {
+				b.Calls = append(b.Calls, inst.Arg1)
+			}
+			b.End = i + 1
+			if endsBlock(inst.CommandType) {
+				b = nil
+			}
+		}
+	}
+
+	labelFn := map[string]*functionCFG{}
+	for _, g := range cfgs {
+		for l := range g.labels {
+			if _, ok := labelFn[l]; !ok {
+				labelFn[l] = g
+			}
+		}
+	}
+	for _, g := range cfgs {
+		for k, b := range g.Blocks {
+			last := instructions[b.End-1]
+			falls := k+1 < len(g.Blocks)
+			switch last.CommandType {
+			case CommandTypeGOTO, CommandTypeIf:
+				if t, ok := g.labels[last.Arg1]; ok {
+					b.Succs = append(b.Succs, t)
+					if last.CommandType == CommandTypeIf {
+						b.Cond = t
+					}
+				} else {
+					b.Jumps = append(b.Jumps, last.Arg1)
+				}
+				falls = falls && last.CommandType == CommandTypeIf
+			case CommandTypeReturn:
+				falls = false
+			}
+			if falls && !slices.Contains(b.Succs, k+1) {
+				b.Succs = append(b.Succs, k+1)
+			}
+		}
+	}
+
+	var visit func(g *functionCFG, id int)
+	visit = func(g *functionCFG, id int) {
+		b := g.Blocks[id]
+		if b.Reachable {
+			return
+		}
+		b.Reachable = true
+		for _, s := range b.Succs {
+			visit(g, s)
+		}
+		for _, l := range b.Jumps {
+			if t, ok := labelFn[l]; ok {
+				visit(t, t.labels[l])
+			}
+		}
+	}
+	for _, g := range cfgs {
+		if len(g.Blocks) > 0 {
+			visit(g, 0)
+		}
+	}
+	return cfgs
+}
+
+// cfgName names the function of a CFG.
+func cfgName(g *functionCFG) string {
+	if g.Function == "" {
+		return callerTopLevel
+	}
+	return g.Function
+}
+
+// cfgDOT renders the control flow graphs in Graphviz DOT, one cluster per
+// function. The branch taken by an if-goto is labelled "if" and
+// unreachable blocks are greyed out.
+func cfgDOT(lines []sourceLine, cfgs []*functionCFG) string {
+	var b strings.Builder
+	b.WriteString("digraph cfg {\n")
+	b.WriteString("\tnode [shape=box, fontname=monospace];\n")
+	for n, g := range cfgs {
+		node := func(id int) string { return fmt.Sprintf("f%d_b%d", n, id) }
+		fmt.Fprintf(&b, "\tsubgraph cluster_%d {\n", n)
+		fmt.Fprintf(&b, "\t\tlabel=%q;\n", cfgName(g))
+		for _, blk := range g.Blocks {
+			text := ""
+			for i := blk.Start; i < blk.End; i++ {
+				text += lines[i].Text + "\n"
+			}
+			attrs := fmt.Sprintf("label=%s", dotLeftJustified(text))
+			if !blk.Reachable {
+				attrs += ", style=filled, fillcolor=lightgrey, fontcolor=grey40"
+			}
+			fmt.Fprintf(&b, "\t\t%s [%s];\n", node(blk.ID), attrs)
+		}
+		for _, blk := range g.Blocks {
+			for _, s := range blk.Succs {
+				attrs := ""
+				if s == blk.Cond {
+					attrs = " [label=\"if\"]"
+				}
+				fmt.Fprintf(&b, "\t\t%s -> %s%s;\n", node(blk.ID), node(s), attrs)
+			}
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotLeftJustified quotes text for a DOT label, its lines justified left.
+func dotLeftJustified(text string) string {
+	q := fmt.Sprintf("%q", text)
+	return strings.ReplaceAll(q, `\n`, `\l`)
+}
+
+type cfgJSONBlock struct {
+	ID        int      `json:"id"`
+	Label     string   `json:"label,omitempty"`
+	Pos       string   `json:"pos"`
+	Commands  []string `json:"commands"`
+	Succs     []int    `json:"succs"`
+	Jumps     []string `json:"jumps,omitempty"`
+	Calls     []string `json:"calls,omitempty"`
+	Reachable bool     `json:"reachable"`
+}
+
+type cfgJSONFunction struct {
+	Function string         `json:"function"`
+	Blocks   []cfgJSONBlock `json:"blocks"`
+}
+
+// cfgJSON renders the control flow graphs as JSON.
+func cfgJSON(lines []sourceLine, cfgs []*functionCFG) ([]byte, error) {
+	out := []cfgJSONFunction{}
+	for _, g := range cfgs {
+		f := cfgJSONFunction{Function: cfgName(g), Blocks: []cfgJSONBlock{}}
+		for _, blk := range g.Blocks {
+			jb := cfgJSONBlock{
+				ID: blk.ID, Label: blk.Label, Pos: lines[blk.Start].Pos(),
+				Commands: []string{}, Succs: append([]int{}, blk.Succs...),
+				Jumps: blk.Jumps, Calls: blk.Calls, Reachable: blk.Reachable,
+			}
+			for i := blk.Start; i < blk.End; i++ {
+				jb.Commands = append(jb.Commands, lines[i].Text)
+			}
+			f.Blocks = append(f.Blocks, jb)
+		}
+		out = append(out, f)
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -1,7 +1,8 @@
 #!/bin/bash
 
-# Find all .asm files recursively in current directory and subdirectories
-asm_files=$(find . -name "*.asm")
+# Find all .asm files recursively in current directory and subdirectories,
+# keeping the golden files recorded by the golden subcommand
+asm_files=$(find . -name "*.asm" ! -name "*.golden.asm")
 
 if [ -z "$asm_files" ]; then
     echo "No .asm files found in current directory or subdirectories"
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// colorEnabled is set by --color when the messages are written with ANSI
+// colors.
+var colorEnabled bool
+
+const (
+	ansiRed    = "1;31"
+	ansiGreen  = "32"
+	ansiYellow = "1;33"
+	ansiCyan   = "36"
+	ansiBold   = "1"
+)
+
+// setupColor decides from a --color mode whether out gets colors: always,
+// never, or auto when out is a terminal and NO_COLOR is not set.
+func setupColor(mode string, out *os.File) error {
+	switch mode {
+	case "always":
+		colorEnabled = true
+	case "never":
+		colorEnabled = false
+	case "auto":
+		fi, err := out.Stat()
+		colorEnabled = err == nil && fi.Mode()&os.ModeCharDevice != 0 &&
+			os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+	default:
+		return fmt.Errorf("Invalid color mode %q, expected auto, always or never", mode)
+	}
+	return nil
+}
+
+// paint wraps s in an ANSI color when colors are enabled.
+func paint(color, s string) string {
+	if !colorEnabled || s == "" {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// paintDiffLine colors a line of a unified diff by its first character.
+func paintDiffLine(l string) string {
+	switch {
+	case strings.HasPrefix(l, "@@"):
+		return paint(ansiCyan, l)
+	case strings.HasPrefix(l, "-"):
+		return paint(ansiRed, l)
+	case strings.HasPrefix(l, "+"):
+		return paint(ansiGreen, l)
+	}
+	return l
+}
+
+// sourceExcerpt is the source line an error is about, logged under the
+// error message with a caret marker under the offending token.
+type sourceExcerpt struct {
+	Line sourceLine
+	// Col is the 1-based column of the token in Line.Text, 0 to mark the
+	// whole command
+	Col int
+}
+
+// LogValue gives the location to the JSON logs.
+func (e sourceExcerpt) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("file", e.Line.File),
+		slog.Int("line", e.Line.Line),
+		slog.Int("col", max(e.Line.Col, 1)+max(e.Col, 1)-1),
+		slog.String("text", e.Line.Text),
+	)
+}
+
+// lines renders the excerpt as the source line, numbered, and its marker.
+func (e sourceExcerpt) lines() []string {
+	text := e.Line.Text
+	start, end := 0, len(text)
+	if e.Col > 0 && e.Col <= len(text) {
+		start = e.Col - 1
+		end = start + 1
+		for end < len(text) && text[end] != ' ' && text[end] != '\t' {
+			end++
+		}
+	}
+	num := fmt.Sprintf("%4d", e.Line.Line)
+	gutter := strings.Repeat(" ", len(num))
+	marker := "^" + strings.Repeat("~", max(end-start-1, 0))
+	return []string{
+		paint(ansiCyan, num+" |") + " " + text,
+		paint(ansiCyan, gutter+" |") + " " + strings.Repeat(" ", start) + paint(ansiRed, marker),
+	}
+}
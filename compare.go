@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// compareContext is the number of kept lines shown around the changes of a
+// failed comparison.
+const compareContext = 3
+
+// compareHunk is a run of differences between the compare file and the
+// output, as a unified diff hunk.
+type compareHunk struct {
+	// ExpectedLine and GotLine are the 1-based lines the hunk starts at in
+	// the compare file and the output, or follows when it has no line there
+	ExpectedLine  int `json:"expected_line"`
+	ExpectedCount int `json:"expected_count"`
+	GotLine       int `json:"got_line"`
+	GotCount      int `json:"got_count"`
+	// Lines are the lines of the hunk prefixed with ' ', '-' (expected
+	// only) or '+' (output only)
+	Lines []string `json:"lines"`
+}
+
+// compareResult is the outcome of -c, printed by --format=json.
+type compareResult struct {
+	Equal      bool   `json:"equal"`
+	Mode       string `json:"mode"`
+	Expected   string `json:"expected"`
+	Output     string `json:"output"`
+	Missing    int    `json:"missing"`
+	Unexpected int    `json:"unexpected"`
+	// Hunks holds at most --max-diffs hunks, Omitted counts the others
+	Hunks   []compareHunk `json:"hunks"`
+	Omitted int           `json:"omitted"`
+}
+
+// compareOptions are the flags of the comparison.
+type compareOptions struct {
+	File     string
+	Mode     string // strict or loose
+	MaxDiffs int    // 0 shows every hunk
+	Format   string // text, json, junit or tap
+}
+
+// header returns the @@ line of the hunk.
+func (h compareHunk) header() string {
+	start := func(line, count int) int {
+		if count == 0 {
+			return line
+		}
+		return line - 1
+	}
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(start(h.ExpectedLine, h.ExpectedCount), h.ExpectedCount), hunkRange(start(h.GotLine, h.GotCount), h.GotCount))
+}
+
+// compareLines diffs the expected lines against the output, numbering the
+// hunks with the lines they come from, so loose comparisons still point
+// into the files.
+func compareLines(expected, got []asmLine) []compareHunk {
+	lineAt := func(lines []asmLine, pos, count int) int {
+		switch {
+		case count > 0:
+			return lines[pos].Line
+		case pos > 0:
+			return lines[pos-1].Line
+		}
+		return 0
+	}
+	ops := diffLines(asmTexts(expected), asmTexts(got))
+	hunks := []compareHunk{}
+	for _, r := range diffHunks(ops, compareContext) {
+		h := compareHunk{}
+		for _, op := range ops[r[0]:r[1]] {
+			if op.Kind != '+' {
+				h.ExpectedCount++
+			}
+			if op.Kind != '-' {
+				h.GotCount++
+			}
+			h.Lines = append(h.Lines, string(op.Kind)+op.Text)
+		}
+		first := ops[r[0]]
+		h.ExpectedLine = lineAt(expected, first.A, h.ExpectedCount)
+		h.GotLine = lineAt(got, first.B, h.GotCount)
+		hunks = append(hunks, h)
+	}
+	return hunks
+}
+
+// compareOutput compares the translated lines with the compare file,
+// printing the differences to out as a unified diff, JSON or a test report,
+// and exits with exitCompareDiffers when there are some. The resultLines
+// come without the header, which is skipped in a compare file starting with
+// one (header being the comment it starts with), so an output the
+// translator wrote itself compares equal.
+func compareOutput(opts compareOptions, dstFile string, resultLines []string, header string, out io.Writer) {
+	cmpF, err := os.Open(opts.File)
+	if err != nil {
+		logger.Error("Error opening compare file", "err", err)
+		os.Exit(exitIO)
+	}
+	defer cmpF.Close()
+	cmpLines := []string{}
+	scanner := newLineScanner(cmpF)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		cmpLines = append(cmpLines, line)
+	}
+	expected, got := numberAsmLines(cmpLines), numberAsmLines(resultLines)
+	if len(expected) > 0 && strings.HasPrefix(expected[0].Text, header) {
+		expected = expected[1:]
+	}
+	if opts.Mode == "loose" {
+		expected, got = stripAsm(cmpLines), stripAsm(resultLines)
+	}
+
+	hunks := compareLines(expected, got)
+	res := compareResult{Equal: len(hunks) == 0, Mode: opts.Mode, Expected: opts.File, Output: dstFile, Hunks: hunks}
+	for _, h := range hunks {
+		for _, l := range h.Lines {
+			switch l[0] {
+			case '-':
+				res.Missing++
+			case '+':
+				res.Unexpected++
+			}
+		}
+	}
+	if opts.MaxDiffs > 0 && len(hunks) > opts.MaxDiffs {
+		res.Hunks, res.Omitted = hunks[:opts.MaxDiffs], len(hunks)-opts.MaxDiffs
+	}
+
+	switch opts.Format {
+	case "json":
+		data, _ := json.MarshalIndent(res, "", "  ")
+		fmt.Fprintln(out, string(data))
+	case "junit", "tap":
+		if err := writeTestReport(out, opts.Format, []testSuite{compareSuite(res, len(hunks))}); err != nil {
+			logger.Error("Error writing the test report", "err", err)
+			os.Exit(exitIO)
+		}
+	default:
+		printCompareResult(out, res, len(hunks))
+	}
+	if !res.Equal {
+		os.Exit(exitCompareDiffers)
+	}
+}
+
+// compareSuite reports a comparison as a test of the output against the
+// compare file, failing with the unified diff.
+func compareSuite(res compareResult, hunks int) testSuite {
+	c := testCase{Class: res.Expected, Name: res.Output}
+	if !res.Equal {
+		c.Failure = fmt.Sprintf("%s, %s expected but missing, %s unexpected",
+			plural(hunks, "differing hunk"), plural(res.Missing, "line"), plural(res.Unexpected, "line"))
+		diff := []string{"--- " + res.Expected + " (expected)", "+++ " + res.Output}
+		for _, h := range res.Hunks {
+			diff = append(diff, h.header())
+			diff = append(diff, h.Lines...)
+		}
+		if res.Omitted > 0 {
+			diff = append(diff, fmt.Sprintf("... %s not shown (--max-diffs %d)", plural(res.Omitted, "more hunk"), len(res.Hunks)))
+		}
+		c.Details = strings.Join(diff, "\n")
+	}
+	return testSuite{Name: "compare", Cases: []testCase{c}}
+}
+
+// printCompareResult prints the outcome of a comparison as a unified diff
+// of the compare file against the output.
+func printCompareResult(out io.Writer, res compareResult, hunks int) {
+	if res.Equal {
+		logger.Info("Successfully compared files")
+		return
+	}
+	fmt.Fprintln(out, paint(ansiBold, "--- "+res.Expected+" (expected)"))
+	fmt.Fprintln(out, paint(ansiBold, "+++ "+res.Output))
+	for _, h := range res.Hunks {
+		fmt.Fprintln(out, paintDiffLine(h.header()))
+		for _, l := range h.Lines {
+			fmt.Fprintln(out, paintDiffLine(l))
+		}
+	}
+	if res.Omitted > 0 {
+		fmt.Fprintf(out, "... %s not shown (--max-diffs %d)\n", plural(res.Omitted, "more hunk"), len(res.Hunks))
+	}
+	fmt.Fprintf(out, "%s: %s, %s expected but missing, %s unexpected\n", paint(ansiRed, "Compare failed"),
+		plural(hunks, "differing hunk"), plural(res.Missing, "line"), plural(res.Unexpected, "line"))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// optVariant is the translation of a program at an optimization level and
+// its run on the emulator.
+type optVariant struct {
+	Level string
+	Tr    *translation
+	Size  int
+	Run   *diffRun
+	Err   error
+}
+
+// runCompareOpts implements the compare-opts subcommand, translating a
+// program at several optimization levels and running every translation on
+// the emulator, to weigh their sizes and speeds against each other and
+// check that they behave the same. It exits with status 1 when a level
+// behaves differently from the first one or does not halt. The levels
+// taking the fewest instructions and the fewest cycles follow the table, as
+// the program may be short of one and not the other.
+func runCompareOpts(args []string) {
+	fs := flag.NewFlagSet("compare-opts", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	levelList := fs.String("levels", strings.Join(optLevels, ","), "comma separated optimization levels to compare, the first one being the baseline")
+	maxCycles := fs.Int("max-cycles", 10_000_000, "cycles a translation may run before it is reported as not halting")
+	maxDiffs := fs.Int("max-diffs", 3, "differences shown for a level that behaves differently (0 shows all)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: compare-opts [flags] -s source ...")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if err := opts.validate(); err != nil {
+		fmt.Println(err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	levels, err := parseOptLevels(*levelList)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitUsage)
+	}
+	// the set commands of the test script give a program without
+	// bootstrap code its pointers, as in difftest
+	var setup []string
+	if len(opts.Sources) == 1 {
+		if setup, err = diffTestSetup(opts.Sources[0]); err != nil {
+			fmt.Println("Error reading the test script", err)
+			os.Exit(exitIO)
+		}
+	}
+
+	variants := []*optVariant{}
+	for _, level := range levels {
+		optLevel = level
+		tr, err := translate(opts)
+		if err != nil {
+			fmt.Printf("Error translating with -%s: %s\n", level, err)
+			os.Exit(exitStatus(err))
+		}
+		v := &optVariant{Level: level, Tr: tr}
+		prog, err := assembleHack(tr.Lines)
+		if err != nil {
+			fmt.Printf("Error assembling the translation of -%s: %s\n", level, err)
+			os.Exit(exitInternal)
+		}
+		v.Size = len(prog.ROM)
+		v.Run, v.Err = runDiffProgram(tr.Lines, setup, *maxCycles)
+		variants = append(variants, v)
+	}
+
+	base := variants[0]
+	rows := [][5]string{{"level", "instructions", "ROM", "cycles", "behavior"}}
+	failed := 0
+	for _, v := range variants {
+		cycles, behavior := "-", "baseline"
+		if v.Run != nil {
+			cycles = fmt.Sprint(v.Run.CPU.Cycles)
+			if v != base && base.Run != nil {
+				cycles = withChange(v.Run.CPU.Cycles, base.Run.CPU.Cycles)
+			}
+		}
+		switch {
+		case v.Err != nil:
+			behavior = "ERROR " + v.Err.Error()
+			failed++
+		case v == base:
+		case base.Run == nil:
+			behavior = "not compared, the baseline failed"
+		default:
+			behavior = "same"
+			if diffs := diffStates(base.Tr, v.Run, base.Run, "-"+v.Level, "-"+base.Level); len(diffs) > 0 {
+				if *maxDiffs > 0 && len(diffs) > *maxDiffs {
+					diffs = append(slices.Clone(diffs[:*maxDiffs]), fmt.Sprintf("and %d more", len(diffs)-*maxDiffs))
+				}
+				behavior = "DIFF " + strings.Join(diffs, "; ")
+				failed++
+			}
+		}
+		size := fmt.Sprint(v.Size)
+		if v != base {
+			size = withChange(v.Size, base.Size)
+		}
+		rom := fmt.Sprintf("%.1f%%", float64(v.Size)*100/hackROMSize)
+		if v.Size > hackROMSize {
+			rom += " (too big)"
+		}
+		rows = append(rows, [5]string{v.Level, size, rom, cycles, behavior})
+	}
+	widths := [4]int{}
+	for _, row := range rows {
+		for k := range widths {
+			widths[k] = max(widths[k], len(row[k]))
+		}
+	}
+	for _, row := range rows {
+		fmt.Printf("%-*s  %*s  %*s  %*s  %s\n", widths[0], row[0], widths[1], row[1], widths[2], row[2], widths[3], row[3], row[4])
+	}
+	var smallest, fastest *optVariant
+	for _, v := range variants {
+		if v.Err != nil || v.Size > hackROMSize {
+			continue
+		}
+		if smallest == nil || v.Size < smallest.Size {
+			smallest = v
+		}
+		if fastest == nil || v.Run.CPU.Cycles < fastest.Run.CPU.Cycles {
+			fastest = v
+		}
+	}
+	if smallest != nil {
+		fmt.Printf("\nsmallest -%s, fastest -%s\n", smallest.Level, fastest.Level)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// withChange formats n with its change from base, in percent.
+func withChange(n, base int) string {
+	if base == 0 {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%d (%+.1f%%)", n, float64(n-base)*100/float64(base))
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tstColumn is a column of an output-list, like RAM[256]%D1.6.1: a
+// variable printed in a format, with the padding around it.
+type tstColumn struct {
+	Name               string
+	Format             byte // D, X, B or S
+	Left, Width, Right int
+}
+
+var tstColumnRe = regexp.MustCompile(`^([^%]+)%([DXBS])(\d+)\.(\d+)\.(\d+)$`)
+
+// parseTstColumn parses a column, defaulting to %D1.6.1.
+func parseTstColumn(s string) tstColumn {
+	m := tstColumnRe.FindStringSubmatch(s)
+	if m == nil {
+		return tstColumn{Name: s, Format: 'D', Left: 1, Width: 6, Right: 1}
+	}
+	c := tstColumn{Name: m[1], Format: m[2][0]}
+	c.Left, _ = strconv.Atoi(m[3])
+	c.Width, _ = strconv.Atoi(m[4])
+	c.Right, _ = strconv.Atoi(m[5])
+	return c
+}
+
+// header centers the name of the column in its width.
+func (c tstColumn) header() string {
+	total := c.Left + c.Width + c.Right
+	name := c.Name
+	if len(name) > total {
+		name = name[:total]
+	}
+	left := (total - len(name)) / 2
+	return strings.Repeat(" ", left) + name + strings.Repeat(" ", total-len(name)-left)
+}
+
+// cell formats a value of the column.
+func (c tstColumn) cell(v int16) string {
+	var s string
+	switch c.Format {
+	case 'X':
+		s = fmt.Sprintf("%0*X", c.Width, uint16(v))
+	case 'B':
+		s = fmt.Sprintf("%0*b", c.Width, uint16(v))
+	default:
+		s = fmt.Sprintf("%*d", c.Width, v)
+	}
+	if len(s) > c.Width {
+		s = s[len(s)-c.Width:]
+	}
+	return strings.Repeat(" ", c.Left) + s + strings.Repeat(" ", c.Right)
+}
+
+// tstRun is the state of a test script running a program.
+type tstRun struct {
+	CPU       *hackCPU
+	Columns   []tstColumn
+	CompareTo string
+	Out       []string
+	// headerDone is set once output-list printed its header
+	headerDone bool
+}
+
+// tokenizeTst splits a test script into words and the separators , ; { },
+// dropping its comments.
+func tokenizeTst(src string) []string {
+	src = regexp.MustCompile(`(?s)/\*.*?\*/`).ReplaceAllString(src, " ")
+	src = regexp.MustCompile(`//[^\n]*`).ReplaceAllString(src, " ")
+	for _, sep := range []string{",", ";", "{", "}"} {
+		src = strings.ReplaceAll(src, sep, " "+sep+" ")
+	}
+	return strings.Fields(src)
+}
+
+// variable returns a pointer to a register or RAM word of the CPU.
+func (r *tstRun) variable(name string) (*int16, error) {
+	switch name {
+	case "A":
+		return &r.CPU.A, nil
+	case "D":
+		return &r.CPU.D, nil
+	}
+	if inner, ok := strings.CutPrefix(name, "RAM["); ok && strings.HasSuffix(inner, "]") {
+		addr, err := strconv.Atoi(strings.TrimSuffix(inner, "]"))
+		if err == nil && addr >= 0 && addr < len(r.CPU.RAM) {
+			return &r.CPU.RAM[addr], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown variable %s", name)
+}
+
+func (r *tstRun) value(name string) (int16, error) {
+	switch name {
+	case "PC":
+		return int16(r.CPU.PC), nil
+	case "time":
+		return int16(r.CPU.Cycles), nil
+	}
+	p, err := r.variable(name)
+	if err != nil {
+		return 0, err
+	}
+	return *p, nil
+}
+
+// exec runs the commands of toks, up to the closing brace of a block.
+func (r *tstRun) exec(toks []string) (rest []string, err error) {
+	for len(toks) > 0 {
+		if toks[0] == "}" {
+			return toks[1:], nil
+		}
+		if toks[0] == "," || toks[0] == ";" {
+			toks = toks[1:]
+			continue
+		}
+		cmd := []string{}
+		for len(toks) > 0 && !strings.Contains(",;{}", toks[0]) {
+			cmd, toks = append(cmd, toks[0]), toks[1:]
+		}
+		if len(cmd) == 0 {
+			return nil, fmt.Errorf("unexpected %s", toks[0])
+		}
+		switch cmd[0] {
+		case "repeat":
+			n := 1
+			if len(cmd) == 2 {
+				if n, err = strconv.Atoi(cmd[1]); err != nil {
+					return nil, fmt.Errorf("invalid repeat count %s", cmd[1])
+				}
+			}
+			if len(toks) == 0 || toks[0] != "{" {
+				return nil, fmt.Errorf("repeat needs a block")
+			}
+			body := toks[1:]
+			toks = skipTstBlock(body)
+			for range n {
+				if _, err = r.exec(body); err != nil {
+					return nil, err
+				}
+			}
+		case "compare-to":
+			if len(cmd) > 1 {
+				r.CompareTo = cmd[1]
+			}
+		case "load", "output-file", "echo", "clear-echo":
+			// the translation is loaded and compared in memory
+		case "output-list":
+			r.Columns = nil
+			for _, c := range cmd[1:] {
+				r.Columns = append(r.Columns, parseTstColumn(c))
+			}
+		case "set":
+			if len(cmd) != 3 {
+				return nil, fmt.Errorf("invalid set")
+			}
+			v, err := strconv.Atoi(cmd[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", cmd[2])
+			}
+			if cmd[1] == "PC" {
+				r.CPU.PC = v
+				continue
+			}
+			p, err := r.variable(cmd[1])
+			if err != nil {
+				return nil, err
+			}
+			*p = int16(v)
+		case "ticktock", "tick", "tock":
+			// beyond the end of the program the ROM holds @0
+			if r.CPU.PC < len(r.CPU.ROM) {
+				if err := r.CPU.Step(); err != nil {
+					return nil, err
+				}
+			}
+		case "output":
+			if !r.headerDone {
+				r.headerDone = true
+				r.Out = append(r.Out, r.line(tstColumn.header))
+			}
+			var err error
+			line := r.line(func(c tstColumn) string {
+				v, e := r.value(c.Name)
+				err = cmp.Or(err, e)
+				return c.cell(v)
+			})
+			if err != nil {
+				return nil, err
+			}
+			r.Out = append(r.Out, line)
+		default:
+			return nil, fmt.Errorf("unsupported test command %s", cmd[0])
+		}
+	}
+	return nil, nil
+}
+
+// line prints a line of the output, one cell per column.
+func (r *tstRun) line(cell func(tstColumn) string) string {
+	var b strings.Builder
+	b.WriteString("|")
+	for _, c := range r.Columns {
+		b.WriteString(cell(c) + "|")
+	}
+	return b.String()
+}
+
+// skipTstBlock returns the tokens after the block toks starts in.
+func skipTstBlock(toks []string) []string {
+	depth := 0
+	for k, t := range toks {
+		switch {
+		case t == "{":
+			depth++
+		case t == "}" && depth == 0:
+			return toks[k+1:]
+		case t == "}":
+			depth--
+		}
+	}
+	return nil
+}
+
+// tstCells splits an output line into its trimmed cells.
+func tstCells(line string) []string {
+	cells := strings.Split(strings.Trim(strings.TrimSpace(line), "|"), "|")
+	for k, c := range cells {
+		cells[k] = strings.TrimSpace(c)
+	}
+	return cells
+}
+
+// conformanceTest is a test folder of projects 7 and 8: the .vm sources
+// and the .tst script running their translation on the CPU emulator.
+type conformanceTest struct {
+	Dir  string
+	Name string
+}
+
+// findConformanceTests finds the test scripts next to .vm sources,
+// leaving out the VM emulator scripts (NameVME.tst).
+func findConformanceTests(root string) ([]conformanceTest, error) {
+	tests := []conformanceTest{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".tst" || strings.HasSuffix(path, "VME.tst") {
+			return err
+		}
+		dir := filepath.Dir(path)
+		if vms, _ := filepath.Glob(filepath.Join(dir, "*.vm")); len(vms) > 0 {
+			tests = append(tests, conformanceTest{dir, strings.TrimSuffix(filepath.Base(path), ".tst")})
+		}
+		return nil
+	})
+	return tests, err
+}
+
+// runConformanceTest translates the folder of a test and runs its script,
+// returning the stage that failed ("" when it passed) and why.
+func runConformanceTest(t conformanceTest, opts translateOptions) (stage, detail string) {
+	opts.Sources = stringsFlag{t.Dir}
+	tr, err := translate(&opts)
+	if err != nil {
+		return "translate", err.Error()
+	}
+	prog, err := assembleHack(tr.Lines)
+	if err != nil {
+		return "translate", err.Error()
+	}
+	return runTstScript(prog, t)
+}
+
+// runTstScript runs the script of a test on a program and compares its
+// output with the compare file, returning the stage that failed ("run" or
+// "compare", "" when it passed) and why.
+func runTstScript(prog *hackProgram, t conformanceTest) (stage, detail string) {
+	script, err := os.ReadFile(filepath.Join(t.Dir, t.Name+".tst"))
+	if err != nil {
+		return "run", err.Error()
+	}
+	r := &tstRun{CPU: newHackCPU(prog)}
+	if _, err := r.exec(tokenizeTst(string(script))); err != nil {
+		return "run", err.Error()
+	}
+	if r.CompareTo == "" {
+		r.CompareTo = t.Name + ".cmp"
+	}
+	data, err := os.ReadFile(filepath.Join(t.Dir, r.CompareTo))
+	if err != nil {
+		return "compare", err.Error()
+	}
+	expected := []string{}
+	for _, l := range splitLines(data) {
+		if strings.TrimSpace(l) != "" {
+			expected = append(expected, l)
+		}
+	}
+	for k, l := range expected {
+		if k >= len(r.Out) {
+			return "compare", fmt.Sprintf("line %d missing: %s", k+1, strings.TrimSpace(l))
+		}
+		want, got := tstCells(l), tstCells(r.Out[k])
+		if strings.Join(want, "|") != strings.Join(got, "|") {
+			head := tstCells(expected[0])
+			for c := range want {
+				if c < len(got) && c < len(head) && want[c] != got[c] {
+					return "compare", fmt.Sprintf("line %d: %s expected %s, got %s", k+1, head[c], want[c], got[c])
+				}
+			}
+			return "compare", fmt.Sprintf("line %d: expected %s, got %s", k+1, strings.TrimSpace(l), r.Out[k])
+		}
+	}
+	return "", ""
+}
+
+// runConformance implements the conformance subcommand, running the
+// project 7 and 8 tests found below a nand2tetris directory.
+func runConformance(args []string) {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	format := fs.String("format", "text", "how the results are reported: text (a pass/fail matrix), junit or tap (a JUnit XML or TAP test report on stdout, the matrix going to stderr)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: conformance [flags] nand2tetris-root")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 || len(opts.Sources) > 0 || !slices.Contains([]string{"text", "junit", "tap"}, *format) {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	root := fs.Arg(0)
+	out := io.Writer(os.Stdout)
+	if *format != "text" {
+		out = os.Stderr
+	}
+	tests, err := findConformanceTests(root)
+	if err != nil {
+		fmt.Println("Error finding tests", err)
+		os.Exit(exitIO)
+	}
+	if len(tests) == 0 {
+		fmt.Println("No VM translator tests found in", root)
+		os.Exit(exitIO)
+	}
+
+	width := 0
+	names := make([]string, len(tests))
+	for k, t := range tests {
+		names[k], _ = filepath.Rel(root, filepath.Join(t.Dir, t.Name))
+		width = max(width, len(names[k]))
+	}
+	fmt.Fprintf(out, "%-*s  %-9s  %-4s  %-7s\n", width, "test", "translate", "run", "compare")
+	failed := 0
+	suite := testSuite{Name: "conformance"}
+	for k, t := range tests {
+		start := time.Now()
+		stage, detail := runConformanceTest(t, *opts)
+		c := testCase{Class: filepath.Dir(names[k]), Name: t.Name, Elapsed: time.Since(start)}
+		if stage != "" {
+			c.Failure = stage + ": " + detail
+		}
+		suite.Cases = append(suite.Cases, c)
+		marks := []string{}
+		for _, s := range []string{"translate", "run", "compare"} {
+			switch {
+			case stage == s:
+				marks = append(marks, "FAIL")
+				stage = "done"
+			case stage == "done":
+				marks = append(marks, "-")
+			default:
+				marks = append(marks, "ok")
+			}
+		}
+		row := fmt.Sprintf("%-*s  %-9s  %-4s  %-7s", width, names[k], marks[0], marks[1], marks[2])
+		if detail != "" {
+			failed++
+			row += "  " + strings.ReplaceAll(detail, "\n", " ")
+		}
+		fmt.Fprintln(out, strings.TrimRight(row, " "))
+	}
+	fmt.Fprintf(out, "%d passed, %d failed\n", len(tests)-failed, failed)
+	if *format != "text" {
+		if err := writeTestReport(os.Stdout, *format, []testSuite{suite}); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing the test report", err)
+			os.Exit(exitIO)
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
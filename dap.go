@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// runDAP implements the dap subcommand, a Debug Adapter Protocol server
+// over stdin/stdout debugging VM programs on the built-in emulator.
+func runDAP(args []string) {
+	fs := flag.NewFlagSet("dap", flag.ExitOnError)
+	prof := registerProfileFlags(fs, true)
+	parseFlags(fs, args)
+
+	stopProfiles := prof.start()
+	s := &dapServer{out: os.Stdout, breakpoints: map[string][]int{}}
+	if err := s.serve(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, "Error serving dap", err)
+		os.Exit(1)
+	}
+	stopProfiles()
+}
+
+// dapCycleSlice is the number of instructions run between two checks for
+// incoming requests, so that a running program can be paused.
+const dapCycleSlice = 100000
+
+type dapServer struct {
+	out         io.Writer
+	seq         int
+	dbg         *vmDebugger
+	run         *vmRun // execution in progress, nil while stopped
+	runReason   string // reason reported when the run stops on a step
+	stopOnEntry bool
+	breakpoints map[string][]int // source path -> lines
+}
+
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// dapLaunchArgs are the launch configuration attributes.
+type dapLaunchArgs struct {
+	Program     string   `json:"program"`
+	Sources     []string `json:"sources"`
+	WithOS      bool     `json:"withOS"`
+	Ext         bool     `json:"ext"`
+	Entry       string   `json:"entry"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapStackFrame struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name"`
+	Source *dapSource `json:"source,omitempty"`
+	Line   int        `json:"line"`
+	Column int        `json:"column"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+const (
+	dapScopeLocal = iota + 1
+	dapScopeArgument
+	dapScopeStack
+	dapScopeStatic
+	dapScopeRegisters
+	dapScopeCount
+)
+
+func (s *dapServer) serve(in io.Reader) error {
+	requests := make(chan dapMessage)
+	readErr := make(chan error, 1)
+	go func() {
+		r := bufio.NewReader(in)
+		for {
+			body, err := readLSPMessage(r)
+			if err != nil {
+				readErr <- err
+				close(requests)
+				return
+			}
+			msg := dapMessage{}
+			if err := json.Unmarshal(body, &msg); err != nil {
+				continue
+			}
+			requests <- msg
+		}
+	}()
+
+	for {
+		var msg dapMessage
+		var ok bool
+		if s.run != nil {
+			select {
+			case msg, ok = <-requests:
+			default:
+				s.advance()
+				continue
+			}
+		} else {
+			msg, ok = <-requests
+		}
+		if !ok {
+			if err := <-readErr; err != io.EOF {
+				return err
+			}
+			return nil
+		}
+		if done := s.handle(msg); done {
+			return nil
+		}
+	}
+}
+
+// advance runs the program in progress for a slice of cycles, reporting
+// where it stops.
+func (s *dapServer) advance() {
+	reason, err := s.dbg.Run(s.run, dapCycleSlice)
+	switch {
+	case err != nil:
+		s.run = nil
+		s.event("output", map[string]any{"category": "stderr", "output": fmt.Sprintf("Error running program %s at %s\n", err, s.dbg.Location())})
+		s.event("terminated", nil)
+	case reason == "budget":
+	case reason == "halt":
+		s.run = nil
+		s.event("output", map[string]any{"category": "console", "output": fmt.Sprintf("Program halted after %d cycles\n", s.dbg.CPU.Cycles)})
+		s.event("terminated", nil)
+	default:
+		if reason == "step" {
+			reason = s.runReason
+		}
+		s.run = nil
+		s.event("stopped", map[string]any{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	}
+}
+
+func (s *dapServer) send(m map[string]any) {
+	s.seq++
+	m["seq"] = s.seq
+	body, _ := json.Marshal(m)
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *dapServer) event(name string, body any) {
+	m := map[string]any{"type": "event", "event": name}
+	if body != nil {
+		m["body"] = body
+	}
+	s.send(m)
+}
+
+func (s *dapServer) respond(req dapMessage, body any, err error) {
+	m := map[string]any{"type": "response", "request_seq": req.Seq, "command": req.Command, "success": err == nil}
+	if err != nil {
+		m["message"] = err.Error()
+	}
+	if body != nil {
+		m["body"] = body
+	}
+	s.send(m)
+}
+
+// handle serves a request, returning true once the session is over.
+func (s *dapServer) handle(req dapMessage) bool {
+	if req.Type != "request" {
+		return false
+	}
+	switch req.Command {
+	case "initialize":
+		s.respond(req, map[string]any{"supportsConfigurationDoneRequest": true, "supportsEvaluateForHovers": true}, nil)
+	case "launch":
+		err := s.launch(req.Arguments)
+		s.respond(req, nil, err)
+		if err == nil {
+			s.event("initialized", nil)
+		}
+	case "setBreakpoints":
+		s.respond(req, s.setBreakpoints(req.Arguments), nil)
+	case "setExceptionBreakpoints":
+		s.respond(req, map[string]any{"breakpoints": []any{}}, nil)
+	case "configurationDone":
+		s.respond(req, nil, nil)
+		if s.stopOnEntry {
+			s.start(stepInto, "entry")
+		} else {
+			s.start(runContinue, "step")
+		}
+	case "threads":
+		s.respond(req, map[string]any{"threads": []any{map[string]any{"id": 1, "name": "hack"}}}, nil)
+	case "stackTrace":
+		s.respond(req, s.stackTrace(), nil)
+	case "scopes":
+		var args struct {
+			FrameID int `json:"frameId"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		s.respond(req, s.scopes(args.FrameID), nil)
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		s.respond(req, map[string]any{"variables": s.variables(args.VariablesReference)}, nil)
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		v, err := s.evaluate(args.Expression)
+		s.respond(req, map[string]any{"result": v, "variablesReference": 0}, err)
+	case "continue":
+		s.respond(req, map[string]any{"allThreadsContinued": true}, nil)
+		s.start(runContinue, "step")
+	case "next":
+		s.respond(req, nil, nil)
+		s.start(stepOver, "step")
+	case "stepIn":
+		s.respond(req, nil, nil)
+		s.start(stepInto, "step")
+	case "stepOut":
+		s.respond(req, nil, nil)
+		s.start(stepOut, "step")
+	case "pause":
+		s.respond(req, nil, nil)
+		if s.run != nil {
+			s.run = nil
+			s.event("stopped", map[string]any{"reason": "pause", "threadId": 1, "allThreadsStopped": true})
+		}
+	case "disconnect", "terminate":
+		s.respond(req, nil, nil)
+		return true
+	default:
+		s.respond(req, nil, fmt.Errorf("unsupported request %s", req.Command))
+	}
+	return false
+}
+
+func (s *dapServer) launch(raw json.RawMessage) error {
+	args := dapLaunchArgs{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	opts := &translateOptions{Bootstrap: "auto", Entry: "Sys.init", WithOS: args.WithOS}
+	if args.Program != "" {
+		opts.Sources = append(opts.Sources, args.Program)
+	}
+	opts.Sources = append(opts.Sources, args.Sources...)
+	if args.Entry != "" {
+		opts.Entry = args.Entry
+	}
+	extendedMode = args.Ext
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	tr, err := translate(opts)
+	if err != nil {
+		return err
+	}
+	for _, w := range tr.Warnings {
+		s.event("output", map[string]any{"category": "console", "output": "Warning: " + w + "\n"})
+	}
+	if s.dbg, err = newVMDebugger(tr); err != nil {
+		return err
+	}
+	s.stopOnEntry = args.StopOnEntry
+	for path, lines := range s.breakpoints {
+		for _, line := range lines {
+			s.dbg.BreakAt(path, line)
+		}
+	}
+	return nil
+}
+
+func (s *dapServer) start(mode stepMode, reason string) {
+	if s.dbg == nil {
+		return
+	}
+	s.run = s.dbg.NewRun(mode, nil)
+	s.runReason = reason
+}
+
+func (s *dapServer) setBreakpoints(raw json.RawMessage) any {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	json.Unmarshal(raw, &args)
+	lines := []int{}
+	for _, bp := range args.Breakpoints {
+		lines = append(lines, bp.Line)
+	}
+	s.breakpoints[args.Source.Path] = lines
+
+	verified := map[int]bool{}
+	if s.dbg != nil {
+		s.dbg.Breakpoints = map[int]bool{}
+		for path, ls := range s.breakpoints {
+			for _, line := range ls {
+				ok := s.dbg.BreakAt(path, line)
+				if path == args.Source.Path {
+					verified[line] = ok
+				}
+			}
+		}
+	}
+	result := []any{}
+	for _, line := range lines {
+		result = append(result, map[string]any{"verified": s.dbg == nil || verified[line], "line": line})
+	}
+	return map[string]any{"breakpoints": result}
+}
+
+func (s *dapServer) stackTrace() any {
+	frames := []dapStackFrame{}
+	if s.dbg != nil {
+		for k, f := range s.dbg.Frames() {
+			frame := dapStackFrame{ID: k + 1, Name: frameName(f), Column: 1}
+			if f.Command >= 0 {
+				sl := s.dbg.Tr.Commands[f.Command]
+				path := sl.File
+				if abs, err := filepath.Abs(path); err == nil {
+					path = abs
+				}
+				frame.Source = &dapSource{Name: filepath.Base(sl.File), Path: path}
+				frame.Line = sl.Line
+			}
+			frames = append(frames, frame)
+		}
+	}
+	return map[string]any{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+func (s *dapServer) scopes(frameID int) any {
+	base := frameID * dapScopeCount
+	scope := func(name string, kind int) map[string]any {
+		return map[string]any{"name": name, "variablesReference": base + kind, "expensive": false}
+	}
+	return map[string]any{"scopes": []any{
+		scope("Local", dapScopeLocal),
+		scope("Argument", dapScopeArgument),
+		scope("Stack", dapScopeStack),
+		scope("Static", dapScopeStatic),
+		scope("Registers", dapScopeRegisters),
+	}}
+}
+
+func (s *dapServer) variables(ref int) []dapVariable {
+	vars := []dapVariable{}
+	if s.dbg == nil {
+		return vars
+	}
+	frames := s.dbg.Frames()
+	k := ref/dapScopeCount - 1
+	if k < 0 || k >= len(frames) {
+		return vars
+	}
+	f := frames[k]
+	ram := s.dbg.CPU.RAM
+	add := func(name string, v int16) {
+		vars = append(vars, dapVariable{Name: name, Value: strconv.Itoa(int(v))})
+	}
+	switch ref % dapScopeCount {
+	case dapScopeLocal:
+		for i := range f.NLocals {
+			if f.LCL+i < len(ram) {
+				add(fmt.Sprintf("local %d", i), ram[f.LCL+i])
+			}
+		}
+	case dapScopeArgument:
+		for i := range f.NArgs {
+			if f.ARG+i < len(ram) {
+				add(fmt.Sprintf("argument %d", i), ram[f.ARG+i])
+			}
+		}
+	case dapScopeStack:
+		for i, v := range s.dbg.Stack(f) {
+			add(fmt.Sprintf("[%d]", i), v)
+		}
+	case dapScopeStatic:
+		if f.Command >= 0 {
+			file := s.dbg.Tr.Commands[f.Command].File
+			indexes, values := s.dbg.Statics(file)
+			for i, n := range indexes {
+				add(fmt.Sprintf("static %d", n), values[i])
+			}
+		}
+	case dapScopeRegisters:
+		for i, name := range []string{"SP", "LCL", "ARG", "THIS", "THAT"} {
+			add(name, ram[i])
+		}
+		vars = append(vars, dapVariable{Name: "PC", Value: strconv.Itoa(s.dbg.CPU.PC)})
+		add("A", s.dbg.CPU.A)
+		add("D", s.dbg.CPU.D)
+	}
+	return vars
+}
+
+var ramExprRe = regexp.MustCompile(`^RAM\[(\d+)\]$`)
+
+// evaluate reads RAM[n] or the RAM cell of a symbol (SP, LCL, Main.0, ...).
+func (s *dapServer) evaluate(expr string) (string, error) {
+	if s.dbg == nil {
+		return "", fmt.Errorf("no program running")
+	}
+	expr = strings.TrimSpace(expr)
+	addr := -1
+	if m := ramExprRe.FindStringSubmatch(expr); m != nil {
+		addr, _ = strconv.Atoi(m[1])
+	} else if v, ok := s.dbg.Prog.Symbols[expr]; ok {
+		addr = v
+	}
+	if addr < 0 || addr >= len(s.dbg.CPU.RAM) {
+		return "", fmt.Errorf("cannot evaluate %s, expected RAM[n] or a symbol", expr)
+	}
+	return strconv.Itoa(int(s.dbg.CPU.RAM[addr])), nil
+}
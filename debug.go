@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// runDebug implements the debug subcommand, an interactive debugger
+// running the translation on the emulator.
+func runDebug(args []string) {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	var breaks stringsFlag
+	fs.Var(&breaks, "break", "set a breakpoint before the session starts, on a function (Main.main) or a line (Foo.vm:27), can be repeated")
+	parseFlags(fs, args)
+	if err := opts.validate(); err != nil {
+		fmt.Println(err)
+		fs.Usage()
+		os.Exit(1)
+	}
+	tr, err := translate(opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitStatus(err))
+	}
+	for _, w := range tr.Warnings {
+		fmt.Println("Warning:", w)
+	}
+	dbg, err := newVMDebugger(tr)
+	if err != nil {
+		fmt.Println("Error", err)
+		os.Exit(2)
+	}
+
+	ds := &debugSession{dbg: dbg, out: os.Stdout}
+	for _, b := range breaks {
+		ds.setBreakpoint(b)
+	}
+	fmt.Println("Type help for the list of commands.")
+	in := bufio.NewScanner(os.Stdin)
+	last := ""
+	for {
+		fmt.Print("(vmdbg) ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(in.Text())
+		if line == "" {
+			// an empty line repeats the previous command
+			line = last
+		}
+		last = line
+		if ds.exec(line) {
+			return
+		}
+	}
+}
+
+// debugSession holds the state of an interactive debugging session.
+type debugSession struct {
+	dbg   *vmDebugger
+	out   io.Writer
+	watch []int // watched RAM addresses
+	ended bool  // the program halted or failed
+}
+
+const debugHelp = `Commands:
+  break FUNCTION | [FILE:]LINE   set a breakpoint (b)
+  delete                         delete all breakpoints
+  watch ADDRESS|SYMBOL           stop when a RAM cell changes
+  unwatch ADDRESS|SYMBOL         stop watching a RAM cell
+  continue                       run until a breakpoint, a watch or the end (c)
+  step                           run to the next VM command, entering calls (s)
+  next                           run to the next VM command, over calls (n)
+  finish                         run until the current function returns
+  regs                           print SP, LCL, ARG, THIS, THAT, A, D and PC
+  print REG|RAM[N]|SYMBOL        print a register or RAM cell (p)
+  frames                         dump the stack frames (bt)
+  where                          print the current command
+  quit                           leave the debugger (q)
+An empty line repeats the previous command.`
+
+// exec runs a debugger command, returning true when the session is over.
+func (ds *debugSession) exec(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	arg := strings.Join(fields[1:], " ")
+	switch fields[0] {
+	case "help", "h":
+		fmt.Fprintln(ds.out, debugHelp)
+	case "quit", "q", "exit":
+		return true
+	case "break", "b":
+		ds.setBreakpoint(arg)
+	case "delete", "d":
+		ds.dbg.Breakpoints = map[int]bool{}
+		fmt.Fprintln(ds.out, "Deleted all breakpoints")
+	case "watch", "unwatch":
+		addr, err := ds.address(arg)
+		if err != nil {
+			fmt.Fprintln(ds.out, err)
+			break
+		}
+		if fields[0] == "watch" {
+			if !slices.Contains(ds.watch, addr) {
+				ds.watch = append(ds.watch, addr)
+			}
+			fmt.Fprintf(ds.out, "Watching RAM[%d] = %d\n", addr, ds.dbg.CPU.RAM[addr])
+		} else {
+			ds.watch = slices.DeleteFunc(ds.watch, func(a int) bool { return a == addr })
+			fmt.Fprintf(ds.out, "No longer watching RAM[%d]\n", addr)
+		}
+	case "continue", "c":
+		ds.resume(runContinue)
+	case "step", "s":
+		ds.resume(stepInto)
+	case "next", "n":
+		ds.resume(stepOver)
+	case "finish", "fin":
+		ds.resume(stepOut)
+	case "regs", "r":
+		ram := ds.dbg.CPU.RAM
+		fmt.Fprintf(ds.out, "SP=%d LCL=%d ARG=%d THIS=%d THAT=%d A=%d D=%d PC=%d\n",
+			ram[0], ram[1], ram[2], ram[3], ram[4], ds.dbg.CPU.A, ds.dbg.CPU.D, ds.dbg.CPU.PC)
+	case "print", "p":
+		ds.print(arg)
+	case "frames", "bt", "backtrace":
+		ds.printFrames()
+	case "where", "w":
+		fmt.Fprintln(ds.out, ds.dbg.Location())
+	default:
+		fmt.Fprintf(ds.out, "Unknown command %q, type help for the list of commands\n", fields[0])
+	}
+	return false
+}
+
+func (ds *debugSession) setBreakpoint(arg string) {
+	if arg == "" {
+		fmt.Fprintln(ds.out, "Usage: break FUNCTION | [FILE:]LINE")
+		return
+	}
+	on, err := ds.dbg.SetBreakpoint(arg)
+	if err != nil {
+		fmt.Fprintln(ds.out, err)
+		return
+	}
+	fmt.Fprintln(ds.out, "Breakpoint at", on)
+}
+
+func (ds *debugSession) resume(mode stepMode) {
+	if ds.ended {
+		fmt.Fprintln(ds.out, "The program is not running")
+		return
+	}
+	reason, err := ds.dbg.Run(ds.dbg.NewRun(mode, ds.watch), 0)
+	switch {
+	case err != nil:
+		ds.ended = true
+		fmt.Fprintf(ds.out, "Error running program %s at %s\n", err, ds.dbg.Location())
+		for _, line := range ds.dbg.StackTrace() {
+			fmt.Fprintln(ds.out, " ", line)
+		}
+	case reason == "halt":
+		ds.ended = true
+		fmt.Fprintf(ds.out, "Program halted after %d cycles\n", ds.dbg.CPU.Cycles)
+	case reason == "watch":
+		fmt.Fprintln(ds.out, "Watched RAM changed at", ds.dbg.Location())
+		for _, addr := range ds.watch {
+			fmt.Fprintf(ds.out, "  RAM[%d] = %d\n", addr, ds.dbg.CPU.RAM[addr])
+		}
+	case reason == "breakpoint":
+		fmt.Fprintln(ds.out, "Breakpoint,", ds.dbg.Location())
+		for _, line := range ds.dbg.StackTrace() {
+			fmt.Fprintln(ds.out, " ", line)
+		}
+	default:
+		fmt.Fprintln(ds.out, ds.dbg.Location())
+	}
+}
+
+// address resolves RAM[N], a number or a symbol to a RAM address.
+func (ds *debugSession) address(expr string) (int, error) {
+	expr = strings.TrimSpace(expr)
+	if inner, ok := strings.CutPrefix(expr, "RAM["); ok {
+		expr = strings.TrimSuffix(inner, "]")
+	}
+	addr, err := strconv.Atoi(expr)
+	if err != nil {
+		v, ok := ds.dbg.Prog.Symbols[expr]
+		if !ok {
+			return 0, fmt.Errorf("Unknown address or symbol %q", expr)
+		}
+		addr = v
+	}
+	if addr < 0 || addr >= len(ds.dbg.CPU.RAM) {
+		return 0, fmt.Errorf("Address %d outside of RAM", addr)
+	}
+	return addr, nil
+}
+
+func (ds *debugSession) print(arg string) {
+	switch arg {
+	case "A":
+		fmt.Fprintln(ds.out, "A =", ds.dbg.CPU.A)
+		return
+	case "D":
+		fmt.Fprintln(ds.out, "D =", ds.dbg.CPU.D)
+		return
+	case "PC":
+		fmt.Fprintln(ds.out, "PC =", ds.dbg.CPU.PC)
+		return
+	}
+	addr, err := ds.address(arg)
+	if err != nil {
+		fmt.Fprintln(ds.out, err)
+		return
+	}
+	fmt.Fprintf(ds.out, "%s = %d\n", arg, ds.dbg.CPU.RAM[addr])
+}
+
+func (ds *debugSession) printFrames() {
+	for k, f := range ds.dbg.Frames() {
+		where := "(no VM command)"
+		if f.Command >= 0 {
+			where = ds.dbg.Tr.Commands[f.Command].Pos()
+		}
+		fmt.Fprintf(ds.out, "#%d %s at %s\n", k, frameName(f), where)
+		fmt.Fprintf(ds.out, "   LCL=%d ARG=%d\n", f.LCL, f.ARG)
+		if f.NArgs > 0 {
+			fmt.Fprintf(ds.out, "   argument: %v\n", ds.dbg.CPU.RAM[f.ARG:f.ARG+f.NArgs])
+		}
+		if f.NLocals > 0 && f.LCL+f.NLocals <= len(ds.dbg.CPU.RAM) {
+			fmt.Fprintf(ds.out, "   local: %v\n", ds.dbg.CPU.RAM[f.LCL:f.LCL+f.NLocals])
+		}
+		fmt.Fprintf(ds.out, "   stack: %v\n", ds.dbg.Stack(f))
+	}
+}
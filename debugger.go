@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// vmDebugger runs a translated program on the emulator and maps the
+// machine state back to the VM commands through the source map of the
+// translation.
+type vmDebugger struct {
+	Tr   *translation
+	Prog *hackProgram
+	CPU  *hackCPU
+	// CommandOf maps every ROM address to the command it was generated
+	// for, -1 for the bootstrap and runtime code
+	CommandOf []int
+	// Start is the first ROM address of every command, -1 for the commands
+	// generating no instruction
+	Start []int
+	// Function is the function every command belongs to, "" before the
+	// first function declaration
+	Function []string
+	NLocals  map[string]int
+	// Breakpoints holds the ROM addresses to stop at
+	Breakpoints map[int]bool
+}
+
+func newVMDebugger(tr *translation) (*vmDebugger, error) {
+	prog, err := assembleHack(tr.Lines)
+	if err != nil {
+		return nil, fmt.Errorf("assembling the translation: %w", err)
+	}
+	d := &vmDebugger{
+		Tr:          tr,
+		Prog:        prog,
+		CPU:         newHackCPU(prog),
+		CommandOf:   make([]int, len(prog.ROM)),
+		Start:       make([]int, len(tr.Instructions)),
+		NLocals:     map[string]int{},
+		Breakpoints: map[int]bool{},
+	}
+	for k := range d.Start {
+		d.Start[k] = -1
+	}
+	for addr, in := range prog.ROM {
+		cmd := tr.Origin[in.Line]
+		d.CommandOf[addr] = cmd
+		if cmd >= 0 && d.Start[cmd] < 0 {
+			d.Start[cmd] = addr
+		}
+	}
+	fn := ""
+	for _, inst := range tr.Instructions {
+		if inst.CommandType == CommandTypeFunction {
+			fn = inst.Arg1
+			d.NLocals[fn] = inst.Arg2Val
+		}
+		d.Function = append(d.Function, fn)
+	}
+	return d, nil
+}
+
+// CommandAt returns the command the instruction at addr belongs to, -1 for
+// the bootstrap and runtime code.
+func (d *vmDebugger) CommandAt(addr int) int {
+	if addr < 0 || addr >= len(d.CommandOf) {
+		return -1
+	}
+	return d.CommandOf[addr]
+}
+
+// atCommandStart reports whether PC is on the first instruction of a
+// command.
+func (d *vmDebugger) atCommandStart() bool {
+	cmd := d.CommandAt(d.CPU.PC)
+	return cmd >= 0 && d.Start[cmd] == d.CPU.PC
+}
+
+// BreakAt sets a breakpoint on the commands of file at line, returning
+// whether there is any. A breakpoint on a command generating no code, like
+// a label, stops at the next command that does.
+func (d *vmDebugger) BreakAt(file string, line int) bool {
+	found := false
+	for k, sl := range d.Tr.Commands {
+		if sl.Line != line || !sameSource(sl.File, file) {
+			continue
+		}
+		if addr := d.codeStart(k); addr >= 0 {
+			d.Breakpoints[addr] = true
+			found = true
+		}
+	}
+	return found
+}
+
+// codeStart returns the first ROM address of command k or, when it
+// generates no code, of the first command after it that does.
+func (d *vmDebugger) codeStart(k int) int {
+	for ; k < len(d.Start); k++ {
+		if d.Start[k] >= 0 {
+			return d.Start[k]
+		}
+	}
+	return -1
+}
+
+// BreakAtFunction sets a breakpoint on the declaration of fn.
+func (d *vmDebugger) BreakAtFunction(fn string) bool {
+	for k, inst := range d.Tr.Instructions {
+		if inst.CommandType == CommandTypeFunction && inst.Arg1 == fn && d.codeStart(k) >= 0 {
+			d.Breakpoints[d.codeStart(k)] = true
+			return true
+		}
+	}
+	return false
+}
+
+// SetBreakpoint sets the breakpoint of a break command or a --break flag:
+// FUNCTION, FILE:LINE or, in the file of the current command, LINE. It
+// returns what the breakpoint is on.
+func (d *vmDebugger) SetBreakpoint(spec string) (string, error) {
+	file, lineText, hasFile := strings.Cut(spec, ":")
+	if !hasFile {
+		lineText = spec
+		if cmd := d.CommandAt(d.CPU.PC); cmd >= 0 {
+			file = d.Tr.Commands[cmd].File
+		}
+	}
+	line, err := strconv.Atoi(lineText)
+	if err != nil {
+		if d.BreakAtFunction(spec) {
+			return "function " + spec, nil
+		}
+		return "", fmt.Errorf("No function %s", spec)
+	}
+	if !hasFile && file == "" {
+		return "", errors.New("No current file, use FILE:LINE")
+	}
+	if !hasFile || d.findSource(file) != "" {
+		if hasFile {
+			file = d.findSource(file)
+		}
+		if d.BreakAt(file, line) {
+			return fmt.Sprintf("%s:%d", file, line), nil
+		}
+	}
+	return "", fmt.Errorf("No VM command at %s:%d", file, line)
+}
+
+// findSource resolves a file name given to a breakpoint, which may be the
+// path of a source or just its base name.
+func (d *vmDebugger) findSource(name string) string {
+	for _, sl := range d.Tr.Commands {
+		if sameSource(sl.File, name) || strings.HasSuffix(sl.File, string(os.PathSeparator)+name) || sl.File == name+".vm" {
+			return sl.File
+		}
+	}
+	for _, sl := range d.Tr.Commands {
+		if base := sl.FileName(); base == strings.TrimSuffix(name, ".vm") {
+			return sl.File
+		}
+	}
+	return ""
+}
+
+func sameSource(a, b string) bool {
+	return a == b || sourceKey(a) == sourceKey(b)
+}
+
+// vmFrame is a function activation reconstructed from the saved frames
+// on the stack.
+type vmFrame struct {
+	Function string
+	Command  int // command being executed, -1 when unknown
+	LCL, ARG int
+	NArgs    int
+	NLocals  int
+	// StackStart and StackEnd delimit the working stack of the frame
+	StackStart, StackEnd int
+}
+
+// frameName names the function of f.
+func frameName(f vmFrame) string {
+	if f.Function == "" {
+		return "(top level)"
+	}
+	return f.Function
+}
+
+// Frames returns the call stack, innermost first, walking the frames
+// saved by call through LCL.
+func (d *vmDebugger) Frames() []vmFrame {
+	ram := d.CPU.RAM
+	cmd := d.CommandAt(d.CPU.PC)
+	lcl, arg, end := int(ram[1]), int(ram[2]), int(ram[0])
+	frames := []vmFrame{}
+	for len(frames) < 4096 {
+		fn := ""
+		if cmd >= 0 {
+			fn = d.Function[cmd]
+		}
+		f := vmFrame{Function: fn, Command: cmd, LCL: lcl, ARG: arg, StackEnd: end}
+		if fn != "" && lcl >= 5 {
+			f.NArgs = max(lcl-5-arg, 0)
+			f.NLocals = d.NLocals[fn]
+		}
+		f.StackStart = lcl + f.NLocals
+		frames = append(frames, f)
+		if fn == "" || lcl < 5 || lcl >= len(ram) {
+			break
+		}
+		ret := int(ram[lcl-5])
+		cmd = d.CommandAt(ret - 1)
+		if cmd < 0 {
+			// called by the bootstrap code
+			break
+		}
+		end = arg
+		lcl, arg = int(ram[lcl-4]), int(ram[lcl-3])
+	}
+	return frames
+}
+
+// StackTrace describes the call stack in VM terms, innermost first: the
+// function of every frame and the command it is at, the call for the
+// calling frames. The frames of a recursion repeating the same call are
+// counted rather than listed.
+func (d *vmDebugger) StackTrace() []string {
+	lines := []string{}
+	last, repeats := "", 0
+	flush := func() {
+		if repeats > 0 {
+			lines = append(lines, fmt.Sprintf("(%s like the one above)", plural(repeats, "more frame")))
+		}
+		repeats = 0
+	}
+	for _, f := range d.Frames() {
+		where := "(no VM command)"
+		if f.Command >= 0 {
+			sl := d.Tr.Commands[f.Command]
+			where = fmt.Sprintf("%s: %s", sl.Pos(), sl.Text)
+		}
+		line := fmt.Sprintf("in %s at %s", frameName(f), where)
+		if line == last {
+			repeats++
+			continue
+		}
+		flush()
+		lines = append(lines, line)
+		last = line
+	}
+	flush()
+	return lines
+}
+
+// Stack returns the working stack of frame f. At the start of a command
+// the top of the stack may still be in D, as the code of the levels
+// above -O0 keeps it, and is returned as the last value.
+func (d *vmDebugger) Stack(f vmFrame) []int16 {
+	if f.StackStart < 0 || f.StackEnd > len(d.CPU.RAM) || f.StackStart > f.StackEnd {
+		return nil
+	}
+	stack := d.CPU.RAM[f.StackStart:f.StackEnd]
+	if f.StackEnd == int(d.CPU.RAM[0]) && d.atCommandStart() && d.Tr.StackInD[d.CommandAt(d.CPU.PC)] {
+		stack = append(slices.Clone(stack), d.CPU.D)
+	}
+	return stack
+}
+
+// Statics returns the static variables of the class defined by file, by
+// index.
+func (d *vmDebugger) Statics(file string) ([]int, []int16) {
+	prefix := sourceLine{File: file}.StaticPrefix() + "."
+	indexes := []int{}
+	for sym := range d.Prog.Symbols {
+		if rest, ok := strings.CutPrefix(sym, prefix); ok {
+			if n, err := strconv.Atoi(rest); err == nil && n >= 0 {
+				indexes = append(indexes, n)
+			}
+		}
+	}
+	sort.Ints(indexes)
+	values := []int16{}
+	for _, n := range indexes {
+		values = append(values, d.CPU.RAM[d.Prog.Symbols[fmt.Sprintf("%s%d", prefix, n)]])
+	}
+	return indexes, values
+}
+
+type stepMode int
+
+const (
+	runContinue stepMode = iota // until a breakpoint
+	stepInto                    // to the next command
+	stepOver                    // to the next command of the same or a calling function
+	stepOut                     // to the next command of a calling function
+)
+
+// vmRun is an execution in progress, which may span several Run calls.
+type vmRun struct {
+	Mode     stepMode
+	startLCL int16
+	// Watch holds the RAM addresses whose change stops the run
+	Watch map[int]int16
+}
+
+func (d *vmDebugger) NewRun(mode stepMode, watch []int) *vmRun {
+	r := &vmRun{Mode: mode, startLCL: d.CPU.RAM[1], Watch: map[int]int16{}}
+	for _, addr := range watch {
+		r.Watch[addr] = d.CPU.RAM[addr]
+	}
+	return r
+}
+
+// Run executes at least one instruction and then stops on the first
+// command boundary the run's mode stops at or with a breakpoint, on a
+// watched RAM change, when the program halts or errors, or after budget
+// instructions when budget is positive. Runs stopped by the budget can be
+// resumed by calling Run again. It returns why it stopped: "step",
+// "breakpoint", "watch", "halt" or "budget".
+func (d *vmDebugger) Run(r *vmRun, budget int) (string, error) {
+	for n := 0; budget <= 0 || n < budget; n++ {
+		if d.CPU.Halted() {
+			return "halt", nil
+		}
+		if err := d.Fault(); err != nil {
+			return "", err
+		}
+		if err := d.CPU.Step(); err != nil {
+			return "", err
+		}
+		for addr, old := range r.Watch {
+			if v := d.CPU.RAM[addr]; v != old {
+				r.Watch[addr] = v
+				return "watch", nil
+			}
+		}
+		if d.CPU.Halted() {
+			return "halt", nil
+		}
+		if !d.atCommandStart() {
+			continue
+		}
+		if d.Breakpoints[d.CPU.PC] {
+			return "breakpoint", nil
+		}
+		lcl := d.CPU.RAM[1]
+		switch {
+		case r.Mode == stepInto,
+			r.Mode == stepOver && lcl <= r.startLCL,
+			r.Mode == stepOut && lcl < r.startLCL:
+			return "step", nil
+		}
+	}
+	return "budget", nil
+}
+
+// Fault reports a state the emulator would run on from but no VM program
+// can be in: at the start of a command, SP outside of the stack, below the
+// stack base or past its end at the heap base.
+func (d *vmDebugger) Fault() error {
+	if !d.atCommandStart() {
+		return nil
+	}
+	if sp := int(d.CPU.RAM[0]); sp < layout.Stack || sp > layout.Heap {
+		return fmt.Errorf("SP %d outside of the stack (%d-%d)", sp, layout.Stack, layout.Heap)
+	}
+	return nil
+}
+
+// Location describes where the program is: the source position of the
+// current command, or the ROM address within the bootstrap or runtime code.
+func (d *vmDebugger) Location() string {
+	if cmd := d.CommandAt(d.CPU.PC); cmd >= 0 {
+		return fmt.Sprintf("%s: %s", d.Tr.Commands[cmd].Pos(), d.Tr.Commands[cmd].Text)
+	}
+	return fmt.Sprintf("pc %d (outside of any VM command)", d.CPU.PC)
+}
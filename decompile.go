@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The decompiler recovers the VM commands of assembly written by the
+// translator, matching the code generated for every command. It reads the
+// instructions only, so it works on assembly stripped of its comments.
+//
+// The code of some commands is the same: a function starting with push
+// constant 0 is read as having one more local. Translating the VM code recovered generates the same
+// instructions again, which is what the decompiler guarantees.
+
+// asmIdiom is the code generated for a VM command. Its pattern lines match
+// stripped assembly lines, where {name} matches any text, the same one
+// wherever the name repeats. Command returns the VM command of a match, or
+// false when the text matched does not fit it.
+type asmIdiom struct {
+	Pattern []string
+	Command func(d *decompiler, m map[string]string) (string, bool)
+}
+
+var (
+	asmPushTail = []string{"@SP", "AM=M+1", "A=A-1", "M=D"}
+	asmPopHead  = []string{"@SP", "AM=M-1", "D=M"}
+	asmVMEnd    = []string{"(__VM_END)", "@__VM_END", "0;JMP"}
+	asmBootHead = []string{"@{sp}", "D=A", "@SP", "M=D"}
+)
+
+// generatedLabelRe matches the labels the translator generates in a
+// function, like Main.main$ret$3 or Main.main$EQ_TRUE$2.
+var generatedLabelRe = regexp.MustCompile(`^(.+)\$(ret|[A-Z]+_[A-Z]+)\$\d+$`)
+
+// staticSymbolRe matches the symbol of a static variable, like Main.3.
+var staticSymbolRe = regexp.MustCompile(`^(.+)\.(\d+)$`)
+
+func concatLines(parts ...[]string) []string {
+	lines := []string{}
+	for _, p := range parts {
+		lines = append(lines, p...)
+	}
+	return lines
+}
+
+// asmNumber parses the number of an A-instruction, false for a symbol.
+func asmNumber(s string, max int) (int, bool) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max || strconv.Itoa(n) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// asmSegments are the segments addressed through a pointer, by the symbol
+// of their pointer.
+var asmSegments = map[string]SegmentType{
+	"LCL":  SegmentTypeLocal,
+	"ARG":  SegmentTypeArgument,
+	"THIS": SegmentTypeThis,
+	"THAT": SegmentTypeThat,
+}
+
+// asmConstants are the ways constants are loaded in D, with the value of
+// a match.
+var asmConstants = []struct {
+	Pattern []string
+	Value   func(m map[string]string) (int, bool)
+}{
+	{[]string{"@32767", "D=-A", "D=D-1"}, func(map[string]string) (int, bool) { return -32768, true }},
+	{[]string{"@{c}", "D=-A"}, func(m map[string]string) (int, bool) {
+		n, ok := asmNumber(m["c"], 32767)
+		return -n, ok && n > 0
+	}},
+	{[]string{"@{c}", "D=A"}, func(m map[string]string) (int, bool) { return asmNumber(m["c"], 32767) }},
+}
+
+// asmIdioms are tried in order, the longest code first where one starts
+// like another.
+var asmIdioms = []asmIdiom{
+	{concatLines(
+		[]string{"@{r}", "D=A", "@SP", "A=M", "M=D", "@SP", "M=M+1"},
+		[]string{"@LCL", "D=M", "@SP", "A=M", "M=D", "@SP", "M=M+1"},
+		[]string{"@ARG", "D=M", "@SP", "A=M", "M=D", "@SP", "M=M+1"},
+		[]string{"@THIS", "D=M", "@SP", "A=M", "M=D", "@SP", "M=M+1"},
+		[]string{"@THAT", "D=M", "@SP", "A=M", "M=D", "@SP", "M=M+1"},
+		[]string{"@{n}", "D=A", "@SP", "A=M", "D=A-D", "@ARG", "M=D"},
+		[]string{"@SP", "D=M", "@LCL", "M=D", "@{f}", "0;JMP", "({r})"},
+	), func(d *decompiler, m map[string]string) (string, bool) {
+		n, ok := asmNumber(m["n"], 32767)
+		if !ok || n < callFrameSize || !generatedLabelRe.MatchString(m["r"]) {
+			return "", false
+		}
+		return fmt.Sprintf("call %s %d", m["f"], n-callFrameSize), true
+	}},
+	{concatLines(
+		[]string{"@LCL", "D=M", "@R13", "M=D", "@5", "A=D-A", "D=M", "@R14", "M=D"},
+		[]string{"@SP", "A=M-1", "D=M", "@ARG", "A=M", "M=D", "@ARG", "D=M+1", "@SP", "M=D"},
+		[]string{"@R13", "ADM=M-1", "D=M", "@THAT", "M=D"},
+		[]string{"@R13", "ADM=M-1", "D=M", "@THIS", "M=D"},
+		[]string{"@R13", "ADM=M-1", "D=M", "@ARG", "M=D"},
+		[]string{"@R13", "ADM=M-1", "D=M", "@LCL", "M=D"},
+		[]string{"@R14", "A=M", "0;JMP"},
+	), func(*decompiler, map[string]string) (string, bool) { return "return", true }},
+	{concatLines([]string{"@{i}", "D=A", "@{seg}", "A=D+M", "D=M"}, asmPushTail), func(d *decompiler, m map[string]string) (string, bool) {
+		i, ok := asmNumber(m["i"], 32767)
+		seg, isSeg := asmSegments[m["seg"]]
+		return fmt.Sprintf("push %s %d", seg, i), ok && isSeg
+	}},
+	{concatLines([]string{"@{i}", "D=A", "@{temp}", "A=D+A", "D=M"}, asmPushTail), func(d *decompiler, m map[string]string) (string, bool) {
+		i, ok := asmNumber(m["i"], 7)
+		return fmt.Sprintf("push temp %d", i), ok && m["temp"] == strconv.Itoa(layout.Temp)
+	}},
+	{concatLines([]string{"@{s}", "D=M"}, asmPushTail), func(d *decompiler, m map[string]string) (string, bool) {
+		return d.static("push", m["s"])
+	}},
+	{[]string{"@{p}", "D=M", "@SP", "A=M", "M=D", "@SP", "M=M+1"}, func(d *decompiler, m map[string]string) (string, bool) {
+		return asmPointer("push", m["p"])
+	}},
+	{[]string{"@{i}", "D=A", "@{seg}", "D=D+M", "@R13", "M=D", "@SP", "AM=M-1", "D=M", "@R13", "A=M", "M=D"}, func(d *decompiler, m map[string]string) (string, bool) {
+		i, ok := asmNumber(m["i"], 32767)
+		seg, isSeg := asmSegments[m["seg"]]
+		return fmt.Sprintf("pop %s %d", seg, i), ok && isSeg
+	}},
+	{[]string{"@{i}", "D=A", "@{temp}", "D=D+A", "@R13", "M=D", "@SP", "AM=M-1", "D=M", "@R13", "A=M", "M=D"}, func(d *decompiler, m map[string]string) (string, bool) {
+		i, ok := asmNumber(m["i"], 7)
+		return fmt.Sprintf("pop temp %d", i), ok && m["temp"] == strconv.Itoa(layout.Temp)
+	}},
+	{concatLines(asmPopHead, []string{"A=A-1", "D=M-D", "@{t}", "D;J{op}", "@SP", "A=M-1", "M=0", "@{f}", "0;JMP", "({t})", "@SP", "A=M-1", "M=-1", "({f})"}), func(d *decompiler, m map[string]string) (string, bool) {
+		op := strings.ToLower(m["op"])
+		ok := generatedLabelRe.MatchString(m["t"]) && generatedLabelRe.MatchString(m["f"])
+		return op, ok && (op == "eq" || op == "gt" || op == "lt")
+	}},
+	{concatLines(asmPopHead, []string{"A=A-1", "M={op}"}), func(d *decompiler, m map[string]string) (string, bool) {
+		op, ok := map[string]string{"D+M": "add", "M-D": "sub", "D&M": "and", "D|M": "or"}[m["op"]]
+		return op, ok
+	}},
+	{concatLines(asmPopHead, []string{"@{l}", "D;JNE"}), func(d *decompiler, m map[string]string) (string, bool) {
+		return "if-goto " + d.vmLabel(m["l"]), true
+	}},
+	{concatLines(asmPopHead, []string{"@{s}", "M=D"}), func(d *decompiler, m map[string]string) (string, bool) {
+		if cmd, ok := asmPointer("pop", m["s"]); ok {
+			return cmd, true
+		}
+		return d.static("pop", m["s"])
+	}},
+	{[]string{"@0", "D=A", "@SP", "A=M-1", "M=D-M"}, func(*decompiler, map[string]string) (string, bool) { return "neg", true }},
+	{[]string{"@SP", "A=M-1", "M={op}"}, func(d *decompiler, m map[string]string) (string, bool) {
+		op, ok := map[string]string{"!M": "not", "M<<": "shl", "M>>": "shr"}[m["op"]]
+		d.Extended = d.Extended || op == "shl" || op == "shr"
+		return op, ok
+	}},
+	{[]string{"@{r}", "D=A", "@R15", "M=D", "@{sub}", "0;JMP", "({r})"}, func(d *decompiler, m map[string]string) (string, bool) {
+		for _, al := range []ALType{ALTypeMult, ALTypeDiv, ALTypeMod} {
+			if m["sub"] == runtimeLabel(al) && generatedLabelRe.MatchString(m["r"]) {
+				d.Extended = true
+				return al.String(), true
+			}
+		}
+		return "", false
+	}},
+	{[]string{"@{l}", "0;JMP"}, func(d *decompiler, m map[string]string) (string, bool) {
+		return "goto " + d.vmLabel(m["l"]), true
+	}},
+}
+
+// asmPointer returns the push or pop of the pointer segment of a pointer
+// symbol.
+func asmPointer(cmd, sym string) (string, bool) {
+	switch sym {
+	case "THIS":
+		return cmd + " pointer 0", true
+	case "THAT":
+		return cmd + " pointer 1", true
+	}
+	return "", false
+}
+
+// matchIdiom matches pattern against the code at the start of code,
+// returning the text of every {name}.
+func matchIdiom(pattern []string, code []asmLine) (map[string]string, bool) {
+	if len(code) < len(pattern) {
+		return nil, false
+	}
+	m := map[string]string{}
+	for k, p := range pattern {
+		text := code[k].Text
+		open := strings.Index(p, "{")
+		if open < 0 {
+			if p != text {
+				return nil, false
+			}
+			continue
+		}
+		end := strings.Index(p, "}")
+		prefix, name, suffix := p[:open], p[open+1:end], p[end+1:]
+		if len(text) <= len(prefix)+len(suffix) || !strings.HasPrefix(text, prefix) || !strings.HasSuffix(text, suffix) {
+			return nil, false
+		}
+		v := text[len(prefix) : len(text)-len(suffix)]
+		if prev, ok := m[name]; ok && prev != v {
+			return nil, false
+		}
+		m[name] = v
+	}
+	return m, true
+}
+
+// decompiledFile is the VM code of a source file recovered by decompile.
+type decompiledFile struct {
+	Name  string
+	Lines []string
+}
+
+// decompiledChunk is the code of a function, or the code before the first
+// one, which goes to the file of its statics.
+type decompiledChunk struct {
+	Function string
+	// Class is the file it goes to when it uses no statics, the class of
+	// the function
+	Class string
+	// Statics is the file its statics belong to, "" when it uses none
+	Statics string
+	Lines   []string
+}
+
+// decompiler holds the state of a decompilation.
+type decompiler struct {
+	functions  map[string]bool
+	candidates map[string]bool
+	// current is the function the labels are generated in, LABEL before
+	// the first one
+	current string
+	chunks  []*decompiledChunk
+	inits   []string
+	// err is a static the file of its function cannot name
+	err error
+	// Bootstrap is the entry function the bootstrap code calls, "" without
+	// bootstrap code
+	Bootstrap  string
+	EntryNArgs int
+	// Extended is set when the commands need --ext
+	Extended bool
+}
+
+// static returns the push or pop of a static variable, false when sym does
+// not name one. The statics of a function all belong to one file.
+func (d *decompiler) static(cmd, sym string) (string, bool) {
+	m := staticSymbolRe.FindStringSubmatch(sym)
+	if m == nil {
+		return "", false
+	}
+	c := d.chunk()
+	if c.Statics != "" && m[1] != c.Statics {
+		d.err = fmt.Errorf("static %s is used next to the statics of %s, which one file cannot name", sym, c.Statics)
+		return "", false
+	}
+	c.Statics = m[1]
+	return fmt.Sprintf("%s static %s", cmd, m[2]), true
+}
+
+// chunk returns the chunk of the current function.
+func (d *decompiler) chunk() *decompiledChunk {
+	if len(d.chunks) == 0 {
+		d.chunks = append(d.chunks, &decompiledChunk{})
+	}
+	return d.chunks[len(d.chunks)-1]
+}
+
+// emit adds a command to the current function.
+func (d *decompiler) emit(line string) {
+	c := d.chunk()
+	c.Lines = append(c.Lines, line)
+}
+
+// Files groups the functions into files. A function using statics goes to
+// their file. One using none goes to the file of its class when it can
+// start it, else to the file of the function before it: the files have to
+// come in the order of the assembly, each in one piece and the one of the
+// entry function last, for translating them to generate it again. The
+// static-init directives head the files of their variables.
+func (d *decompiler) Files(defaultFile string) []*decompiledFile {
+	entry := d.Bootstrap
+	if entry == "" {
+		entry = "Sys.init"
+	}
+	entryFile := ""
+	files := []*decompiledFile{}
+	add := func(name string, lines ...string) *decompiledFile {
+		for _, f := range files {
+			if f.Name == name {
+				f.Lines = append(f.Lines, lines...)
+				return f
+			}
+		}
+		files = append(files, &decompiledFile{name, lines})
+		return files[len(files)-1]
+	}
+	// canStart reports whether the file class can follow cur at chunk k,
+	// the chunks after it using the statics of neither cur nor, after
+	// those of another file, class, nor, for the entry file, of any other
+	canStart := func(k int, cur, class string) bool {
+		if entryFile != "" {
+			return false
+		}
+		first := ""
+		for _, c := range d.chunks[k+1:] {
+			switch {
+			case c.Statics == "":
+			case c.Statics == cur && cur != "":
+				return false
+			case d.chunks[k].Function == entry && c.Statics != class:
+				return false
+			case first == "":
+				first = c.Statics
+			case c.Statics == class && first != class:
+				return false
+			}
+		}
+		return true
+	}
+	started := func(name string) bool {
+		return slices.ContainsFunc(files, func(f *decompiledFile) bool { return f.Name == name })
+	}
+	cur := ""
+	for k, c := range d.chunks {
+		if len(c.Lines) == 0 {
+			continue
+		}
+		class := c.Class
+		if class == "" {
+			// the commands before the first function
+			class = defaultFile
+			if k+1 < len(d.chunks) {
+				class = d.chunks[k+1].Class
+			}
+		}
+		file := c.Statics
+		if file == "" {
+			file = cur
+			if !started(class) && canStart(k, cur, class) {
+				file = class
+			}
+		}
+		if file == "" {
+			// the first chunk, going to the file of the statics after it
+			file = class
+			if j := slices.IndexFunc(d.chunks, func(c *decompiledChunk) bool { return c.Statics != "" }); j >= 0 {
+				file = d.chunks[j].Statics
+			}
+		}
+		add(file, c.Lines...)
+		cur = file
+		if c.Function == entry {
+			entryFile = file
+		}
+	}
+	for _, line := range slices.Backward(d.inits) {
+		sym := strings.Fields(line)[1]
+		f := add(sym[:strings.LastIndex(sym, ".")])
+		f.Lines = slices.Insert(f.Lines, 0, line)
+	}
+	return files
+}
+
+// findFunctions returns the labels that are functions: the targets of the
+// calls and the functions the generated labels are numbered in. The labels
+// with a dot nothing jumps to may be functions too, like a Class.method
+// never called, and are returned as candidates, those with a $ being
+// labels of a function.
+func findFunctions(code []asmLine) (functions, candidates map[string]bool) {
+	functions, candidates = map[string]bool{}, map[string]bool{}
+	referenced := map[string]bool{}
+	for k, l := range code {
+		if sym, ok := strings.CutPrefix(l.Text, "@"); ok {
+			referenced[sym] = true
+			if k >= 2 && code[k-2].Text == "@LCL" && code[k-1].Text == "M=D" && k+1 < len(code) && code[k+1].Text == "0;JMP" {
+				functions[sym] = true
+			}
+		}
+		if label, ok := asmLabel(l.Text); ok {
+			if m := generatedLabelRe.FindStringSubmatch(label); m != nil && m[1] != "LABEL" {
+				functions[m[1]] = true
+			}
+		}
+	}
+	for _, l := range code {
+		if label, ok := asmLabel(l.Text); ok && !functions[label] && !referenced[label] && strings.Contains(label, ".") && !strings.Contains(label, "$") {
+			candidates[label] = true
+		}
+	}
+	return functions, candidates
+}
+
+// isFunction reports whether the label at the start of code defines a
+// function. A candidate does when the code before it does not fall through
+// to it, unless the labels generated after it, up to the next function,
+// are numbered in the current function.
+func (d *decompiler) isFunction(label string, code []asmLine) bool {
+	if d.functions[label] || !d.candidates[label] {
+		return d.functions[label]
+	}
+	if c := d.chunk(); len(c.Lines) > 0 {
+		last := c.Lines[len(c.Lines)-1]
+		if last != "return" && !strings.HasPrefix(last, "goto ") {
+			return false
+		}
+	}
+	for _, l := range code[1:] {
+		next, ok := asmLabel(l.Text)
+		if !ok {
+			continue
+		}
+		if d.functions[next] {
+			break
+		}
+		if m := generatedLabelRe.FindStringSubmatch(next); m != nil {
+			return m[1] != d.current
+		}
+	}
+	return true
+}
+
+// vmLabel is the VM label of the symbol of a label of the current
+// function, which the translator scopes as functionName$label.
+func (d *decompiler) vmLabel(sym string) string {
+	if d.current == "LABEL" {
+		return sym
+	}
+	return strings.TrimPrefix(sym, d.current+"$")
+}
+
+// asmLabel returns the symbol a label line defines.
+func asmLabel(text string) (string, bool) {
+	if len(text) > 2 && text[0] == '(' && text[len(text)-1] == ')' {
+		return text[1 : len(text)-1], true
+	}
+	return "", false
+}
+
+// decompileAsm recovers the VM code of assembly written by the translator
+// with the scratch registers of --scratch, see Files for the files it
+// goes to.
+func decompileAsm(lines []string) (*decompiler, error) {
+	code := stripAsm(defaultScratch(lines))
+	d := &decompiler{current: "LABEL"}
+	d.functions, d.candidates = findFunctions(code)
+	p := 0
+	if _, ok := matchIdiom(asmBootHead, code); ok {
+		p = len(asmBootHead)
+	}
+	boot := p > 0
+	// the static initialization, in the bootstrap code when there is one
+	for p < len(code) {
+		n, line, ok := d.matchStaticInit(code[p:])
+		if !ok {
+			break
+		}
+		d.Extended = true
+		d.inits = append(d.inits, line)
+		p += n
+	}
+	if boot {
+		nArgs := 0
+		for {
+			if cmd, n, ok := d.matchCommand(code[p:]); ok && cmd == "push constant 0" {
+				nArgs++
+				p += n
+				continue
+			}
+			break
+		}
+		cmd, n, ok := d.matchCommand(code[p:])
+		fn, isCall := strings.CutPrefix(cmd, "call ")
+		if !ok || !isCall || !strings.HasSuffix(fn, fmt.Sprintf(" %d", nArgs)) {
+			return nil, fmt.Errorf("line %d: bootstrap code without the call of the entry function", code[min(p, len(code)-1)].Line)
+		}
+		d.Bootstrap, d.EntryNArgs = strings.TrimSuffix(fn, fmt.Sprintf(" %d", nArgs)), nArgs
+		p += n
+	}
+
+	for p < len(code) {
+		if _, ok := matchIdiom(asmVMEnd, code[p:]); ok {
+			// the runtime subroutines follow
+			break
+		}
+		if label, ok := asmLabel(code[p].Text); ok {
+			function := d.isFunction(label, code[p:])
+			p++
+			if !function {
+				d.emit("label " + d.vmLabel(label))
+				continue
+			}
+			d.current = label
+			class, _, _ := strings.Cut(label, ".")
+			d.chunks = append(d.chunks, &decompiledChunk{Function: label, Class: class})
+			nVars := 0
+			for {
+				if cmd, n, ok := d.matchCommand(code[p:]); ok && cmd == "push constant 0" {
+					nVars++
+					p += n
+					continue
+				}
+				break
+			}
+			d.emit(fmt.Sprintf("function %s %d", label, nVars))
+			continue
+		}
+		if n, cmd, ok := d.matchStringBlob(code[p:]); ok {
+			d.Extended = true
+			d.emit(cmd)
+			p += n
+			continue
+		}
+		cmd, n, ok := d.matchCommand(code[p:])
+		if d.err != nil {
+			return nil, fmt.Errorf("line %d: %w", code[p].Line, d.err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("line %d: %s is not code the translator generates", code[p].Line, code[p].Text)
+		}
+		d.emit(cmd)
+		p += n
+	}
+
+	return d, nil
+}
+
+// matchCommand matches the code of a VM command at the start of code,
+// returning it with the number of lines it spans.
+func (d *decompiler) matchCommand(code []asmLine) (string, int, bool) {
+	for _, c := range asmConstants {
+		if m, ok := matchIdiom(concatLines(c.Pattern, asmPushTail), code); ok {
+			if v, ok := c.Value(m); ok {
+				d.Extended = d.Extended || v < 0
+				return fmt.Sprintf("push constant %d", v), len(c.Pattern) + len(asmPushTail), true
+			}
+		}
+	}
+	for _, idiom := range asmIdioms {
+		m, ok := matchIdiom(idiom.Pattern, code)
+		if !ok {
+			continue
+		}
+		if cmd, ok := idiom.Command(d, m); ok {
+			return cmd, len(idiom.Pattern), true
+		}
+	}
+	return "", 0, false
+}
+
+// matchStaticInit matches the store of a static-init value.
+func (d *decompiler) matchStaticInit(code []asmLine) (int, string, bool) {
+	for _, c := range asmConstants {
+		m, ok := matchIdiom(concatLines(c.Pattern, []string{"@{s}", "M=D"}), code)
+		if !ok || staticSymbolRe.FindStringSubmatch(m["s"]) == nil {
+			continue
+		}
+		if v, ok := c.Value(m); ok {
+			return len(c.Pattern) + 2, fmt.Sprintf("static-init %s %d", m["s"], v), true
+		}
+	}
+	return 0, "", false
+}
+
+// matchStringBlob matches a push string laid out without an OS: the
+// stores of its length and characters at consecutive addresses, followed
+// by the push of its address.
+func (d *decompiler) matchStringBlob(code []asmLine) (int, string, bool) {
+	values := []int{}
+	addr, p := 0, 0
+	for {
+		m, ok := matchIdiom([]string{"@{v}", "D=A", "@{a}", "M=D"}, code[p:])
+		if !ok {
+			break
+		}
+		v, isValue := asmNumber(m["v"], 32767)
+		a, isAddr := asmNumber(m["a"], layout.RAMSize()-1)
+		if !isValue || !isAddr || (p > 0 && a != addr+len(values)) {
+			break
+		}
+		if p == 0 {
+			addr = a
+		}
+		values = append(values, v)
+		p += 4
+	}
+	if len(values) == 0 || values[0] != len(values)-1 {
+		return 0, "", false
+	}
+	cmd, n, ok := d.matchCommand(code[p:])
+	if !ok || cmd != fmt.Sprintf("push constant %d", addr) {
+		return 0, "", false
+	}
+	literal := []byte{}
+	for _, c := range values[1:] {
+		if c < ' ' || c > '~' || c == '"' {
+			return 0, "", false
+		}
+		literal = append(literal, byte(c))
+	}
+	return p + n, `push string "` + string(literal) + `"`, true
+}
+
+// runDecompile implements the decompile subcommand, writing the VM code
+// recovered from assembly like decode does.
+func runDecompile(args []string) {
+	fs := flag.NewFlagSet("decompile", flag.ExitOnError)
+	dstFile := fs.String("o", "", "destination vm file (defaults to stdout)")
+	dir := fs.String("dir", "", "write the commands of every source file to a .vm file of the same name in this directory")
+	registerScratchFlag(fs)
+	registerLayoutFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: decompile [-o out.vm | -dir DIR] program.asm")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Println("Error reading asm file", err)
+		os.Exit(1)
+	}
+	base := strings.TrimSuffix(filepath.Base(fs.Arg(0)), filepath.Ext(fs.Arg(0)))
+	d, err := decompileAsm(strings.Split(string(data), "\n"))
+	if err != nil {
+		fmt.Println("Error decompiling", fs.Arg(0), err)
+		os.Exit(2)
+	}
+
+	notes := []string{}
+	if d.Bootstrap != "" && (d.Bootstrap != "Sys.init" || d.EntryNArgs != 0) {
+		notes = append(notes, fmt.Sprintf("the bootstrap code calls %s %d, translate with --entry %s --entry-nargs %d", d.Bootstrap, d.EntryNArgs, d.Bootstrap, d.EntryNArgs))
+	}
+	if d.Extended {
+		notes = append(notes, "the program uses extended commands, translate with --ext")
+	}
+
+	files := d.Files(base)
+	if *dir != "" {
+		for _, f := range files {
+			path := filepath.Join(*dir, f.Name+".vm")
+			if err := os.WriteFile(path, []byte(strings.Join(f.Lines, "\n")+"\n"), 0644); err != nil {
+				fmt.Println("Error writing vm file", err)
+				os.Exit(1)
+			}
+			fmt.Println("Successfully wrote vm file:", path)
+		}
+		for _, n := range notes {
+			fmt.Println("Note:", n)
+		}
+		return
+	}
+
+	var out bytes.Buffer
+	for _, n := range notes {
+		fmt.Fprintf(&out, "// %s\n", n)
+	}
+	for _, f := range files {
+		fmt.Fprintf(&out, "// %s.vm\n", f.Name)
+		for _, l := range f.Lines {
+			fmt.Fprintln(&out, l)
+		}
+	}
+	if *dstFile == "" {
+		os.Stdout.Write(out.Bytes())
+		return
+	}
+	if err := os.WriteFile(*dstFile, out.Bytes(), 0644); err != nil {
+		fmt.Println("Error writing vm file", err)
+		os.Exit(1)
+	}
+	fmt.Println("Successfully wrote vm file:", *dstFile)
+}
+
+// verifyRoundTrip decompiles the assembly of a translation and translates
+// the VM code recovered again with the entry flags of opts, returning an
+// error when the instructions differ: a self-check of the code generation
+// and of the decompiler.
+func verifyRoundTrip(tr *translation, opts *translateOptions) error {
+	d, err := decompileAsm(tr.Lines)
+	if err != nil {
+		return fmt.Errorf("decompiling the translation: %w", err)
+	}
+	inputs, fsys := []vmSource{}, memFS{}
+	for _, f := range d.Files("Prog") {
+		name := f.Name
+		if staticPrefixMode == "path" {
+			// the prefix of the statics is the path of their file
+			name = strings.ReplaceAll(name, ".", "/")
+		}
+		inputs = append(inputs, fsys.add(name+".vm", []byte(strings.Join(f.Lines, "\n")+"\n")))
+	}
+	again, err := translate(&translateOptions{Inputs: inputs, Bootstrap: opts.Bootstrap, Entry: opts.Entry, EntryNArgs: opts.EntryNArgs})
+	if err != nil {
+		return fmt.Errorf("translating the decompiled code: %w", err)
+	}
+	want, got := stripAsm(tr.Lines), stripAsm(again.Lines)
+	for k := range min(len(want), len(got)) {
+		if want[k].Text != got[k].Text {
+			return fmt.Errorf("after %s: %s became %s", plural(k, "matching instruction"), want[k].Text, got[k].Text)
+		}
+	}
+	if len(want) != len(got) {
+		return fmt.Errorf("%s became %d", plural(len(want), "instruction"), len(got))
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffOp is one line of the edit script turning a into b.
+type diffOp struct {
+	Kind byte // ' ' kept, '-' removed from a, '+' added from b
+	Text string
+	A, B int // 0-based position in a and b before the op
+}
+
+// maxDiffEdits bounds the edit distance searched for; inputs differing by
+// more are reported as one block being replaced by the other.
+const maxDiffEdits = 4000
+
+// diffLines returns the shortest edit script (Myers' algorithm) turning
+// the lines of a into the lines of b.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	kinds := []byte{}
+	for range prefix {
+		kinds = append(kinds, ' ')
+	}
+	kinds = append(kinds, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for range suffix {
+		kinds = append(kinds, ' ')
+	}
+
+	ops := make([]diffOp, 0, len(kinds))
+	x, y := 0, 0
+	for _, k := range kinds {
+		op := diffOp{Kind: k, A: x, B: y}
+		switch k {
+		case ' ':
+			op.Text = a[x]
+			x++
+			y++
+		case '-':
+			op.Text = a[x]
+			x++
+		case '+':
+			op.Text = b[y]
+			y++
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// myers returns the kinds of the edit script turning a into b.
+func myers(a, b []string) []byte {
+	n, m := len(a), len(b)
+	replace := func() []byte {
+		return append([]byte(strings.Repeat("-", n)), strings.Repeat("+", m)...)
+	}
+	if n == 0 || m == 0 {
+		return replace()
+	}
+
+	total := n + m
+	offset := total
+	v := make([]int, 2*total+2)
+	// trace[d] holds v[-d..d] once step d is done
+	trace := [][]int{}
+	found := false
+	for d := 0; d <= total && !found; d++ {
+		if d > maxDiffEdits {
+			return replace()
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	kinds := []byte{}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		get := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			kinds = append(kinds, ' ')
+			x--
+			y--
+		}
+		if x == prevX {
+			kinds = append(kinds, '+')
+		} else {
+			kinds = append(kinds, '-')
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		kinds = append(kinds, ' ')
+		x--
+		y--
+	}
+	for i, j := 0, len(kinds)-1; i < j; i, j = i+1, j-1 {
+		kinds[i], kinds[j] = kinds[j], kinds[i]
+	}
+	return kinds
+}
+
+// diffHunks groups the changes of an edit script into hunks, returning the
+// [start, end) range of ops of every hunk, with context kept lines around
+// the changes.
+func diffHunks(ops []diffOp, context int) [][2]int {
+	changes := []int{}
+	for i, op := range ops {
+		if op.Kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	hunks := [][2]int{}
+	for c := 0; c < len(changes); {
+		start := max(changes[c]-context, 0)
+		end := changes[c]
+		for c < len(changes) && changes[c] <= end+2*context {
+			end = changes[c]
+			c++
+		}
+		hunks = append(hunks, [2]int{start, min(end+context+1, len(ops))})
+	}
+	return hunks
+}
+
+// unifiedDiff formats the differences between a and b as a unified diff
+// with context lines around every change, or returns "" when they are equal.
+func unifiedDiff(aName, bName string, a, b []string, context int) string {
+	ops := diffLines(a, b)
+	hunks := diffHunks(ops, context)
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+	for _, h := range hunks {
+		start, end := h[0], h[1]
+		aLen, bLen := 0, 0
+		for _, op := range ops[start:end] {
+			if op.Kind != '+' {
+				aLen++
+			}
+			if op.Kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(ops[start].A, aLen), hunkRange(ops[start].B, bLen))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.Kind)
+			sb.WriteString(op.Text)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
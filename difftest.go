@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// diffRun is a program run on the emulator by difftest.
+type diffRun struct {
+	CPU  *hackCPU
+	Prog *hackProgram
+}
+
+// runReference translates src with the reference translator, a command
+// taking the path of a .vm file or of a directory and writing the .asm
+// file named after it, like the VMTranslator of the course. It runs on a
+// copy of the sources in a temporary directory, which keeps the
+// corpus clean.
+func runReference(ref []string, src string, timeout time.Duration) ([]string, error) {
+	tmp, err := os.MkdirTemp("", "difftest-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	st, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{src}
+	name := strings.TrimSuffix(filepath.Base(src), ".vm")
+	arg, dst := filepath.Join(tmp, name+".vm"), filepath.Join(tmp, name+".asm")
+	if st.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(src, "*.vm")); err != nil {
+			return nil, err
+		}
+		arg = filepath.Join(tmp, name)
+		dst = filepath.Join(arg, name+".asm")
+		if err := os.Mkdir(arg, 0755); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		to := arg
+		if st.IsDir() {
+			to = filepath.Join(arg, filepath.Base(f))
+		}
+		if err := os.WriteFile(to, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ref[0], append(slices.Clone(ref[1:]), arg)...).CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("no output within %s", timeout)
+	}
+	if msg := strings.TrimSpace(string(out)); err != nil && msg != "" {
+		return nil, fmt.Errorf("%w: %s", err, msg)
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no %s written", filepath.Base(dst))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(data), nil
+}
+
+// diffTestSetup returns the set commands starting the test script of a
+// fixture, which give a program without bootstrap code its pointers, nil
+// when it has no script.
+func diffTestSetup(src string) ([]string, error) {
+	script := strings.TrimSuffix(src, ".vm") + ".tst"
+	if st, err := os.Stat(src); err == nil && st.IsDir() {
+		script = filepath.Join(src, filepath.Base(src)+".tst")
+	}
+	data, err := os.ReadFile(script)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	toks := tokenizeTst(string(data))
+	for k, t := range toks {
+		if t == "repeat" || t == "ticktock" || t == "tick" || t == "tock" || t == "output" {
+			return toks[:k], nil
+		}
+	}
+	return toks, nil
+}
+
+// runDiffProgram assembles and runs a program until it halts, after the
+// set commands of setup.
+func runDiffProgram(lines, setup []string, maxCycles int) (*diffRun, error) {
+	prog, err := assembleHack(lines)
+	if err != nil {
+		return nil, fmt.Errorf("assembling: %w", err)
+	}
+	r := &tstRun{CPU: newHackCPU(prog)}
+	if _, err := r.exec(setup); err != nil {
+		return nil, fmt.Errorf("running the test script: %w", err)
+	}
+	for !r.CPU.Halted() {
+		if r.CPU.Cycles >= maxCycles {
+			return nil, fmt.Errorf("did not halt within %d cycles", maxCycles)
+		}
+		if err := r.CPU.Step(); err != nil {
+			return nil, fmt.Errorf("emulating: %w", err)
+		}
+	}
+	return &diffRun{r.CPU, prog}, nil
+}
+
+// diffStates returns the differences between the final states of two
+// runs of a program, named oursName and refName in the messages: its
+// pointers and temp segment, its static variables, found by their
+// symbols, its stack below SP and its heap and screen. The
+// scratch registers are left out, those of temp included, so are the
+// return addresses in the frames, which are addresses of two different
+// programs.
+func diffStates(tr *translation, ours, ref *diffRun, oursName, refName string) []string {
+	diffs := []string{}
+	check := func(what string, a, b int16) {
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s: %d %s, %d %s", what, a, oursName, b, refName))
+		}
+	}
+	for k, name := range []string{"SP", "LCL", "ARG", "THIS", "THAT"} {
+		check(name, ours.CPU.RAM[k], ref.CPU.RAM[k])
+	}
+	for k := range 8 {
+		if !isScratch(layout.Temp + k) {
+			check(fmt.Sprintf("temp %d", k), ours.CPU.RAM[layout.Temp+k], ref.CPU.RAM[layout.Temp+k])
+		}
+	}
+	seen := map[string]bool{}
+	for _, inst := range tr.Instructions {
+		sym, ok := staticSymbol(inst)
+		if !ok || seen[sym] {
+			continue
+		}
+		seen[sym] = true
+		check(sym, staticValue(ours, sym), staticValue(ref, sym))
+	}
+	retSlots := map[int]bool{}
+	for lcl, n := int(ours.CPU.RAM[1]), 0; lcl >= layout.Stack+callFrameSize && lcl < layout.RAMSize() && n < layout.RAMSize(); n++ {
+		retSlots[lcl-callFrameSize] = true
+		lcl = int(ours.CPU.RAM[lcl-4])
+	}
+	for addr := layout.Stack; addr < int(ours.CPU.RAM[0]) && addr < layout.Heap; addr++ {
+		if !retSlots[addr] {
+			check(fmt.Sprintf("RAM[%d] (stack)", addr), ours.CPU.RAM[addr], ref.CPU.RAM[addr])
+		}
+	}
+	for addr := layout.Heap; addr < layout.RAMSize(); addr++ {
+		if addr != layout.Keyboard {
+			check(fmt.Sprintf("RAM[%d]", addr), ours.CPU.RAM[addr], ref.CPU.RAM[addr])
+		}
+	}
+	return diffs
+}
+
+// staticValue is the value of a static variable at the end of a run, 0
+// when the program has no symbol for it, only code the optimizations left
+// out using it.
+func staticValue(r *diffRun, sym string) int16 {
+	if addr, ok := r.Prog.Symbols[sym]; ok {
+		return r.CPU.RAM[addr]
+	}
+	return 0
+}
+
+// runDiffTest implements the difftest subcommand, running the programs of
+// a corpus translated by this translator and by a reference one, and
+// reporting where they end in different states.
+func runDiffTest(args []string) {
+	fs := flag.NewFlagSet("difftest", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	reference := fs.String("reference", "", "reference translator, run with the path of a .vm file or directory (e.g. /path/to/VMTranslator.sh or 'python3 VMTranslator.py')")
+	maxCycles := fs.Int("max-cycles", 10_000_000, "cycles a program may run before it is reported as not halting")
+	timeout := fs.Duration("timeout", time.Minute, "time the reference translator may take for a program")
+	maxDiffs := fs.Int("max-diffs", 3, "differences shown for a program that diverges (0 shows all)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: difftest --reference CMD [flags] dir|dir/... ...")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	ref := strings.Fields(*reference)
+	if len(ref) == 0 || fs.NArg() == 0 || len(opts.Sources) > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fixtures, err := findFixtures(fs.Args())
+	if err != nil {
+		fmt.Println("Error finding programs", err)
+		os.Exit(1)
+	}
+	if len(fixtures) == 0 {
+		fmt.Println("No programs found in", strings.Join(fs.Args(), " "))
+		os.Exit(1)
+	}
+
+	width := 0
+	for _, f := range fixtures {
+		width = max(width, len(f.Source))
+	}
+	fmt.Printf("%-*s  %10s  %10s  %s\n", width, "program", "cycles", "reference", "result")
+	diverged, failed := 0, 0
+	for _, f := range fixtures {
+		result, cycles, refCycles := diffTestFixture(f.Source, *opts, ref, *maxCycles, *timeout, *maxDiffs)
+		switch {
+		case strings.HasPrefix(result, "DIFF"):
+			diverged++
+		case result != "ok":
+			failed++
+		}
+		fmt.Println(strings.TrimRight(fmt.Sprintf("%-*s  %10s  %10s  %s", width, f.Source, cycles, refCycles, result), " "))
+	}
+	fmt.Printf("%d agree, %d diverge, %d failed\n", len(fixtures)-diverged-failed, diverged, failed)
+	if diverged+failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// diffTestFixture runs a program of the corpus with both translators,
+// returning the result and the cycles each run took ("-" when it did not
+// complete).
+func diffTestFixture(src string, opts translateOptions, ref []string, maxCycles int, timeout time.Duration, maxDiffs int) (result, cycles, refCycles string) {
+	cycles, refCycles = "-", "-"
+	setup, err := diffTestSetup(src)
+	if err != nil {
+		return "ERROR reading the test script: " + err.Error(), cycles, refCycles
+	}
+	opts.Sources = stringsFlag{src}
+	tr, err := translate(&opts)
+	if err != nil {
+		return "ERROR translating: " + err.Error(), cycles, refCycles
+	}
+	ours, err := runDiffProgram(tr.Lines, setup, maxCycles)
+	if err != nil {
+		return "ERROR ours " + err.Error(), cycles, refCycles
+	}
+	cycles = fmt.Sprint(ours.CPU.Cycles)
+	refLines, err := runReference(ref, src, timeout)
+	if err != nil {
+		return "ERROR reference translating: " + err.Error(), cycles, refCycles
+	}
+	theirs, err := runDiffProgram(refLines, setup, maxCycles)
+	if err != nil {
+		return "ERROR reference " + err.Error(), cycles, refCycles
+	}
+	refCycles = fmt.Sprint(theirs.CPU.Cycles)
+	diffs := diffStates(tr, ours, theirs, "ours", "reference")
+	if len(diffs) == 0 {
+		return "ok", cycles, refCycles
+	}
+	shown := diffs
+	if maxDiffs > 0 && len(diffs) > maxDiffs {
+		shown = append(slices.Clone(diffs[:maxDiffs]), fmt.Sprintf("and %d more", len(diffs)-maxDiffs))
+	}
+	return "DIFF " + strings.Join(shown, "; "), cycles, refCycles
+}
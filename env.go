@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the environment variables setting flags: --bootstrap is
+// VMTRANSLATOR_BOOTSTRAP, --with-os VMTRANSLATOR_WITH_OS.
+const envPrefix = "VMTRANSLATOR_"
+
+// envName is the environment variable of a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseFlags parses args into fs, then sets the flags left off the command
+// line from their environment variables, so that the command line wins
+// over the environment and the environment over the defaults.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.Parse(args)
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			fmt.Fprintf(fs.Output(), "invalid value %q for %s: %v\n", v, envName(f.Name), err)
+			os.Exit(2)
+		}
+	})
+}
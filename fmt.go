@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// vmCommands lists the command keywords, lowercased by the formatter.
+var vmCommands = []string{
+	"push", "pop", "add", "sub", "neg", "eq", "gt", "lt", "and", "or", "not",
+	"label", "goto", "if-goto", "function", "call", "return",
+	"shl", "shr", "mult", "div", "mod", "static-init", "import",
+}
+
+// vmSegments lists the segment names, lowercased by the formatter.
+var vmSegments = []string{
+	"constant", "local", "argument", "this", "that", "static", "temp", "pointer", "string",
+}
+
+const fmtIndent = "\t"
+
+// runFmt implements the fmt subcommand, rewriting vm sources into their
+// canonical form like gofmt does for Go sources.
+func runFmt(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("w", false, "write the result to the source file instead of stdout")
+	diff := fs.Bool("d", false, "display diffs instead of rewriting files")
+	list := fs.Bool("l", false, "list files whose formatting differs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: fmt [-w] [-d] [-l] [path ...]")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		if *write || *list {
+			fmt.Println("Error: -w and -l need file arguments")
+			os.Exit(exitUsage)
+		}
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Println("Error reading stdin", err)
+			os.Exit(exitIO)
+		}
+		out := formatVM(src)
+		if *diff {
+			fmt.Print(unifiedDiff("<standard input>.orig", "<standard input>", splitLines(src), splitLines(out), 3))
+			return
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	paths, err := resolveSources(fs.Args(), nil)
+	if err != nil {
+		fmt.Println("Error resolving source files", err)
+		os.Exit(exitIO)
+	}
+	opened := newSourceFiles()
+	defer opened.Close()
+	for _, path := range paths {
+		if _, _, ok := splitArchivePath(path); ok && *write {
+			fmt.Println("Error: -w cannot rewrite", path, "inside an archive")
+			os.Exit(exitUsage)
+		}
+		f, err := opened.open(path)
+		if err != nil {
+			fmt.Println("Error reading source file", err)
+			os.Exit(exitIO)
+		}
+		src, err := f.ReadFile()
+		if err != nil {
+			fmt.Println("Error reading source file", err)
+			os.Exit(exitIO)
+		}
+		out := formatVM(src)
+		changed := !bytes.Equal(src, out)
+		if *list && changed {
+			fmt.Println(path)
+		}
+		if *diff && changed {
+			fmt.Print(unifiedDiff(path+".orig", path, splitLines(src), splitLines(out), 3))
+		}
+		if *write && changed {
+			if err := os.WriteFile(path, out, 0644); err != nil {
+				fmt.Println("Error writing source file", err)
+				os.Exit(exitIO)
+			}
+		}
+		if !*write && !*list && !*diff {
+			os.Stdout.Write(out)
+		}
+	}
+}
+
+// splitLines splits src into lines, accepting the same line endings and
+// BOM as the translator.
+func splitLines(src []byte) []string {
+	lines := []string{}
+	scanner := newLineScanner(bytes.NewReader(src))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// fmtLine is a line of formatted output, its comment kept apart until the
+// comments of consecutive lines are aligned.
+type fmtLine struct {
+	Code    string
+	Comment string
+}
+
+// formatVM returns src in canonical form: commands on a single line with
+// their words separated by one space, keywords and segments lowercased,
+// function bodies indented by a tab with labels flush left, inline
+// comments of consecutive lines aligned, runs of blank lines collapsed and
+// a blank line before every function. Comment lines take the indentation
+// of the command they precede. Lines involved in a block comment and
+// preprocessor directives are kept as they are.
+func formatVM(src []byte) []byte {
+	out := []fmtLine{}
+	blank := false
+	inFunction := false
+	blockStart := 0
+	// comment lines since the last command, indented like the next one
+	pending := []int{}
+	emit := func(l fmtLine) {
+		if blank && len(out) > 0 {
+			out = append(out, fmtLine{})
+		}
+		blank = false
+		out = append(out, l)
+	}
+	for n, raw := range splitLines(src) {
+		before := blockStart
+		if stripBlockComments(raw, &blockStart, n+1) != raw || before != 0 {
+			emit(fmtLine{Code: strings.TrimRight(raw, " \t")})
+			pending = pending[:0]
+			continue
+		}
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			blank = true
+			continue
+		}
+		if strings.HasPrefix(line, "//!") {
+			emit(fmtLine{Code: line})
+			pending = pending[:0]
+			continue
+		}
+		code, comment := splitComment(line)
+		indent := ""
+		if inFunction {
+			indent = fmtIndent
+		}
+		if code == "" {
+			emit(fmtLine{Code: indent + comment})
+			pending = append(pending, len(out)-1)
+			continue
+		}
+		code = formatCommand(code)
+		if strings.HasPrefix(code, "label ") {
+			indent = ""
+		}
+		if strings.HasPrefix(code, "function ") {
+			inFunction = true
+			indent = ""
+			// separate functions, unless a comment documents this one
+			if len(out) > 0 && !blank {
+				if last := out[len(out)-1]; last.Code != "" && !isCommentLine(last.Code) {
+					blank = true
+				}
+			}
+		}
+		if indent == "" {
+			for _, k := range pending {
+				out[k].Code = strings.TrimPrefix(out[k].Code, fmtIndent)
+			}
+		}
+		pending = pending[:0]
+		emit(fmtLine{Code: indent + code, Comment: comment})
+	}
+
+	// align the comments of consecutive commented lines
+	for start := 0; start < len(out); {
+		if out[start].Comment == "" {
+			start++
+			continue
+		}
+		end := start
+		width := 0
+		for end < len(out) && out[end].Comment != "" {
+			width = max(width, displayWidth(out[end].Code))
+			end++
+		}
+		for k := start; k < end; k++ {
+			out[k].Code += strings.Repeat(" ", width-displayWidth(out[k].Code)+1) + out[k].Comment
+		}
+		start = end
+	}
+
+	var buf bytes.Buffer
+	for _, l := range out {
+		buf.WriteString(l.Code)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// displayWidth is the number of columns line takes with 8 column tabs.
+func displayWidth(line string) int {
+	w := 0
+	for _, c := range line {
+		if c == '\t' {
+			w += 8 - w%8
+		} else {
+			w++
+		}
+	}
+	return w
+}
+
+func isCommentLine(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "//") || strings.HasPrefix(line, "/*")
+}
+
+// formatCommand normalizes the spacing and case of a command, leaving
+// anything it cannot tokenize untouched.
+func formatCommand(code string) string {
+	toks, err := tokenize(code)
+	if err != nil {
+		return code
+	}
+	words := make([]string, len(toks))
+	for k, t := range toks {
+		words[k] = t.Text
+	}
+	if kw := strings.ToLower(words[0]); slices.Contains(vmCommands, kw) {
+		words[0] = kw
+		if (kw == "push" || kw == "pop") && len(words) > 1 {
+			if seg := strings.ToLower(words[1]); slices.Contains(vmSegments, seg) {
+				words[1] = seg
+			}
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fuzzSeeds are the example programs of the repository, whole and line by
+// line.
+func fuzzSeeds(t testing.TB) (files, lines []string) {
+	paths := []string{}
+	for _, pattern := range []string{"vm1/*.vm", "vm2/*.vm", "vm2/*/*.vm", "os/*.vm"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, matches...)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, string(data))
+		for _, line := range strings.Split(string(data), "\n") {
+			if code, _, _ := strings.Cut(line, "//"); strings.TrimSpace(code) != "" {
+				lines = append(lines, strings.TrimSpace(code))
+			}
+		}
+	}
+	return files, lines
+}
+
+func FuzzParseInstruction(f *testing.F) {
+	_, lines := fuzzSeeds(f)
+	for _, line := range lines {
+		f.Add(line, false)
+	}
+	for _, line := range []string{"push", "pop local", "push string \"a", "static-init Foo.1 7", "label", "call F"} {
+		f.Add(line, true)
+	}
+	for _, line := range []string{"push local -1", "pop that 32768", "function F.g -1", "call F.g -1"} {
+		f.Add(line, false)
+	}
+	f.Fuzz(func(t *testing.T, line string, ext bool) {
+		defer func(ext bool) { extendedMode = ext }(extendedMode)
+		extendedMode = ext
+		inst, err := parseInstruction(0, "Fuzz", line)
+		if err != nil {
+			if inst != nil {
+				t.Errorf("%q: an instruction and the error %v", line, err)
+			}
+			return
+		}
+		if inst == nil {
+			t.Fatalf("%q: neither an instruction nor an error", line)
+		}
+	})
+}
+
+func FuzzTranslate(f *testing.F) {
+	files, _ := fuzzSeeds(f)
+	for _, file := range files {
+		f.Add(file, false)
+	}
+	f.Add("function Main.main 0\npush string \"hi\"\nmult\nreturn\n", true)
+	f.Add("function Main.main 0\npush local -1\nreturn\n", false)
+	f.Add("function Main.main 0\ncall Main.g -1\nreturn\nfunction Main.g -1\nreturn\n", false)
+	f.Add("function Main.main 0\nreturn\nfunction Main.main 0\nreturn\n", false)
+	f.Fuzz(func(t *testing.T, src string, ext bool) {
+		defer func(ext bool) { extendedMode = ext }(extendedMode)
+		extendedMode = ext
+		tr, err := translateText(t, map[string]string{"Main.vm": src})
+		if err == nil {
+			if len(tr.Lines) == 0 {
+				t.Fatalf("%q: no code and no error", src)
+			}
+			return
+		}
+		var se *statusError
+		if !errors.As(err, &se) {
+			t.Fatalf("%q: unstructured error %v", src, err)
+		}
+		if se.Status == exitInternal {
+			t.Fatalf("%q: internal error %v", src, err)
+		}
+	})
+}
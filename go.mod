@@ -0,0 +1,3 @@
+module github.com/AhmedAbouelkher/hack_vm_translator
+
+go 1.27.1
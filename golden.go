@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// goldenSuffix names the expected output of a fixture, next to its sources.
+const goldenSuffix = ".golden.asm"
+
+// goldenFixture is a program translated by the golden subcommand.
+type goldenFixture struct {
+	// Source is the directory of a multi-file program or a lone .vm file
+	Source string
+	Golden string
+}
+
+// findFixtures finds the fixtures in the directories of patterns, a
+// trailing /... including every directory below. A directory defining
+// Sys.init is one program, otherwise each of its .vm files is its own.
+func findFixtures(patterns []string) ([]goldenFixture, error) {
+	dirs := []string{}
+	for _, p := range patterns {
+		root, recursive := strings.CutSuffix(p, "...")
+		if root = filepath.Clean(root); !recursive {
+			dirs = append(dirs, root)
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				dirs = append(dirs, path)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fixtures := []goldenFixture{}
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*.vm"))
+		if err != nil {
+			return nil, err
+		}
+		program := slices.ContainsFunc(files, func(f string) bool {
+			data, err := os.ReadFile(f)
+			return err == nil && sourceDefinesFunction(f, data, "Sys.init")
+		})
+		if program {
+			fixtures = append(fixtures, goldenFixture{dir, filepath.Join(dir, filepath.Base(dir)+goldenSuffix)})
+			continue
+		}
+		for _, f := range files {
+			fixtures = append(fixtures, goldenFixture{f, strings.TrimSuffix(f, ".vm") + goldenSuffix})
+		}
+	}
+	return fixtures, nil
+}
+
+// runGolden implements the golden subcommand: update translates every
+// fixture and records its output as the golden file, verify checks the
+// translations still match them.
+func runGolden(args []string) {
+	fs := flag.NewFlagSet("golden", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: golden update|verify [flags] dir|dir/... ...")
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || (args[0] != "update" && args[0] != "verify") {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	update := args[0] == "update"
+	parseFlags(fs, args[1:])
+	if fs.NArg() == 0 || len(opts.Sources) > 0 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	fixtures, err := findFixtures(fs.Args())
+	if err != nil {
+		fmt.Println("Error finding fixtures", err)
+		os.Exit(exitIO)
+	}
+	if len(fixtures) == 0 {
+		fmt.Println("No fixtures found in", strings.Join(fs.Args(), " "))
+		os.Exit(exitIO)
+	}
+
+	failed := 0
+	for _, f := range fixtures {
+		fixtureOpts := *opts
+		fixtureOpts.Sources = stringsFlag{f.Source}
+		if err := fixtureOpts.validate(); err != nil {
+			fmt.Println(err)
+			os.Exit(exitUsage)
+		}
+		tr, err := translate(&fixtureOpts)
+		if err != nil {
+			fmt.Printf("FAIL %s: %s\n", f.Source, err)
+			failed++
+			continue
+		}
+		out := strings.Join(tr.Lines, "\n") + "\n"
+		old, err := os.ReadFile(f.Golden)
+		switch {
+		case update && err == nil && string(old) == out:
+			fmt.Println("unchanged", f.Golden)
+		case update:
+			if err := os.WriteFile(f.Golden, []byte(out), 0644); err != nil {
+				fmt.Println("Error writing golden file", err)
+				os.Exit(exitIO)
+			}
+			fmt.Println("updated", f.Golden)
+		case err != nil:
+			fmt.Printf("FAIL %s: missing golden file %s, run golden update\n", f.Source, f.Golden)
+			failed++
+		case string(old) != out:
+			fmt.Printf("FAIL %s: output differs from %s\n", f.Source, f.Golden)
+			fmt.Print(unifiedDiff(f.Golden, f.Source, splitLines(old), tr.Lines, compareContext))
+			failed++
+		default:
+			fmt.Println("ok", f.Source)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%s of %d failed\n", plural(failed, "fixture"), len(fixtures))
+		os.Exit(1)
+	}
+}
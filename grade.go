@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gradingTest is a test script batch --tests runs on the translations.
+type gradingTest struct {
+	conformanceTest
+	// Project is the name of the projects the test applies to, "" when it
+	// applies to all of them
+	Project string
+}
+
+// testResult is the outcome of a test script on a translation.
+type testResult struct {
+	Test    string        `json:"test"`
+	Passed  bool          `json:"passed"`
+	Detail  string        `json:"detail,omitempty"`
+	Elapsed time.Duration `json:"-"`
+}
+
+// findGradingTests finds the test scripts below root, leaving out the VM
+// emulator scripts (NameVME.tst). The scripts directly in root apply to
+// every project, the others to the projects named after their folder, so
+// that the projects folder of nand2tetris can be used as is.
+func findGradingTests(root string) ([]gradingTest, error) {
+	tests := []gradingTest{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".tst" || strings.HasSuffix(path, "VME.tst") {
+			return err
+		}
+		t := gradingTest{conformanceTest: conformanceTest{filepath.Dir(path), strings.TrimSuffix(d.Name(), ".tst")}}
+		if filepath.Clean(t.Dir) != filepath.Clean(root) {
+			t.Project = filepath.Base(t.Dir)
+		}
+		tests = append(tests, t)
+		return nil
+	})
+	return tests, err
+}
+
+// projectName is the name of a project tests are matched with: the base
+// name of its folder or archive.
+func projectName(project string) string {
+	name := filepath.Base(project)
+	return strings.TrimSuffix(name, archiveExt(name))
+}
+
+// testsFor returns the tests applying to a project. A project in an
+// archive is also known by the folders of its files in the archive
+// (alice.zip/FibonacciElement/Main.vm).
+func testsFor(tests []gradingTest, project string) []gradingTest {
+	names := []string{projectName(project)}
+	if isArchive(project) {
+		files, _ := archiveFiles(project)
+		for _, f := range files {
+			if dir := filepath.Dir(f); dir != project {
+				names = append(names, filepath.Base(dir))
+			}
+		}
+	}
+	applies := []gradingTest{}
+	for _, t := range tests {
+		if t.Project == "" || slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(t.Project, n) }) {
+			applies = append(applies, t)
+		}
+	}
+	return applies
+}
+
+// gradeProject runs the tests applying to a project of the batch on its
+// translation. They all fail when it was not translated.
+func gradeProject(tests []gradingTest, res batchResult) []testResult {
+	results := []testResult{}
+	var prog *hackProgram
+	reason := "not translated: " + res.Status
+	if res.Status == "ok" {
+		data, err := os.ReadFile(res.Output)
+		if err == nil {
+			prog, err = assembleHack(splitLines(data))
+		}
+		if err != nil {
+			reason = "not assembled: " + err.Error()
+		}
+	}
+	for _, t := range testsFor(tests, res.Project) {
+		tr := testResult{Test: t.Name, Passed: prog != nil, Detail: reason}
+		if prog != nil {
+			start := time.Now()
+			stage, detail := runTstScript(prog, t.conformanceTest)
+			tr.Passed, tr.Detail, tr.Elapsed = stage == "", "", time.Since(start)
+			if !tr.Passed {
+				tr.Detail = stage + ": " + detail
+			}
+		}
+		results = append(results, tr)
+	}
+	return results
+}
+
+// studentGrade is the grade of a student: the results of the tests of
+// every project they submitted.
+type studentGrade struct {
+	Student string `json:"student"`
+	Passed  int    `json:"passed"`
+	Total   int    `json:"total"`
+	// Score is the percentage of the tests passed
+	Score float64 `json:"score"`
+	// Result is pass when every test passed, fail otherwise and no tests
+	// when none applies
+	Result   string         `json:"result"`
+	Projects []projectGrade `json:"projects"`
+}
+
+type projectGrade struct {
+	Project string `json:"project"`
+	Result  string `json:"result"` // ok or why it was not translated
+	// Diagnostics are the messages of the translation of a project that
+	// failed to translate or failed a test
+	Diagnostics []string     `json:"diagnostics,omitempty"`
+	Tests       []testResult `json:"tests"`
+}
+
+// studentOf is the student a project of the batch belongs to: the first
+// folder or archive below the root.
+func studentOf(root, project string) string {
+	rel, err := filepath.Rel(root, project)
+	if err != nil || rel == "." {
+		return projectName(project)
+	}
+	return projectName(strings.Split(filepath.ToSlash(rel), "/")[0])
+}
+
+// gradeBatch groups the results of a graded batch by student, in the
+// order of their first project.
+func gradeBatch(root string, results []batchResult) []*studentGrade {
+	grades := []*studentGrade{}
+	byStudent := map[string]*studentGrade{}
+	for _, r := range results {
+		name := studentOf(root, r.Project)
+		g, ok := byStudent[name]
+		if !ok {
+			g = &studentGrade{Student: name}
+			byStudent[name] = g
+			grades = append(grades, g)
+		}
+		pg := projectGrade{Project: r.Project, Result: r.Status, Tests: r.Tests}
+		failed := r.Status != "ok"
+		for _, t := range r.Tests {
+			g.Total++
+			if t.Passed {
+				g.Passed++
+			} else {
+				failed = true
+			}
+		}
+		if failed {
+			pg.Diagnostics = r.Diagnostics
+		}
+		g.Projects = append(g.Projects, pg)
+	}
+	for _, g := range grades {
+		failed := false
+		for _, p := range g.Projects {
+			failed = failed || p.Result != "ok"
+		}
+		switch {
+		case g.Total > 0:
+			g.Score = math.Round(1000*float64(g.Passed)/float64(g.Total)) / 10
+		case !failed:
+			g.Result = "no tests"
+			continue
+		}
+		g.Result = "fail"
+		if !failed && g.Passed == g.Total {
+			g.Result = "pass"
+		}
+	}
+	return grades
+}
+
+// gradeSuites reports the grades as test results, a suite per student. A
+// project that did not translate and has no test fails as a translate
+// test.
+func gradeSuites(grades []*studentGrade) []testSuite {
+	suites := []testSuite{}
+	for _, g := range grades {
+		s := testSuite{Name: g.Student}
+		for _, p := range g.Projects {
+			details := strings.Join(p.Diagnostics, "\n")
+			if len(p.Tests) == 0 && p.Result != "ok" {
+				s.Cases = append(s.Cases, testCase{Class: p.Project, Name: "translate", Failure: p.Result, Details: details})
+			}
+			for _, t := range p.Tests {
+				c := testCase{Class: p.Project, Name: t.Test, Elapsed: t.Elapsed}
+				if !t.Passed {
+					c.Failure, c.Details = t.Detail, details
+				}
+				s.Cases = append(s.Cases, c)
+			}
+		}
+		suites = append(suites, s)
+	}
+	return suites
+}
+
+// writeGradeReport writes the grades to path: in JSON when it ends with
+// .json, as JUnit XML with .xml, as TAP with .tap and in CSV, one row per
+// student, otherwise.
+func writeGradeReport(path string, grades []*studentGrade) error {
+	if strings.HasSuffix(path, ".json") {
+		data, err := json.MarshalIndent(map[string]any{"students": grades}, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(data, '\n'), 0644)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if ext := filepath.Ext(path); ext == ".xml" || ext == ".tap" {
+		format := "junit"
+		if ext == ".tap" {
+			format = "tap"
+		}
+		if err := writeTestReport(f, format, gradeSuites(grades)); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"student", "passed", "total", "score", "result", "failed_tests", "diagnostics"})
+	for _, g := range grades {
+		failures, diagnostics := []string{}, []string{}
+		for _, p := range g.Projects {
+			for _, t := range p.Tests {
+				if !t.Passed {
+					failures = append(failures, fmt.Sprintf("%s %s: %s", p.Project, t.Test, t.Detail))
+				}
+			}
+			for _, d := range p.Diagnostics {
+				diagnostics = append(diagnostics, p.Project+": "+d)
+			}
+		}
+		w.Write([]string{
+			g.Student, strconv.Itoa(g.Passed), strconv.Itoa(g.Total),
+			strconv.FormatFloat(g.Score, 'f', -1, 64), g.Result,
+			strings.Join(failures, "\n"), strings.Join(diagnostics, "\n"),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
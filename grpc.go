@@ -0,0 +1,562 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The gRPC service of api/vmtranslator.proto, served by serve --grpc over
+// HTTP/2 without TLS. The standard library has no protobuf, so the
+// messages are encoded and decoded by hand, field number by field number.
+
+// grpcService is the path prefix of the calls of the service.
+const grpcService = "/vmtranslator.v1.Translator/"
+
+// The gRPC status codes the service answers with.
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcAborted           = 10
+	grpcUnimplemented     = 12
+)
+
+// grpcEmulateCycles bounds the runs of Emulate not giving max_cycles.
+const grpcEmulateCycles = 10_000_000
+
+// grpcError ends a call with a status other than OK.
+type grpcError struct {
+	Code int
+	Msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.Msg
+}
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// The protobuf wire types.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// pbField is a field of a decoded protobuf message, its value in Varint
+// or Bytes by its wire type.
+type pbField struct {
+	Num    int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+// pbFields decodes the fields of a message. A field of schema must have
+// the wire type it maps to, the others are skipped.
+func pbFields(data []byte, schema map[int]int) ([]pbField, error) {
+	fields := []pbField{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 == 0 {
+			return nil, errors.New("invalid protobuf message")
+		}
+		data = data[n:]
+		f := pbField{Num: int(tag >> 3), Type: int(tag & 7)}
+		switch f.Type {
+		case pbVarint:
+			if f.Varint, n = binary.Uvarint(data); n <= 0 {
+				return nil, errors.New("invalid protobuf message")
+			}
+		case pbBytes:
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return nil, errors.New("invalid protobuf message")
+			}
+			f.Bytes, n = data[m:m+int(size)], m+int(size)
+		case pbFixed64, pbFixed32:
+			n = 8
+			if f.Type == pbFixed32 {
+				n = 4
+			}
+			if len(data) < n {
+				return nil, errors.New("invalid protobuf message")
+			}
+		default:
+			return nil, fmt.Errorf("invalid protobuf wire type %d", f.Type)
+		}
+		data = data[n:]
+		want, ok := schema[f.Num]
+		if !ok {
+			continue
+		}
+		// a repeated scalar field may be packed or not
+		if f.Type != want && (want != pbVarint || f.Type != pbBytes) {
+			return nil, fmt.Errorf("invalid wire type %d of field %d", f.Type, f.Num)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// pbVarints returns the values of a varint field, packed or not.
+func pbVarints(f pbField) ([]uint64, error) {
+	if f.Type == pbVarint {
+		return []uint64{f.Varint}, nil
+	}
+	values := []uint64{}
+	for data := f.Bytes; len(data) > 0; {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid packed field")
+		}
+		values, data = append(values, v), data[n:]
+	}
+	return values, nil
+}
+
+// pbStringMap decodes an entry of a map<string, string> into m.
+func pbStringMap(m map[string]string, entry []byte) error {
+	fields, err := pbFields(entry, map[int]int{1: pbBytes, 2: pbBytes})
+	if err != nil {
+		return err
+	}
+	key, value := "", ""
+	for _, f := range fields {
+		if f.Num == 1 {
+			key = string(f.Bytes)
+		} else {
+			value = string(f.Bytes)
+		}
+	}
+	m[key] = value
+	return nil
+}
+
+// pbMessage is a protobuf message being encoded. The scalars equal to
+// their default value are left out, as proto3 does.
+type pbMessage []byte
+
+func (m *pbMessage) tag(num, wire int) {
+	*m = binary.AppendUvarint(*m, uint64(num<<3|wire))
+}
+
+// int encodes an int32 or int64 field, a negative value taking ten bytes.
+func (m *pbMessage) int(num int, v int) {
+	if v != 0 {
+		m.tag(num, pbVarint)
+		*m = binary.AppendUvarint(*m, uint64(int64(v)))
+	}
+}
+
+func (m *pbMessage) bool(num int, v bool) {
+	if v {
+		m.int(num, 1)
+	}
+}
+
+func (m *pbMessage) string(num int, s string) {
+	if s != "" {
+		m.bytes(num, []byte(s))
+	}
+}
+
+func (m *pbMessage) bytes(num int, b []byte) {
+	m.tag(num, pbBytes)
+	*m = binary.AppendUvarint(*m, uint64(len(b)))
+	*m = append(*m, b...)
+}
+
+// message encodes an embedded message, also when it is empty, as the one
+// set in a oneof.
+func (m *pbMessage) message(num int, sub pbMessage) {
+	m.bytes(num, sub)
+}
+
+// decodeTranslateRequest decodes a TranslateRequest.
+func decodeTranslateRequest(data []byte) (*serveRequest, error) {
+	fields, err := pbFields(data, map[int]int{1: pbBytes, 2: pbBytes, 3: pbBytes, 4: pbVarint, 5: pbVarint, 6: pbVarint})
+	if err != nil {
+		return nil, err
+	}
+	req := &serveRequest{Files: map[string]string{}}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			err = pbStringMap(req.Files, f.Bytes)
+		case 2:
+			req.Bootstrap = string(f.Bytes)
+		case 3:
+			req.Entry = string(f.Bytes)
+		case 4:
+			req.EntryNArgs = int(int32(f.Varint))
+		case 5:
+			req.Ext = f.Varint != 0
+		case 6:
+			req.WithOS = f.Varint != 0
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return req, req.normalize()
+}
+
+func encodeDiagnostic(d serveDiagnostic, rule string) pbMessage {
+	m := pbMessage{}
+	severity := 1 // ERROR
+	if d.Severity == "warning" {
+		severity = 2
+	}
+	m.int(1, severity)
+	m.string(2, d.Message)
+	m.string(3, d.File)
+	m.int(4, d.Line)
+	m.int(5, d.Col)
+	m.string(6, rule)
+	return m
+}
+
+// encodeTranslateResult encodes the answer of serve as a TranslateResult.
+func encodeTranslateResult(res *serveResponse) pbMessage {
+	m := pbMessage{}
+	m.bool(1, res.OK)
+	m.int(2, res.ExitStatus)
+	m.string(3, res.Asm)
+	for _, d := range res.Diagnostics {
+		m.message(4, encodeDiagnostic(d, ""))
+	}
+	if st := res.Stats; st != nil {
+		stats := pbMessage{}
+		stats.int(1, st.Files)
+		stats.int(2, st.Commands)
+		stats.int(3, st.Functions)
+		stats.int(4, st.Lines)
+		stats.int(5, st.Instructions)
+		m.message(5, stats)
+	}
+	return m
+}
+
+// encodeSnapshot encodes the state of cpu as a Snapshot, with the RAM
+// words at addresses.
+func encodeSnapshot(cpu *hackCPU, addresses []int) pbMessage {
+	m := pbMessage{}
+	m.int(1, cpu.Cycles)
+	m.int(2, cpu.PC)
+	for _, addr := range addresses {
+		entry := pbMessage{}
+		entry.int(1, addr)
+		entry.int(2, int(cpu.RAM[addr]))
+		m.message(3, entry)
+	}
+	return m
+}
+
+// grpcStream is a call answering with a stream of messages.
+type grpcStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// send writes msg as a length-prefixed, uncompressed message and flushes
+// it to the client.
+func (s *grpcStream) send(msg pbMessage) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	if _, err := s.w.Write(append(frame, msg...)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// readGRPCMessage reads the single message of a request, at most max
+// bytes long.
+func readGRPCMessage(r io.Reader, max int64) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request: %s", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	size := int64(binary.BigEndian.Uint32(prefix[1:]))
+	if size > max {
+		return nil, grpcErrorf(grpcResourceExhausted, "request of %d bytes larger than %d", size, max)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading the request: %s", err)
+	}
+	return msg, nil
+}
+
+// grpcPercentEncode encodes a grpc-message trailer, which is limited to
+// the printable ASCII characters.
+func grpcPercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// handleGRPC serves the calls of the service, ending each with its
+// status in the trailers.
+func (t *translator) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "expected a gRPC call over HTTP/2", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	s := &grpcStream{w: w, rc: http.NewResponseController(w)}
+	err := t.serveGRPC(s, r)
+	code, msg := grpcOK, ""
+	if ge := (*grpcError)(nil); errors.As(err, &ge) {
+		code, msg = ge.Code, ge.Msg
+	} else if err != nil {
+		// the client is gone, or the answer could not be written
+		code, msg = grpcCanceled, err.Error()
+	}
+	logger.Debug("Served gRPC call", "method", r.PathValue("method"), "status", code, "remote", r.RemoteAddr)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+	}
+}
+
+func (t *translator) serveGRPC(s *grpcStream, r *http.Request) error {
+	method := r.PathValue("method")
+	if method != "Translate" && method != "Lint" && method != "Emulate" {
+		return grpcErrorf(grpcUnimplemented, "unknown method %s", method)
+	}
+	msg, err := readGRPCMessage(r.Body, t.maxBytes)
+	if err != nil {
+		return err
+	}
+	switch method {
+	case "Translate":
+		return t.grpcTranslate(s, msg)
+	case "Lint":
+		return t.grpcLint(s, msg)
+	}
+	return t.grpcEmulate(s, r, msg)
+}
+
+// grpcTranslate implements Translate, streaming a Progress event each
+// time a stage is a percent further.
+func (t *translator) grpcTranslate(s *grpcStream, msg []byte) error {
+	req, err := decodeTranslateRequest(msg)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+	}
+	stage, pct := "", -1
+	var sendErr error
+	req.Progress = func(st string, done, total int) {
+		if total == 0 || sendErr != nil || st == stage && done*100/total == pct {
+			return
+		}
+		stage, pct = st, done*100/total
+		progress := pbMessage{}
+		progress.string(1, st)
+		progress.int(2, done)
+		progress.int(3, total)
+		event := pbMessage{}
+		event.message(1, progress)
+		sendErr = s.send(event)
+	}
+	res := t.translate(req)
+	if sendErr != nil {
+		return sendErr
+	}
+	event := pbMessage{}
+	event.message(2, encodeTranslateResult(res))
+	return s.send(event)
+}
+
+// grpcLint implements Lint, the lint subcommand over the files of the
+// request. The findings are warnings, the lines failing to parse errors.
+func (t *translator) grpcLint(s *grpcStream, msg []byte) error {
+	fields, err := pbFields(msg, map[int]int{1: pbBytes, 2: pbBytes, 3: pbBytes, 4: pbVarint})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+	}
+	req := &serveRequest{Files: map[string]string{}}
+	var enable, disable []string
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			err = pbStringMap(req.Files, f.Bytes)
+		case 2:
+			enable = append(enable, string(f.Bytes))
+		case 3:
+			disable = append(disable, string(f.Bytes))
+		case 4:
+			req.Ext = f.Varint != 0
+		}
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+		}
+	}
+	err = req.normalize()
+	enabled := map[string]bool{}
+	for _, r := range lintRules {
+		enabled[r.Name] = true
+	}
+	if err == nil {
+		err = setLintRules(enabled, disable, false)
+	}
+	if err == nil {
+		err = setLintRules(enabled, enable, true)
+	}
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+	}
+
+	res := pbMessage{}
+	func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		savedExt, savedPrefix := extendedMode, staticPrefixMode
+		defer func() { extendedMode, staticPrefixMode = savedExt, savedPrefix }()
+		extendedMode, staticPrefixMode = req.Ext, "file"
+
+		pp, fsys := newPreprocessor(), memFS{}
+		for _, name := range slices.Sorted(maps.Keys(req.Files)) {
+			data := []byte(req.Files[name])
+			if err := pp.readSource(fsys.add(name, data), data, nil); err != nil {
+				res.message(1, encodeDiagnostic(serveDiagnostic{Severity: "error", Message: err.Error(), File: name}, ""))
+			}
+		}
+		prog, parseErrs := newLintProgram(pp.lines)
+		for _, e := range parseErrs {
+			d := serveDiagnostic{Severity: "error", Message: e.Err.Error(), File: e.Line.File, Line: e.Line.Line, Col: e.Line.Col}
+			res.message(1, encodeDiagnostic(d, ""))
+		}
+		for _, f := range runLintRules(prog, enabled) {
+			sl := prog.Lines[f.Index]
+			d := serveDiagnostic{Severity: "warning", Message: f.Msg, File: sl.File, Line: sl.Line, Col: sl.Col}
+			res.message(1, encodeDiagnostic(d, f.Rule))
+		}
+	}()
+	return s.send(res)
+}
+
+// grpcEmulate implements Emulate: it translates the program, sends the
+// result, and when it translated runs it on the CPU emulator, sending a
+// Snapshot every snapshot_every cycles and the last one as halted, or as
+// a snapshot when the cycles ran out. Without addresses the snapshots
+// hold R0 to R15.
+func (t *translator) grpcEmulate(s *grpcStream, r *http.Request, msg []byte) error {
+	fields, err := pbFields(msg, map[int]int{1: pbBytes, 2: pbVarint, 3: pbVarint, 4: pbVarint})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+	}
+	req := &serveRequest{}
+	maxCycles, every, addresses := 0, 0, []int{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			req, err = decodeTranslateRequest(f.Bytes)
+		case 2:
+			maxCycles = int(int64(f.Varint))
+		case 3:
+			every = int(int64(f.Varint))
+		case 4:
+			var values []uint64
+			values, err = pbVarints(f)
+			for _, v := range values {
+				addresses = append(addresses, int(int32(v)))
+			}
+		}
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+		}
+	}
+	if req.Files == nil {
+		if err := req.normalize(); err != nil {
+			return grpcErrorf(grpcInvalidArgument, "invalid request: %s", err)
+		}
+	}
+	if maxCycles < 0 || every < 0 {
+		return grpcErrorf(grpcInvalidArgument, "invalid request: negative max_cycles or snapshot_every")
+	}
+	if maxCycles == 0 {
+		maxCycles = grpcEmulateCycles
+	}
+	if len(addresses) == 0 {
+		for addr := range 16 {
+			addresses = append(addresses, addr)
+		}
+	}
+	for _, addr := range addresses {
+		if addr < 0 || addr >= layout.RAMSize() {
+			return grpcErrorf(grpcInvalidArgument, "invalid request: address %d outside of the RAM", addr)
+		}
+	}
+
+	var prog *hackProgram
+	res, err := func() (*serveResponse, error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		res, tr := translateProgram(req)
+		if tr != nil {
+			var err error
+			if prog, err = assembleHack(tr.Lines); err != nil {
+				return nil, fmt.Errorf("assembling the translation: %w", err)
+			}
+		}
+		return res, nil
+	}()
+	if err != nil {
+		return err
+	}
+	event := pbMessage{}
+	event.message(1, encodeTranslateResult(res))
+	if err := s.send(event); err != nil || !res.OK {
+		return err
+	}
+
+	cpu := newHackCPU(prog)
+	for !cpu.Halted() && cpu.Cycles < maxCycles {
+		if err := cpu.Step(); err != nil {
+			return grpcErrorf(grpcAborted, "the program failed after %s: %s", plural(cpu.Cycles, "cycle"), err)
+		}
+		if every > 0 && cpu.Cycles%every == 0 && !cpu.Halted() {
+			event := pbMessage{}
+			event.message(2, encodeSnapshot(cpu, addresses))
+			if err := s.send(event); err != nil {
+				return err
+			}
+		}
+		if cpu.Cycles%(1<<16) == 0 && r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+	}
+	event = pbMessage{}
+	switch {
+	case cpu.Halted():
+		event.message(3, encodeSnapshot(cpu, addresses))
+	case every > 0 && cpu.Cycles%every == 0:
+		// the snapshot of the last cycle is sent
+		return nil
+	default:
+		event.message(2, encodeSnapshot(cpu, addresses))
+	}
+	return s.send(event)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// grpcCall calls a method of the service over HTTP/2 without TLS,
+// returning the messages answered and the grpc-status.
+func grpcCall(t *testing.T, method string, req pbMessage) ([][]byte, string) {
+	t.Helper()
+	tr := &translator{maxBytes: 1 << 20}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+grpcService+"{method}", tr.handleGRPC)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(req)))
+	httpReq, err := http.NewRequest("POST", srv.URL+grpcService+method, bytes.NewReader(append(frame, req...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := [][]byte{}
+	for len(body) >= 5 {
+		size := int(binary.BigEndian.Uint32(body[1:5]))
+		msgs, body = append(msgs, body[5:5+size]), body[5+size:]
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status")
+}
+
+// pbFirst returns the first field num of msg.
+func pbFirst(t *testing.T, msg []byte, num, wire int) (pbField, bool) {
+	t.Helper()
+	fields, err := pbFields(msg, map[int]int{num: wire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		if f.Num == num {
+			return f, true
+		}
+	}
+	return pbField{}, false
+}
+
+func translateRequestMessage(files map[string]string, bootstrap string) pbMessage {
+	m := pbMessage{}
+	for name, src := range files {
+		entry := pbMessage{}
+		entry.string(1, name)
+		entry.string(2, src)
+		m.message(1, entry)
+	}
+	m.string(2, bootstrap)
+	return m
+}
+
+func TestGRPCTranslate(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		ok     bool
+		status int
+	}{
+		{"translated", "push constant 7\npush constant 8\nadd\n", true, 0},
+		{"parse error", "push constnt 7\n", false, exitParse},
+	}
+	for _, tt := range tests {
+		msgs, status := grpcCall(t, "Translate", translateRequestMessage(map[string]string{"Main.vm": tt.src}, "off"))
+		if status != "0" || len(msgs) == 0 {
+			t.Fatalf("%s: status %s with %d messages", tt.name, status, len(msgs))
+		}
+		for _, msg := range msgs[:len(msgs)-1] {
+			if _, ok := pbFirst(t, msg, 1, pbBytes); !ok {
+				t.Errorf("%s: an event other than progress before the result", tt.name)
+			}
+		}
+		result, ok := pbFirst(t, msgs[len(msgs)-1], 2, pbBytes)
+		if !ok {
+			t.Fatalf("%s: no result", tt.name)
+		}
+		okField, _ := pbFirst(t, result.Bytes, 1, pbVarint)
+		exit, _ := pbFirst(t, result.Bytes, 2, pbVarint)
+		asm, _ := pbFirst(t, result.Bytes, 3, pbBytes)
+		if got := okField.Varint != 0; got != tt.ok || int(exit.Varint) != tt.status {
+			t.Errorf("%s: ok %v exit status %d, want %v and %d", tt.name, got, exit.Varint, tt.ok, tt.status)
+		}
+		if tt.ok && !strings.Contains(string(asm.Bytes), "@8") {
+			t.Errorf("%s: asm without @8:\n%s", tt.name, asm.Bytes)
+		}
+	}
+}
+
+func TestGRPCLint(t *testing.T) {
+	req := pbMessage{}
+	entry := pbMessage{}
+	entry.string(1, "Main.vm")
+	entry.string(2, "function Main.main 0\ngoto END\npush constant 0\nreturn\n")
+	req.message(1, entry)
+	msgs, status := grpcCall(t, "Lint", req)
+	if status != "0" || len(msgs) != 1 {
+		t.Fatalf("status %s with %d messages", status, len(msgs))
+	}
+	d, ok := pbFirst(t, msgs[0], 1, pbBytes)
+	if !ok {
+		t.Fatal("no diagnostic")
+	}
+	rule, _ := pbFirst(t, d.Bytes, 6, pbBytes)
+	line, _ := pbFirst(t, d.Bytes, 4, pbVarint)
+	if string(rule.Bytes) != "undefined-label" || line.Varint != 2 {
+		t.Errorf("rule %s at line %d, want undefined-label at line 2", rule.Bytes, line.Varint)
+	}
+}
+
+func TestGRPCEmulate(t *testing.T) {
+	req := pbMessage{}
+	req.message(1, translateRequestMessage(map[string]string{
+		"Sys.vm": "function Sys.init 0\npush constant 7\npush constant 8\nadd\npop static 0\nlabel END\ngoto END\n",
+	}, ""))
+	req.bytes(4, binary.AppendUvarint(nil, 16)) // packed addresses
+	msgs, status := grpcCall(t, "Emulate", req)
+	if status != "0" || len(msgs) != 2 {
+		t.Fatalf("status %s with %d messages", status, len(msgs))
+	}
+	halted, ok := pbFirst(t, msgs[1], 3, pbBytes)
+	if !ok {
+		t.Fatal("the program did not halt")
+	}
+	ram, _ := pbFirst(t, halted.Bytes, 3, pbBytes)
+	value, _ := pbFirst(t, ram.Bytes, 2, pbVarint)
+	if value.Varint != 15 {
+		t.Errorf("RAM[16] = %d, want 15", value.Varint)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	tests := []struct {
+		method string
+		req    pbMessage
+		status string
+	}{
+		{"Assemble", pbMessage{}, "12"},
+		{"Translate", pbMessage{0x0a, 0x05}, "3"}, // truncated files
+		{"Translate", pbMessage{0x10, 0x01}, "3"}, // bootstrap as a varint
+		{"Lint", append(pbMessage{0x12, 0x04}, "nope"...), "3"},
+	}
+	for _, tt := range tests {
+		if _, status := grpcCall(t, tt.method, tt.req); status != tt.status {
+			t.Errorf("%s %x: status %s, want %s", tt.method, tt.req, status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// hackInstruction is an assembled Hack instruction.
+type hackInstruction struct {
+	Address bool  // A-instruction loading Value
+	Value   int16 // constant of an A-instruction
+	Comp    string
+	Dest    string // any combination of A, D and M
+	Jump    string // JGT, JEQ, JGE, JLT, JNE, JLE, JMP or "" for none
+	Line    int    // index of the assembly line the instruction comes from
+
+	eval                func(a, d, m int16) int16
+	readM               bool
+	destA, destD, destM bool
+}
+
+// hackProgram is an assembled Hack program.
+type hackProgram struct {
+	ROM     []hackInstruction
+	Symbols map[string]int
+}
+
+// hackComp describes a computation of the Hack ALU: its comp bits (the a
+// bit followed by c1..c6) and how it evaluates.
+type hackComp struct {
+	Bits  string
+	Shift bool // extended shift instruction, encoded with a 101 prefix
+	Eval  func(a, d, m int16) int16
+}
+
+var hackComps = map[string]hackComp{
+	"0":   {"0101010", false, func(a, d, m int16) int16 { return 0 }},
+	"1":   {"0111111", false, func(a, d, m int16) int16 { return 1 }},
+	"-1":  {"0111010", false, func(a, d, m int16) int16 { return -1 }},
+	"D":   {"0001100", false, func(a, d, m int16) int16 { return d }},
+	"A":   {"0110000", false, func(a, d, m int16) int16 { return a }},
+	"M":   {"1110000", false, func(a, d, m int16) int16 { return m }},
+	"!D":  {"0001101", false, func(a, d, m int16) int16 { return ^d }},
+	"!A":  {"0110001", false, func(a, d, m int16) int16 { return ^a }},
+	"!M":  {"1110001", false, func(a, d, m int16) int16 { return ^m }},
+	"-D":  {"0001111", false, func(a, d, m int16) int16 { return -d }},
+	"-A":  {"0110011", false, func(a, d, m int16) int16 { return -a }},
+	"-M":  {"1110011", false, func(a, d, m int16) int16 { return -m }},
+	"D+1": {"0011111", false, func(a, d, m int16) int16 { return d + 1 }},
+	"A+1": {"0110111", false, func(a, d, m int16) int16 { return a + 1 }},
+	"M+1": {"1110111", false, func(a, d, m int16) int16 { return m + 1 }},
+	"D-1": {"0001110", false, func(a, d, m int16) int16 { return d - 1 }},
+	"A-1": {"0110010", false, func(a, d, m int16) int16 { return a - 1 }},
+	"M-1": {"1110010", false, func(a, d, m int16) int16 { return m - 1 }},
+	"D+A": {"0000010", false, func(a, d, m int16) int16 { return d + a }},
+	"D+M": {"1000010", false, func(a, d, m int16) int16 { return d + m }},
+	"D-A": {"0010011", false, func(a, d, m int16) int16 { return d - a }},
+	"D-M": {"1010011", false, func(a, d, m int16) int16 { return d - m }},
+	"A-D": {"0000111", false, func(a, d, m int16) int16 { return a - d }},
+	"M-D": {"1000111", false, func(a, d, m int16) int16 { return m - d }},
+	"D&A": {"0000000", false, func(a, d, m int16) int16 { return d & a }},
+	"D&M": {"1000000", false, func(a, d, m int16) int16 { return d & m }},
+	"D|A": {"0010101", false, func(a, d, m int16) int16 { return d | a }},
+	"D|M": {"1010101", false, func(a, d, m int16) int16 { return d | m }},
+	"A<<": {"0100000", true, func(a, d, m int16) int16 { return a << 1 }},
+	"D<<": {"0110000", true, func(a, d, m int16) int16 { return d << 1 }},
+	"M<<": {"1100000", true, func(a, d, m int16) int16 { return m << 1 }},
+	"A>>": {"0000000", true, func(a, d, m int16) int16 { return a >> 1 }},
+	"D>>": {"0010000", true, func(a, d, m int16) int16 { return d >> 1 }},
+	"M>>": {"1000000", true, func(a, d, m int16) int16 { return m >> 1 }},
+}
+
+// hackCompAliases are the commutated spellings accepted for binary comps.
+var hackCompAliases = map[string]string{
+	"A+D": "D+A", "M+D": "D+M", "A&D": "D&A", "M&D": "D&M", "A|D": "D|A", "M|D": "D|M",
+}
+
+var hackJumps = []string{"", "JGT", "JEQ", "JGE", "JLT", "JNE", "JLE", "JMP"}
+
+// hackAsmError is an error of assembleHack about the assembly line Line,
+// counted from 0.
+type hackAsmError struct {
+	Line int
+	Msg  string
+}
+
+func (e *hackAsmError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line+1, e.Msg)
+}
+
+// newHackSymbols returns the predefined symbols of the Hack platform, the
+// devices where the memory layout puts them.
+func newHackSymbols() map[string]int {
+	symbols := map[string]int{
+		"SP": 0, "LCL": 1, "ARG": 2, "THIS": 3, "THAT": 4,
+		"SCREEN": layout.Screen, "KBD": layout.Keyboard,
+	}
+	for r := range 16 {
+		symbols[fmt.Sprintf("R%d", r)] = r
+	}
+	return symbols
+}
+
+// assembleHack assembles Hack assembly, variables being allocated from
+// the static address of the memory layout (16) in order of first use. Comments, blank lines and labels
+// produce no instruction.
+func assembleHack(lines []string) (*hackProgram, error) {
+	prog := &hackProgram{Symbols: newHackSymbols()}
+	type pending struct {
+		text string
+		line int
+	}
+	code := []pending{}
+	for n, line := range lines {
+		if k := strings.Index(line, "//"); k >= 0 {
+			line = line[:k]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "("):
+			label := strings.TrimSuffix(strings.TrimPrefix(line, "("), ")")
+			if label == "" || !strings.HasSuffix(line, ")") {
+				return nil, &hackAsmError{n, "invalid label " + line}
+			}
+			if _, ok := prog.Symbols[label]; ok {
+				return nil, &hackAsmError{n, fmt.Sprintf("label %s already defined", label)}
+			}
+			prog.Symbols[label] = len(code)
+		default:
+			code = append(code, pending{line, n})
+		}
+	}
+
+	next := layout.Static
+	for _, p := range code {
+		in := hackInstruction{Line: p.line}
+		if sym, ok := strings.CutPrefix(p.text, "@"); ok {
+			in.Address = true
+			v, err := strconv.Atoi(sym)
+			if err != nil {
+				addr, ok := prog.Symbols[sym]
+				if !ok {
+					addr = next
+					prog.Symbols[sym] = addr
+					next++
+				}
+				v = addr
+			} else if v < 0 || v > 32767 {
+				return nil, &hackAsmError{p.line, "constant out of range 0..32767: " + p.text}
+			}
+			in.Value = int16(v)
+			prog.ROM = append(prog.ROM, in)
+			continue
+		}
+		comp := p.text
+		if dest, rest, ok := strings.Cut(comp, "="); ok {
+			in.Dest, comp = dest, rest
+		}
+		comp, in.Jump, _ = strings.Cut(comp, ";")
+		if alias, ok := hackCompAliases[comp]; ok {
+			comp = alias
+		}
+		c, ok := hackComps[comp]
+		if !ok {
+			return nil, &hackAsmError{p.line, "invalid computation " + p.text}
+		}
+		if strings.Trim(in.Dest, "ADM") != "" {
+			return nil, &hackAsmError{p.line, "invalid destination " + p.text}
+		}
+		if !slices.Contains(hackJumps, in.Jump) {
+			return nil, &hackAsmError{p.line, "invalid jump " + p.text}
+		}
+		in.Comp, in.eval = comp, c.Eval
+		in.readM = strings.Contains(comp, "M")
+		in.destA = strings.Contains(in.Dest, "A")
+		in.destD = strings.Contains(in.Dest, "D")
+		in.destM = strings.Contains(in.Dest, "M")
+		prog.ROM = append(prog.ROM, in)
+	}
+	return prog, nil
+}
+
+// hackCPU emulates the Hack computer running a program.
+type hackCPU struct {
+	ROM    []hackInstruction
+	RAM    []int16
+	A, D   int16
+	PC     int
+	Cycles int
+}
+
+const hackROMSize = 32768
+
+func newHackCPU(prog *hackProgram) *hackCPU {
+	return &hackCPU{ROM: prog.ROM, RAM: make([]int16, layout.RAMSize())}
+}
+
+// Step executes the instruction at PC, failing on an access outside of the
+// RAM.
+func (c *hackCPU) Step() error {
+	if c.PC < 0 || c.PC >= len(c.ROM) {
+		return fmt.Errorf("pc %d outside of the program", c.PC)
+	}
+	in := &c.ROM[c.PC]
+	c.Cycles++
+	if in.Address {
+		c.A = in.Value
+		c.PC++
+		return nil
+	}
+
+	addr := int(uint16(c.A))
+	var m int16
+	if addr < len(c.RAM) {
+		m = c.RAM[addr]
+	} else if in.readM {
+		return fmt.Errorf("pc %d: read of RAM[%d] outside of memory", c.PC, addr)
+	}
+	r := in.eval(c.A, c.D, m)
+	jump := false
+	switch in.Jump {
+	case "JGT":
+		jump = r > 0
+	case "JEQ":
+		jump = r == 0
+	case "JGE":
+		jump = r >= 0
+	case "JLT":
+		jump = r < 0
+	case "JNE":
+		jump = r != 0
+	case "JLE":
+		jump = r <= 0
+	case "JMP":
+		jump = true
+	}
+	if in.destM {
+		if addr >= len(c.RAM) {
+			return fmt.Errorf("pc %d: write to RAM[%d] outside of memory", c.PC, addr)
+		}
+		c.RAM[addr] = r
+	}
+	// the jump target is the A register as it was before this instruction
+	target := int(uint16(c.A))
+	if in.destA {
+		c.A = r
+	}
+	if in.destD {
+		c.D = r
+	}
+	if jump {
+		c.PC = target
+	} else {
+		c.PC++
+	}
+	return nil
+}
+
+// Halted reports whether the program ran off its end or sits in the
+// @LOOP, 0;JMP idiom jumping to itself, or on a jump to itself with A
+// already holding its address.
+func (c *hackCPU) Halted() bool {
+	if c.PC < 0 || c.PC >= len(c.ROM) {
+		return true
+	}
+	in := c.ROM[c.PC]
+	if !in.Address && in.Jump == "JMP" && !in.destA && int(uint16(c.A)) == c.PC {
+		return true
+	}
+	if !in.Address || int(in.Value) != c.PC || c.PC+1 >= len(c.ROM) {
+		return false
+	}
+	next := c.ROM[c.PC+1]
+	return !next.Address && next.Jump == "JMP" && !next.destA
+}
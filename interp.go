@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+)
+
+// vmInterpreter runs VM commands directly, following the VM specification
+// rather than the generated assembly. It lays the stack, the frames and the
+// segments out in RAM like the translation, so the two can be compared,
+// but keeps the static variables by symbol.
+type vmInterpreter struct {
+	Instructions []*Instruction
+	RAM          []int16
+	Statics      map[string]int16
+	// PC is the index of the next command
+	PC    int
+	Steps int
+	// RetSlots marks the stack words holding the return address of a
+	// frame, a command index here and a ROM address in the translation
+	RetSlots  map[int]bool
+	labels    map[string]int
+	functions map[string]int
+
+	// WrapCompare makes gt and lt test the sign of x - y wrapped to 16
+	// bits, as the generated code does, rather than compare x and y, the
+	// two differing when the subtraction overflows
+	WrapCompare bool
+}
+
+// newVMInterpreter resolves the labels and functions of the commands and
+// applies their static initializers.
+func newVMInterpreter(instructions []*Instruction) (*vmInterpreter, error) {
+	m := &vmInterpreter{
+		Instructions: instructions,
+		RAM:          make([]int16, layout.RAMSize()),
+		Statics:      map[string]int16{},
+		RetSlots:     map[int]bool{},
+		labels:       map[string]int{},
+		functions:    map[string]int{},
+	}
+	for k, inst := range instructions {
+		switch inst.CommandType {
+		case CommandTypeLabel:
+			if _, ok := m.labels[inst.labelSymbol()]; ok {
+				return nil, fmt.Errorf("label %s defined twice", inst.labelSymbol())
+			}
+			m.labels[inst.labelSymbol()] = k
+		case CommandTypeFunction:
+			m.functions[inst.Arg1] = k
+		case CommandTypeStaticInit:
+			m.Statics[inst.Arg1] = int16(inst.Arg2Val)
+		}
+	}
+	return m, nil
+}
+
+// Bootstrap does what the bootstrap code does: SP set to the stack base
+// (256) and a call of entry with nArgs zero arguments.
+func (m *vmInterpreter) Bootstrap(entry string, nArgs int) error {
+	m.RAM[0] = int16(layout.Stack)
+	for range nArgs {
+		if err := m.push(0); err != nil {
+			return err
+		}
+	}
+	return m.call(entry, nArgs, len(m.Instructions))
+}
+
+// Halted reports whether the program ran off its end or sits in a label
+// followed by a goto to itself, the end loop of VM programs.
+func (m *vmInterpreter) Halted() bool {
+	if m.PC < 0 || m.PC >= len(m.Instructions) {
+		return true
+	}
+	inst := m.Instructions[m.PC]
+	return inst.CommandType == CommandTypeGOTO && m.PC > 0 && m.labels[inst.labelSymbol()] == m.PC-1
+}
+
+func (m *vmInterpreter) sp() int { return int(uint16(m.RAM[0])) }
+
+func (m *vmInterpreter) load(addr int) (int16, error) {
+	if addr < 0 || addr >= len(m.RAM) {
+		return 0, fmt.Errorf("read of RAM[%d] outside of memory", addr)
+	}
+	return m.RAM[addr], nil
+}
+
+func (m *vmInterpreter) store(addr int, v int16) error {
+	if addr < 0 || addr >= len(m.RAM) {
+		return fmt.Errorf("write to RAM[%d] outside of memory", addr)
+	}
+	m.RAM[addr] = v
+	return nil
+}
+
+func (m *vmInterpreter) push(v int16) error {
+	if err := m.store(m.sp(), v); err != nil {
+		return err
+	}
+	m.RAM[0]++
+	return nil
+}
+
+func (m *vmInterpreter) pop() (int16, error) {
+	if m.sp() == 0 {
+		return 0, fmt.Errorf("stack underflow")
+	}
+	m.RAM[0]--
+	return m.load(m.sp())
+}
+
+// segmentAddr returns the RAM address of a push or pop operand, "" with
+// the symbol of a static variable instead.
+func (m *vmInterpreter) segmentAddr(inst *Instruction) (int, string, error) {
+	i := inst.Arg2Val
+	switch inst.SegmentType {
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		base := map[SegmentType]int{SegmentTypeLocal: 1, SegmentTypeArgument: 2, SegmentTypeThis: 3, SegmentTypeThat: 4}[inst.SegmentType]
+		return int(uint16(m.RAM[base])) + i, "", nil
+	case SegmentTypeTemp:
+		if i > 7 {
+			return 0, "", fmt.Errorf("temp %d out of range", i)
+		}
+		return layout.Temp + i, "", nil
+	case SegmentTypePointer:
+		if i > 1 {
+			return 0, "", fmt.Errorf("pointer %d out of range", i)
+		}
+		return 3 + i, "", nil
+	case SegmentTypeStatic:
+		sym, _ := staticSymbol(inst)
+		return 0, sym, nil
+	}
+	return 0, "", fmt.Errorf("segment %s not supported", inst.SegmentType)
+}
+
+// call pushes the frame of a call returning to command ret and jumps to fn.
+func (m *vmInterpreter) call(fn string, nArgs, ret int) error {
+	target, ok := m.functions[fn]
+	if !ok {
+		return fmt.Errorf("call of undefined function %s", fn)
+	}
+	slot := m.sp()
+	if err := m.push(int16(ret)); err != nil {
+		return err
+	}
+	m.RetSlots[slot] = true
+	for _, seg := range []int{1, 2, 3, 4} {
+		if err := m.push(m.RAM[seg]); err != nil {
+			return err
+		}
+	}
+	m.RAM[2] = int16(m.sp() - callFrameSize - nArgs)
+	m.RAM[1] = int16(m.sp())
+	m.PC = target
+	return nil
+}
+
+// Step executes the command at PC.
+func (m *vmInterpreter) Step() error {
+	if m.PC < 0 || m.PC >= len(m.Instructions) {
+		return fmt.Errorf("command %d outside of the program", m.PC)
+	}
+	inst := m.Instructions[m.PC]
+	m.PC++
+	m.Steps++
+	switch inst.CommandType {
+	case CommandTypeArithmetic:
+		return m.arithmetic(inst.ALType)
+	case CommandTypePush:
+		if inst.SegmentType == SegmentTypeConstant {
+			return m.push(int16(inst.Arg2Val))
+		}
+		addr, sym, err := m.segmentAddr(inst)
+		if err != nil {
+			return err
+		}
+		v := m.Statics[sym]
+		if sym == "" {
+			if v, err = m.load(addr); err != nil {
+				return err
+			}
+		}
+		return m.push(v)
+	case CommandTypePop:
+		if inst.SegmentType == SegmentTypeConstant {
+			return fmt.Errorf("pop constant")
+		}
+		addr, sym, err := m.segmentAddr(inst)
+		if err != nil {
+			return err
+		}
+		v, err := m.pop()
+		if err != nil {
+			return err
+		}
+		if sym != "" {
+			m.Statics[sym] = v
+			return nil
+		}
+		return m.store(addr, v)
+	case CommandTypeLabel, CommandTypeStaticInit:
+		return nil
+	case CommandTypeGOTO, CommandTypeIf:
+		if inst.CommandType == CommandTypeIf {
+			v, err := m.pop()
+			if err != nil || v == 0 {
+				return err
+			}
+		}
+		target, ok := m.labels[inst.labelSymbol()]
+		if !ok {
+			return fmt.Errorf("jump to undefined label %s", inst.Arg1)
+		}
+		m.PC = target
+		return nil
+	case CommandTypeFunction:
+		for range inst.Arg2Val {
+			if err := m.push(0); err != nil {
+				return err
+			}
+		}
+		return nil
+	case CommandTypeCall:
+		return m.call(inst.Arg1, inst.Arg2Val, m.PC)
+	case CommandTypeReturn:
+		frame := int(uint16(m.RAM[1]))
+		ret, err := m.load(frame - callFrameSize)
+		if err != nil {
+			return err
+		}
+		v, err := m.pop()
+		if err != nil {
+			return err
+		}
+		arg := int(uint16(m.RAM[2]))
+		if err := m.store(arg, v); err != nil {
+			return err
+		}
+		delete(m.RetSlots, frame-callFrameSize)
+		m.RAM[0] = int16(arg + 1)
+		for k, seg := range []int{4, 3, 2, 1} {
+			if m.RAM[seg], err = m.load(frame - 1 - k); err != nil {
+				return err
+			}
+		}
+		m.PC = int(ret)
+		return nil
+	}
+	return fmt.Errorf("%s not supported", inst.CommandType)
+}
+
+// arithmetic applies an arithmetic command to the top of the stack.
+func (m *vmInterpreter) arithmetic(al ALType) error {
+	y, err := m.pop()
+	if err != nil {
+		return err
+	}
+	unary := map[ALType]func(int16) int16{
+		ALTypeNeg: func(v int16) int16 { return -v },
+		ALTypeNot: func(v int16) int16 { return ^v },
+		ALTypeShl: func(v int16) int16 { return v << 1 },
+		ALTypeShr: func(v int16) int16 { return v >> 1 },
+	}
+	if f, ok := unary[al]; ok {
+		return m.push(f(y))
+	}
+	x, err := m.pop()
+	if err != nil {
+		return err
+	}
+	truth := func(b bool) int16 {
+		if b {
+			return -1
+		}
+		return 0
+	}
+	var r int16
+	switch al {
+	case ALTypeAdd:
+		r = x + y
+	case ALTypeSub:
+		r = x - y
+	case ALTypeAnd:
+		r = x & y
+	case ALTypeOr:
+		r = x | y
+	case ALTypeEq:
+		r = truth(x == y)
+	case ALTypeGt:
+		r = truth(x > y)
+		if m.WrapCompare {
+			r = truth(x-y > 0)
+		}
+	case ALTypeLt:
+		r = truth(x < y)
+		if m.WrapCompare {
+			r = truth(x-y < 0)
+		}
+	case ALTypeMult:
+		r = x * y
+	case ALTypeDiv:
+		// dividing by zero yields 0, like the runtime subroutine
+		if y != 0 {
+			r = x / y
+		}
+	case ALTypeMod:
+		r = x
+		if y != 0 {
+			r = x % y
+		}
+	default:
+		return fmt.Errorf("arithmetic command %s not supported", al)
+	}
+	return m.push(r)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// irFormat and irVersion identify the JSON IR written by --emit=json.
+const (
+	irFormat  = "hack-vm-ir"
+	irVersion = 1
+)
+
+// irProgram is the JSON IR of a parsed program: every VM command in
+// translation order, after includes and macros are expanded.
+type irProgram struct {
+	Format   string      `json:"format"`
+	Version  int         `json:"version"`
+	Commands []irCommand `json:"commands"`
+}
+
+// irCommand is a parsed VM command. Command is the arithmetic command
+// (add, neg, ...) or the command keyword; the other fields are set as the
+// command takes them.
+type irCommand struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Command string `json:"command"`
+	// Segment and Index are the operands of push and pop
+	Segment string `json:"segment,omitempty"`
+	Index   *int   `json:"index,omitempty"`
+	// Symbol is the assembly symbol of a static variable
+	Symbol string `json:"symbol,omitempty"`
+	// String is the literal of push string
+	String *string `json:"string,omitempty"`
+	// Name is the label of label, goto and if-goto and the function of
+	// function and call
+	Name string `json:"name,omitempty"`
+	// Count is the number of locals of function and of arguments of call
+	Count *int `json:"count,omitempty"`
+	// Value is the initial value of static-init
+	Value *int `json:"value,omitempty"`
+	// Function is the function the command belongs to
+	Function string `json:"function,omitempty"`
+	Text     string `json:"text"`
+}
+
+// newIRProgram converts parsed commands to their IR.
+func newIRProgram(lines []sourceLine, instructions []*Instruction) *irProgram {
+	p := &irProgram{Format: irFormat, Version: irVersion, Commands: []irCommand{}}
+	fn := ""
+	for k, inst := range instructions {
+		if inst.CommandType == CommandTypeFunction {
+			fn = inst.Arg1
+		}
+		n := inst.Arg2Val
+		c := irCommand{File: lines[k].File, Line: lines[k].Line, Command: inst.CommandType.String(), Function: fn, Text: lines[k].Text}
+		switch inst.CommandType {
+		case CommandTypeArithmetic:
+			c.Command = inst.Arg1
+		case CommandTypePush, CommandTypePop:
+			c.Segment = inst.SegmentType.String()
+			if inst.SegmentType == SegmentTypeString {
+				s := inst.Arg2
+				c.String = &s
+				break
+			}
+			c.Index = &n
+			if sym, ok := staticSymbol(inst); ok {
+				c.Symbol = sym
+			}
+		case CommandTypeLabel, CommandTypeGOTO, CommandTypeIf:
+			c.Name = inst.Arg1
+		case CommandTypeFunction, CommandTypeCall:
+			c.Name, c.Count = inst.Arg1, &n
+		case CommandTypeStaticInit:
+			c.Symbol, c.Value = inst.Arg1, &n
+		}
+		p.Commands = append(p.Commands, c)
+	}
+	return p
+}
+
+// marshalIR encodes the IR of a translation as indented JSON.
+func marshalIR(tr *translation) ([]byte, error) {
+	data, err := json.MarshalIndent(newIRProgram(tr.Commands, tr.Instructions), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("encoding the IR: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// isIRSource reports whether a source is JSON IR rather than VM code.
+func isIRSource(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".json")
+}
+
+// readIR decodes JSON IR, as written by --emit=json.
+func readIR(r io.Reader) (*irProgram, error) {
+	p := &irProgram{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return nil, fmt.Errorf("decoding the IR: %w", err)
+	}
+	if p.Format != irFormat || p.Version != irVersion {
+		return nil, fmt.Errorf("unsupported IR format %q version %d, expected %q version %d", p.Format, p.Version, irFormat, irVersion)
+	}
+	return p, nil
+}
+
+// vmText renders an IR command back as a VM command, from its operands
+// rather than its text, which front ends may leave out.
+func (c irCommand) vmText() (string, error) {
+	need := func(ok bool, field string) error {
+		if !ok {
+			return fmt.Errorf("%s needs a %s", c.Command, field)
+		}
+		return nil
+	}
+	switch c.Command {
+	case "push", "pop":
+		if err := need(c.Segment != "", "segment"); err != nil {
+			return "", err
+		}
+		if c.Segment == "string" {
+			if err := need(c.String != nil, "string"); err != nil {
+				return "", err
+			}
+			if strings.Contains(*c.String, `"`) {
+				return "", fmt.Errorf("string literals cannot contain a double quote: %s", *c.String)
+			}
+			return fmt.Sprintf("%s string \"%s\"", c.Command, *c.String), nil
+		}
+		if err := need(c.Index != nil, "index"); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %d", c.Command, c.Segment, *c.Index), nil
+	case "label", "goto", "if-goto":
+		if err := need(c.Name != "", "name"); err != nil {
+			return "", err
+		}
+		return c.Command + " " + c.Name, nil
+	case "function", "call":
+		if err := need(c.Name != "" && c.Count != nil, "name and a count"); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %d", c.Command, c.Name, *c.Count), nil
+	case "static-init":
+		if err := need(c.Symbol != "" && c.Value != nil, "symbol and a value"); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("static-init %s %d", c.Symbol, *c.Value), nil
+	case "plugin":
+		// the plugin parses its commands again
+		if err := need(c.Text != "", "text"); err != nil {
+			return "", err
+		}
+		return c.Text, nil
+	case "":
+		return "", fmt.Errorf("missing command")
+	}
+	// return and the arithmetic commands, checked by the parser
+	return c.Command, nil
+}
+
+// readIRSource adds the commands of a JSON IR source. They keep the file
+// and line they come from, so diagnostics and static variable names refer
+// to the original VM sources; a command without a file is attributed to
+// the IR file itself.
+func (pp *preprocessor) readIRSource(src vmSource, data []byte) error {
+	pp.included[sourceKey(src.Name)] = true
+	p, err := readIR(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", src.Name, err)
+	}
+	for k, c := range p.Commands {
+		text, err := c.vmText()
+		if err != nil {
+			return fmt.Errorf("%s: command %d: %w", src.Name, k+1, err)
+		}
+		sl := sourceLine{File: c.File, Line: c.Line, Text: text}
+		if sl.File == "" {
+			sl.File, sl.Line = src.Name, k+1
+		}
+		pp.lines = append(pp.lines, sl)
+	}
+	return nil
+}
+
+// irDefinesFunction reports whether a JSON IR source declares fn.
+func irDefinesFunction(src io.Reader, fn string) bool {
+	p, err := readIR(src)
+	if err != nil {
+		return false
+	}
+	for _, c := range p.Commands {
+		if c.Command == "function" && c.Name == fn {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// jackSources returns the sources of a translation with the .jack files
+// given replaced by the .vm files the Jack compiler writes next to them,
+// and the directories holding Jack sources, which the frontend compiles.
+func jackSources(sources []string) (vmSources, dirs []string) {
+	for _, src := range sources {
+		if strings.EqualFold(filepath.Ext(src), ".jack") {
+			vmSources = append(vmSources, strings.TrimSuffix(src, filepath.Ext(src))+".vm")
+			if dir := filepath.Dir(src); !slices.Contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+			continue
+		}
+		vmSources = append(vmSources, src)
+		if st, err := os.Stat(src); err == nil && st.IsDir() && !slices.Contains(dirs, src) {
+			if files, _ := filepath.Glob(filepath.Join(src, "*.jack")); len(files) > 0 {
+				dirs = append(dirs, src)
+			}
+		}
+	}
+	return vmSources, dirs
+}
+
+// runFrontend runs the frontend command on a directory of Jack sources,
+// like the JackCompiler of the course writing a .vm file next to every
+// .jack file. Every {dir} in the command is replaced by the directory,
+// which is passed as the last argument when the command has none.
+func runFrontend(frontend, dir string) error {
+	args := strings.Fields(frontend)
+	if len(args) == 0 {
+		return failf(exitUsage, "Invalid frontend %q", frontend)
+	}
+	placed := false
+	for k, a := range args {
+		if strings.Contains(a, "{dir}") {
+			args[k], placed = strings.ReplaceAll(a, "{dir}", dir), true
+		}
+	}
+	if !placed {
+		args = append(args, dir)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		return failf(exitParse, "Error compiling the Jack sources of %s: %s", dir, msg)
+	case err != nil:
+		return failf(exitUsage, "Error running the frontend %s", err)
+	}
+	return nil
+}
+
+// staleJackWarnings warns about the .vm sources older than the .jack file
+// next to them, compiled before their last change, and about the .jack
+// files of the source directories not compiled at all.
+func staleJackWarnings(srcPaths, dirs []string) []string {
+	warnings := []string{}
+	for _, p := range srcPaths {
+		jack := strings.TrimSuffix(p, filepath.Ext(p)) + ".jack"
+		vmSt, err := os.Stat(p)
+		if err != nil {
+			// inside an archive
+			continue
+		}
+		if jackSt, err := os.Stat(jack); err == nil && jackSt.ModTime().After(vmSt.ModTime()) {
+			warnings = append(warnings, fmt.Sprintf("%s is older than %s, compile it again or pass --frontend", p, jack))
+		}
+	}
+	for _, dir := range dirs {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.jack"))
+		for _, f := range files {
+			if _, err := os.Stat(strings.TrimSuffix(f, filepath.Ext(f)) + ".vm"); errors.Is(err, os.ErrNotExist) {
+				warnings = append(warnings, fmt.Sprintf("%s has not been compiled to VM code, compile it or pass --frontend", f))
+			}
+		}
+	}
+	return warnings
+}
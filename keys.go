@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// keyCyclesPerSecond is the clock durations of keyboard scripts are
+	// counted in, so that a run is the same whatever the speed of the
+	// emulator
+	keyCyclesPerSecond = 1_000_000
+	// keyHold is how long a key of a keyboard script is pressed unless
+	// told otherwise, and how long it stays released before the next one
+	keyHold = 100 * time.Millisecond
+)
+
+// hackKeyNames are the codes of the keys of the Hack keyboard that are not
+// characters. A character key is named by the character, its code being
+// the character code.
+var hackKeyNames = map[string]int16{
+	"SPACE": ' ', "ENTER": 128, "NEWLINE": 128, "BACKSPACE": 129,
+	"LEFT": 130, "UP": 131, "RIGHT": 132, "DOWN": 133,
+	"HOME": 134, "END": 135, "PAGEUP": 136, "PAGEDOWN": 137,
+	"INSERT": 138, "DELETE": 139, "ESC": 140, "ESCAPE": 140,
+	"F1": 141, "F2": 142, "F3": 143, "F4": 144, "F5": 145, "F6": 146,
+	"F7": 147, "F8": 148, "F9": 149, "F10": 150, "F11": 151, "F12": 152,
+}
+
+// parseKeyName returns the code of a key: a character, or one of
+// hackKeyNames in any case.
+func parseKeyName(name string) (int16, error) {
+	if len(name) == 1 && name[0] > ' ' && name[0] <= '~' {
+		return int16(name[0]), nil
+	}
+	if code, ok := hackKeyNames[strings.ToUpper(name)]; ok {
+		return code, nil
+	}
+	return 0, fmt.Errorf("unknown key %q", name)
+}
+
+// parseKeyPress parses KEY or KEY:HOLD, a key pressed for keyHold or for
+// the duration given.
+func parseKeyPress(tok string) (int16, time.Duration, error) {
+	name, holdText, hasHold := tok, "", false
+	// the last colon, the first one being the colon key in ::1s
+	if i := strings.LastIndex(tok, ":"); i > 0 {
+		name, holdText, hasHold = tok[:i], tok[i+1:], true
+	}
+	code, err := parseKeyName(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	hold := keyHold
+	if hasHold {
+		if hold, err = time.ParseDuration(holdText); err != nil || hold <= 0 {
+			return 0, 0, fmt.Errorf("invalid hold time in %q", tok)
+		}
+	}
+	return code, hold, nil
+}
+
+func keyCycles(d time.Duration) int {
+	return int(d.Seconds() * keyCyclesPerSecond)
+}
+
+// keyEvent presses or releases a key when the emulator reaches a cycle.
+type keyEvent struct {
+	Cycle   int
+	Code    int16
+	Release bool
+}
+
+// keyboardScript plays keyEvents on the keyboard register of a run.
+type keyboardScript struct {
+	events []keyEvent
+	next   int
+}
+
+// press adds a key pressed from cycle for hold.
+func (ks *keyboardScript) press(cycle int, code int16, hold time.Duration) {
+	ks.events = append(ks.events, keyEvent{cycle, code, false}, keyEvent{cycle + keyCycles(hold), code, true})
+}
+
+// parseKeyScript parses a keyboard script of --keys: keys pressed one
+// after the other, each held for keyHold or for the duration after its
+// name (RIGHT:2s), then released for keyHold, and durations (500ms)
+// waiting with no key pressed.
+func parseKeyScript(script string) (*keyboardScript, error) {
+	ks := &keyboardScript{}
+	cycle := 0
+	for _, tok := range strings.Fields(script) {
+		if d, err := time.ParseDuration(tok); err == nil && len(tok) > 1 {
+			if d < 0 {
+				return nil, fmt.Errorf("negative wait %q", tok)
+			}
+			cycle += keyCycles(d)
+			continue
+		}
+		code, hold, err := parseKeyPress(tok)
+		if err != nil {
+			return nil, err
+		}
+		ks.press(cycle, code, hold)
+		cycle += keyCycles(hold) + keyCycles(keyHold)
+	}
+	return ks, nil
+}
+
+// parseKeyFile parses a file of timed keystrokes of --keys-file, a
+// keystroke a line: the time it is pressed at from the start of the run,
+// then the key, held for keyHold or for the duration after its name (2s
+// LEFT:500ms). Lines starting with # are comments.
+func parseKeyFile(data []byte) (*keyboardScript, error) {
+	ks := &keyboardScript{}
+	scanner := newLineScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a time and a key, got %q", n, line)
+		}
+		at, err := time.ParseDuration(fields[0])
+		if err != nil || at < 0 {
+			return nil, fmt.Errorf("line %d: invalid time %q", n, fields[0])
+		}
+		code, hold, err := parseKeyPress(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		ks.press(keyCycles(at), code, hold)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(ks.events, func(a, b keyEvent) int { return a.Cycle - b.Cycle })
+	return ks, nil
+}
+
+// apply plays the events due at the current cycle of cpu. A release only
+// releases its key, not one pressed after it.
+func (ks *keyboardScript) apply(cpu *hackCPU) {
+	for ks.next < len(ks.events) && ks.events[ks.next].Cycle <= cpu.Cycles {
+		e := ks.events[ks.next]
+		switch {
+		case !e.Release:
+			cpu.RAM[layout.Keyboard] = e.Code
+		case cpu.RAM[layout.Keyboard] == e.Code:
+			cpu.RAM[layout.Keyboard] = 0
+		}
+		ks.next++
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// memoryLayout is the memory map of the Hack platform the translation and
+// the emulator target, the one of the book unless --memory-layout gives
+// another, for modified platforms with relocated segments or devices.
+type memoryLayout struct {
+	// Temp is the address of temp 0, followed by the 7 others
+	Temp int `json:"temp"`
+	// Static is the address of the first variable of the assembler, the
+	// static variables growing up from it to the stack
+	Static int `json:"static"`
+	// Stack is the address the bootstrap code sets SP to
+	Stack int `json:"stack"`
+	// Heap is the end of the stack and the start of the heap, which runs
+	// to the first device
+	Heap int `json:"heap"`
+	// Screen is the address of the screen memory map
+	Screen int `json:"screen"`
+	// Keyboard is the address of the keyboard register
+	Keyboard int `json:"keyboard"`
+	// RAM is the number of words of the RAM, 0 for the RAM running up to
+	// the last device
+	RAM int `json:"ram,omitempty"`
+}
+
+// defaultLayout is the memory map of the standard Hack platform.
+var defaultLayout = memoryLayout{Temp: 5, Static: 16, Stack: 256, Heap: 2048, Screen: 16384, Keyboard: 24576}
+
+// layout is the memory map of --memory-layout.
+var layout = defaultLayout
+
+// screenWords is the size of the screen memory map.
+const screenWords = screenWidth / 16 * screenHeight
+
+// RAMSize is the size of the RAM, --ram-size or up to and including the
+// last device.
+func (l memoryLayout) RAMSize() int {
+	if l.RAM > 0 {
+		return l.RAM
+	}
+	return l.devicesEnd()
+}
+
+// devicesEnd is the (exclusive) end of the last device.
+func (l memoryLayout) devicesEnd() int {
+	return max(l.Screen+screenWords, l.Keyboard+1)
+}
+
+// HeapEnd is the (exclusive) end of the heap, the first device.
+func (l memoryLayout) HeapEnd() int {
+	return min(l.Screen, l.Keyboard)
+}
+
+// layoutField is an address of a memoryLayout and its name in
+// --memory-layout.
+type layoutField struct {
+	name string
+	addr *int
+}
+
+func (l *memoryLayout) fields() []layoutField {
+	return []layoutField{
+		{"temp", &l.Temp}, {"static", &l.Static}, {"stack", &l.Stack},
+		{"heap", &l.Heap}, {"screen", &l.Screen}, {"keyboard", &l.Keyboard},
+		{"ram", &l.RAM},
+	}
+}
+
+// check fails on a layout whose regions overlap or are out of order: the
+// pointers, temp, the statics, the stack and the heap follow each other in
+// this order, the devices lying anywhere after the heap within the 32K
+// words an A-instruction addresses, and the RAM holding them all.
+func (l memoryLayout) check() error {
+	switch {
+	case l.Temp < 5:
+		return fmt.Errorf("temp at RAM[%d] overlaps the pointers SP to THAT in RAM[0..4]", l.Temp)
+	case l.Static < 16:
+		return fmt.Errorf("statics at RAM[%d] overlap the predefined registers R0-R15", l.Static)
+	case l.Temp+8 > l.Static:
+		return fmt.Errorf("temp RAM[%d..%d] runs into the statics at RAM[%d]", l.Temp, l.Temp+7, l.Static)
+	case l.Stack <= l.Static:
+		return fmt.Errorf("stack at RAM[%d] leaves no room for the statics at RAM[%d]", l.Stack, l.Static)
+	case l.Heap <= l.Stack:
+		return fmt.Errorf("heap at RAM[%d] leaves no room for the stack at RAM[%d]", l.Heap, l.Stack)
+	case l.HeapEnd() <= l.Heap:
+		return fmt.Errorf("the devices must lie above the heap at RAM[%d]", l.Heap)
+	case l.Keyboard >= l.Screen && l.Keyboard < l.Screen+screenWords:
+		return fmt.Errorf("keyboard at RAM[%d] overlaps the screen RAM[%d..%d]", l.Keyboard, l.Screen, l.Screen+screenWords-1)
+	case l.devicesEnd() > 32768:
+		return fmt.Errorf("the devices run past RAM[32767], the last address of an A-instruction")
+	case l.RAM > 65536:
+		return fmt.Errorf("RAM of %d words larger than the 64K words the A register addresses", l.RAM)
+	case l.RAM > 0 && l.RAM < l.devicesEnd():
+		return fmt.Errorf("RAM of %d words too small for the devices, which end at RAM[%d]", l.RAM, l.devicesEnd()-1)
+	}
+	return nil
+}
+
+// layoutFlag is the --memory-layout flag setting layout, or with a name
+// the flag setting that address alone, --ram-size.
+type layoutFlag struct{ name string }
+
+func (f layoutFlag) String() string {
+	items := []string{}
+	for _, lf := range layout.fields() {
+		if f.name == "" && *lf.addr != 0 || lf.name == f.name {
+			items = append(items, fmt.Sprintf("%s=%d", lf.name, *lf.addr))
+		}
+	}
+	if f.name != "" {
+		_, v, _ := strings.Cut(items[0], "=")
+		return v
+	}
+	return strings.Join(items, ",")
+}
+
+func (f layoutFlag) Set(v string) error {
+	if f.name != "" {
+		v = f.name + "=" + v
+	}
+	l, err := parseLayout(v)
+	if err != nil {
+		return err
+	}
+	layout = l
+	return nil
+}
+
+func registerLayoutFlag(fs *flag.FlagSet) {
+	fs.Var(layoutFlag{}, "memory-layout", "memory map of the target platform, comma separated NAME=ADDRESS (temp, static, stack, heap, screen, keyboard, ram; e.g. stack=512,heap=4096) or a JSON file of them, the others keeping their standard address")
+	fs.Var(layoutFlag{"ram"}, "ram-size", "number of words of the RAM of the target platform (e.g. 32768), 0 for a RAM up to the last device")
+}
+
+// parseLayout parses the value of --memory-layout: NAME=ADDRESS items, or
+// the name of a JSON file holding an object of them. The addresses not
+// given keep the value they have.
+func parseLayout(spec string) (memoryLayout, error) {
+	l := layout
+	if !strings.Contains(spec, "=") {
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return l, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&l); err != nil {
+			return l, fmt.Errorf("%s: %w", spec, err)
+		}
+		return l, l.check()
+	}
+	for _, item := range strings.Split(spec, ",") {
+		name, value, _ := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		var addr *int
+		for _, f := range l.fields() {
+			if f.name == name {
+				addr = f.addr
+			}
+		}
+		if addr == nil {
+			return l, fmt.Errorf("unknown address %q, expected temp, static, stack, heap, screen, keyboard or ram", name)
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 0, 32)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid address %q of %s", strings.TrimSpace(value), name)
+		}
+		*addr = int(n)
+	}
+	return l, l.check()
+}
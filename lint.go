@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// lintProgram is the parsed program the lint rules run on.
+type lintProgram struct {
+	Lines        []sourceLine
+	Instructions []*Instruction
+	// Function is the name of the function each command belongs to, ""
+	// before the first function declaration
+	Function []string
+	// Defined maps every function declared in the program to its index
+	Defined map[string]int
+	// External holds the functions of the bundled OS, callable without
+	// being defined
+	External map[string]bool
+}
+
+type lintFinding struct {
+	Index int // command the finding is about
+	Rule  string
+	Msg   string
+}
+
+type lintRule struct {
+	Name  string
+	Doc   string
+	Check func(p *lintProgram) []lintFinding
+}
+
+var lintRules = []lintRule{
+	{"undefined-label", "goto/if-goto targets a label not defined in the same function", lintUndefinedLabels},
+	{"duplicate-label", "a label defined twice in the same function", lintDuplicateLabels},
+	{"duplicate-function", "a function declared twice", lintDuplicateFunctions},
+	{"undefined-function", "call targets a function neither defined nor part of the bundled OS", lintUndefinedFunctions},
+	{"arity-mismatch", "a function is called with different numbers of arguments", lintArity},
+	{"stack-balance", "paths through a function underflowing its stack, or returning with other than one value on it", lintStackBalance},
+	{"unused-static", "static variables written but never read, or read but never written", lintStatics},
+	{"argument-count", "a call passes fewer arguments than the called function uses", lintArgumentCount},
+	{"unreachable", "commands no path from their function entry reaches", lintUnreachable},
+	{"nonstandard-name", "function names not of the form Class.name matching their file", lintNames},
+}
+
+// lintConfig is the content of the lint configuration file.
+type lintConfig struct {
+	Disable []string `json:"disable"`
+	Enable  []string `json:"enable"`
+}
+
+const defaultLintConfig = ".vmlint.json"
+
+// runLint implements the lint subcommand, reporting the findings of the
+// enabled rules without generating code. It exits with status 1 when
+// anything is found and 2 when the sources cannot be read or parsed.
+func runLint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	var enable, disable stringsFlag
+	configFile := fs.String("config", "", "JSON configuration file with \"enable\" and \"disable\" rule lists (defaults to "+defaultLintConfig+" when present)")
+	fs.Var(&enable, "enable", "comma separated rules to enable, can be repeated")
+	fs.Var(&disable, "disable", "comma separated rules to disable, can be repeated")
+	listRules := fs.Bool("rules", false, "list the available rules and exit")
+	fs.BoolVar(&extendedMode, "ext", false, "accept the extended VM commands")
+	fs.StringVar(&pluginCommand, "plugin", "", "command line of a plugin process parsing the commands and segments the translator does not know")
+	unusedSuppressions := fs.Bool("unused-suppressions", false, "also report the vm:ignore comments suppressing nothing or naming unknown rules (rule unused-suppression)")
+	format := fs.String("format", "text", "how the findings are reported: text (a file:line: message (rule) line each) or sarif (a SARIF log on stdout, with the parse errors and the static variable collisions, the other messages going to stderr)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: lint [flags] path ...")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if *format != "text" && *format != "sarif" {
+		fmt.Printf("Unknown format %q\n", *format)
+		os.Exit(2)
+	}
+	stdout := os.Stdout
+	if *format == "sarif" {
+		os.Stdout = os.Stderr
+	}
+
+	if *listRules {
+		for _, r := range lintRules {
+			fmt.Printf("%-20s %s\n", r.Name, r.Doc)
+		}
+		return
+	}
+	if fs.NArg() == 0 {
+		fmt.Println("No source file provided")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	enabled := map[string]bool{}
+	for _, r := range lintRules {
+		enabled[r.Name] = true
+	}
+	cfg, err := readLintConfig(*configFile)
+	if err != nil {
+		fmt.Println("Error reading lint configuration", err)
+		os.Exit(2)
+	}
+	apply := func(names []string, on bool) {
+		if err := setLintRules(enabled, names, on); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	apply(cfg.Disable, false)
+	apply(cfg.Enable, true)
+	apply(disable, false)
+	apply(enable, true)
+
+	paths, err := resolveSources(fs.Args(), nil)
+	if err != nil {
+		fmt.Println("Error resolving source files", err)
+		os.Exit(2)
+	}
+	prog, parseErrs, err := loadLintProgram(paths)
+	if err != nil {
+		fmt.Println("Error", err)
+		os.Exit(2)
+	}
+	lint := func() []lintFinding {
+		findings := runLintRules(prog, enabled)
+		if *unusedSuppressions {
+			findings = append(findings, lintUnusedSuppressions(prog, enabled)...)
+			sort.SliceStable(findings, func(a, b int) bool {
+				return findings[a].Index < findings[b].Index
+			})
+		}
+		return findings
+	}
+	if *format == "sarif" {
+		// the parse errors are reported with the findings of the commands
+		// that parse
+		findings := lint()
+		if err := writeSARIF(stdout, lintSARIF(prog, parseErrs, findings)); err != nil {
+			fmt.Println("Error writing the SARIF log", err)
+			os.Exit(2)
+		}
+		switch {
+		case len(parseErrs) > 0:
+			os.Exit(2)
+		case len(findings) > 0:
+			os.Exit(1)
+		}
+		return
+	}
+	if len(parseErrs) > 0 {
+		for _, e := range parseErrs {
+			fmt.Println("Error parsing instruction", e)
+		}
+		os.Exit(2)
+	}
+
+	findings := lint()
+	for _, f := range findings {
+		fmt.Printf("%s: %s (%s)\n", prog.Lines[f.Index].Pos(), f.Msg, f.Rule)
+	}
+	if len(findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// setLintRules turns the rules of the comma separated lists on or off.
+func setLintRules(enabled map[string]bool, lists []string, on bool) error {
+	for _, list := range lists {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := enabled[name]; !ok {
+				return fmt.Errorf("Unknown lint rule %q", name)
+			}
+			enabled[name] = on
+		}
+	}
+	return nil
+}
+
+// readLintConfig reads the configuration file, the default one being
+// optional.
+func readLintConfig(path string) (*lintConfig, error) {
+	cfg := &lintConfig{}
+	if path == "" {
+		path = defaultLintConfig
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return cfg, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// loadLintProgram reads and parses the sources in the given order.
+func loadLintProgram(paths []string) (*lintProgram, []lineError, error) {
+	pp := newPreprocessor()
+	opened := newSourceFiles()
+	defer opened.Close()
+	for _, path := range paths {
+		if pp.included[sourceKey(path)] {
+			continue
+		}
+		f, err := opened.open(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening source file %s: %w", path, err)
+		}
+		data, err := f.ReadFile()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading source file: %w", err)
+		}
+		if err := pp.readSource(f, data, nil); err != nil {
+			return nil, nil, fmt.Errorf("reading source: %w", err)
+		}
+	}
+	prog, errs := newLintProgram(pp.lines)
+	return prog, errs, nil
+}
+
+// lineError is an error about one source line.
+type lineError struct {
+	Line sourceLine
+	Err  error
+}
+
+func (le lineError) Error() string {
+	return fmt.Sprintf("%s: %s", le.Line.PosOf(le.Err), le.Err)
+}
+
+// newLintProgram parses lines, leaving out and returning the lines that
+// fail to parse.
+func newLintProgram(lines []sourceLine) (*lintProgram, []lineError) {
+	prog := &lintProgram{
+		Defined:  map[string]int{},
+		External: bundledOSFunctions(),
+	}
+	errs := []lineError{}
+	function := ""
+	for _, sl := range lines {
+		i := len(prog.Instructions)
+		inst, err := parseInstruction(i, sl.StaticPrefix(), sl.Text)
+		if err != nil {
+			errs = append(errs, lineError{sl, err})
+			continue
+		}
+		if inst.CommandType == CommandTypeFunction {
+			function = inst.Arg1
+			if _, ok := prog.Defined[function]; !ok {
+				prog.Defined[function] = i
+			}
+		}
+		inst.Function = function
+		prog.Lines = append(prog.Lines, sl)
+		prog.Instructions = append(prog.Instructions, inst)
+		prog.Function = append(prog.Function, function)
+	}
+	return prog, errs
+}
+
+// bundledOSFunctions returns the names of the functions the bundled OS
+// defines.
+func bundledOSFunctions() map[string]bool {
+	names := map[string]bool{}
+	osSources, err := openOSSources(nil)
+	if err != nil {
+		// the OS is embedded, reading it cannot fail
+		panic(err)
+	}
+	for _, src := range osSources {
+		data, err := src.ReadFile()
+		if err != nil {
+			panic(err)
+		}
+		scanner := newLineScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(removeCommentsAndSpaces(scanner.Text()))
+			if len(fields) == 3 && fields[0] == "function" {
+				names[fields[1]] = true
+			}
+		}
+	}
+	return names
+}
+
+// runLintRules returns the findings of the enabled rules in source order,
+// but for those the vm:ignore comments of their lines suppress.
+func runLintRules(prog *lintProgram, enabled map[string]bool) []lintFinding {
+	findings := []lintFinding{}
+	for _, r := range lintRules {
+		if !enabled[r.Name] {
+			continue
+		}
+		for _, f := range r.Check(prog) {
+			if s := suppressing(prog.Lines[f.Index], f.Rule); s != nil {
+				s.used[f.Rule] = true
+				continue
+			}
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(a, b int) bool {
+		return findings[a].Index < findings[b].Index
+	})
+	return findings
+}
+
+// suppression is a // vm:ignore comment, written after a command or alone
+// on the line above it, silencing the findings of the rules it names on
+// that command, of all of them when it names none:
+//
+//	pop static 0 // vm:ignore unused-static,stack-balance kept for the tests
+type suppression struct {
+	Pos   string   // file:line of the comment
+	Rules []string // the rules suppressed, all when empty
+	// used records the rules a finding was suppressed of
+	used map[string]bool
+}
+
+// parseSuppression parses a // comment, returning the suppression it is
+// or nil. The rules are the comma separated word after vm:ignore, the
+// rest of the comment being free to say why.
+func parseSuppression(comment, pos string) *suppression {
+	fields := strings.Fields(strings.TrimPrefix(comment, "//"))
+	if len(fields) == 0 || fields[0] != "vm:ignore" {
+		return nil
+	}
+	s := &suppression{Pos: pos, used: map[string]bool{}}
+	if len(fields) > 1 {
+		for _, name := range strings.Split(fields[1], ",") {
+			if name != "" {
+				s.Rules = append(s.Rules, name)
+			}
+		}
+	}
+	return s
+}
+
+// suppressing returns the first vm:ignore comment of sl suppressing rule,
+// nil when there is none.
+func suppressing(sl sourceLine, rule string) *suppression {
+	for _, s := range sl.Ignore {
+		if len(s.Rules) == 0 || slices.Contains(s.Rules, rule) {
+			return s
+		}
+	}
+	return nil
+}
+
+// lintUnusedSuppressions reports the vm:ignore comments naming unknown
+// rules or suppressing nothing, once runLintRules has run. A comment of a
+// disabled rule cannot be told unused and is left alone, and so is one
+// naming no rule when any is disabled.
+func lintUnusedSuppressions(p *lintProgram, enabled map[string]bool) []lintFinding {
+	allOn := true
+	for _, r := range lintRules {
+		allOn = allOn && enabled[r.Name]
+	}
+	findings := []lintFinding{}
+	seen := map[*suppression]bool{}
+	for i, sl := range p.Lines {
+		for _, s := range sl.Ignore {
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			where := ""
+			if s.Pos != fmt.Sprintf("%s:%d", sl.File, sl.Line) {
+				where = " at " + s.Pos
+			}
+			if len(s.Rules) == 0 && len(s.used) == 0 && allOn {
+				findings = append(findings, lintFinding{i, "unused-suppression", "vm:ignore" + where + " suppresses nothing"})
+			}
+			for _, name := range s.Rules {
+				on, known := enabled[name]
+				switch {
+				case !known:
+					findings = append(findings, lintFinding{i, "unused-suppression", fmt.Sprintf("vm:ignore%s names unknown rule %q", where, name)})
+				case on && !s.used[name]:
+					findings = append(findings, lintFinding{i, "unused-suppression", fmt.Sprintf("vm:ignore%s suppresses no %s finding", where, name)})
+				}
+			}
+		}
+	}
+	return findings
+}
+
+func lintUndefinedLabels(p *lintProgram) []lintFinding {
+	labels := map[string]map[string]bool{}
+	owner := map[string]string{}
+	for i, inst := range p.Instructions {
+		if inst.CommandType != CommandTypeLabel {
+			continue
+		}
+		fn := p.Function[i]
+		if labels[fn] == nil {
+			labels[fn] = map[string]bool{}
+		}
+		labels[fn][inst.Arg1] = true
+		if _, ok := owner[inst.Arg1]; !ok {
+			owner[inst.Arg1] = fn
+		}
+	}
+	findings := []lintFinding{}
+	for i, inst := range p.Instructions {
+		if inst.CommandType != CommandTypeGOTO && inst.CommandType != CommandTypeIf {
+			continue
+		}
+		fn := p.Function[i]
+		if labels[fn][inst.Arg1] {
+			continue
+		}
+		msg := fmt.Sprintf("undefined label %s", inst.Arg1)
+		if other, ok := owner[inst.Arg1]; ok {
+			msg = fmt.Sprintf("label %s is defined in %s, not in %s", inst.Arg1, describeFunction(other), describeFunction(fn))
+		}
+		findings = append(findings, lintFinding{i, "undefined-label", msg})
+	}
+	return findings
+}
+
+func describeFunction(name string) string {
+	if name == "" {
+		return "the code before the first function"
+	}
+	return "function " + name
+}
+
+func lintDuplicateLabels(p *lintProgram) []lintFinding {
+	return duplicateLabels(p.Lines, p.Instructions)
+}
+
+// duplicateLabels finds the label commands defining a label an earlier one
+// of the same function already defines, the translation failing on the
+// first of them. The labels of different functions are apart in the
+// assembly, being scoped by their function.
+func duplicateLabels(lines []sourceLine, instructions []*Instruction) []lintFinding {
+	first := map[string]int{}
+	findings := []lintFinding{}
+	for i, inst := range instructions {
+		if inst.CommandType != CommandTypeLabel {
+			continue
+		}
+		k, ok := first[inst.labelSymbol()]
+		if !ok {
+			first[inst.labelSymbol()] = i
+			continue
+		}
+		findings = append(findings, lintFinding{i, "duplicate-label", fmt.Sprintf("label %s already defined in %s at %s", inst.Arg1, describeFunction(inst.Function), lines[k].Pos())})
+	}
+	return findings
+}
+
+func lintDuplicateFunctions(p *lintProgram) []lintFinding {
+	return duplicateFunctions(p.Lines, p.Instructions)
+}
+
+// duplicateFunctions finds the function commands declaring a function an
+// earlier one already declares, the translation failing on the first of
+// them.
+func duplicateFunctions(lines []sourceLine, instructions []*Instruction) []lintFinding {
+	first := map[string]int{}
+	findings := []lintFinding{}
+	for i, inst := range instructions {
+		if inst.CommandType != CommandTypeFunction {
+			continue
+		}
+		k, ok := first[inst.Arg1]
+		if !ok {
+			first[inst.Arg1] = i
+			continue
+		}
+		findings = append(findings, lintFinding{i, "duplicate-function", fmt.Sprintf("function %s already declared at %s", inst.Arg1, lines[k].Pos())})
+	}
+	return findings
+}
+
+func lintUndefinedFunctions(p *lintProgram) []lintFinding {
+	findings := []lintFinding{}
+	for i, inst := range p.Instructions {
+		if inst.CommandType != CommandTypeCall {
+			continue
+		}
+		if _, ok := p.Defined[inst.Arg1]; ok || p.External[inst.Arg1] {
+			continue
+		}
+		findings = append(findings, lintFinding{i, "undefined-function", fmt.Sprintf("call to undefined function %s", inst.Arg1)})
+	}
+	return findings
+}
+
+func lintArity(p *lintProgram) []lintFinding {
+	first := map[string]int{}
+	findings := []lintFinding{}
+	for i, inst := range p.Instructions {
+		if inst.CommandType != CommandTypeCall {
+			continue
+		}
+		k, ok := first[inst.Arg1]
+		if !ok {
+			first[inst.Arg1] = i
+			continue
+		}
+		if nArgs := p.Instructions[k].Arg2Val; inst.Arg2Val != nArgs {
+			findings = append(findings, lintFinding{i, "arity-mismatch", fmt.Sprintf(
+				"%s called with %d arguments, but with %d at %s", inst.Arg1, inst.Arg2Val, nArgs, p.Lines[k].Pos())})
+		}
+	}
+	return findings
+}
+
+// lintArgumentCount checks the calls against the highest argument the
+// called function accesses. Reading past the arguments reads the frame
+// saved by call, and writing there corrupts the return address or the
+// caller's segment pointers.
+func lintArgumentCount(p *lintProgram) []lintFinding {
+	// highest argument index used by every function and where
+	used := map[string]int{}
+	for i, inst := range p.Instructions {
+		if inst.SegmentType != SegmentTypeArgument || inst.CommandType != CommandTypePush && inst.CommandType != CommandTypePop {
+			continue
+		}
+		fn := p.Function[i]
+		if k, ok := used[fn]; fn != "" && (!ok || inst.Arg2Val > p.Instructions[k].Arg2Val) {
+			used[fn] = i
+		}
+	}
+	findings := []lintFinding{}
+	for i, inst := range p.Instructions {
+		if inst.CommandType != CommandTypeCall {
+			continue
+		}
+		k, ok := used[inst.Arg1]
+		if !ok || inst.Arg2Val > p.Instructions[k].Arg2Val {
+			continue
+		}
+		access := "reads"
+		if p.Instructions[k].CommandType == CommandTypePop {
+			access = "writes"
+		}
+		findings = append(findings, lintFinding{i, "argument-count", fmt.Sprintf(
+			"%s called with %s, but it %s argument %d at %s", inst.Arg1, plural(inst.Arg2Val, "argument"), access, p.Instructions[k].Arg2Val, p.Lines[k].Pos())})
+	}
+	return findings
+}
+
+// lintStackBalance follows every path through each function, checking
+// that its working stack never underflows, that the paths joining at a
+// label agree on its height and that one value, the result, is left
+// when it returns.
+func lintStackBalance(p *lintProgram) []lintFinding {
+	findings := []lintFinding{}
+	for _, g := range buildCFGs(p.Instructions) {
+		heights := make([]int, len(g.Blocks))
+		for k := range heights {
+			heights[k] = unreachedHeight
+		}
+		reported := map[int]bool{}
+		report := func(i int, format string, args ...any) {
+			if !reported[i] {
+				reported[i] = true
+				findings = append(findings, lintFinding{i, "stack-balance", fmt.Sprintf(format, args...)})
+			}
+		}
+		if len(g.Blocks) > 0 {
+			heights[0] = 0
+		}
+		work := []int{0}
+		for len(work) > 0 && len(g.Blocks) > 0 {
+			id := work[0]
+			work = work[1:]
+			b := g.Blocks[id]
+			h := heights[id]
+			for i := b.Start; i < b.End; i++ {
+				inst := p.Instructions[i]
+				if inst.CommandType == CommandTypeReturn {
+					if g.Function != "" && h != 1 {
+						report(i, "%s returns with %s on the stack, expected 1", g.Function, plural(h, "value"))
+					}
+					break
+				}
+				pops, pushes := stackEffect(inst)
+				if h < pops {
+					report(i, "stack underflow: %s pops %d but the stack holds %d", inst.Line, pops, h)
+					h = pops
+				}
+				h += pushes - pops
+			}
+			for _, s := range b.Succs {
+				switch heights[s] {
+				case unreachedHeight:
+					heights[s] = h
+					work = append(work, s)
+				case h:
+				default:
+					report(g.Blocks[s].Start, "the stack holds %d values on one path to here and %d on another", heights[s], h)
+				}
+			}
+		}
+	}
+	return findings
+}
+
+func lintStatics(p *lintProgram) []lintFinding {
+	type staticUse struct {
+		read, write int // first push and pop, -1 for none
+		init        bool
+	}
+	uses := map[string]*staticUse{}
+	symbols := []string{}
+	for i, inst := range p.Instructions {
+		sym, ok := staticSymbol(inst)
+		if !ok {
+			continue
+		}
+		u, ok := uses[sym]
+		if !ok {
+			u = &staticUse{read: -1, write: -1}
+			uses[sym] = u
+			symbols = append(symbols, sym)
+		}
+		switch {
+		case inst.CommandType == CommandTypeStaticInit:
+			u.init = true
+		case inst.CommandType == CommandTypePush && u.read < 0:
+			u.read = i
+		case inst.CommandType == CommandTypePop && u.write < 0:
+			u.write = i
+		}
+	}
+	findings := []lintFinding{}
+	for _, sym := range symbols {
+		u := uses[sym]
+		switch {
+		case u.read < 0 && u.write >= 0:
+			findings = append(findings, lintFinding{u.write, "unused-static", fmt.Sprintf("static %s is written but never read", sym)})
+		case u.read >= 0 && u.write < 0 && !u.init:
+			findings = append(findings, lintFinding{u.read, "unused-static", fmt.Sprintf("static %s is read but never written, it is always 0", sym)})
+		}
+	}
+	return findings
+}
+
+func lintUnreachable(p *lintProgram) []lintFinding {
+	findings := []lintFinding{}
+	for _, g := range buildCFGs(p.Instructions) {
+		for k, b := range g.Blocks {
+			// report a run of unreachable blocks once
+			if b.Reachable || k > 0 && !g.Blocks[k-1].Reachable {
+				continue
+			}
+			for i := b.Start; i < b.End; i++ {
+				if ct := p.Instructions[i].CommandType; ct != CommandTypeLabel && ct != CommandTypeStaticInit {
+					findings = append(findings, lintFinding{i, "unreachable", "unreachable code"})
+					break
+				}
+			}
+		}
+	}
+	return findings
+}
+
+var (
+	functionNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\.[A-Za-z_][A-Za-z0-9_]*$`)
+	// hackSymbolRe are the symbols of Hack assembly, the names functions
+	// and labels are parsed with
+	hackSymbolRe = regexp.MustCompile(`^[A-Za-z_.$:][A-Za-z0-9_.$:]*$`)
+	// generatedSuffixRe is the $ and digit that only the labels the
+	// translator generates have, see generatedLabel
+	generatedSuffixRe = regexp.MustCompile(`\$[0-9]`)
+)
+
+func lintNames(p *lintProgram) []lintFinding {
+	findings := []lintFinding{}
+	for i, inst := range p.Instructions {
+		switch inst.CommandType {
+		case CommandTypeFunction:
+			if !functionNameRe.MatchString(inst.Arg1) {
+				findings = append(findings, lintFinding{i, "nonstandard-name", fmt.Sprintf("function name %s is not of the form Class.name", inst.Arg1)})
+				continue
+			}
+			class, _, _ := strings.Cut(inst.Arg1, ".")
+			if file := p.Lines[i].FileName(); class != file {
+				findings = append(findings, lintFinding{i, "nonstandard-name", fmt.Sprintf("function %s is defined in %s.vm, expected class %s", inst.Arg1, file, file)})
+			}
+		}
+	}
+	return findings
+}
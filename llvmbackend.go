@@ -0,0 +1,553 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// llvmBackend generates textual LLVM IR running the program, laid out
+// like the C of cBackend: the RAM is a global array of i16 words, the
+// commands the blocks of a single function, the values they pop and push
+// loads and stores of RAM, and the state a return passes to the
+// dispatching of the return points an alloca. The IR is left for LLVM to
+// optimize, so that its output can be compared with the translation's.
+//
+// It uses typed pointers, which LLVM 14 reads and the later versions read
+// as opaque ones. Its main takes the arguments of the C program.
+type llvmBackend struct{}
+
+func (llvmBackend) Ext() string { return ".ll" }
+
+func (llvmBackend) Comment(text string) string { return "; " + text }
+
+// llvmRAMType is the type of the @ram global.
+func llvmRAMType() string {
+	return fmt.Sprintf("[%d x i16]", layout.RAMSize())
+}
+
+// llvmRAM is the constant pointer to the RAM word at addr.
+func llvmRAM(addr int) string {
+	return fmt.Sprintf("getelementptr inbounds (%s, %s* @ram, i64 0, i64 %d)", llvmRAMType(), llvmRAMType(), addr)
+}
+
+// llvmPrelude declares the machine the program runs on, and the C library
+// functions it calls.
+func llvmPrelude() []string {
+	return []string{
+		"@ram = internal global " + llvmRAMType() + " zeroinitializer",
+		"",
+		"declare i32 @dprintf(i32, i8*, ...)",
+		"declare i32 @printf(i8*, ...)",
+		"declare i32 @sscanf(i8*, i8*, ...)",
+		"declare void @exit(i32) noreturn",
+		"",
+		"; @fail prints the message msg on stderr and stops the program.",
+		"define internal void @fail(i8* %msg) noreturn {",
+		"  call i32 (i32, i8*, ...) @dprintf(i32 2, i8* " + llvmFormat("line") + ", i8* %msg)",
+		"  call void @exit(i32 1)",
+		"  unreachable",
+		"}",
+		"",
+		"; @m returns the RAM word at addr, stopping the program outside of it.",
+		"define internal i16* @m(i64 %addr) {",
+		"  %in = icmp ult i64 %addr, " + fmt.Sprint(layout.RAMSize()),
+		"  br i1 %in, label %ok, label %out",
+		"ok:",
+		"  %p = getelementptr inbounds " + llvmRAMType() + ", " + llvmRAMType() + "* @ram, i64 0, i64 %addr",
+		"  ret i16* %p",
+		"out:",
+		"  call i32 (i32, i8*, ...) @dprintf(i32 2, i8* " + llvmFormat("oob") + ", i64 %addr)",
+		"  call void @exit(i32 1)",
+		"  unreachable",
+		"}",
+		"",
+		"; @reg returns the address held by the pointer register r.",
+		"define internal i64 @reg(i64 %r) {",
+		"  %p = getelementptr inbounds " + llvmRAMType() + ", " + llvmRAMType() + "* @ram, i64 0, i64 %r",
+		"  %v = load i16, i16* %p",
+		"  %a = zext i16 %v to i64",
+		"  ret i64 %a",
+		"}",
+		"",
+		"define internal void @push(i16 %v) {",
+		"  %sp = call i64 @reg(i64 0)",
+		"  %p = call i16* @m(i64 %sp)",
+		"  store i16 %v, i16* %p",
+		"  %sp1 = add i64 %sp, 1",
+		"  %w = trunc i64 %sp1 to i16",
+		"  store i16 %w, i16* " + llvmRAM(0),
+		"  ret void",
+		"}",
+		"",
+		"define internal i16 @pop() {",
+		"  %sp = call i64 @reg(i64 0)",
+		"  %sp1 = sub i64 %sp, 1",
+		"  %w = trunc i64 %sp1 to i16",
+		"  store i16 %w, i16* " + llvmRAM(0),
+		"  %p = call i16* @m(i64 %sp1)",
+		"  %v = load i16, i16* %p",
+		"  ret i16 %v",
+		"}",
+		"",
+		"; @div and @mod divide like the runtime subroutines: by zero yields 0",
+		"; and x, and the quotient of -32768 by -1 wraps.",
+		"define internal i16 @div(i16 %x, i16 %y) {",
+		"  %zero = icmp eq i16 %y, 0",
+		"  br i1 %zero, label %done, label %nonzero",
+		"nonzero:",
+		"  %minus = icmp eq i16 %y, -1",
+		"  br i1 %minus, label %neg, label %divide",
+		"neg:",
+		"  %n = sub i16 0, %x",
+		"  ret i16 %n",
+		"divide:",
+		"  %q = sdiv i16 %x, %y",
+		"  ret i16 %q",
+		"done:",
+		"  ret i16 0",
+		"}",
+		"",
+		"define internal i16 @mod(i16 %x, i16 %y) {",
+		"  %zero = icmp eq i16 %y, 0",
+		"  br i1 %zero, label %done, label %nonzero",
+		"nonzero:",
+		"  %minus = icmp eq i16 %y, -1",
+		"  br i1 %minus, label %wrap, label %divide",
+		"wrap:",
+		"  ret i16 0",
+		"divide:",
+		"  %r = srem i16 %x, %y",
+		"  ret i16 %r",
+		"done:",
+		"  ret i16 %x",
+		"}",
+	}
+}
+
+// llvmMain runs the program between the arguments setting and printing
+// RAM, ADDR=VALUE and ADDR like the C program.
+func llvmMain() []string {
+	return []string{
+		"define i32 @main(i32 %argc, i8** %argv) {",
+		"entry:",
+		"  %a = alloca i64",
+		"  %v = alloca i64",
+		"  %printed = alloca i1",
+		"  store i1 false, i1* %printed",
+		"  br label %set",
+		"set:",
+		"  %k = phi i32 [ 1, %entry ], [ %k1, %set.next ]",
+		"  %more = icmp slt i32 %k, %argc",
+		"  br i1 %more, label %set.arg, label %run",
+		"set.arg:",
+		"  %ap = getelementptr inbounds i8*, i8** %argv, i32 %k",
+		"  %arg = load i8*, i8** %ap",
+		"  %n = call i32 (i8*, i8*, ...) @sscanf(i8* %arg, i8* " + llvmFormat("arg") + ", i64* %a, i64* %v)",
+		"  %assign = icmp eq i32 %n, 2",
+		"  br i1 %assign, label %set.store, label %set.check",
+		"set.store:",
+		"  %addr = load i64, i64* %a",
+		"  %p = call i16* @m(i64 %addr)",
+		"  %value = load i64, i64* %v",
+		"  %word = trunc i64 %value to i16",
+		"  store i16 %word, i16* %p",
+		"  br label %set.next",
+		"set.check:",
+		"  %valid = icmp eq i32 %n, 1",
+		"  br i1 %valid, label %set.next, label %usage",
+		"set.next:",
+		"  %k1 = add i32 %k, 1",
+		"  br label %set",
+		"usage:",
+		"  call i32 (i32, i8*, ...) @dprintf(i32 2, i8* " + llvmFormat("usage") + ")",
+		"  ret i32 2",
+		"run:",
+		"  call void @run()",
+		"  br label %print",
+		"print:",
+		"  %j = phi i32 [ 1, %run ], [ %j1, %print.next ]",
+		"  %left = icmp slt i32 %j, %argc",
+		"  br i1 %left, label %print.arg, label %stack",
+		"print.arg:",
+		"  %bp = getelementptr inbounds i8*, i8** %argv, i32 %j",
+		"  %barg = load i8*, i8** %bp",
+		"  %bn = call i32 (i8*, i8*, ...) @sscanf(i8* %barg, i8* " + llvmFormat("arg") + ", i64* %a, i64* %v)",
+		"  %show = icmp eq i32 %bn, 1",
+		"  br i1 %show, label %print.word, label %print.next",
+		"print.word:",
+		"  %paddr = load i64, i64* %a",
+		"  %pp = call i16* @m(i64 %paddr)",
+		"  %pw = load i16, i16* %pp",
+		"  %pv = sext i16 %pw to i32",
+		"  call i32 (i8*, ...) @printf(i8* " + llvmFormat("word") + ", i64 %paddr, i32 %pv)",
+		"  store i1 true, i1* %printed",
+		"  br label %print.next",
+		"print.next:",
+		"  %j1 = add i32 %j, 1",
+		"  br label %print",
+		"stack:",
+		"  %any = load i1, i1* %printed",
+		"  br i1 %any, label %done, label %stack.word",
+		"stack.word:",
+		fmt.Sprintf("  %%s = phi i64 [ %d, %%stack ], [ %%s1, %%stack.print ]", layout.Stack),
+		"  %sp = call i64 @reg(i64 0)",
+		"  %below = icmp ult i64 %s, %sp",
+		"  br i1 %below, label %stack.print, label %done",
+		"stack.print:",
+		"  %sptr = call i16* @m(i64 %s)",
+		"  %sw = load i16, i16* %sptr",
+		"  %sv = sext i16 %sw to i32",
+		"  call i32 (i8*, ...) @printf(i8* " + llvmFormat("word") + ", i64 %s, i32 %sv)",
+		"  %s1 = add i64 %s, 1",
+		"  br label %stack.word",
+		"done:",
+		"  ret i32 0",
+		"}",
+	}
+}
+
+// llvmFormats are the strings of the prelude and of main, @.fmt.<name>.
+var llvmFormats = [][2]string{
+	{"line", "%s\n"},
+	{"oob", "access to RAM[%lld] outside of memory\n"},
+	{"arg", "%lld=%lld"},
+	{"usage", "usage: program [ADDR=VALUE...] [ADDR...]\n"},
+	{"word", "RAM[%lld] = %d\n"},
+}
+
+// llvmString is the pointer to the first byte of the string constant
+// global holding s.
+func llvmString(global, s string) string {
+	return fmt.Sprintf("getelementptr ([%d x i8], [%d x i8]* %s, i64 0, i64 0)", len(s)+1, len(s)+1, global)
+}
+
+// llvmFormat is the pointer to the format name of llvmFormats.
+func llvmFormat(name string) string {
+	for _, f := range llvmFormats {
+		if f[0] == name {
+			return llvmString("@.fmt."+name, f[1])
+		}
+	}
+	panic("no format " + name)
+}
+
+// llvmStringConstant is the global holding s.
+func llvmStringConstant(global, s string) string {
+	return fmt.Sprintf("%s = private unnamed_addr constant [%d x i8] c\"%s\\00\"", global, len(s)+1, llvmEscape(s))
+}
+
+// llvmFunction builds the blocks of a function, starting a block for the
+// instructions following a terminator and branching to the blocks
+// following instructions that fall through.
+type llvmFunction struct {
+	lines      []string
+	temps      int
+	blocks     int
+	terminated bool
+}
+
+// tmp returns a new SSA value name.
+func (f *llvmFunction) tmp() string {
+	f.temps++
+	return fmt.Sprintf("%%t%d", f.temps)
+}
+
+func (f *llvmFunction) emit(format string, args ...any) {
+	if f.terminated {
+		f.blocks++
+		f.label(fmt.Sprintf("d%d", f.blocks))
+	}
+	f.lines = append(f.lines, "  "+fmt.Sprintf(format, args...))
+}
+
+// term emits a terminator, ending the block.
+func (f *llvmFunction) term(format string, args ...any) {
+	f.emit(format, args...)
+	f.terminated = true
+}
+
+func (f *llvmFunction) label(name string) {
+	if !f.terminated {
+		f.lines = append(f.lines, "  br label %"+name)
+	}
+	f.lines = append(f.lines, name+":")
+	f.terminated = false
+}
+
+func (f *llvmFunction) comment(text string) {
+	f.lines = append(f.lines, "  ; "+text)
+}
+
+func (be llvmBackend) Generate(tr *translation) ([]string, error) {
+	pl := newProgramLabels(tr)
+	statics, err := staticAddresses(tr)
+	if err != nil {
+		return nil, err
+	}
+	messages := []string{}
+	f := &llvmFunction{}
+	fail := func(format string, args ...any) {
+		messages = append(messages, fmt.Sprintf(format, args...))
+		f.emit("call void @fail(i8* %s)", llvmString(fmt.Sprintf("@.msg.%d", len(messages)-1), messages[len(messages)-1]))
+		f.term("unreachable")
+	}
+	// store stores the word v in the RAM word at the constant address addr
+	store := func(v string, addr int) {
+		f.emit("store i16 %s, i16* %s", v, llvmRAM(addr))
+	}
+	load := func(addr int) string {
+		v := f.tmp()
+		f.emit("%s = load i16, i16* %s", v, llvmRAM(addr))
+		return v
+	}
+	returns := 0
+	call := func(fn string, nArgs int) {
+		if _, ok := pl.Functions[fn]; !ok {
+			fail("call of undefined function %s", fn)
+			return
+		}
+		f.emit("call void @push(i16 %d)", returns)
+		for addr := 1; addr <= 4; addr++ {
+			f.emit("call void @push(i16 %s)", load(addr))
+		}
+		sp, arg, word := f.tmp(), f.tmp(), f.tmp()
+		f.emit("%s = call i64 @reg(i64 0)", sp)
+		f.emit("%s = sub i64 %s, %d", arg, sp, callFrameSize+nArgs)
+		f.emit("%s = trunc i64 %s to i16", word, arg)
+		store(word, 2)
+		store(load(0), 1)
+		f.term("br label %%f%d", pl.Functions[fn])
+		f.label(fmt.Sprintf("r%d", returns))
+		returns++
+	}
+	usesReturn := false
+
+	f.lines = append(f.lines, "define internal void @run() {", "entry:", "  %ret = alloca i16")
+	inits := map[string]bool{}
+	for _, inst := range tr.Instructions {
+		if inst.CommandType == CommandTypeStaticInit && !inits[inst.Arg1] {
+			inits[inst.Arg1] = true
+			f.comment(inst.Line)
+			store(fmt.Sprint(int16(inst.Arg2Val)), statics[inst.Arg1])
+		}
+	}
+	if tr.Bootstrap != "" {
+		store(fmt.Sprint(layout.Stack), 0)
+		for range tr.EntryNArgs {
+			f.emit("call void @push(i16 0)")
+		}
+		f.comment(fmt.Sprintf("call %s %d", tr.Bootstrap, tr.EntryNArgs))
+		call(tr.Bootstrap, tr.EntryNArgs)
+		f.term("br label %%halt")
+	}
+
+	for k, inst := range tr.Instructions {
+		pos := tr.Commands[k].Pos()
+		switch inst.CommandType {
+		case CommandTypeStaticInit:
+			continue
+		case CommandTypeLabel:
+			if n, ok := pl.Labels[inst.labelSymbol()]; ok {
+				f.label(fmt.Sprintf("l%d", n))
+			}
+			continue
+		case CommandTypeFunction:
+			f.lines = append(f.lines, "")
+			if n, ok := pl.Functions[inst.Arg1]; ok {
+				f.comment(inst.Line)
+				f.label(fmt.Sprintf("f%d", n))
+			} else {
+				f.comment(inst.Line + " (never called)")
+			}
+			for range inst.Arg2Val {
+				f.emit("call void @push(i16 0)")
+			}
+			continue
+		}
+		f.comment(inst.Line)
+		switch inst.CommandType {
+		case CommandTypeArithmetic:
+			x, y, r := "", f.tmp(), f.tmp()
+			f.emit("%s = call i16 @pop()", y)
+			if !slices.Contains([]ALType{ALTypeNeg, ALTypeNot, ALTypeShl, ALTypeShr}, inst.ALType) {
+				x = f.tmp()
+				f.emit("%s = call i16 @pop()", x)
+			}
+			switch inst.ALType {
+			case ALTypeNeg:
+				f.emit("%s = sub i16 0, %s", r, y)
+			case ALTypeNot:
+				f.emit("%s = xor i16 %s, -1", r, y)
+			case ALTypeShl:
+				f.emit("%s = shl i16 %s, 1", r, y)
+			case ALTypeShr:
+				f.emit("%s = ashr i16 %s, 1", r, y)
+			case ALTypeAdd, ALTypeSub, ALTypeAnd, ALTypeOr, ALTypeMult:
+				op := map[ALType]string{ALTypeAdd: "add", ALTypeSub: "sub", ALTypeAnd: "and", ALTypeOr: "or", ALTypeMult: "mul"}[inst.ALType]
+				f.emit("%s = %s i16 %s, %s", r, op, x, y)
+			case ALTypeEq, ALTypeGt, ALTypeLt:
+				c := f.tmp()
+				cond := map[ALType]string{ALTypeEq: "eq", ALTypeGt: "sgt", ALTypeLt: "slt"}[inst.ALType]
+				f.emit("%s = icmp %s i16 %s, %s", c, cond, x, y)
+				// true is -1
+				f.emit("%s = sext i1 %s to i16", r, c)
+			case ALTypeDiv, ALTypeMod:
+				f.emit("%s = call i16 @%s(i16 %s, i16 %s)", r, inst.ALType, x, y)
+			default:
+				return nil, fmt.Errorf("%s: %s is not supported by the llvm target", pos, inst.ALType)
+			}
+			f.emit("call void @push(i16 %s)", r)
+		case CommandTypePush, CommandTypePop:
+			ptr, err := llvmSegmentWord(f, inst, statics)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", pos, err)
+			}
+			v := f.tmp()
+			if inst.SegmentType == SegmentTypeConstant {
+				f.emit("call void @push(i16 %d)", int16(inst.Arg2Val))
+			} else if inst.CommandType == CommandTypePush {
+				f.emit("%s = load i16, i16* %s", v, ptr)
+				f.emit("call void @push(i16 %s)", v)
+			} else {
+				f.emit("%s = call i16 @pop()", v)
+				f.emit("store i16 %s, i16* %s", v, ptr)
+			}
+		case CommandTypeGOTO:
+			n, ok := pl.Labels[inst.labelSymbol()]
+			switch {
+			case endLoop(tr.Instructions, k):
+				f.term("br label %%halt")
+			case ok:
+				f.term("br label %%l%d", n)
+			default:
+				fail("jump to undefined label %s", inst.Arg1)
+			}
+		case CommandTypeIf:
+			v, c := f.tmp(), f.tmp()
+			f.emit("%s = call i16 @pop()", v)
+			f.emit("%s = icmp ne i16 %s, 0", c, v)
+			f.blocks++
+			next := fmt.Sprintf("d%d", f.blocks)
+			if n, ok := pl.Labels[inst.labelSymbol()]; ok {
+				f.term("br i1 %s, label %%l%d, label %%%s", c, n, next)
+			} else {
+				f.term("br i1 %s, label %%u%d, label %%%s", c, f.blocks, next)
+				f.label(fmt.Sprintf("u%d", f.blocks))
+				fail("jump to undefined label %s", inst.Arg1)
+			}
+			f.label(next)
+		case CommandTypeCall:
+			call(inst.Arg1, inst.Arg2Val)
+		case CommandTypeReturn:
+			usesReturn = true
+			frame, retAddr, retPtr, ret := f.tmp(), f.tmp(), f.tmp(), f.tmp()
+			f.emit("%s = call i64 @reg(i64 1)", frame)
+			f.emit("%s = sub i64 %s, %d", retAddr, frame, callFrameSize)
+			f.emit("%s = call i16* @m(i64 %s)", retPtr, retAddr)
+			f.emit("%s = load i16, i16* %s", ret, retPtr)
+			f.emit("store i16 %s, i16* %%ret", ret)
+			v, arg, argPtr, sp, spWord := f.tmp(), f.tmp(), f.tmp(), f.tmp(), f.tmp()
+			f.emit("%s = call i16 @pop()", v)
+			f.emit("%s = call i64 @reg(i64 2)", arg)
+			f.emit("%s = call i16* @m(i64 %s)", argPtr, arg)
+			f.emit("store i16 %s, i16* %s", v, argPtr)
+			f.emit("%s = add i64 %s, 1", sp, arg)
+			f.emit("%s = trunc i64 %s to i16", spWord, sp)
+			store(spWord, 0)
+			for k, seg := range []int{4, 3, 2, 1} {
+				addr, ptr, saved := f.tmp(), f.tmp(), f.tmp()
+				f.emit("%s = sub i64 %s, %d", addr, frame, k+1)
+				f.emit("%s = call i16* @m(i64 %s)", ptr, addr)
+				f.emit("%s = load i16, i16* %s", saved, ptr)
+				store(saved, seg)
+			}
+			f.term("br label %%dispatch")
+		default:
+			return nil, fmt.Errorf("%s: %s is not supported by the llvm target", pos, inst.CommandType)
+		}
+	}
+	if !f.terminated {
+		f.term("br label %%halt")
+	}
+	if usesReturn {
+		f.lines = append(f.lines, "", "  ; return jumps to the return point of the call")
+		f.label("dispatch")
+		r := f.tmp()
+		f.emit("%s = load i16, i16* %%ret", r)
+		cases := []string{}
+		for n := range returns {
+			cases = append(cases, fmt.Sprintf("i16 %d, label %%r%d", n, n))
+		}
+		f.term("switch i16 %s, label %%badret [ %s ]", r, strings.Join(cases, " "))
+		f.label("badret")
+		fail("return to an unknown address")
+	}
+	f.label("halt")
+	f.lines = append(f.lines, "  ret void", "}")
+
+	lines := []string{be.Comment("Compile with llc -O2 -relocation-model=pic Program.ll && cc -o program Program.s, or run with lli Program.ll [ADDR=VALUE...] [ADDR...]"), ""}
+	for _, f := range llvmFormats {
+		lines = append(lines, llvmStringConstant("@.fmt."+f[0], f[1]))
+	}
+	for k, msg := range messages {
+		lines = append(lines, llvmStringConstant(fmt.Sprintf("@.msg.%d", k), msg))
+	}
+	lines = append(lines, "")
+	lines = append(lines, llvmPrelude()...)
+	lines = append(lines, "")
+	lines = append(lines, f.lines...)
+	lines = append(lines, "")
+	lines = append(lines, llvmMain()...)
+	return lines, nil
+}
+
+// llvmSegmentRegs are the addresses of the registers pointing to the
+// segments.
+var llvmSegmentRegs = map[SegmentType]int{SegmentTypeLocal: 1, SegmentTypeArgument: 2, SegmentTypeThis: 3, SegmentTypeThat: 4}
+
+// llvmSegmentWord returns the pointer to the word a push or pop reads or
+// writes, "" for push constant.
+func llvmSegmentWord(f *llvmFunction, inst *Instruction, statics map[string]int) (string, error) {
+	i := inst.Arg2Val
+	switch inst.SegmentType {
+	case SegmentTypeConstant:
+		if inst.CommandType == CommandTypePop {
+			return "", fmt.Errorf("pop constant")
+		}
+		return "", nil
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		base, addr, ptr := f.tmp(), f.tmp(), f.tmp()
+		f.emit("%s = call i64 @reg(i64 %d)", base, llvmSegmentRegs[inst.SegmentType])
+		f.emit("%s = add i64 %s, %d", addr, base, i)
+		f.emit("%s = call i16* @m(i64 %s)", ptr, addr)
+		return ptr, nil
+	case SegmentTypeTemp:
+		if i > 7 {
+			return "", fmt.Errorf("temp %d out of range", i)
+		}
+		return llvmRAM(layout.Temp + i), nil
+	case SegmentTypePointer:
+		if i > 1 {
+			return "", fmt.Errorf("pointer %d out of range", i)
+		}
+		return llvmRAM(3 + i), nil
+	case SegmentTypeStatic:
+		sym, _ := staticSymbol(inst)
+		return llvmRAM(statics[sym]), nil
+	}
+	return "", fmt.Errorf("push %s is not supported by the llvm target", inst.SegmentType)
+}
+
+// llvmEscape escapes s for a c"..." string constant.
+func llvmEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c < ' ' || c > '~' || c == '"' || c == '\\' {
+			fmt.Fprintf(&b, "\\%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logger prints the status messages of the translation, set up by
+// --log-level and --log-format.
+var logger = slog.New(&plainHandler{out: ioStdout{}, level: slog.LevelInfo, mu: &sync.Mutex{}})
+
+// ioStdout writes to the os.Stdout of the time of the write, which is
+// stderr with --format=json.
+type ioStdout struct{}
+
+func (ioStdout) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+
+// levelTrace is the level of the generated assembly traced by -vv, below
+// debug.
+const levelTrace = slog.LevelDebug - 4
+
+// logLevels are the values of --log-level.
+var logLevels = map[string]slog.Level{
+	"trace": levelTrace,
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// newLogger returns the logger of a --log-level and a --log-format.
+func newLogger(out io.Writer, level, format string) (*slog.Logger, error) {
+	l, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("Invalid log level %q, expected trace, debug, info, warn or error", level)
+	}
+	switch format {
+	case "text":
+		return slog.New(&plainHandler{out: out, level: l, mu: &sync.Mutex{}}), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: l, ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == levelTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		}})), nil
+	}
+	return nil, fmt.Errorf("Invalid log format %q, expected text or json", format)
+}
+
+// plainHandler prints a record the way the translator always printed its
+// messages: the message followed by the values of its attributes, without
+// time or keys. Warnings start with "Warning:"; errors say what failed in
+// their message, followed by the source line they are about. Debug messages start with "Debug:" and keep the keys, as
+// they are mostly numbers, and trace messages are indented assembly lines.
+type plainHandler struct {
+	out   io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *plainHandler) Enabled(_ context.Context, l slog.Level) bool { return l >= h.level }
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level <= levelTrace:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		_, err := io.WriteString(h.out, "        "+r.Message+"\n")
+		return err
+	case r.Level == slog.LevelWarn:
+		b.WriteString(paint(ansiYellow, "Warning:") + " ")
+	case r.Level < slog.LevelInfo:
+		b.WriteString("Debug: ")
+	}
+	msg := r.Message
+	if r.Level >= slog.LevelError {
+		msg = paint(ansiRed, msg)
+	}
+	b.WriteString(msg)
+	values := []string{}
+	excerpts := []sourceExcerpt{}
+	value := func(a slog.Attr) bool {
+		if e, ok := a.Value.Any().(sourceExcerpt); ok {
+			excerpts = append(excerpts, e)
+		} else if r.Level < slog.LevelInfo {
+			values = append(values, a.String())
+		} else {
+			values = append(values, a.Value.String())
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		value(a)
+	}
+	r.Attrs(value)
+	if len(values) > 0 {
+		b.WriteString(": " + strings.Join(values, " "))
+	}
+	b.WriteString("\n")
+	for _, e := range excerpts {
+		b.WriteString(strings.Join(e.lines(), "\n") + "\n")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, b.String())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(c.attrs[:len(c.attrs):len(c.attrs)], attrs...)
+	return &c
+}
+
+// WithGroup is not needed by the messages of the translator, which keep
+// their attributes flat.
+func (h *plainHandler) WithGroup(string) slog.Handler { return h }
+
+// traceTranslation logs every command of tr with its classification and
+// the number of assembly lines generated for it, at debug level, and the
+// lines themselves at trace level.
+func traceTranslation(tr *translation) {
+	ctx := context.Background()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	generated := make([][]string, len(tr.Commands))
+	for k, line := range tr.Lines {
+		if o := tr.Origin[k]; o >= 0 {
+			generated[o] = append(generated[o], line)
+		}
+	}
+	for k, inst := range tr.Instructions {
+		attrs := []any{"pos", tr.Commands[k].Pos(), "type", inst.CommandType.String()}
+		switch inst.CommandType {
+		case CommandTypeArithmetic:
+			attrs = append(attrs, "op", inst.ALType.String())
+		case CommandTypePush, CommandTypePop:
+			attrs = append(attrs, "segment", inst.SegmentType.String())
+		}
+		attrs = append(attrs, "lines", len(generated[k]))
+		logger.Debug(inst.String(), attrs...)
+		for _, line := range generated[k] {
+			logger.Log(ctx, levelTrace, line, "pos", tr.Commands[k].Pos())
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// runLSP implements the lsp subcommand, a Language Server Protocol server
+// for vm sources speaking JSON-RPC over stdin/stdout.
+func runLSP(args []string) {
+	fs := flag.NewFlagSet("lsp", flag.ExitOnError)
+	fs.BoolVar(&extendedMode, "ext", false, "accept the extended VM commands")
+	prof := registerProfileFlags(fs, true)
+	parseFlags(fs, args)
+
+	stopProfiles := prof.start()
+	s := &lspServer{out: os.Stdout, docs: map[string]string{}}
+	if err := s.serve(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, "Error serving lsp", err)
+		os.Exit(1)
+	}
+	stopProfiles()
+}
+
+// lspServer keeps the documents open in the editor. A document is analyzed
+// together with the other vm files of its directory, like a directory
+// given to -s, the open documents taking precedence over the files on disk.
+type lspServer struct {
+	out  io.Writer
+	docs map[string]string // path -> text of the open documents
+}
+
+type lspMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *lspError       `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspDocumentSymbol struct {
+	Name           string              `json:"name"`
+	Kind           int                 `json:"kind"`
+	Range          lspRange            `json:"range"`
+	SelectionRange lspRange            `json:"selectionRange"`
+	Children       []lspDocumentSymbol `json:"children,omitempty"`
+}
+
+type lspTextDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	Position       lspPosition `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+	lspSymbolFunction  = 12
+	lspSymbolKey       = 20
+)
+
+func (s *lspServer) serve(in io.Reader) error {
+	r := bufio.NewReader(in)
+	for {
+		body, err := readLSPMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg := lspMessage{}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			s.send(lspMessage{Error: &lspError{-32700, err.Error()}})
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, rpcErr := s.handle(msg.Method, msg.Params)
+		if msg.ID == nil {
+			// notifications get no response
+			continue
+		}
+		if result == nil && rpcErr == nil {
+			result = json.RawMessage("null")
+		}
+		s.send(lspMessage{ID: msg.ID, Result: result, Error: rpcErr})
+	}
+}
+
+// readLSPMessage reads the body of the next message, framed by a
+// Content-Length header.
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("invalid Content-Length %q", v)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+func (s *lspServer) send(msg lspMessage) {
+	msg.JSONRPC = "2.0"
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) notify(method string, params any) {
+	raw, _ := json.Marshal(params)
+	s.send(lspMessage{Method: method, Params: raw})
+}
+
+func (s *lspServer) handle(method string, raw json.RawMessage) (any, *lspError) {
+	params := lspTextDocumentParams{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, &lspError{-32602, err.Error()}
+		}
+	}
+	path := uriToPath(params.TextDocument.URI)
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync": map[string]any{
+					"openClose": true,
+					"change":    1, // full text
+					"save":      true,
+				},
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"documentSymbolProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "vmtranslator"},
+		}, nil
+	case "initialized", "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		s.docs[path] = params.TextDocument.Text
+		s.publishDiagnostics(filepath.Dir(path))
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			s.docs[path] = params.ContentChanges[n-1].Text
+		}
+	case "textDocument/didSave":
+		s.publishDiagnostics(filepath.Dir(path))
+	case "textDocument/didClose":
+		delete(s.docs, path)
+		s.notify("textDocument/publishDiagnostics", map[string]any{"uri": pathToURI(path), "diagnostics": []lspDiagnostic{}})
+	case "textDocument/definition":
+		return s.definition(path, params.Position), nil
+	case "textDocument/hover":
+		return s.hover(path, params.Position), nil
+	case "textDocument/documentSymbol":
+		return s.documentSymbols(path), nil
+	default:
+		if strings.HasPrefix(method, "$/") {
+			return nil, nil
+		}
+		return nil, &lspError{-32601, "method not found: " + method}
+	}
+	return nil, nil
+}
+
+// lspWorkspace is the analysis of the vm files of a directory.
+type lspWorkspace struct {
+	Prog      *lintProgram
+	ParseErrs []lineError
+	ReadErrs  map[string]error // path -> preprocessing error
+}
+
+func (s *lspServer) text(path string) (string, bool) {
+	if text, ok := s.docs[path]; ok {
+		return text, true
+	}
+	data, err := os.ReadFile(path)
+	return string(data), err == nil
+}
+
+func (s *lspServer) load(dir string) *lspWorkspace {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.vm"))
+	for p := range s.docs {
+		if filepath.Dir(p) == dir && !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+
+	ws := &lspWorkspace{ReadErrs: map[string]error{}}
+	pp := newPreprocessor()
+	for _, path := range paths {
+		if pp.included[sourceKey(path)] {
+			continue
+		}
+		text, ok := s.text(path)
+		if !ok {
+			continue
+		}
+		// the editor's text of the file, its includes read from disk
+		if err := pp.readSource(diskSource(path), []byte(text), nil); err != nil {
+			ws.ReadErrs[path] = err
+		}
+	}
+	ws.Prog, ws.ParseErrs = newLintProgram(pp.lines)
+	return ws
+}
+
+func (s *lspServer) publishDiagnostics(dir string) {
+	ws := s.load(dir)
+	enabled := map[string]bool{}
+	for _, r := range lintRules {
+		enabled[r.Name] = true
+	}
+	findings := runLintRules(ws.Prog, enabled)
+	for path := range s.docs {
+		if filepath.Dir(path) != dir {
+			continue
+		}
+		diags := []lspDiagnostic{}
+		if err, ok := ws.ReadErrs[path]; ok {
+			line := 0
+			if rest, ok := strings.CutPrefix(err.Error(), path+":"); ok {
+				n, _, _ := strings.Cut(rest, ":")
+				if v, err := strconv.Atoi(n); err == nil {
+					line = v - 1
+				}
+			}
+			diags = append(diags, lspDiagnostic{Range: lineRange(line, 0, 0), Severity: lspSeverityError, Source: "vmtranslator", Message: err.Error()})
+		}
+		for _, e := range ws.ParseErrs {
+			if e.Line.File != path {
+				continue
+			}
+			r := sourceLineRange(e.Line)
+			if te, ok := e.Err.(*tokenError); ok && e.Line.Col > 0 && len(e.Line.Expansion) == 0 {
+				r.Start.Character = e.Line.Col + te.Col - 2
+			}
+			diags = append(diags, lspDiagnostic{Range: r, Severity: lspSeverityError, Source: "vmtranslator", Message: e.Err.Error()})
+		}
+		for _, f := range findings {
+			if sl := ws.Prog.Lines[f.Index]; sl.File == path {
+				diags = append(diags, lspDiagnostic{Range: sourceLineRange(sl), Severity: lspSeverityWarning, Code: f.Rule, Source: "vmlint", Message: f.Msg})
+			}
+		}
+		s.notify("textDocument/publishDiagnostics", map[string]any{"uri": pathToURI(path), "diagnostics": diags})
+	}
+}
+
+// definition resolves the function or label named at pos.
+func (s *lspServer) definition(path string, pos lspPosition) []lspLocation {
+	cmd, word, ok := s.wordAt(path, pos)
+	if !ok {
+		return nil
+	}
+	ws := s.load(filepath.Dir(path))
+	p := ws.Prog
+	switch cmd {
+	case "call", "function":
+		if i, ok := p.Defined[word]; ok {
+			return []lspLocation{{pathToURI(p.Lines[i].File), sourceLineRange(p.Lines[i])}}
+		}
+	case "goto", "if-goto", "label":
+		fn := ""
+		if i := s.commandAt(ws, path, pos.Line); i >= 0 {
+			fn = p.Function[i]
+		}
+		found := -1
+		for i, inst := range p.Instructions {
+			if inst.CommandType != CommandTypeLabel || inst.Arg1 != word {
+				continue
+			}
+			if p.Function[i] == fn {
+				found = i
+				break
+			}
+			if found < 0 {
+				found = i
+			}
+		}
+		if found >= 0 {
+			return []lspLocation{{pathToURI(p.Lines[found].File), sourceLineRange(p.Lines[found])}}
+		}
+	}
+	return nil
+}
+
+// wordAt returns the command of the line at pos and the word of its
+// argument pos is on.
+func (s *lspServer) wordAt(path string, pos lspPosition) (string, string, bool) {
+	text, ok := s.text(path)
+	if !ok {
+		return "", "", false
+	}
+	lines := splitLines([]byte(text))
+	if pos.Line >= len(lines) {
+		return "", "", false
+	}
+	toks, err := tokenize(lines[pos.Line])
+	if err != nil {
+		return "", "", false
+	}
+	for k, t := range toks {
+		if strings.HasPrefix(t.Text, "//") {
+			toks = toks[:k]
+			break
+		}
+	}
+	for k, t := range toks {
+		if k == 1 && pos.Character >= t.Col-1 && pos.Character <= t.Col-1+len(t.Text) {
+			return toks[0].Text, t.Text, true
+		}
+	}
+	return "", "", false
+}
+
+// commandAt returns the index of the first command of path on line, -1
+// when there is none.
+func (s *lspServer) commandAt(ws *lspWorkspace, path string, line int) int {
+	for i, sl := range ws.Prog.Lines {
+		if sl.File == path && sl.Line == line+1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// hover shows the assembly generated for the command(s) of the line at pos.
+func (s *lspServer) hover(path string, pos lspPosition) any {
+	ws := s.load(filepath.Dir(path))
+	p := ws.Prog
+	asm := []string{}
+	for i, sl := range p.Lines {
+		if sl.File != path || sl.Line != pos.Line+1 {
+			continue
+		}
+		lines, err := genIsolated(p.Instructions[i], p.Function[i])
+		if err != nil {
+			return nil
+		}
+		asm = append(asm, lines...)
+	}
+	if len(asm) == 0 {
+		return nil
+	}
+	return map[string]any{
+		"contents": map[string]string{
+			"kind":  "markdown",
+			"value": "```asm\n" + strings.Join(asm, "\n") + "\n```",
+		},
+	}
+}
+
+// genIsolated generates the code of one command as if it were translated
+// inside function fn, leaving the translation state as it was.
+func genIsolated(inst *Instruction, fn string) ([]string, error) {
+	savedFn, savedCounts, savedTop := currentFunctionName, labelCounts, stringBlobTop
+	savedRuntime := usedRuntime
+	defer func() {
+		currentFunctionName, labelCounts, stringBlobTop = savedFn, savedCounts, savedTop
+		usedRuntime = savedRuntime
+	}()
+	if fn != "" {
+		currentFunctionName = fn
+	}
+	labelCounts, usedRuntime = maps.Clone(labelCounts), map[ALType]bool{}
+	return inst.GenAsm()
+}
+
+func (s *lspServer) documentSymbols(path string) []lspDocumentSymbol {
+	ws := s.load(filepath.Dir(path))
+	p := ws.Prog
+	symbols := []lspDocumentSymbol{}
+	var current *lspDocumentSymbol
+	for i, inst := range p.Instructions {
+		sl := p.Lines[i]
+		if sl.File != path || len(sl.Expansion) > 0 {
+			continue
+		}
+		switch inst.CommandType {
+		case CommandTypeFunction:
+			r := sourceLineRange(sl)
+			symbols = append(symbols, lspDocumentSymbol{Name: inst.Arg1, Kind: lspSymbolFunction, Range: r, SelectionRange: r})
+			current = &symbols[len(symbols)-1]
+			continue
+		case CommandTypeLabel:
+			r := sourceLineRange(sl)
+			label := lspDocumentSymbol{Name: inst.Arg1, Kind: lspSymbolKey, Range: r, SelectionRange: r}
+			if current == nil {
+				symbols = append(symbols, label)
+			} else {
+				current.Children = append(current.Children, label)
+			}
+		}
+		if current != nil {
+			// a function spans up to its last command
+			current.Range.End = sourceLineRange(sl).End
+		}
+	}
+	return symbols
+}
+
+func lineRange(line, start, end int) lspRange {
+	return lspRange{lspPosition{line, start}, lspPosition{line, end}}
+}
+
+// sourceLineRange is the range of the command text of sl.
+func sourceLineRange(sl sourceLine) lspRange {
+	if sl.Col == 0 {
+		return lineRange(sl.Line-1, 0, len(sl.Text))
+	}
+	return lineRange(sl.Line-1, sl.Col-1, sl.Col-1+len(sl.Text))
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.Clean(filepath.FromSlash(u.Path))
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
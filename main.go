@@ -2,21 +2,67 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"embed"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
+// osFS holds the standard OS classes linked in by --with-os.
+//
+//go:embed os/*.vm
+var osFS embed.FS
+
 var (
 	currentCallerName   string
 	currentFunctionName = "LABEL"
-	retIndex            = 1
+	// labelCounts numbers the labels generated in currentFunctionName, by
+	// kind (ret, EQ_TRUE, ...), so that they only depend on the function
+	labelCounts = map[string]int{}
+	// extendedMode enables the non standard VM commands (--ext)
+	extendedMode bool
+	// usedRuntime records the shared subroutines referenced by the program,
+	// appended once after the translated code
+	usedRuntime = map[ALType]bool{}
+	// usedFrameRuntime records that the program calls and returns through
+	// the subroutines of -Osize
+	usedFrameRuntime bool
+	// optLevel is the optimization level of the code generation (-O0, -O1,
+	// -Ospeed, -Osize)
+	optLevel = optNone
+	// stringsViaOS makes push string build String objects through the OS,
+	// set when the translation unit defines String.new
+	stringsViaOS bool
+	// stringBlobTop is the (exclusive) end of the memory still free for the
+	// raw string blobs laid out without an OS, growing down from the heap end
+	stringBlobTop = layout.HeapEnd()
+	// staticPrefixMode selects how static variables are named (--static-prefix):
+	// "file" for FileName.index, "path" for the path of the file
+	staticPrefixMode = "file"
 )
 
+// resetCodegenState resets the state the code generation accumulates, so
+// one process can translate several programs.
+func resetCodegenState() {
+	currentFunctionName, labelCounts, usedRuntime, stringBlobTop = "LABEL", map[string]int{}, map[ALType]bool{}, layout.HeapEnd()
+	usedFrameRuntime, stackCached, stringsViaOS = false, false, false
+}
+
 type CommandType int
 type SegmentType int
 type ALType int
@@ -31,6 +77,9 @@ const (
 	CommandTypeFunction
 	CommandTypeReturn
 	CommandTypeCall
+	CommandTypeStaticInit
+	// CommandTypePlugin is a command claimed by the --plugin process
+	CommandTypePlugin
 )
 
 func (ct CommandType) String() string {
@@ -44,6 +93,8 @@ func (ct CommandType) String() string {
 		"function",
 		"return",
 		"call",
+		"static-init",
+		"plugin",
 	}[ct]
 }
 
@@ -56,6 +107,7 @@ const (
 	SegmentTypeStatic
 	SegmentTypeTemp
 	SegmentTypePointer
+	SegmentTypeString
 )
 
 func (st SegmentType) String() string {
@@ -68,6 +120,7 @@ func (st SegmentType) String() string {
 		"static",
 		"temp",
 		"pointer",
+		"string",
 	}[st]
 }
 
@@ -81,6 +134,7 @@ func (st SegmentType) ID() string {
 		"",     // static
 		"",     // temp
 		"",     // pointer
+		"",     // string
 	}[st]
 }
 
@@ -94,6 +148,11 @@ const (
 	ALTypeAnd
 	ALTypeOr
 	ALTypeNot
+	ALTypeShl
+	ALTypeShr
+	ALTypeMult
+	ALTypeDiv
+	ALTypeMod
 )
 
 func (lt ALType) String() string {
@@ -107,266 +166,1632 @@ func (lt ALType) String() string {
 		"and",
 		"or",
 		"not",
+		"shl",
+		"shr",
+		"mult",
+		"div",
+		"mod",
 	}[lt]
 }
 
+// stringsFlag is a flag.Value collecting every occurrence of a repeated flag.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(v string) error {
+	*sf = append(*sf, v)
+	return nil
+}
+
+// platformMain, when set by the build of a platform without a command
+// line (js/wasm), runs instead of it.
+var platformMain func()
+
 func main() {
-	var vmSrcFiles, cmpFile string
-	flag.StringVar(&vmSrcFiles, "s", "", "source file in vm extension (e.g. Add.vm or a Directory with multiple vm files)")
-	flag.StringVar(&cmpFile, "c", "", "compare file")
-	flag.Parse()
-	if vmSrcFiles == "" {
-		fmt.Println("No source file provided")
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Internal error: %v\n%s", r, debug.Stack())
+			os.Exit(exitInternal)
+		}
+	}()
+	if platformMain != nil {
+		platformMain()
+		return
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fmt":
+			runFmt(os.Args[2:])
+			return
+		case "lint":
+			runLint(os.Args[2:])
+			return
+		case "lsp":
+			runLSP(os.Args[2:])
+			return
+		case "dap":
+			runDAP(os.Args[2:])
+			return
+		case "debug":
+			runDebug(os.Args[2:])
+			return
+		case "run":
+			runRun(os.Args[2:])
+			return
+		case "repl":
+			runREPL(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "golden":
+			runGolden(os.Args[2:])
+			return
+		case "proptest":
+			runPropTest(os.Args[2:])
+			return
+		case "conformance":
+			runConformance(os.Args[2:])
+			return
+		case "batch":
+			runBatch(os.Args[2:])
+			return
+		case "difftest":
+			runDiffTest(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "compare-opts":
+			runCompareOpts(os.Args[2:])
+			return
+		case "verify-codegen":
+			runVerifyCodegen(os.Args[2:])
+			return
+		case "superopt":
+			runSuperopt(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "encode":
+			runEncode(os.Args[2:])
+			return
+		case "decode":
+			runDecode(os.Args[2:])
+			return
+		case "decompile":
+			runDecompile(os.Args[2:])
+			return
+		case "version", "--version", "-version":
+			printVersion()
+			return
+		}
+	}
+
+	var dstFile, callGraphFile, cfgFile, emit, target, reportFile, splitDir, metrics, metadataFile string
+	var stackDepth, statics, unusedFunctions, noHeader, force, dryRun, roundTrip bool
+	var keepFunctions stringsFlag
+	var cmp compareOptions
+	opts := registerTranslateFlags(flag.CommandLine)
+	prof := registerProfileFlags(flag.CommandLine, false)
+	flag.StringVar(&cmp.File, "c", "", "compare file")
+	flag.IntVar(&cmp.MaxDiffs, "max-diffs", 0, "show at most this many differing hunks when -c fails (0 shows all)")
+	flag.StringVar(&cmp.Mode, "compare-mode", "strict", "how -c compares: strict (every line, comments included) or loose (ignoring comments, blank lines and spaces)")
+	flag.StringVar(&cmp.Format, "format", "text", "how -c reports: text (a unified diff), json (the result on stdout, the other messages going to stderr), junit or tap (the result as a JUnit XML or TAP test report on stdout)")
+	flag.StringVar(&dstFile, "o", "", "destination asm file (defaults to a name derived from the first source)")
+	flag.StringVar(&emit, "emit", "asm", "output format: asm (the program of --target) or json (the parsed commands as JSON IR)")
+	flag.StringVar(&target, "target", "hack", "what the program is translated to: hack (Hack assembly), c (portable C modeling the Hack RAM), llvm (textual LLVM IR) or riscv32 (RV32I assembly)")
+	flag.StringVar(&splitDir, "split-output", "", "also write the assembly of every function to its own file in this directory, with a link.sh script joining them")
+	flag.StringVar(&reportFile, "report", "", "also write an HTML report of the translation to this file")
+	flag.StringVar(&metadataFile, "emit-metadata", "", "also write the build metadata to this JSON file: the sources in translation order, the output, the settings and the symbols of the program, for editors and build systems")
+	flag.StringVar(&cfgFile, "cfg", "", "also write the control flow graph of every function to this file, in JSON when it ends with .json and in Graphviz DOT otherwise")
+	flag.BoolVar(&statics, "statics", false, "report the static variables of every file and the RAM addresses they are allocated at")
+	flag.BoolVar(&stackDepth, "stack-depth", false, "report the maximum stack depth of every function and of the program, warning when it could reach the heap or run out of the RAM")
+	flag.StringVar(&metrics, "metrics", "", "report the VM commands, instructions, calls and goto nesting of every function, sorted by one of "+strings.Join(metricsOrders, ", ")+" (the counts from the largest)")
+	flag.BoolVar(&unusedFunctions, "unused-functions", false, "report the functions no chain of calls from the entry function reaches, even when the code generation keeps them")
+	flag.Var(&keepFunctions, "keep-functions", "comma separated globs of functions --unused-functions does not report, nor the functions they call (e.g. 'Math.*,String.*'), can be repeated; the bundled OS of --with-os is kept")
+	flag.StringVar(&callGraphFile, "callgraph", "", "also write the call graph of the program in Graphviz DOT format to this file")
+	flag.BoolVar(&dryRun, "dry-run", false, "translate and print statistics and diagnostics, but write no file")
+	flag.BoolVar(&roundTrip, "verify-roundtrip", false, "decompile the assembly, translate it again and fail when the instructions differ, a self-check of the translator")
+	flag.BoolVar(&force, "force", false, "overwrite the destination file even when it was not written by the translator")
+	flag.BoolVar(&noHeader, "no-header", false, "leave out the comment naming the translator version at the top of the assembly")
+	logLevel := flag.String("log-level", "info", "least severe messages printed: trace, debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "how messages are printed: text (for people) or json (one object per line)")
+	color := flag.String("color", "auto", "color the messages and the -c diff: auto (on a terminal, unless NO_COLOR is set), always or never")
+	progressMode := flag.String("progress", "auto", "show the progress of the translation on stderr: auto (a bar on a terminal), on (also percentages when not on a terminal) or off")
+	quiet := flag.Bool("q", false, "print nothing on success, only the errors (--log-level=error)")
+	verbose := flag.Bool("v", false, "trace every command parsed and the number of lines generated for it (--log-level=debug)")
+	veryVerbose := flag.Bool("vv", false, "also trace the lines generated for every command (--log-level=trace)")
+	parseFlags(flag.CommandLine, os.Args[1:])
+	switch {
+	case *quiet && (*verbose || *veryVerbose):
+		fmt.Fprintln(os.Stderr, "-q cannot be combined with -v or -vv")
+		os.Exit(exitUsage)
+	case *quiet:
+		*logLevel = "error"
+		*progressMode = "off"
+	case *veryVerbose:
+		*logLevel = "trace"
+	case *verbose:
+		*logLevel = "debug"
+	}
+	var err error
+	if logger, err = newLogger(ioStdout{}, *logLevel, *logFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(exitUsage)
+	}
+	if err := opts.validate(); err != nil {
+		logger.Error(err.Error())
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
-	// check if the source is a directory
-	srcStat, err := os.Stat(vmSrcFiles)
-	if err != nil {
-		fmt.Println("Error getting source file status", err)
-		os.Exit(1)
+	if emit != "asm" && emit != "json" {
+		logger.Error(fmt.Sprintf("Invalid output format %q, expected asm or json", emit))
+		os.Exit(exitUsage)
+	}
+	be, ok := backends[target]
+	if !ok {
+		logger.Error(fmt.Sprintf("Invalid target %q, expected %s", target, backendNames()))
+		os.Exit(exitUsage)
+	}
+	if metrics != "" && !slices.Contains(metricsOrders, metrics) {
+		logger.Error(fmt.Sprintf("Invalid metrics order %q, expected %s", metrics, strings.Join(metricsOrders, ", ")))
+		os.Exit(exitUsage)
+	}
+	if target != "hack" {
+		needsHack := map[string]bool{"-" + optLevel: optLevel != optNone, "--emit=json": emit == "json", "-c": cmp.File != "", "--split-output": splitDir != "", "--report": reportFile != "", "--metrics": metrics != "", "--annotate-stack": opts.AnnotateStack}
+		for _, name := range slices.Sorted(maps.Keys(needsHack)) {
+			if needsHack[name] {
+				logger.Error(fmt.Sprintf("%s needs --target=hack", name))
+				os.Exit(exitUsage)
+			}
+		}
+	}
+	if cmp.Mode != "strict" && cmp.Mode != "loose" {
+		logger.Error(fmt.Sprintf("Invalid compare mode %q, expected strict or loose", cmp.Mode))
+		os.Exit(exitUsage)
+	}
+	if !slices.Contains([]string{"text", "json", "junit", "tap"}, cmp.Format) {
+		logger.Error(fmt.Sprintf("Invalid compare format %q, expected text, json, junit or tap", cmp.Format))
+		os.Exit(exitUsage)
+	}
+	if roundTrip && optLevel != optNone {
+		logger.Error("--verify-roundtrip needs -O0, the decompiler only reading the code of the course")
+		os.Exit(exitUsage)
+	}
+	if emit != "asm" && cmp.File != "" {
+		logger.Error("Comparing (-c) needs --emit=asm")
+		os.Exit(exitUsage)
 	}
 
-	dstFile := ""
-	srcFiles := []*os.File{}
-	defer func() {
-		for _, f := range srcFiles {
-			f.Close()
+	// with --format=json, junit or tap the compare result is all stdout
+	// holds
+	stdout := os.Stdout
+	if cmp.Format != "text" {
+		os.Stdout = os.Stderr
+	}
+	if err := setupColor(*color, os.Stdout); err != nil {
+		logger.Error(err.Error())
+		os.Exit(exitUsage)
+	}
+
+	if dstFile == "" {
+		dstFile, err = defaultDstFile(opts.Sources[0])
+		if err != nil {
+			logger.Error("Error getting source file status", "err", err)
+			os.Exit(exitIO)
 		}
-	}()
+		if emit == "json" {
+			dstFile = strings.TrimSuffix(dstFile, ".asm") + ".json"
+			if sameSource(dstFile, opts.Sources[0]) {
+				logger.Error(fmt.Sprintf("The JSON output would replace the source %s, pass -o", dstFile))
+				os.Exit(exitUsage)
+			}
+		} else {
+			dstFile = strings.TrimSuffix(dstFile, ".asm") + be.Ext()
+		}
+	}
 
-	if srcStat.IsDir() {
-		basename := filepath.Base(vmSrcFiles)
-		dstFile = filepath.Join(vmSrcFiles, basename+".asm")
+	// a source that does not resolve fails the translation below
+	srcPaths, _ := resolveSources(opts.Sources, opts.Excludes)
+	owned, err := checkDestination(dstFile, srcPaths, emit, be, force || dryRun)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(exitStatus(err))
+	}
+
+	progress, err := newProgressReporter(*progressMode)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(exitUsage)
+	}
+	if progress != nil {
+		opts.Progress = progress.report
+	}
+
+	stopProfiles := prof.start()
+	start := time.Now()
+	tr, err := translate(opts)
+	if progress != nil {
+		progress.finish()
+	}
+	if err != nil {
+		logger.Error(err.Error(), errorAttrs(err)...)
+		os.Exit(exitStatus(err))
+	}
+	traceTranslation(tr)
+	logger.Debug("Translated", "commands", len(tr.Commands), "lines", len(tr.Lines), "elapsed", time.Since(start))
+	for _, w := range tr.Warnings {
+		logger.Warn(w)
+	}
+	if roundTrip {
+		if err := verifyRoundTrip(tr, opts); err != nil {
+			logger.Error(fmt.Sprintf("Round trip failed %s", err))
+			os.Exit(exitInternal)
+		}
+		logger.Debug("Round trip verified")
+	}
+	resultLines, err := be.Generate(tr)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error generating the %s program %s", target, err))
+		os.Exit(exitSemantic)
+	}
 
-		files, err := filepath.Glob(filepath.Join(vmSrcFiles, "*.vm"))
+	if dryRun {
+		outputs := map[string]string{"split output": splitDir, "report": reportFile, "call graph": callGraphFile, "control flow graph": cfgFile, "build metadata": metadataFile}
+		printDryRun(tr, dstFile, owned || force, outputs)
+	} else {
+		// MARK: - Write to Destination File
+		err = writeFileAtomic(dstFile, func(w io.Writer) error {
+			if emit == "json" {
+				data, err := marshalIR(tr)
+				if err == nil {
+					_, err = w.Write(data)
+				}
+				return err
+			}
+			lines := resultLines
+			if !noHeader {
+				lines = append([]string{be.Comment(readBuildInfo().String())}, resultLines...)
+			}
+			return writeLinesToDst(w, lines)
+		})
 		if err != nil {
-			fmt.Printf("Error listing files %s: %s\n", vmSrcFiles, err)
-			os.Exit(1)
+			logger.Error("Error writing to destination file", "err", err)
+			os.Exit(exitIO)
+		}
+
+		logger.Info("Successfully wrote to destination file", "file", dstFile)
+
+		if splitDir != "" {
+			if err := writeSplitOutput(splitDir, tr, filepath.Base(dstFile)); err != nil {
+				logger.Error("Error writing split output", "err", err)
+				os.Exit(exitIO)
+			}
+			logger.Info("Successfully wrote split output", "dir", splitDir)
+		}
+		if metadataFile != "" {
+			if err := writeMetadata(metadataFile, tr, opts, dstFile, target, emit); err != nil {
+				logger.Error("Error writing build metadata", "err", err)
+				os.Exit(exitIO)
+			}
+			logger.Info("Successfully wrote build metadata", "file", metadataFile)
+		}
+		if reportFile != "" {
+			if err := writeHTMLReport(reportFile, tr); err != nil {
+				logger.Error("Error writing report", "err", err)
+				os.Exit(exitIO)
+			}
+			logger.Info("Successfully wrote report", "file", reportFile)
+		}
+		if callGraphFile != "" {
+			if err := os.WriteFile(callGraphFile, []byte(callGraphDOT(tr)), 0644); err != nil {
+				logger.Error("Error writing call graph", "err", err)
+				os.Exit(exitIO)
+			}
+			logger.Info("Successfully wrote call graph", "file", callGraphFile)
 		}
-		for _, file := range files {
-			srcF, err := os.Open(file)
+		if cfgFile != "" {
+			cfgs := buildCFGs(tr.Instructions)
+			data := []byte(cfgDOT(tr.Commands, cfgs))
+			if strings.HasSuffix(cfgFile, ".json") {
+				data, err = cfgJSON(tr.Commands, cfgs)
+			}
+			if err == nil {
+				err = os.WriteFile(cfgFile, data, 0644)
+			}
 			if err != nil {
-				fmt.Printf("Error opening source file %s: %s\n", file, err)
-				os.Exit(1)
+				logger.Error("Error writing control flow graph", "err", err)
+				os.Exit(exitIO)
 			}
-			srcFiles = append(srcFiles, srcF)
+			logger.Info("Successfully wrote control flow graph", "file", cfgFile)
 		}
-	} else {
-		dstFile = strings.TrimSuffix(filepath.Base(vmSrcFiles), filepath.Ext(vmSrcFiles))
-		dstFile = filepath.Join(filepath.Dir(vmSrcFiles), dstFile+".asm")
+	}
+	if statics {
+		report, err := staticsReport(tr)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(exitSemantic)
+		}
+		for _, line := range report {
+			fmt.Println(line)
+		}
+	}
+	if stackDepth {
+		for _, line := range stackDepthReport(tr) {
+			fmt.Println(line)
+		}
+	}
+	if metrics != "" {
+		for _, line := range metricsReport(tr, metrics) {
+			fmt.Println(line)
+		}
+	}
+	if unusedFunctions {
+		keep := []string{opts.Entry}
+		for _, list := range keepFunctions {
+			for _, pattern := range strings.Split(list, ",") {
+				keep = append(keep, strings.TrimSpace(pattern))
+			}
+		}
+		if opts.WithOS {
+			for fn := range bundledOSFunctions() {
+				keep = append(keep, fn)
+			}
+		}
+		for _, line := range unusedFunctionsReport(tr, keep) {
+			fmt.Println(line)
+		}
+	}
+
+	stopProfiles()
+
+	// MARK: - Compare with Expected Output
+	if cmp.File != "" {
+		compareOutput(cmp, dstFile, resultLines, be.Comment("vmtranslator "), stdout)
+	}
+
+}
 
-		srcF, err := os.Open(vmSrcFiles)
+// translateOptions are the flags selecting and translating the sources,
+// shared by the commands running a translation.
+type translateOptions struct {
+	Sources    stringsFlag
+	Excludes   stringsFlag
+	Order      string
+	Bootstrap  string
+	Entry      string
+	EntryNArgs int
+	WithOS     bool
+	// Frontend is the command compiling the Jack sources of a directory
+	// before the translation, "" to translate the .vm files as they are
+	Frontend string
+	// Inputs are sources held in memory, translated after those of
+	// Sources, for the callers without a file system to read them from
+	Inputs []vmSource
+	// Progress, when set, is told how far each stage of the translation
+	// (reading, parsing, generating) is
+	Progress func(stage string, done, total int)
+	// AnnotateStack comments the code of every command with its effect on
+	// the stack and the RAM
+	AnnotateStack bool
+}
+
+func registerTranslateFlags(fs *flag.FlagSet) *translateOptions {
+	opts := registerSourceFlags(fs)
+	fs.StringVar(&opts.Bootstrap, "bootstrap", "auto", "bootstrap code calling the entry function: auto (when it is defined), on or off")
+	fs.StringVar(&opts.Entry, "entry", "Sys.init", "entry function called by the bootstrap code")
+	fs.IntVar(&opts.EntryNArgs, "entry-nargs", 0, "number of arguments passed to the entry function (pushed as zeros)")
+	fs.BoolVar(&opts.AnnotateStack, "annotate-stack", false, "comment the code of every command with the stack pointer before and after it and the words of the segments it reads and writes (e.g. // SP: LCL+3->LCL+2, writes RAM[LCL+2]), for tracing it in the CPU emulator")
+	registerOptFlags(fs)
+	registerScratchFlag(fs)
+	registerLayoutFlag(fs)
+	registerTemplatesFlag(fs)
+	return opts
+}
+
+// registerSourceFlags registers the flags of the sources of a translation
+// and of how they parse, the flags of encode.
+func registerSourceFlags(fs *flag.FlagSet) *translateOptions {
+	opts := &translateOptions{}
+	fs.Var(&opts.Sources, "s", "source file in vm extension (e.g. Add.vm, a Directory with multiple vm files or a glob like os/*.vm), can be repeated")
+	fs.Var(&opts.Excludes, "exclude", "glob of source files to skip (e.g. '*_test.vm' or 'backup/*'), can be repeated")
+	fs.StringVar(&opts.Order, "order", "", "comma separated source order (e.g. Main.vm,Sys.vm) or a manifest file listing one source per line")
+	fs.BoolVar(&extendedMode, "ext", false, "enable extended VM commands (shl, shr, mult, div, mod, negative constants, push string)")
+	fs.StringVar(&staticPrefixMode, "static-prefix", "file", "prefix of the static variable symbols: file (the file base name) or path (the file path, keeping files with the same name apart)")
+	fs.StringVar(&pluginCommand, "plugin", "", "command line of a plugin process generating the code of the commands and segments the translator does not know, see Plugins in the README (e.g. 'python3 ioplugin.py')")
+	fs.BoolVar(&opts.WithOS, "with-os", false, "link the bundled OS classes (Sys, Memory, Math, Array, String, Screen, Output, Keyboard) into the translation")
+	fs.StringVar(&opts.Frontend, "frontend", "", "Jack compiler run on the source directories holding .jack files, and the directories of the .jack files given with -s, before the translation, {dir} standing for the directory (e.g. 'JackCompiler.sh {dir}')")
+	return opts
+}
+
+func (opts *translateOptions) validate() error {
+	if len(opts.Sources) == 0 && len(opts.Inputs) == 0 {
+		return fmt.Errorf("No source file provided")
+	}
+	if !slices.Contains([]string{"auto", "on", "off"}, opts.Bootstrap) {
+		return fmt.Errorf("Invalid bootstrap mode %q, expected auto, on or off", opts.Bootstrap)
+	}
+	if opts.Entry == "" || opts.EntryNArgs < 0 {
+		return fmt.Errorf("Invalid entry function %s %d", opts.Entry, opts.EntryNArgs)
+	}
+	if !slices.Contains([]string{"file", "path"}, staticPrefixMode) {
+		return fmt.Errorf("Invalid static prefix %q, expected file or path", staticPrefixMode)
+	}
+	return nil
+}
+
+// translation is the result of translating a program.
+type translation struct {
+	// Lines is the generated assembly
+	Lines []string
+	// Origin maps every line of Lines to the index in Commands of the VM
+	// command it was generated for, -1 for the bootstrap and runtime code
+	Origin       []int
+	Commands     []sourceLine
+	Instructions []*Instruction
+	Warnings     []string
+	// Bootstrap is the entry function called by the bootstrap code, ""
+	// when there is none
+	Bootstrap string
+	// EntryNArgs is the number of arguments the bootstrap code passes
+	EntryNArgs int
+	// StackInD holds the commands whose code starts with the top of the
+	// stack in D, not yet stored, by the stack caching above -O0
+	StackInD map[int]bool
+}
+
+// The exit statuses of the translation, by the kind of failure.
+const (
+	// exitInternal is a bug of the translator, a panic included
+	exitInternal = 1
+	// exitUsage is an invalid command line: a flag, a source pattern
+	// matching nothing, an unknown file in --order
+	exitUsage = 2
+	// exitCompareDiffers is a translation that succeeded but differs from
+	// the compare file
+	exitCompareDiffers = 3
+	// exitIO is a file that cannot be read or written
+	exitIO = 4
+	// exitParse is a source that is not valid VM code
+	exitParse = 5
+	// exitSemantic is a program that parses but cannot be translated: a
+	// missing entry function, a function declared twice, a temp or pointer
+	// index past the end of its segment, ...
+	exitSemantic = 6
+	// exitProjectsFailed is a batch some projects of which did not
+	// translate or failed a test
+	exitProjectsFailed = 7
+)
+
+// statusError is a translation failure reported with the given exit status.
+type statusError struct {
+	Status int
+	Msg    string
+	// Source is the source line the failure is about, nil when it is not
+	// about one line
+	Source *sourceExcerpt
+}
+
+func (e *statusError) Error() string {
+	return e.Msg
+}
+
+func failf(status int, format string, args ...any) error {
+	return &statusError{Status: status, Msg: fmt.Sprintf(format, args...)}
+}
+
+// failAt is failf about the source line sl, pointing at the token err is
+// about when it is a tokenError.
+func failAt(status int, sl sourceLine, err error, format string, args ...any) error {
+	src := &sourceExcerpt{Line: sl}
+	var te *tokenError
+	if errors.As(err, &te) {
+		src.Col = te.Col
+	}
+	return &statusError{Status: status, Msg: fmt.Sprintf(format, args...), Source: src}
+}
+
+// errorAttrs are the attributes logging err with: the source line it is
+// about, if any.
+func errorAttrs(err error) []any {
+	var se *statusError
+	if errors.As(err, &se) && se.Source != nil {
+		return []any{"source", *se.Source}
+	}
+	return nil
+}
+
+// exitStatus is the exit status the commands fail with on err.
+func exitStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	return exitInternal
+}
+
+// translate reads, parses and translates the sources selected by opts.
+func translate(opts *translateOptions) (*translation, error) {
+	if len(codegenTemplates) > 0 && optLevel != optNone {
+		return nil, failf(exitUsage, "Invalid -%s with --codegen-templates, which replace the code of -O0", optLevel)
+	}
+	if err := checkTemplates(); err != nil {
+		return nil, failf(exitUsage, "Error in codegen template %s", err)
+	}
+	resetCodegenState()
+	srcPaths := []string{}
+	sources, jackDirs := jackSources(opts.Sources)
+	if opts.Frontend != "" {
+		for _, dir := range jackDirs {
+			if err := runFrontend(opts.Frontend, dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(sources) > 0 {
+		var err error
+		if srcPaths, err = resolveSources(sources, opts.Excludes); err != nil {
+			return nil, failf(exitIO, "Error resolving source files %s", err)
+		}
+	}
+	if len(srcPaths) == 0 && len(opts.Inputs) == 0 {
+		if len(jackDirs) > 0 && opts.Frontend == "" {
+			return nil, failf(exitUsage, "No vm source files matched %s, pass --frontend to compile its .jack files", opts.Sources.String())
+		}
+		return nil, failf(exitUsage, "No vm source files matched %s", opts.Sources.String())
+	}
+	if opts.Order != "" {
+		names, err := parseOrder(opts.Order)
+		if err != nil {
+			return nil, failf(exitUsage, "Error reading source order %s", err)
+		}
+		if srcPaths, err = orderSources(srcPaths, names); err != nil {
+			return nil, failf(exitUsage, "Error ordering source files %s", err)
+		}
+	}
+
+	srcFiles := []vmSource{}
+	if opts.WithOS {
+		userPaths := slices.Clone(srcPaths)
+		for _, in := range opts.Inputs {
+			userPaths = append(userPaths, in.Name)
+		}
+		osFiles, err := openOSSources(userPaths)
 		if err != nil {
-			fmt.Printf("Error opening source file %s: %s\n", vmSrcFiles, err)
-			os.Exit(1)
+			return nil, failf(exitInternal, "Error loading bundled OS %s", err)
+		}
+		srcFiles = append(srcFiles, osFiles...)
+	}
+	opened := newSourceFiles()
+	defer opened.Close()
+	for _, file := range srcPaths {
+		srcF, err := opened.open(file)
+		if err != nil {
+			return nil, failf(exitIO, "Error opening source file %s: %s", file, err)
 		}
 		srcFiles = append(srcFiles, srcF)
 	}
+	srcFiles = append(srcFiles, opts.Inputs...)
+
+	// every source is read once, its contents used both to find the entry
+	// function and to translate it
+	contents := make([][]byte, len(srcFiles))
+	for k, srcF := range srcFiles {
+		data, err := srcF.ReadFile()
+		if err != nil {
+			return nil, failf(exitIO, "Error reading source file %s", err)
+		}
+		contents[k] = data
+	}
 
 	hasMultipleSrcFiles := len(srcFiles) > 1
-	var fileWithSysInit *os.File
-
-	for _, srcF := range srcFiles {
-		scanner := bufio.NewScanner(srcF)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "//") ||
-				strings.TrimSpace(line) == "" {
+	fileWithEntry := -1
+	for k, srcF := range srcFiles {
+		if sourceDefinesFunction(srcF.Name, contents[k], opts.Entry) {
+			fileWithEntry = k
+			break
+		}
+	}
+
+	pp := newPreprocessor()
+
+	files := make([]int, 0, len(srcFiles))
+	for k := range srcFiles {
+		files = append(files, k)
+	}
+	if hasMultipleSrcFiles && opts.Order == "" && fileWithEntry >= 0 {
+		// we need to scan the file with the entry function (Sys.init) last
+		files = append(slices.Delete(files, fileWithEntry, fileWithEntry+1), fileWithEntry)
+	}
+	progress := opts.Progress
+	if progress == nil {
+		progress = func(string, int, int) {}
+	}
+	// Loop through all files in the correct order
+	for k, f := range files {
+		progress("reading", k, len(files))
+		if pp.included[sourceKey(srcFiles[f].Name)] {
+			// already pulled in by an include directive
+			continue
+		}
+		if err := pp.readSource(srcFiles[f], contents[f], nil); err != nil {
+			status := exitParse
+			if pe := (*fs.PathError)(nil); errors.As(err, &pe) {
+				status = exitIO
+			}
+			return nil, failf(status, "Error reading source %s", err)
+		}
+	}
+	progress("reading", len(files), len(files))
+	instructionsLines := pp.lines
+
+	if len(instructionsLines) == 0 {
+		return nil, failf(exitSemantic, "No source lines found")
+	}
+
+	instructions := make([]*Instruction, 0, len(instructionsLines))
+	for i, sLine := range instructionsLines {
+		progress("parsing", i, len(instructionsLines))
+		instruction, err := parseInstruction(i, sLine.StaticPrefix(), sLine.Text)
+		if err != nil {
+			return nil, failAt(exitParse, sLine, err, "Error parsing instruction %s: %s", sLine.PosOf(err), err)
+		}
+		if instruction.CommandType == CommandTypeFunction && instruction.Arg1 == "String.new" {
+			stringsViaOS = true
+		}
+		instructions = append(instructions, instruction)
+	}
+	progress("parsing", len(instructions), len(instructions))
+	scopeLabels(instructions)
+	if k, err := qualifyStaticInits(instructionsLines, instructions); err != nil {
+		return nil, failAt(exitSemantic, instructionsLines[k], err, "Error %s: %s", instructionsLines[k].Pos(), err)
+	}
+	if k, err := checkSegments(instructions); err != nil {
+		return nil, failAt(exitSemantic, instructionsLines[k], err, "Error %s: %s", instructionsLines[k].Pos(), err)
+	}
+	if k, err := checkScratch(instructions); err != nil {
+		return nil, failAt(exitUsage, instructionsLines[k], err, "Error %s: %s", instructionsLines[k].Pos(), err)
+	}
+	dups := duplicateFunctions(instructionsLines, instructions)
+	if len(dups) == 0 {
+		dups = duplicateLabels(instructionsLines, instructions)
+	}
+	if len(dups) > 0 {
+		sl := instructionsLines[dups[0].Index]
+		return nil, failAt(exitSemantic, sl, nil, "Error %s: %s", sl.Pos(), dups[0].Msg)
+	}
+
+	tr := &translation{Commands: instructionsLines, Instructions: instructions}
+	tr.Warnings = append(tr.Warnings, staleJackWarnings(srcPaths, jackDirs)...)
+	tr.Warnings = append(tr.Warnings, staticCollisions(instructionsLines, instructions)...)
+	if opts.WithOS && (layout.Heap != defaultLayout.Heap || layout.Screen != defaultLayout.Screen || layout.Keyboard != defaultLayout.Keyboard) {
+		tr.Warnings = append(tr.Warnings, fmt.Sprintf("the bundled OS assumes the standard memory map, the heap at RAM[%d], the screen at RAM[%d] and the keyboard at RAM[%d], not the one of --memory-layout", defaultLayout.Heap, defaultLayout.Screen, defaultLayout.Keyboard))
+	}
+	entryDefined := slices.ContainsFunc(instructions, func(i *Instruction) bool {
+		return i.CommandType == CommandTypeFunction && i.Arg1 == opts.Entry
+	})
+	if !entryDefined {
+		switch {
+		case opts.Bootstrap == "on":
+			return nil, failf(exitSemantic, "%s not found in any source file, cannot emit bootstrap code", opts.Entry)
+		case opts.Bootstrap == "auto" && hasMultipleSrcFiles:
+			tr.Warnings = append(tr.Warnings, opts.Entry+" not found in any source file, skipping bootstrap code")
+		}
+	}
+
+	staticInit, err := genStaticInit(instructions)
+	if err != nil {
+		return nil, failf(exitSemantic, "Error generating static initialization %s", err)
+	}
+
+	emit := func(origin int, lines ...string) {
+		tr.Lines = append(tr.Lines, lines...)
+		for range lines {
+			tr.Origin = append(tr.Origin, origin)
+		}
+	}
+
+	if entryDefined && opts.Bootstrap != "off" {
+		lines := []string{
+			"// Bootstrap code",
+			fmt.Sprintf("@%d", layout.Stack),
+			"D=A",
+			"@SP",
+			"M=D",
+		}
+		lines = append(lines, staticInit...)
+		for range opts.EntryNArgs {
+			lines = append(lines, (&Instruction{}).genConstantPUSH(0)...)
+		}
+		lines = append(lines, fmt.Sprintf("/// call %s %d", opts.Entry, opts.EntryNArgs))
+		lines = append(lines, genCall(opts.Entry, opts.EntryNArgs)...)
+		emit(-1, lines...)
+		tr.Bootstrap, tr.EntryNArgs = opts.Entry, opts.EntryNArgs
+	} else {
+		emit(-1, staticInit...)
+	}
+
+	if optLevel != optNone {
+		planJumps(instructions)
+		planDeadCode(instructions)
+	}
+	if optLevel == optSize {
+		planSharedCommands(instructions)
+	}
+	tr.StackInD = map[int]bool{}
+	for i, instruction := range instructions {
+		progress("generating", i, len(instructions))
+		if stackCached {
+			tr.StackInD[i] = true
+		}
+		asm, err := instruction.GenAsm()
+		if err != nil {
+			return nil, failAt(exitSemantic, instructionsLines[i], err, "Error generating asm %s", err)
+		}
+		emit(i, asm...)
+	}
+	// the top of the stack of a program falling off its end
+	emit(-1, genSpill()...)
+	emit(-1, genRuntime()...)
+	progress("generating", len(instructions), len(instructions))
+	if err := checkGeneratedAsm(tr); err != nil {
+		return nil, err
+	}
+	if opts.AnnotateStack {
+		annotateStack(tr)
+	}
+	return tr, nil
+}
+
+// vmSource is a translation input: the file Path of FS, which is the file
+// system of the OS, the embedded OS classes, an archive or memory. Name is
+// the path messages and static symbols know the source by.
+type vmSource struct {
+	FS   fs.FS
+	Path string
+	Name string
+}
+
+// diskSource is the source file name of the OS file system.
+func diskSource(name string) vmSource {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		abs = filepath.Clean(name)
+	}
+	vol := filepath.VolumeName(abs)
+	root := vol + string(filepath.Separator)
+	return vmSource{
+		FS:   os.DirFS(root),
+		Path: strings.TrimPrefix(filepath.ToSlash(abs[len(vol):]), "/"),
+		Name: name,
+	}
+}
+
+// ReadFile reads the contents of the source, failing with an error about
+// its Name.
+func (s vmSource) ReadFile() ([]byte, error) {
+	data, err := fs.ReadFile(s.FS, s.Path)
+	if pe := (*fs.PathError)(nil); errors.As(err, &pe) {
+		pe.Path = s.Name
+	}
+	return data, err
+}
+
+// Sibling is the source at the path rel relative to s, in the same file
+// system, as named by an include directive.
+func (s vmSource) Sibling(rel string) vmSource {
+	return vmSource{
+		FS:   s.FS,
+		Path: path.Join(path.Dir(s.Path), filepath.ToSlash(rel)),
+		Name: filepath.Join(filepath.Dir(s.Name), rel),
+	}
+}
+
+// openOSSources returns the bundled OS classes, leaving out any class the
+// user provides a file for (e.g. their own Math.vm) so it can be replaced.
+func openOSSources(userPaths []string) ([]vmSource, error) {
+	entries, err := osFS.ReadDir("os")
+	if err != nil {
+		return nil, err
+	}
+	sources := []vmSource{}
+	for _, e := range entries {
+		overridden := slices.ContainsFunc(userPaths, func(p string) bool {
+			return filepath.Base(p) == e.Name()
+		})
+		if overridden {
+			continue
+		}
+		name := "os/" + e.Name()
+		sources = append(sources, vmSource{FS: osFS, Path: name, Name: name})
+	}
+	return sources, nil
+}
+
+// resolveSources expands every -s argument (a file, an archive, a directory
+// or a glob pattern) into the list of vm files to translate, dropping
+// duplicates and anything matching one of the exclude patterns while keeping
+// the order in which they were given. The files of an archive are listed as
+// paths below it (submission.zip/Project/Main.vm), excludes matching them
+// relative to the archive.
+func resolveSources(sources, excludes []string) ([]string, error) {
+	for _, ex := range excludes {
+		if _, err := filepath.Match(ex, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %s: %w", ex, err)
+		}
+	}
+	paths := []string{}
+	seen := map[string]bool{}
+	root := ""
+	add := func(p string) {
+		p = filepath.Clean(p)
+		if seen[p] || isExcluded(root, p, excludes) {
+			return
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	addFile := func(p string) error {
+		if !isArchive(p) {
+			add(p)
+			return nil
+		}
+		files, err := archiveFiles(p)
+		if err != nil {
+			return err
+		}
+		archiveRoot := root
+		root = p
+		for _, f := range files {
+			add(f)
+		}
+		root = archiveRoot
+		return nil
+	}
+	for _, src := range sources {
+		root = src
+		if strings.ContainsAny(src, "*?[") {
+			root = globRoot(src)
+			matches, err := filepath.Glob(src)
+			if err != nil {
+				return nil, fmt.Errorf("invalid glob pattern %s: %w", src, err)
+			}
+			for _, m := range matches {
+				if st, err := os.Stat(m); err == nil && !st.IsDir() {
+					if err := addFile(m); err != nil {
+						return nil, err
+					}
+				}
+			}
+			continue
+		}
+		srcStat, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		if !srcStat.IsDir() {
+			if err := addFile(src); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(src, "*.vm"))
+		if err != nil {
+			return nil, fmt.Errorf("listing files %s: %w", src, err)
+		}
+		for _, f := range files {
+			add(f)
+		}
+	}
+	return paths, nil
+}
+
+// parseOrder reads the --order value, either a comma separated list of
+// sources or the path of a manifest file with one source per line (blank
+// lines and lines starting with # are ignored).
+func parseOrder(order string) ([]string, error) {
+	raw := strings.Split(order, ",")
+	if st, err := os.Stat(order); err == nil && !st.IsDir() && filepath.Ext(order) != ".vm" {
+		data, err := os.ReadFile(order)
+		if err != nil {
+			return nil, err
+		}
+		raw = strings.Split(string(data), "\n")
+	}
+	names := []string{}
+	for _, n := range raw {
+		n = strings.TrimSpace(n)
+		if n == "" || strings.HasPrefix(n, "#") {
+			continue
+		}
+		names = append(names, n)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("empty source order %q", order)
+	}
+	return names, nil
+}
+
+// orderSources puts paths in the order given by names, each matching a source
+// by its path or base name. Sources not named keep their relative order and
+// follow the named ones.
+func orderSources(paths, names []string) ([]string, error) {
+	ordered := make([]string, 0, len(paths))
+	used := make([]bool, len(paths))
+	for _, name := range names {
+		found := false
+		for i, p := range paths {
+			if used[i] {
 				continue
 			}
-			if strings.Contains(line, "function Sys.init 0") {
-				fileWithSysInit = srcF
+			if p == filepath.Clean(name) || filepath.Base(p) == name {
+				ordered = append(ordered, p)
+				used[i] = true
+				found = true
 				break
 			}
 		}
-		if fileWithSysInit != nil {
-			break
+		if !found {
+			return nil, fmt.Errorf("%s is not one of the source files", name)
+		}
+	}
+	for i, p := range paths {
+		if !used[i] {
+			ordered = append(ordered, p)
+		}
+	}
+	return ordered, nil
+}
+
+// globRoot returns the leading directory of a glob pattern that contains no
+// meta characters, used as the base for matching exclude patterns.
+func globRoot(pattern string) string {
+	dir := pattern
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// isExcluded reports whether path matches one of the exclude patterns. A
+// pattern is tried against the path relative to the source root it was found
+// under, against the path as given and against its base name, so both
+// '*_test.vm' and 'backup/*' behave as expected.
+func isExcluded(root, path string, excludes []string) bool {
+	if len(excludes) == 0 {
+		return false
+	}
+	candidates := []string{path, filepath.Base(path)}
+	if rel, err := filepath.Rel(root, path); err == nil && rel != "." {
+		candidates = append(candidates, rel)
+	}
+	for _, ex := range excludes {
+		for _, c := range candidates {
+			if ok, _ := filepath.Match(ex, c); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// defaultDstFile derives the output path from a source argument: Dir/Dir.asm
+// for a directory, Foo.asm next to Foo.vm for a file or Foo.zip archive and,
+// for a glob, an asm named after the directory the pattern lives in.
+func defaultDstFile(src string) (string, error) {
+	if strings.ContainsAny(src, "*?[") {
+		dir := filepath.Dir(src)
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, filepath.Base(abs)+".asm"), nil
+	}
+	srcStat, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if srcStat.IsDir() {
+		return filepath.Join(src, filepath.Base(src)+".asm"), nil
+	}
+	ext := filepath.Ext(src)
+	if isArchive(src) {
+		ext = archiveExt(src)
+	}
+	dst := strings.TrimSuffix(filepath.Base(src), ext)
+	return filepath.Join(filepath.Dir(src), dst+".asm"), nil
+}
+
+// sourceDefinesFunction reports whether the contents of a source, VM code,
+// JSON IR or bytecode by the extension of srcName, declare the function
+// name.
+func sourceDefinesFunction(srcName string, data []byte, name string) bool {
+	switch {
+	case isIRSource(srcName):
+		return irDefinesFunction(bytes.NewReader(data), name)
+	case isBytecodeSource(srcName):
+		return bytecodeDefinesFunction(bytes.NewReader(data), name)
+	}
+	scanner := newLineScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if definesFunction(scanner.Text(), name) {
+			return true
 		}
 	}
-	if fileWithSysInit == nil && hasMultipleSrcFiles {
-		fmt.Println("Sys.init not found in any source file")
-		os.Exit(1)
+	return false
+}
+
+// definesFunction reports whether a raw source line declares the function
+// name, whatever its spacing, trailing comment or number of locals.
+func definesFunction(line, name string) bool {
+	fields := strings.Fields(removeCommentsAndSpaces(line))
+	return len(fields) == 3 && fields[0] == "function" && fields[1] == name
+}
+
+// sourceKey identifies a source file for include bookkeeping.
+func sourceKey(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return filepath.Clean(name)
+}
+
+// includeTarget returns the file named by an include directive on a raw
+// source line, either //!include Other.vm or import Other (extended mode).
+func includeTarget(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if target, ok := strings.CutPrefix(line, "//!include "); ok {
+		return strings.TrimSpace(target), true
+	}
+	fields := strings.Fields(removeCommentsAndSpaces(line))
+	if extendedMode && len(fields) == 2 && fields[0] == "import" {
+		target := fields[1]
+		if filepath.Ext(target) != ".vm" {
+			target += ".vm"
+		}
+		return target, true
+	}
+	return "", false
+}
+
+// sourceLine is a VM command, stripped of comments and surrounding spaces,
+// together with where it comes from.
+type sourceLine struct {
+	File string // path of the file the command is translated as part of
+	Line int    // 1-based line number in File
+	Col  int    // 1-based column Text starts at, 0 when not known
+	Text string
+	// Expansion is the chain of macro expansions that produced the line,
+	// outermost first, empty for a line written as is
+	Expansion []string
+	// Ignore holds the vm:ignore comments of the line, written on it or
+	// above it, and those of the macro lines it was expanded from
+	Ignore []*suppression
+}
+
+// FileName is the name statics of the line are prefixed with: the file base
+// name without extension, spaces replaced by underscores.
+func (sl sourceLine) FileName() string {
+	fileName := strings.TrimSuffix(filepath.Base(sl.File), filepath.Ext(sl.File))
+	return strings.ReplaceAll(fileName, " ", "_")
+}
+
+// StaticPrefix is the name static variables of the line are prefixed
+// with, by the --static-prefix mode: FileName, or the path of the file
+// relative to the working directory with its separators replaced by dots.
+func (sl sourceLine) StaticPrefix() string {
+	if staticPrefixMode != "path" {
+		return sl.FileName()
+	}
+	path := strings.TrimSuffix(sl.File, filepath.Ext(sl.File))
+	if rel, err := filepath.Rel(".", path); err == nil && !strings.HasPrefix(rel, "..") {
+		path = rel
+	}
+	parts := []string{}
+	for _, part := range strings.FieldsFunc(filepath.ToSlash(path), func(r rune) bool { return r == '/' }) {
+		if part == ".." {
+			part = "up"
+		}
+		parts = append(parts, strings.Map(func(r rune) rune {
+			if r == '_' || r == '$' || r == ':' || r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				return r
+			}
+			return '_'
+		}, part))
+	}
+	return strings.Join(parts, ".")
+}
+
+// Pos formats the location of the line for diagnostics.
+func (sl sourceLine) Pos() string {
+	return sl.posAt(0)
+}
+
+// PosOf formats the location err is about, down to the column of the
+// offending token when err is a tokenError.
+func (sl sourceLine) PosOf(err error) string {
+	var te *tokenError
+	if errors.As(err, &te) {
+		return sl.posAt(te.Col)
+	}
+	return sl.Pos()
+}
+
+func (sl sourceLine) posAt(col int) string {
+	pos := fmt.Sprintf("%s:%d", sl.File, sl.Line)
+	if col > 0 && sl.Col > 0 && len(sl.Expansion) == 0 {
+		pos += fmt.Sprintf(":%d", sl.Col+col-1)
+	}
+	for _, e := range sl.Expansion {
+		pos += " (in expansion of " + e + ")"
+	}
+	return pos
+}
+
+// macro is a //!macro NAME(a,b) ... //!end definition.
+type macro struct {
+	Name   string
+	Params []string
+	Body   []sourceLine
+	Pos    string
+}
+
+// preprocessor reads the sources into the flat list of commands to parse,
+// expanding include directives and macros on the way.
+type preprocessor struct {
+	lines []sourceLine
+	// included records every file read so far so that each one is
+	// translated only once
+	included map[string]bool
+	macros   map[string]*macro
+}
+
+func newPreprocessor() *preprocessor {
+	return &preprocessor{
+		included: map[string]bool{},
+		macros:   map[string]*macro{},
+	}
+}
+
+// readSource appends the commands of src, read as data, expanding its
+// include directives in place with the file resolved relative to src.
+// stack holds the files being expanded to detect include cycles.
+func (pp *preprocessor) readSource(src vmSource, data []byte, stack []string) error {
+	switch {
+	case isIRSource(src.Name):
+		return pp.readIRSource(src, data)
+	case isBytecodeSource(src.Name):
+		return pp.readBytecodeSource(src, data)
+	}
+	key := sourceKey(src.Name)
+	stack = append(stack, key)
+	pp.included[key] = true
+	scanner := newLineScanner(bytes.NewReader(data))
+	lineNo := 0
+	var current *macro
+	blockStart := 0 // line of the /* comment still open, 0 when none
+	// pending holds the vm:ignore comments alone on their lines, waiting
+	// for the command they apply to
+	var pending []*suppression
+	ignores := func(raw, pos string) []*suppression {
+		code, comment := splitComment(raw)
+		s := parseSuppression(comment, pos)
+		switch {
+		case code == "" && s != nil:
+			pending = append(pending, s)
+		case code != "":
+			ignore := pending
+			pending = nil
+			if s != nil {
+				ignore = append(ignore, s)
+			}
+			return ignore
+		}
+		return nil
+	}
+	for scanner.Scan() {
+		lineNo++
+		raw := stripBlockComments(scanner.Text(), &blockStart, lineNo)
+		pos := fmt.Sprintf("%s:%d", src.Name, lineNo)
+		if current != nil {
+			if strings.TrimSpace(raw) == "//!end" {
+				pp.macros[current.Name] = current
+				current = nil
+				continue
+			}
+			ignore := ignores(raw, pos)
+			if line := removeCommentsAndSpaces(raw); line != "" {
+				current.Body = append(current.Body, sourceLine{File: src.Name, Line: lineNo, Text: line, Ignore: ignore})
+			}
+			continue
+		}
+		if header, ok := strings.CutPrefix(strings.TrimSpace(raw), "//!macro "); ok {
+			m, err := parseMacroHeader(header)
+			if err != nil {
+				return fmt.Errorf("%s: %w", pos, err)
+			}
+			if prev, ok := pp.macros[m.Name]; ok {
+				return fmt.Errorf("%s: macro %s already defined at %s", pos, m.Name, prev.Pos)
+			}
+			m.Pos = pos
+			current = m
+			continue
+		}
+		if target, ok := includeTarget(raw); ok {
+			inc := src.Sibling(target)
+			incKey := sourceKey(inc.Name)
+			if slices.Contains(stack, incKey) {
+				return fmt.Errorf("%s: include cycle: %s includes %s", pos, src.Name, inc.Name)
+			}
+			if pp.included[incKey] {
+				continue
+			}
+			incData, err := inc.ReadFile()
+			if err != nil {
+				return fmt.Errorf("%s: %w", pos, err)
+			}
+			if err := pp.readSource(inc, incData, stack); err != nil {
+				return err
+			}
+			continue
+		}
+		ignore := ignores(raw, pos)
+		line := removeCommentsAndSpaces(raw)
+		if line == "" {
+			continue
+		}
+		col := len(raw) - len(strings.TrimLeft(raw, " \t")) + 1
+		if err := pp.addLine(sourceLine{File: src.Name, Line: lineNo, Col: col, Text: line, Ignore: ignore}, nil); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading file %s: %w", src.Name, err)
+	}
+	if current != nil {
+		return fmt.Errorf("%s: macro %s is missing its //!end", current.Pos, current.Name)
+	}
+	if blockStart != 0 {
+		return fmt.Errorf("%s:%d: unterminated /* comment", src.Name, blockStart)
+	}
+	return nil
+}
+
+// addLine appends a command, expanding it when it invokes a macro. active
+// lists the macros being expanded, guarding against recursive definitions.
+func (pp *preprocessor) addLine(sl sourceLine, active []string) error {
+	name, args, ok := parseMacroCall(sl.Text)
+	m := pp.macros[name]
+	if !ok || m == nil {
+		pp.lines = append(pp.lines, sl)
+		return nil
+	}
+	if slices.Contains(active, name) {
+		return fmt.Errorf("%s: macro %s expands itself", sl.Pos(), name)
+	}
+	if len(args) != len(m.Params) {
+		return fmt.Errorf("%s: macro %s expects %d arguments, got %d", sl.Pos(), name, len(m.Params), len(args))
+	}
+	for _, body := range m.Body {
+		expanded := sourceLine{
+			File:      sl.File,
+			Line:      sl.Line,
+			Text:      substituteParams(body.Text, m.Params, args),
+			Expansion: append(slices.Clone(sl.Expansion), fmt.Sprintf("%s defined at %s:%d", name, body.File, body.Line)),
+			Ignore:    append(slices.Clone(sl.Ignore), body.Ignore...),
+		}
+		if err := pp.addLine(expanded, append(active, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// substituteParams replaces every token of text equal to one of params by
+// the matching argument, tokens being delimited by spaces, commas and
+// parentheses so that arguments of nested macro calls are substituted too.
+func substituteParams(text string, params, args []string) string {
+	var sb strings.Builder
+	start := 0
+	flush := func(end int) {
+		token := text[start:end]
+		if p := slices.Index(params, token); p >= 0 {
+			token = args[p]
+		}
+		sb.WriteString(token)
+	}
+	for k := 0; k < len(text); k++ {
+		if strings.IndexByte(" \t,()", text[k]) >= 0 {
+			flush(k)
+			sb.WriteByte(text[k])
+			start = k + 1
+		}
+	}
+	flush(len(text))
+	return sb.String()
+}
+
+// parseMacroHeader parses the NAME(a,b) part of a macro definition.
+func parseMacroHeader(header string) (*macro, error) {
+	name, params, ok := parseMacroCall(strings.TrimSpace(header))
+	if !ok {
+		return nil, fmt.Errorf("invalid macro definition, expected //!macro NAME(a,b): %s", header)
+	}
+	for k, p := range params {
+		if p == "" || strings.ContainsAny(p, " \t") || slices.Contains(params[:k], p) {
+			return nil, fmt.Errorf("invalid parameter %q in macro %s", p, name)
+		}
+	}
+	return &macro{Name: name, Params: params}, nil
+}
+
+// parseMacroCall splits NAME(a, b) into its name and arguments.
+func parseMacroCall(text string) (string, []string, bool) {
+	open := strings.Index(text, "(")
+	if open <= 0 || !strings.HasSuffix(text, ")") || strings.ContainsAny(text[:open], " \t") {
+		return "", nil, false
+	}
+	name := text[:open]
+	inner := strings.TrimSpace(text[open+1 : len(text)-1])
+	if inner == "" {
+		return name, []string{}, true
+	}
+	args := strings.Split(inner, ",")
+	for k := range args {
+		args[k] = strings.TrimSpace(args[k])
+	}
+	return name, args, true
+}
+
+// stripBlockComments blanks out the parts of line covered by /* ... */
+// comments, which may span lines; blockStart carries the line the comment
+// still open at the end of line was started on. Comment text is replaced
+// by spaces rather than removed so columns stay accurate.
+func stripBlockComments(line string, blockStart *int, lineNo int) string {
+	if *blockStart == 0 && !strings.Contains(line, "/*") {
+		return line
+	}
+	b := []byte(line)
+	inString := false
+	for i := 0; i < len(b); i++ {
+		switch {
+		case *blockStart != 0:
+			if strings.HasPrefix(line[i:], "*/") {
+				*blockStart = 0
+				b[i], b[i+1] = ' ', ' '
+				i++
+			} else {
+				b[i] = ' '
+			}
+		case b[i] == '"':
+			inString = !inString
+		case inString:
+		case strings.HasPrefix(line[i:], "//"):
+			return string(b)
+		case strings.HasPrefix(line[i:], "/*"):
+			*blockStart = lineNo
+			b[i], b[i+1] = ' ', ' '
+			i++
+		}
 	}
+	return string(b)
+}
 
-	// create dst if not exists
-	var dstF *os.File
-	if _, err := os.Stat(dstFile); os.IsNotExist(err) {
-		dstF, err = os.Create(dstFile)
-		if err != nil {
-			fmt.Println("Error creating destination file", err)
-			os.Exit(1)
-		}
-		defer dstF.Close()
-	} else {
-		dstF, err = os.OpenFile(dstFile, os.O_WRONLY, 0644)
-		if err != nil {
-			fmt.Println("Error opening destination file", err)
-			os.Exit(1)
-		}
-		defer dstF.Close()
-	}
-
-	// rawSourceLines := []string{}
-	instructionsLines := []string{}
-
-	if hasMultipleSrcFiles {
-		// we need to scan the file with Sys.init last
-		// Create a new slice with Sys.init file last
-		files := make([]*os.File, 0, len(srcFiles))
-		// Add all other files first
-		for _, f := range srcFiles {
-			if f != fileWithSysInit {
-				files = append(files, f)
-			}
-		}
-		// Add the file with Sys.init last if it exists
-		if fileWithSysInit != nil {
-			files = append(files, fileWithSysInit)
-		}
-		// Loop through all files in the correct order
-		for _, sFile := range files {
-			// Reset file pointer to beginning of file
-			sFile.Seek(0, 0)
-			scanner := bufio.NewScanner(sFile)
-			for scanner.Scan() {
-				line := removeCommentsAndSpaces(scanner.Text())
-				if line == "" {
-					continue
-				}
-				line = encodeLineFileName(sFile.Name(), line)
-				instructionsLines = append(instructionsLines, line)
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// newLineScanner returns a scanner over the lines of r that accepts \n,
+// \r\n and lone \r line endings and skips a leading UTF-8 byte order mark.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	first := true
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		skip := 0
+		if first {
+			if !atEOF && len(data) < len(utf8BOM) && bytes.HasPrefix(utf8BOM, data) {
+				return 0, nil, nil
 			}
-			if err := scanner.Err(); err != nil {
-				fmt.Printf("Error reading file %s: %v\n", sFile.Name(), err)
-				os.Exit(1)
+			if bytes.HasPrefix(data, utf8BOM) {
+				skip = len(utf8BOM)
 			}
 		}
-	} else {
-		sFile := srcFiles[0]
-		sFile.Seek(0, 0)
-		scanner := bufio.NewScanner(sFile)
-		for scanner.Scan() {
-			line := removeCommentsAndSpaces(scanner.Text())
-			if line == "" {
-				continue
+		if i := bytes.IndexAny(data[skip:], "\r\n"); i >= 0 {
+			i += skip
+			advance := i + 1
+			if data[i] == '\r' {
+				if i+1 < len(data) {
+					if data[i+1] == '\n' {
+						advance++
+					}
+				} else if !atEOF {
+					// the \n of a \r\n may be in the next read
+					return 0, nil, nil
+				}
 			}
-			line = encodeLineFileName(sFile.Name(), line)
-			instructionsLines = append(instructionsLines, line)
+			first = false
+			return advance, data[skip:i], nil
 		}
-	}
-
-	if len(instructionsLines) == 0 {
-		fmt.Println("No source lines found")
-		os.Exit(1)
-	}
+		if atEOF && len(data) > skip {
+			first = false
+			return len(data), data[skip:], nil
+		}
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	})
+	return scanner
+}
 
-	resultLines := []string{}
+func removeCommentsAndSpaces(line string) string {
+	code, _ := splitComment(line)
+	return code
+}
 
-	if fileWithSysInit != nil {
-		lines := []string{
-			"// Bootstrap code",
-			"@256",
-			"D=A",
-			"@SP",
-			"M=D",
-			"/// call Sys.init 0",
+// splitComment splits line into its trimmed code and its // comment, if
+// any.
+func splitComment(line string) (string, string) {
+	// a // inside a string literal does not start a comment
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '"':
+			inString = !inString
+		case !inString && strings.HasPrefix(line[i:], "//"):
+			return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i:])
 		}
-		lines = append(lines, genCall("Sys.init", 0)...)
-		resultLines = append(resultLines, lines...)
 	}
+	return strings.TrimSpace(line), ""
+}
 
-	for i, rLine := range instructionsLines {
-		fileName, line := decodeLineFileName(rLine)
-		instruction, err := parseInstruction(i, fileName, line)
-		if err != nil {
-			fmt.Println("Error parsing instruction", err)
-			os.Exit(2)
+// translationStats is the size of a program and of its translation.
+type translationStats struct {
+	Files        int `json:"files"`
+	Commands     int `json:"commands"`
+	Functions    int `json:"functions"`
+	Lines        int `json:"lines"`
+	Instructions int `json:"instructions"` // Hack instructions, the ROM words
+}
+
+func newTranslationStats(tr *translation) translationStats {
+	files := map[string]bool{}
+	st := translationStats{Commands: len(tr.Commands), Lines: len(tr.Lines)}
+	for k, inst := range tr.Instructions {
+		files[tr.Commands[k].File] = true
+		if inst.CommandType == CommandTypeFunction {
+			st.Functions++
 		}
-		asm, err := instruction.GenAsm()
-		if err != nil {
-			fmt.Println("Error generating asm", err)
-			os.Exit(2)
+	}
+	st.Files = len(files)
+	for _, l := range stripAsm(tr.Lines) {
+		if !strings.HasPrefix(l.Text, "(") {
+			st.Instructions++
 		}
-		resultLines = append(resultLines, asm...)
 	}
+	return st
+}
 
-	// MARK: - Write to Destination File
-	if err = writeLinesToDst(dstF, resultLines); err != nil {
-		fmt.Println("Error writing to destination file", err)
-		os.Exit(2)
+// printDryRun prints what a translation would write instead of writing
+// it: the size of the program and of its assembly, whether the
+// destination exists and the other outputs asked for.
+func printDryRun(tr *translation, dstFile string, canWrite bool, outputs map[string]string) {
+	st := newTranslationStats(tr)
+	logger.Info(fmt.Sprintf("Dry run, nothing written: %s in %s and %s, translated to %s and %s",
+		plural(st.Commands, "command"), plural(st.Files, "file"), plural(st.Functions, "function"),
+		plural(st.Lines, "line"), plural(st.Instructions, "instruction")))
+	switch _, err := os.Stat(dstFile); {
+	case err != nil:
+		logger.Info("Would create destination file", "file", dstFile)
+	case canWrite:
+		logger.Info("Would replace destination file", "file", dstFile)
+	default:
+		logger.Warn(fmt.Sprintf("Would not replace %s, which was not written by the translator, without --force", dstFile))
 	}
-
-	fmt.Println("Successfully wrote to destination file:", dstFile)
-
-	// MARK: - Compare with Expected Output
-	if cmpFile != "" {
-		// read cmp file and compare with filteredLines
-		cmpF, err := os.Open(cmpFile)
-		if err != nil {
-			fmt.Println("Error opening compare file", err)
-			os.Exit(2)
-		}
-		defer cmpF.Close()
-		cmpLines := []string{}
-		scanner := bufio.NewScanner(cmpF)
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			cmpLines = append(cmpLines, line)
-		}
-		if len(cmpLines) != len(resultLines) {
-			fmt.Println("Compare file has a different number of lines than the source file")
-			os.Exit(2)
-		}
-		for i, line := range cmpLines {
-			if line != resultLines[i] {
-				fmt.Printf(
-					"Error in file %s:%d %s\n"+
-						"\t Expected: %s\n"+
-						"\t Got: %s\n",
-					cmpFile,
-					i+1,
-					"lines are not equal",
-					line,
-					resultLines[i],
-				)
-				os.Exit(2)
-			}
+	for _, what := range slices.Sorted(maps.Keys(outputs)) {
+		if outputs[what] != "" {
+			logger.Info("Would write "+what, "file", outputs[what])
 		}
-		fmt.Println("Successfully compared files")
 	}
-
 }
 
-func encodeLineFileName(fileName, line string) string {
-	fileName = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
-	fileName = strings.ReplaceAll(fileName, " ", "_")
-	return fmt.Sprintf("%s#%s", fileName, line)
+// writtenByTranslator reports whether the destination file path can be
+// overwritten without --force: it does not exist, or the translator wrote
+// it, as the header comment (the version string of readBuildInfo) of the
+// program of be says and the format field of JSON IR.
+func writtenByTranslator(path, emit string, be backend) (bool, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if emit == "json" {
+		_, err := readIR(f)
+		return err == nil, nil
+	}
+	first, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.HasPrefix(first, be.Comment("vmtranslator ")), nil
 }
 
-func decodeLineFileName(line string) (string, string) {
-	parts := strings.Split(line, "#")
-	if len(parts) != 2 {
-		return "", ""
+// checkDestination reports whether the translator wrote dstFile, failing
+// when it may not be written: never over one of the sources, and over a
+// file the translator did not write only with force. The output of
+// --no-header is such a file, having no header to be recognized by.
+func checkDestination(dstFile string, sources []string, emit string, be backend, force bool) (bool, error) {
+	for _, src := range sources {
+		if sameSource(dstFile, src) {
+			return false, failf(exitUsage, "%s is a source of the translation, pass -o to write elsewhere", dstFile)
+		}
+	}
+	owned, err := writtenByTranslator(dstFile, emit, be)
+	if err != nil {
+		return false, failf(exitIO, "Error reading destination file %s", err)
+	}
+	if !owned && !force {
+		return false, failf(exitUsage, "%s exists and was not written by the translator, pass --force to overwrite it or -o to write elsewhere", dstFile)
 	}
-	return parts[0], strings.TrimSpace(parts[1])
+	return owned, nil
 }
 
-func removeCommentsAndSpaces(line string) string {
-	v := strings.Split(line, "//")
-	if len(v) == 0 {
-		return ""
+// writeFileAtomic writes path through write, first to a temporary file
+// next to it then renamed over it, so that a failed or interrupted write
+// leaves the previous file, or none, rather than a part of the new one.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// an interrupt while writing removes the temporary file
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		signal.Stop(sig)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-sig:
+			tmp.Close()
+			os.Remove(tmp.Name())
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	err = write(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
 	}
-	return strings.TrimSpace(v[0])
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
-func writeLinesToDst(dstF *os.File, lines []string) error {
-	dstF.Truncate(0)
-	dstF.Seek(0, 0)
+func writeLinesToDst(dst io.Writer, lines []string) error {
+	w := bufio.NewWriter(dst)
 	for _, line := range lines {
-		dstF.WriteString(line + "\n")
+		if _, err := w.WriteString(line + "\n"); err != nil {
+			return err
+		}
 	}
-	return nil
+	return w.Flush()
 }
 
 type Instruction struct {
@@ -379,12 +1804,63 @@ type Instruction struct {
 	Arg2Val     int
 	ALType      ALType
 	Index       int
+	// Plugin is the code of a CommandTypePlugin command
+	Plugin *pluginCode
+	// Function is the function the command is in, "" before the first
+	// function, set by scopeLabels
+	Function string
+}
+
+// labelSymbol is the assembly symbol of the label of a label, goto or
+// if-goto command: functionName$label in a function, as the course
+// specifies, and the label itself before the first function.
+func (i *Instruction) labelSymbol() string {
+	if i.Function == "" {
+		return i.Arg1
+	}
+	return i.Function + "$" + i.Arg1
+}
+
+// scopeLabels sets the function of every command, scoping its labels.
+func scopeLabels(instructions []*Instruction) {
+	fn := ""
+	for _, i := range instructions {
+		if i.CommandType == CommandTypeFunction {
+			fn = i.Arg1
+		}
+		i.Function = fn
+	}
+}
+
+// checkSegments fails on a command outside of its segment, temp having 8
+// words and pointer 2, and on a pop into constant, which is not in memory.
+func checkSegments(instructions []*Instruction) (int, error) {
+	for k, i := range instructions {
+		if i.CommandType != CommandTypePush && i.CommandType != CommandTypePop {
+			continue
+		}
+		switch {
+		case i.SegmentType == SegmentTypeTemp && i.Arg2Val > 7:
+			return k, fmt.Errorf("temp %d out of range 0..7", i.Arg2Val)
+		case i.SegmentType == SegmentTypePointer && i.Arg2Val > 1:
+			return k, fmt.Errorf("pointer %d out of range 0..1", i.Arg2Val)
+		case i.CommandType == CommandTypePop && i.SegmentType == SegmentTypeConstant:
+			return k, fmt.Errorf("pop constant %d, constant is not a memory segment", i.Arg2Val)
+		}
+	}
+	return -1, nil
 }
 
 func (i *Instruction) String() string {
 	if i.CommandType == CommandTypeArithmetic {
 		return i.Arg1
 	}
+	if i.CommandType == CommandTypePlugin {
+		return i.Line
+	}
+	if i.CommandType == CommandTypePush && i.SegmentType == SegmentTypeString {
+		return fmt.Sprintf("push string %q", i.Arg2)
+	}
 	if i.CommandType == CommandTypePush {
 		return fmt.Sprintf("push %s %d", i.SegmentType.String(), i.Arg2Val)
 	}
@@ -394,15 +1870,90 @@ func (i *Instruction) String() string {
 	return fmt.Sprintf("%s %s %s", i.CommandType.String(), i.Arg1, i.Arg2)
 }
 
+// token is a word of a VM command.
+type token struct {
+	Text string
+	Col  int // 1-based column of the token in the command
+}
+
+// tokenError is a parse error about a specific token of a command.
+type tokenError struct {
+	Col int
+	Msg string
+}
+
+func (e *tokenError) Error() string {
+	return e.Msg
+}
+
+func errAt(t token, format string, args ...any) error {
+	return &tokenError{Col: t.Col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// tokenize splits a command into words separated by any run of spaces or
+// tabs (strings.Fields semantics), except that a double quoted string
+// literal, quotes included, is a single token whatever it contains.
+func tokenize(text string) ([]token, error) {
+	toks := []token{}
+	for i := 0; i < len(text); {
+		if text[i] == ' ' || text[i] == '\t' {
+			i++
+			continue
+		}
+		start := i
+		if text[i] == '"' {
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				return nil, &tokenError{Col: start + 1, Msg: "unterminated string literal"}
+			}
+			i += end + 2
+		} else {
+			for i < len(text) && text[i] != ' ' && text[i] != '\t' {
+				i++
+			}
+		}
+		toks = append(toks, token{Text: text[start:i], Col: start + 1})
+	}
+	return toks, nil
+}
+
 func parseInstruction(index int, fileName string, line string) (*Instruction, error) {
-	parts := strings.Split(line, " ")
-	pl := len(parts)
-	if pl == 0 || pl > 3 {
-		return nil, fmt.Errorf("invalid instruction length: %d", pl)
+	toks, err := tokenize(line)
+	if err != nil {
+		return nil, err
+	}
+	pl := len(toks)
+	if pl == 0 {
+		return nil, fmt.Errorf("empty instruction")
+	}
+	if inst, ok, err := parsePluginCommand(index, fileName, line, toks); ok {
+		return inst, err
+	}
+	switch toks[0].Text {
+	case "push":
+		if pl > 1 && toks[1].Text == "string" {
+			return parseStringPush(index, fileName, line, toks)
+		}
+	case "static-init":
+		return parseStaticInit(index, fileName, line, toks)
+	case "import":
+		// expanded while reading the sources in extended mode
+		return nil, errAt(toks[0], "import is an extended directive, enable it with --ext or use //!include")
+	}
+	if pl > 3 {
+		return nil, errAt(toks[3], "invalid instruction length: %d", pl)
+	}
+	parts := make([]string, pl)
+	for k, t := range toks {
+		parts[k] = t.Text
 	}
 	// arithmetic/logical command parsing
 	validAL := []string{"add", "sub", "neg", "eq", "gt", "lt", "and", "or", "not"}
-	if pl == 1 && slices.Contains(validAL, parts[0]) {
+	extendedAL := []string{"shl", "shr", "mult", "div", "mod"}
+	if pl == 1 && slices.Contains(extendedAL, parts[0]) && !extendedMode {
+		return nil, errAt(toks[0], "%s is an extended command, enable it with --ext", parts[0])
+	}
+	if pl == 1 && (slices.Contains(validAL, parts[0]) || slices.Contains(extendedAL, parts[0])) {
 		al := ALTypeAdd
 		rawAl := parts[0]
 		switch rawAl {
@@ -424,6 +1975,16 @@ func parseInstruction(index int, fileName string, line string) (*Instruction, er
 			al = ALTypeOr
 		case "not":
 			al = ALTypeNot
+		case "shl":
+			al = ALTypeShl
+		case "shr":
+			al = ALTypeShr
+		case "mult":
+			al = ALTypeMult
+		case "div":
+			al = ALTypeDiv
+		case "mod":
+			al = ALTypeMod
 		}
 		return &Instruction{
 			FileName:    fileName,
@@ -456,7 +2017,20 @@ func parseInstruction(index int, fileName string, line string) (*Instruction, er
 	case "call":
 		ct = CommandTypeCall
 	default:
-		return nil, fmt.Errorf("invalid command type: %s", parts[0])
+		return nil, errAt(toks[0], "invalid command type: %s", parts[0])
+	}
+
+	// operand count, checked before the operands are indexed
+	want := map[CommandType]int{
+		CommandTypePush: 3, CommandTypePop: 3, CommandTypeFunction: 3, CommandTypeCall: 3,
+		CommandTypeLabel: 2, CommandTypeGOTO: 2, CommandTypeIf: 2,
+	}[ct]
+	if ct != CommandTypeReturn && pl != want {
+		at := toks[len(toks)-1]
+		if pl > want {
+			at = toks[want]
+		}
+		return nil, errAt(at, "invalid %s, expected %s", parts[0], plural(want-1, "argument"))
 	}
 
 	// arg1 parsing
@@ -484,13 +2058,26 @@ func parseInstruction(index int, fileName string, line string) (*Instruction, er
 		case "pointer":
 			st = SegmentTypePointer
 		default:
-			return nil, fmt.Errorf("invalid arg1 segment type: %s", parts[1])
+			return nil, errAt(toks[1], "invalid arg1 segment type: %s", parts[1])
 		}
 	case CommandTypeLabel, CommandTypeGOTO, CommandTypeIf, CommandTypeFunction, CommandTypeCall:
 		arg1 = parts[1]
+		kind := "label"
+		if ct == CommandTypeFunction || ct == CommandTypeCall {
+			kind = "function"
+		}
+		if !hackSymbolRe.MatchString(arg1) {
+			return nil, errAt(toks[1], "invalid %s name %s, expected letters, digits, _ . $ and : not starting with a digit", kind, arg1)
+		}
+		if _, ok := newHackSymbols()[arg1]; ok {
+			return nil, errAt(toks[1], "invalid %s name %s, a predefined symbol of Hack assembly", kind, arg1)
+		}
+		if generatedSuffixRe.MatchString(arg1) {
+			return nil, errAt(toks[1], "invalid %s name %s, a $ followed by a digit is kept for the labels the translator generates", kind, arg1)
+		}
 	case CommandTypeReturn:
 		if len(parts) > 1 {
-			return nil, fmt.Errorf("invalid arg1 return, no argument expected")
+			return nil, errAt(toks[1], "invalid arg1 return, no argument expected")
 		}
 	default:
 		return nil, fmt.Errorf("invalid command type: %s", parts[0])
@@ -501,17 +2088,28 @@ func parseInstruction(index int, fileName string, line string) (*Instruction, er
 	arg2 := ""
 	if ct == CommandTypePush || ct == CommandTypePop ||
 		ct == CommandTypeFunction || ct == CommandTypeCall {
-		if len(parts) > 2 {
-			arg2 = parts[2]
-		} else {
-			return nil, fmt.Errorf("invalid arg2 value: %s", arg2)
+		arg2 = parts[2]
+		var err error
+		arg2Val, err = strconv.Atoi(arg2)
+		if err != nil {
+			return nil, errAt(toks[2], "invalid arg2 value: %s", arg2)
 		}
-		if len(arg2) > 0 {
-			var err error
-			arg2Val, err = strconv.Atoi(arg2)
-			if err != nil {
-				return nil, fmt.Errorf("invalid arg2 value: %s", arg2)
+		if ct == CommandTypePush && st == SegmentTypeConstant {
+			if arg2Val < 0 && !extendedMode {
+				return nil, errAt(toks[2], "negative constant %d, enable it with --ext", arg2Val)
 			}
+			if arg2Val < -32768 || arg2Val > 32767 {
+				return nil, errAt(toks[2], "constant out of range -32768..32767: %d", arg2Val)
+			}
+		} else if arg2Val < 0 || arg2Val > 32767 {
+			what := parts[1] + " index"
+			switch ct {
+			case CommandTypeFunction:
+				what = "number of locals"
+			case CommandTypeCall:
+				what = "number of arguments"
+			}
+			return nil, errAt(toks[2], "%s out of range 0..32767: %d", what, arg2Val)
 		}
 	}
 
@@ -526,10 +2124,121 @@ func parseInstruction(index int, fileName string, line string) (*Instruction, er
 	}, nil
 }
 
+// parseStringPush handles the extended push string "literal" command.
+func parseStringPush(index int, fileName, line string, toks []token) (*Instruction, error) {
+	if !extendedMode {
+		return nil, errAt(toks[1], "push string is an extended command, enable it with --ext")
+	}
+	if len(toks) != 3 {
+		return nil, errAt(toks[len(toks)-1], "invalid push string, expected push string \"literal\"")
+	}
+	literal := toks[2].Text
+	if len(literal) < 2 || literal[0] != '"' || literal[len(literal)-1] != '"' {
+		return nil, errAt(toks[2], "invalid string literal: %s", literal)
+	}
+	literal = literal[1 : len(literal)-1]
+	for _, c := range literal {
+		if c < ' ' || c > '~' {
+			return nil, errAt(toks[2], "invalid character %q in string literal, only printable ASCII is allowed", c)
+		}
+	}
+	return &Instruction{
+		FileName:    fileName,
+		Line:        line,
+		CommandType: CommandTypePush,
+		SegmentType: SegmentTypeString,
+		Arg1:        SegmentTypeString.String(),
+		Arg2:        literal,
+		Arg2Val:     len(literal),
+		Index:       index,
+	}, nil
+}
+
+// parseStaticInit handles the extended static-init directive giving a static
+// variable its initial value, either as static-init Foo.3 1234 or, for the
+// current file, as static-init 3 1234.
+func parseStaticInit(index int, fileName, line string, toks []token) (*Instruction, error) {
+	if !extendedMode {
+		return nil, errAt(toks[0], "static-init is an extended directive, enable it with --ext")
+	}
+	if len(toks) != 3 {
+		return nil, errAt(toks[0], "invalid static-init, expected static-init File.index value: %s", line)
+	}
+	parts := []string{toks[0].Text, toks[1].Text, toks[2].Text}
+	symbol := parts[1]
+	if !strings.Contains(symbol, ".") {
+		symbol = fileName + "." + symbol
+	}
+	dot := strings.LastIndex(symbol, ".")
+	staticIndex, err := strconv.Atoi(symbol[dot+1:])
+	if err != nil || dot == 0 || staticIndex < 0 {
+		return nil, errAt(toks[1], "invalid static-init variable: %s", parts[1])
+	}
+	value, err := strconv.Atoi(parts[2])
+	if err != nil || value < -32768 || value > 32767 {
+		return nil, errAt(toks[2], "invalid static-init value, expected -32768..32767: %s", parts[2])
+	}
+	return &Instruction{
+		FileName:    fileName,
+		Line:        line,
+		CommandType: CommandTypeStaticInit,
+		Arg1:        symbol,
+		Arg2:        parts[2],
+		Arg2Val:     value,
+		Index:       index,
+	}, nil
+}
+
+// genStaticInit emits the stores of every static-init directive, run by the
+// bootstrap code before the entry function (or first thing without one).
+func genStaticInit(instructions []*Instruction) ([]string, error) {
+	lines := []string{}
+	values := map[string]int{}
+	for _, i := range instructions {
+		if i.CommandType != CommandTypeStaticInit {
+			continue
+		}
+		if v, ok := values[i.Arg1]; ok {
+			if v != i.Arg2Val {
+				return nil, fmt.Errorf("conflicting static-init values for %s: %d and %d", i.Arg1, v, i.Arg2Val)
+			}
+			continue
+		}
+		values[i.Arg1] = i.Arg2Val
+		if len(lines) == 0 {
+			lines = append(lines, "// Static initialization")
+		}
+		lines = append(lines, fmt.Sprintf("/// %s", i.Line))
+		lines = append(lines, genLoadConstant(i.Arg2Val)...)
+		lines = append(lines, "@"+i.Arg1)
+		lines = append(lines, "M=D")
+	}
+	return lines, nil
+}
+
 func (i *Instruction) GenAsm() ([]string, error) {
 	lines := []string{
 		fmt.Sprintf("// %s", i.Line),
 	}
+	if i.CommandType == CommandTypePlugin {
+		// the plugin's code expects the whole stack in RAM
+		return append(append(lines, genSpill()...), i.Plugin.Asm...), nil
+	}
+	if code, ok, err := i.templateCode(); ok {
+		if err != nil {
+			return nil, fmt.Errorf("%s.tmpl: %w", i.templateKey(), err)
+		}
+		return append(lines, code...), nil
+	}
+	if optLevel != optNone {
+		if cached := i.genCached(); cached != nil {
+			return append(lines, cached...), nil
+		}
+		lines = append(lines, genSpill()...)
+		if short := i.genShort(); short != nil {
+			return append(lines, short...), nil
+		}
+	}
 	switch i.CommandType {
 	case CommandTypeArithmetic:
 		aLines, err := i.genArithmetic()
@@ -550,6 +2259,12 @@ func (i *Instruction) GenAsm() ([]string, error) {
 			lines = append(lines, i.genTempPUSH()...)
 		case SegmentTypePointer:
 			lines = append(lines, i.genPointerPUSH()...)
+		case SegmentTypeString:
+			sLines, err := i.genStringPUSH()
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, sLines...)
 		default:
 			lines = append(lines, i.genSegmentPUSH(i.SegmentType, i.Arg2Val)...)
 		}
@@ -569,17 +2284,17 @@ func (i *Instruction) GenAsm() ([]string, error) {
 		}
 		return lines, nil
 	case CommandTypeLabel:
-		lines = append(lines, fmt.Sprintf("(%s)", i.Arg1))
+		lines = append(lines, fmt.Sprintf("(%s)", i.labelSymbol()))
 		return lines, nil
 	case CommandTypeGOTO:
-		lines = append(lines, fmt.Sprintf("@%s", i.Arg1))
+		lines = append(lines, fmt.Sprintf("@%s", i.labelSymbol()))
 		lines = append(lines, "0;JMP")
 		return lines, nil
 	case CommandTypeIf:
 		lines = append(lines, "@SP")
 		lines = append(lines, "AM=M-1") // pop & set A to SP-1
 		lines = append(lines, "D=M")    // D = value at SP-1
-		lines = append(lines, fmt.Sprintf("@%s", i.Arg1))
+		lines = append(lines, fmt.Sprintf("@%s", i.labelSymbol()))
 		lines = append(lines, "D;JNE") // if D != 0, jump to label
 		return lines, nil
 	case CommandTypeFunction:
@@ -591,6 +2306,9 @@ func (i *Instruction) GenAsm() ([]string, error) {
 	case CommandTypeCall:
 		lines = append(lines, genCall(i.Arg1, i.Arg2Val)...)
 		return lines, nil
+	case CommandTypeStaticInit:
+		// stored by the static initialization block, see genStaticInit
+		return lines, nil
 	}
 	return nil, fmt.Errorf("invalid or not handled command with type: %s", i.CommandType.String())
 }
@@ -624,13 +2342,15 @@ func (i *Instruction) genArithmetic() ([]string, error) {
 		lines = append(lines, "M=D-M")
 
 	case ALTypeEq, ALTypeGt, ALTypeLt:
-		id := i.ALType.String()
+		id := strings.ToUpper(i.ALType.String())
+		n := nextLabelIndex(id)
+		trueLabel, falseLabel := generatedLabel(id+"_TRUE", n), generatedLabel(id+"_FALSE", n)
 		lines = append(lines, "@SP")
 		lines = append(lines, "AM=M-1")
 		lines = append(lines, "D=M")
 		lines = append(lines, "A=A-1")
 		lines = append(lines, "D=M-D")
-		lines = append(lines, i.getLogicalARegister(id+"_true"))
+		lines = append(lines, "@"+trueLabel)
 		switch i.ALType {
 		case ALTypeEq:
 			lines = append(lines, "D;JEQ")
@@ -642,41 +2362,89 @@ func (i *Instruction) genArithmetic() ([]string, error) {
 		lines = append(lines, "@SP")
 		lines = append(lines, "A=M-1")
 		lines = append(lines, "M=0") // set to 0 if false
-		lines = append(lines, i.getLogicalARegister(id+"_false"))
+		lines = append(lines, "@"+falseLabel)
 		lines = append(lines, "0;JMP")
 
-		lines = append(lines, i.getLogicalLabel(id+"_true")) // LABEL
+		lines = append(lines, "("+trueLabel+")")
 		lines = append(lines, "@SP")
 		lines = append(lines, "A=M-1")
 		lines = append(lines, "M=-1") // set to -1 if true
 
-		lines = append(lines, i.getLogicalLabel(id+"_false")) // LABEL
+		lines = append(lines, "("+falseLabel+")")
 
 	case ALTypeNot:
 		lines = append(lines, "@SP")
 		lines = append(lines, "A=M-1")
 		lines = append(lines, "M=!M")
 
+	case ALTypeShl, ALTypeShr:
+		// extended ALU shift instructions
+		op := "M=M<<"
+		if i.ALType == ALTypeShr {
+			op = "M=M>>"
+		}
+		lines = append(lines, "@SP")
+		lines = append(lines, "A=M-1")
+		lines = append(lines, op)
+
+	case ALTypeMult, ALTypeDiv, ALTypeMod:
+		// call the shared subroutine with the return address in the third
+		// scratch register
+		id := strings.ToUpper(i.ALType.String()) + "_RETURN"
+		retLabel := generatedLabel(id, nextLabelIndex(id))
+		usedRuntime[i.ALType] = true
+		lines = append(lines, "@"+retLabel)
+		lines = append(lines, "D=A")
+		lines = append(lines, "@"+scratch(2))
+		lines = append(lines, "M=D")
+		lines = append(lines, "@"+runtimeLabel(i.ALType))
+		lines = append(lines, "0;JMP")
+		lines = append(lines, "("+retLabel+")")
+
 	default:
 		return nil, fmt.Errorf("invalid arithmetic/logical command: %s", i.ALType.String())
 	}
 	return lines, nil
 }
 
-func (i *Instruction) getLogicalLabel(prefix string) string {
-	v := fmt.Sprintf("(%s.%d)", prefix, i.Index)
-	return strings.ToUpper(v)
+// nextLabelIndex returns the number of the next label of a kind in the
+// current function.
+func nextLabelIndex(kind string) int {
+	n := labelCounts[kind]
+	labelCounts[kind]++
+	return n
 }
 
-func (i *Instruction) getLogicalARegister(prefix string) string {
-	v := fmt.Sprintf("@%s.%d", prefix, i.Index)
-	return strings.ToUpper(v)
+// generatedLabel is the n-th label of a kind generated in the current
+// function, like Main.main$EQ_TRUE$2. No name of the VM code has a $
+// followed by a digit, so no function or label of the program can be
+// named the same, whatever its function.
+func generatedLabel(kind string, n int) string {
+	return fmt.Sprintf("%s$%s$%d", currentFunctionName, kind, n)
 }
 
-func (i *Instruction) genConstantPUSH(val int) []string {
+// genLoadConstant sets D to val, negating the positive constant for
+// negative values.
+func genLoadConstant(val int) []string {
 	lines := []string{}
-	lines = append(lines, fmt.Sprintf("@%d", val))
-	lines = append(lines, "D=A")
+	switch {
+	case val == -32768:
+		// 32768 does not fit an A-instruction
+		lines = append(lines, "@32767")
+		lines = append(lines, "D=-A")
+		lines = append(lines, "D=D-1")
+	case val < 0:
+		lines = append(lines, fmt.Sprintf("@%d", -val))
+		lines = append(lines, "D=-A")
+	default:
+		lines = append(lines, fmt.Sprintf("@%d", val))
+		lines = append(lines, "D=A")
+	}
+	return lines
+}
+
+func (i *Instruction) genConstantPUSH(val int) []string {
+	lines := genLoadConstant(val)
 	lines = append(lines, "@SP")
 	lines = append(lines, "AM=M+1")
 	lines = append(lines, "A=A-1")
@@ -713,7 +2481,7 @@ func (i *Instruction) genTempPUSH() []string {
 	lines := []string{}
 	lines = append(lines, fmt.Sprintf("@%d", i.Arg2Val)) // offset
 	lines = append(lines, "D=A")
-	lines = append(lines, "@5")
+	lines = append(lines, fmt.Sprintf("@%d", layout.Temp))
 	lines = append(lines, "A=D+A")
 	lines = append(lines, "D=M")
 	lines = append(lines, "@SP")
@@ -739,6 +2507,41 @@ func (i *Instruction) genPointerPUSH() []string {
 	return lines
 }
 
+// genStringPUSH pushes a string literal. With an OS it is built like the
+// Jack compiler does, String.new followed by one appendChar per character;
+// without one the literal is stored as a raw blob (its length followed by
+// its characters) at a fixed address below the end of the heap, whose
+// address is pushed.
+func (i *Instruction) genStringPUSH() ([]string, error) {
+	lines := []string{}
+	if stringsViaOS {
+		lines = append(lines, i.genConstantPUSH(len(i.Arg2))...)
+		lines = append(lines, genCall("String.new", 1)...)
+		for _, c := range i.Arg2 {
+			lines = append(lines, i.genConstantPUSH(int(c))...)
+			lines = append(lines, genCall("String.appendChar", 2)...)
+		}
+		return lines, nil
+	}
+	addr := stringBlobTop - len(i.Arg2) - 1
+	if addr < layout.Heap {
+		return nil, fmt.Errorf("no memory left in the heap for string literal %q", i.Arg2)
+	}
+	stringBlobTop = addr
+	values := []int{len(i.Arg2)}
+	for _, c := range i.Arg2 {
+		values = append(values, int(c))
+	}
+	for k, v := range values {
+		lines = append(lines, fmt.Sprintf("@%d", v))
+		lines = append(lines, "D=A")
+		lines = append(lines, fmt.Sprintf("@%d", addr+k))
+		lines = append(lines, "M=D")
+	}
+	lines = append(lines, i.genConstantPUSH(addr)...)
+	return lines, nil
+}
+
 func (i *Instruction) genConstantPOP() []string {
 	lines := []string{}
 	lines = append(lines, "@SP")
@@ -753,12 +2556,12 @@ func (i *Instruction) genSegmentPOP(sgt SegmentType, val int) []string {
 	lines = append(lines, "D=A")
 	lines = append(lines, fmt.Sprintf("@%s", sgt.ID()))
 	lines = append(lines, "D=D+M")
-	lines = append(lines, "@R13")
+	lines = append(lines, "@"+scratch(0))
 	lines = append(lines, "M=D")
 	lines = append(lines, "@SP")
 	lines = append(lines, "AM=M-1")
 	lines = append(lines, "D=M")
-	lines = append(lines, "@R13")
+	lines = append(lines, "@"+scratch(0))
 	lines = append(lines, "A=M")
 	lines = append(lines, "M=D")
 	return lines
@@ -778,14 +2581,14 @@ func (i *Instruction) genTempPOP() []string {
 	lines := []string{}
 	lines = append(lines, fmt.Sprintf("@%d", i.Arg2Val))
 	lines = append(lines, "D=A")
-	lines = append(lines, "@5")
+	lines = append(lines, fmt.Sprintf("@%d", layout.Temp))
 	lines = append(lines, "D=D+A")
-	lines = append(lines, "@R13")
+	lines = append(lines, "@"+scratch(0))
 	lines = append(lines, "M=D")
 	lines = append(lines, "@SP")
 	lines = append(lines, "AM=M-1")
 	lines = append(lines, "D=M")
-	lines = append(lines, "@R13")
+	lines = append(lines, "@"+scratch(0))
 	lines = append(lines, "A=M")
 	lines = append(lines, "M=D")
 	return lines
@@ -805,12 +2608,236 @@ func (i *Instruction) genPointerPOP() []string {
 	return lines
 }
 
+func runtimeLabel(al ALType) string {
+	return "__VM_" + strings.ToUpper(al.String())
+}
+
+// genRuntime emits the shared subroutines used by mult, div and mod, and
+// with -Osize by the comparisons, call and return, each once, behind an
+// end loop so the program never falls through into them. An arithmetic
+// subroutine takes its operands from the stack, leaves the result in
+// place of them and jumps back to the address in the third scratch
+// register (R15 by default); its variables are
+// plain symbols, allocated by the assembler like statics.
+func genRuntime() []string {
+	if len(usedRuntime) == 0 && !usedFrameRuntime {
+		return nil
+	}
+	lines := []string{
+		"// runtime subroutines",
+		"(__VM_END)",
+		"@__VM_END",
+		"0;JMP",
+	}
+	if usedRuntime[ALTypeMult] {
+		lines = append(lines, genMultRuntime()...)
+	}
+	if usedRuntime[ALTypeDiv] || usedRuntime[ALTypeMod] {
+		lines = append(lines, genDivModRuntime()...)
+	}
+	for _, al := range []ALType{ALTypeEq, ALTypeGt, ALTypeLt} {
+		if usedRuntime[al] {
+			lines = append(lines, genCompareRuntime(al)...)
+		}
+	}
+	if usedFrameRuntime {
+		lines = append(lines, genCallRuntime()...)
+		lines = append(lines, genReturnRuntime()...)
+	}
+	return lines
+}
+
+// x * y by shift-and-add over the 16 bits of y
+func genMultRuntime() []string {
+	lines := []string{}
+	lines = append(lines, "/// runtime ; mult")
+	lines = append(lines, "(__VM_MULT)")
+	lines = append(lines, "@SP")
+	lines = append(lines, "AM=M-1")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMMULT.y")
+	lines = append(lines, "M=D") // y = pop()
+	lines = append(lines, "@SP")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMMULT.x")
+	lines = append(lines, "M=D") // x = top
+	lines = append(lines, "@SP")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "M=0") // result accumulates on the stack
+	lines = append(lines, "@__VMMULT.mask")
+	lines = append(lines, "M=1")
+	lines = append(lines, "(__VM_MULT_LOOP)")
+	lines = append(lines, "@__VMMULT.mask")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VM_MULT_END")
+	lines = append(lines, "D;JEQ") // mask shifted out after 16 bits
+	lines = append(lines, "@__VMMULT.y")
+	lines = append(lines, "D=D&M")
+	lines = append(lines, "@__VM_MULT_SKIP")
+	lines = append(lines, "D;JEQ")
+	lines = append(lines, "@__VMMULT.x")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@SP")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "M=D+M") // result += x
+	lines = append(lines, "(__VM_MULT_SKIP)")
+	lines = append(lines, "@__VMMULT.x")
+	lines = append(lines, "D=M")
+	lines = append(lines, "M=D+M") // x <<= 1
+	lines = append(lines, "@__VMMULT.mask")
+	lines = append(lines, "D=M")
+	lines = append(lines, "M=D+M") // mask <<= 1
+	lines = append(lines, "@__VM_MULT_LOOP")
+	lines = append(lines, "0;JMP")
+	lines = append(lines, "(__VM_MULT_END)")
+	lines = append(lines, "@"+scratch(2))
+	lines = append(lines, "A=M")
+	lines = append(lines, "0;JMP")
+	return lines
+}
+
+// x / y and x mod y, truncating towards zero (the remainder has the sign of
+// x). Dividing by zero yields 0 for div and x for mod.
+func genDivModRuntime() []string {
+	lines := []string{}
+	lines = append(lines, "/// runtime ; div & mod")
+	lines = append(lines, "(__VM_DIV)")
+	lines = append(lines, "@__VMDIV.mode")
+	lines = append(lines, "M=0")
+	lines = append(lines, "@__VM_DIVMOD")
+	lines = append(lines, "0;JMP")
+	lines = append(lines, "(__VM_MOD)")
+	lines = append(lines, "@__VMDIV.mode")
+	lines = append(lines, "M=-1")
+	lines = append(lines, "(__VM_DIVMOD)")
+
+	lines = append(lines, "/// runtime ; b = |y|")
+	lines = append(lines, "@SP")
+	lines = append(lines, "AM=M-1")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMDIV.b")
+	lines = append(lines, "M=D")
+	lines = append(lines, "@__VMDIV.yneg")
+	lines = append(lines, "M=0")
+	lines = append(lines, "@__VM_DIVMOD_YPOS")
+	lines = append(lines, "D;JGE")
+	lines = append(lines, "@__VMDIV.yneg")
+	lines = append(lines, "M=-1")
+	lines = append(lines, "@__VMDIV.b")
+	lines = append(lines, "M=-M")
+	lines = append(lines, "(__VM_DIVMOD_YPOS)")
+
+	lines = append(lines, "/// runtime ; a = |x|")
+	lines = append(lines, "@SP")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMDIV.a")
+	lines = append(lines, "M=D")
+	lines = append(lines, "@__VMDIV.xneg")
+	lines = append(lines, "M=0")
+	lines = append(lines, "@__VM_DIVMOD_XPOS")
+	lines = append(lines, "D;JGE")
+	lines = append(lines, "@__VMDIV.xneg")
+	lines = append(lines, "M=-1")
+	lines = append(lines, "@__VMDIV.a")
+	lines = append(lines, "M=-M")
+	lines = append(lines, "(__VM_DIVMOD_XPOS)")
+	lines = append(lines, "@__VMDIV.q")
+	lines = append(lines, "M=0")
+	lines = append(lines, "@__VMDIV.b")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VM_DIVMOD_DONE")
+	lines = append(lines, "D;JEQ") // division by zero
+
+	lines = append(lines, "/// runtime ; while a >= b subtract the largest b * 2^k <= a")
+	lines = append(lines, "(__VM_DIVMOD_OUTER)")
+	lines = append(lines, "@__VMDIV.b")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMDIV.a")
+	lines = append(lines, "D=M-D")
+	lines = append(lines, "@__VM_DIVMOD_DONE")
+	lines = append(lines, "D;JLT")
+	lines = append(lines, "@__VMDIV.b")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMDIV.t")
+	lines = append(lines, "M=D") // t = b
+	lines = append(lines, "@__VMDIV.m")
+	lines = append(lines, "M=1") // m = 1
+	lines = append(lines, "(__VM_DIVMOD_INNER)")
+	lines = append(lines, "@__VMDIV.t")
+	lines = append(lines, "D=M")
+	lines = append(lines, "D=D+M") // 2t
+	lines = append(lines, "@__VM_DIVMOD_SUB")
+	lines = append(lines, "D;JLE") // 2t overflowed
+	lines = append(lines, "@__VMDIV.a")
+	lines = append(lines, "D=D-M")
+	lines = append(lines, "@__VM_DIVMOD_SUB")
+	lines = append(lines, "D;JGT") // 2t > a
+	lines = append(lines, "@__VMDIV.t")
+	lines = append(lines, "D=M")
+	lines = append(lines, "M=D+M")
+	lines = append(lines, "@__VMDIV.m")
+	lines = append(lines, "D=M")
+	lines = append(lines, "M=D+M")
+	lines = append(lines, "@__VM_DIVMOD_INNER")
+	lines = append(lines, "0;JMP")
+	lines = append(lines, "(__VM_DIVMOD_SUB)")
+	lines = append(lines, "@__VMDIV.t")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMDIV.a")
+	lines = append(lines, "M=M-D") // a -= t
+	lines = append(lines, "@__VMDIV.m")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMDIV.q")
+	lines = append(lines, "M=D+M") // q += m
+	lines = append(lines, "@__VM_DIVMOD_OUTER")
+	lines = append(lines, "0;JMP")
+
+	lines = append(lines, "/// runtime ; apply the signs")
+	lines = append(lines, "(__VM_DIVMOD_DONE)")
+	lines = append(lines, "@__VMDIV.mode")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VM_DIVMOD_REM")
+	lines = append(lines, "D;JNE")
+	lines = append(lines, "@__VMDIV.xneg")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VMDIV.yneg")
+	lines = append(lines, "D=D-M") // 0 when the signs agree
+	lines = append(lines, "@__VM_DIVMOD_QPOS")
+	lines = append(lines, "D;JEQ")
+	lines = append(lines, "@__VMDIV.q")
+	lines = append(lines, "M=-M")
+	lines = append(lines, "(__VM_DIVMOD_QPOS)")
+	lines = append(lines, "@__VMDIV.q")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VM_DIVMOD_RETURN")
+	lines = append(lines, "0;JMP")
+	lines = append(lines, "(__VM_DIVMOD_REM)")
+	lines = append(lines, "@__VMDIV.xneg")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@__VM_DIVMOD_RPOS")
+	lines = append(lines, "D;JEQ")
+	lines = append(lines, "@__VMDIV.a")
+	lines = append(lines, "M=-M")
+	lines = append(lines, "(__VM_DIVMOD_RPOS)")
+	lines = append(lines, "@__VMDIV.a")
+	lines = append(lines, "D=M")
+	lines = append(lines, "(__VM_DIVMOD_RETURN)")
+	lines = append(lines, "@SP")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "M=D")
+	lines = append(lines, "@"+scratch(2))
+	lines = append(lines, "A=M")
+	lines = append(lines, "0;JMP")
+	return lines
+}
+
 func genCall(calleeFn string, calleeNArgs int) []string {
 	lines := []string{}
 
 	// push return address
-	retAddrLabel := fmt.Sprintf("%s$ret.%d", currentFunctionName, retIndex)
-	retIndex++
+	retAddrLabel := generatedLabel("ret", nextLabelIndex("ret"))
 	lines = append(lines, fmt.Sprintf("/// call ; working with return address %s", retAddrLabel))
 	lines = append(lines, "@"+retAddrLabel)
 	lines = append(lines, "D=A")
@@ -861,7 +2888,7 @@ func genCall(calleeFn string, calleeNArgs int) []string {
 // Handling: function functionName nVars
 func (i *Instruction) genFunction() []string {
 	lines := []string{}
-	currentFunctionName = i.Arg1
+	currentFunctionName, labelCounts = i.Arg1, map[string]int{}
 
 	lines = append(lines, fmt.Sprintf("(%s)", i.Arg1))
 	for range i.Arg2Val {
@@ -876,14 +2903,14 @@ func (i *Instruction) genReturn() []string {
 	lines = append(lines, "/// return ; endFrame = LCL")
 	lines = append(lines, "@LCL")
 	lines = append(lines, "D=M")
-	lines = append(lines, "@R13")
+	lines = append(lines, "@"+scratch(0))
 	lines = append(lines, "M=D") /// endFrame = LCL ///
 
 	lines = append(lines, "/// return ; retAddr = D = RAM[endFrame - 5]")
 	lines = append(lines, "@5")
 	lines = append(lines, "A=D-A") // endFrame - 5
 	lines = append(lines, "D=M")   // D = RAM[endFrame - 5]
-	lines = append(lines, "@R14")
+	lines = append(lines, "@"+scratch(1))
 	lines = append(lines, "M=D") /// retAddr = D = RAM[endFrame - 5] ///
 
 	lines = append(lines, "/// return ; RAM[ARG] = pop() = RAM[SP-1]")
@@ -903,7 +2930,7 @@ func (i *Instruction) genReturn() []string {
 	segments := []SegmentType{SegmentTypeThat, SegmentTypeThis, SegmentTypeArgument, SegmentTypeLocal}
 	for _, seg := range segments {
 		lines = append(lines, fmt.Sprintf("/// %s ; working with %s", i.Line, seg.String()))
-		lines = append(lines, "@R13")
+		lines = append(lines, "@"+scratch(0))
 		lines = append(lines, "ADM=M-1")
 		lines = append(lines, "D=M")
 		lines = append(lines, "@"+seg.ID())
@@ -911,7 +2938,7 @@ func (i *Instruction) genReturn() []string {
 	}
 
 	lines = append(lines, "/// return ; goto caller")
-	lines = append(lines, "@R14")
+	lines = append(lines, "@"+scratch(1))
 	lines = append(lines, "A=M")
 	lines = append(lines, "0;JMP") // goto retAddr
 	return lines
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// translateText translates the VM files of files, by name, in memory
+// and without bootstrap code.
+func translateText(t *testing.T, files map[string]string) (*translation, error) {
+	t.Helper()
+	return translateFiles(t, &translateOptions{Bootstrap: "off", Entry: "Sys.init"}, files)
+}
+
+// translateFiles translates files, by name, with opts.
+func translateFiles(t *testing.T, opts *translateOptions, files map[string]string) (*translation, error) {
+	t.Helper()
+	fsys := memFS{}
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		opts.Inputs = append(opts.Inputs, fsys.add(name, []byte(files[name])))
+	}
+	return translate(opts)
+}
+
+func TestStringsViaOSResetBetweenTranslations(t *testing.T) {
+	defer func(ext bool) { extendedMode = ext }(extendedMode)
+	extendedMode = true
+	withOS := map[string]string{
+		"String.vm": "function String.new 0\npush constant 0\nreturn\nfunction String.appendChar 0\npush argument 0\nreturn\n",
+		"Main.vm":   "function Main.main 0\npush string \"hi\"\nreturn\n",
+	}
+	withoutOS := map[string]string{
+		"Main.vm": "function Main.main 0\npush string \"hi\"\nreturn\n",
+	}
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  bool // code calling String.new
+	}{
+		{"via the OS", withOS, true},
+		{"as a blob", withoutOS, false},
+		{"via the OS again", withOS, true},
+		{"as a blob again", withoutOS, false},
+	}
+	for _, tt := range tests {
+		tr, err := translateText(t, tt.files)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := slices.Contains(tr.Lines, "@String.new"); got != tt.want {
+			t.Errorf("%s: calls String.new = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseInstructionNames(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"label LOOP", true},
+		{"label IF_TRUE0", true},
+		{"goto Main.main$end:1", true},
+		{"function Main.main 0", true},
+		{"call Math.multiply 2", true},
+		{"label 1LOOP", false},
+		{"goto a-b", false},
+		{"function Main-x.main 0", false},
+		{"label SP", false},
+		{"if-goto R15", false},
+		{"function SCREEN 0", false},
+		{"call KBD 0", false},
+		{"label THAT", false},
+		{"label ret$0", false},
+		{"function Main.main$ret$0 0", false},
+	}
+	for _, tt := range tests {
+		_, err := parseInstruction(0, "Main", tt.line)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%q: error %v, want valid = %v", tt.line, err, tt.ok)
+		}
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	sys := "function Sys.init 0\nlabel END\ngoto END\n"
+	main := "function Main.main 0\npush constant 0\nreturn\n"
+	tests := []struct {
+		name      string
+		files     map[string]string
+		bootstrap string
+		want      bool
+	}{
+		{"a single file defining Sys.init", map[string]string{"Sys.vm": sys}, "auto", true},
+		{"Sys.init in a file of another name", map[string]string{"Main.vm": main + sys}, "auto", true},
+		{"several files", map[string]string{"Main.vm": main, "Sys.vm": sys}, "auto", true},
+		{"a single file without Sys.init", map[string]string{"Main.vm": main}, "auto", false},
+		{"Sys.init only called", map[string]string{"Main.vm": main + "call Sys.init 0\n"}, "auto", false},
+		{"Sys.init in a comment", map[string]string{"Main.vm": "// function Sys.init 0\n" + main}, "auto", false},
+		{"turned off", map[string]string{"Sys.vm": sys}, "off", false},
+		{"turned on", map[string]string{"Sys.vm": sys}, "on", true},
+	}
+	for _, tt := range tests {
+		tr, err := translateFiles(t, &translateOptions{Bootstrap: tt.bootstrap, Entry: "Sys.init"}, tt.files)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := slices.Contains(tr.Lines, "// Bootstrap code"); got != tt.want {
+			t.Errorf("%s: bootstrap code %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []token
+	}{
+		{"push constant 7", []token{{"push", 1}, {"constant", 6}, {"7", 15}}},
+		{"push  constant   7", []token{{"push", 1}, {"constant", 7}, {"7", 18}}},
+		{"push\tconstant\t7", []token{{"push", 1}, {"constant", 6}, {"7", 15}}},
+		{" \tpush \t constant 7 \t ", []token{{"push", 3}, {"constant", 10}, {"7", 19}}},
+		{"add\t", []token{{"add", 1}}},
+		{"push string \"a  b\"", []token{{"push", 1}, {"string", 6}, {"\"a  b\"", 13}}},
+		{"", []token{}},
+		{" \t ", []token{}},
+	}
+	for _, tt := range tests {
+		got, err := tokenize(tt.text)
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("tokenize(%q) = %v, %v, want %v", tt.text, got, err, tt.want)
+		}
+	}
+	if _, err := tokenize(`push string "ab`); err == nil || err.(*tokenError).Col != 13 {
+		t.Errorf("unterminated string: error %v, want one at column 13", err)
+	}
+}
+
+func TestParseInstructionWhitespace(t *testing.T) {
+	tests := []struct {
+		line string
+		col  int // of the error, 0 when the line parses as push constant 7
+	}{
+		{"push constant 7", 0},
+		{"push  constant  7", 0},
+		{"\tpush\tconstant\t7", 0},
+		{"push constant 7 \t", 0},
+		{"  push constant 7", 0},
+		{"push  constnt 7", 7},
+		{"push\tconstant\tx", 15},
+	}
+	for _, tt := range tests {
+		inst, err := parseInstruction(0, "Main", tt.line)
+		if tt.col == 0 {
+			if err != nil || inst.CommandType != CommandTypePush || inst.Arg1 != "constant" || inst.Arg2Val != 7 {
+				t.Errorf("%q: %+v, %v, want push constant 7", tt.line, inst, err)
+			}
+			continue
+		}
+		var te *tokenError
+		if !errors.As(err, &te) || te.Col != tt.col {
+			t.Errorf("%q: error %v, want one at column %d", tt.line, err, tt.col)
+		}
+	}
+}
+
+// TestLineEndings translates the fixtures of testdata/encodings, one
+// program saved with LF, CRLF and CR line endings and with a UTF-8 BOM,
+// which must all translate as the LF one.
+func TestLineEndings(t *testing.T) {
+	want, err := os.ReadFile("testdata/encodings/lf/Main.golden.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir   string
+		check func([]byte) bool // the fixture is saved as the test says
+	}{
+		{"lf", func(b []byte) bool { return !bytes.Contains(b, []byte("\r")) }},
+		{"crlf", func(b []byte) bool { return bytes.Count(b, []byte("\r\n")) == bytes.Count(b, []byte("\n")) }},
+		{"cr", func(b []byte) bool { return !bytes.Contains(b, []byte("\n")) }},
+		{"bom", func(b []byte) bool { return bytes.HasPrefix(b, utf8BOM) }},
+	}
+	for _, tt := range tests {
+		src := filepath.Join("testdata/encodings", tt.dir, "Main.vm")
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.check(data) {
+			t.Fatalf("%s is not saved as the test expects, were its line endings converted?", src)
+		}
+		tr, err := translate(&translateOptions{Sources: stringsFlag{src}, Bootstrap: "off", Entry: "Sys.init"})
+		if err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+		if got := strings.Join(tr.Lines, "\n") + "\n"; got != string(want) {
+			t.Errorf("%s: translated as\n%s\nwant\n%s", src, got, want)
+		}
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	src := write("Main.vm", "push constant 7\n")
+	owned := write("Owned.asm", "// vmtranslator (devel)\n@7\n")
+	noHeader := write("NoHeader.asm", "@7\n")
+	tests := []struct {
+		name   string
+		dst    string
+		force  bool
+		status int // 0 when the file may be written
+	}{
+		{"a missing file", filepath.Join(dir, "New.asm"), false, 0},
+		{"a file with the header", owned, false, 0},
+		{"the output of --no-header", noHeader, false, exitUsage},
+		{"the output of --no-header, forced", noHeader, true, 0},
+		{"the source", src, false, exitUsage},
+		{"the source, with --no-header and --force", src, true, exitUsage},
+		{"the source by another path", filepath.Join(dir, ".", "x", "..", "Main.vm"), true, exitUsage},
+	}
+	for _, tt := range tests {
+		_, err := checkDestination(tt.dst, []string{src}, "asm", hackBackend{}, tt.force)
+		if status := map[bool]int{true: exitStatus(err), false: 0}[err != nil]; status != tt.status {
+			t.Errorf("%s: status %d (%v), want %d", tt.name, status, err, tt.status)
+		}
+	}
+	if data, _ := os.ReadFile(src); string(data) != "push constant 7\n" {
+		t.Errorf("the source was changed to %q", data)
+	}
+}
+
+// TestTranslateStatus checks the exit status of programs that must not
+// reach the code generation, where their errors would be internal ones.
+func TestTranslateStatus(t *testing.T) {
+	tests := []struct {
+		src    string
+		status int
+	}{
+		{"function Main.main 0\npush local -1\n", exitParse},
+		{"function Main.main 0\npop argument 32768\n", exitParse},
+		{"function Main.main -1\n", exitParse},
+		{"function Main.main 0\ncall Main.main -1\n", exitParse},
+		{"function Main.main 0\nreturn\nfunction Main.main 1\nreturn\n", exitSemantic},
+		{"function Main.main 0\npush temp 8\n", exitSemantic},
+		{"function Main.main 0\npop temp 16\n", exitSemantic},
+		{"function Main.main 0\npush pointer 2\n", exitSemantic},
+		{"function Main.main 0\npush constant 1\npop constant 1\n", exitSemantic},
+	}
+	for _, tt := range tests {
+		_, err := translateText(t, map[string]string{"Main.vm": tt.src})
+		if err == nil || exitStatus(err) != tt.status {
+			t.Errorf("%q: error %v, want exit status %d", tt.src, err, tt.status)
+		}
+	}
+}
+
+// TestGeneratedLabelsApart translates labels named as the translator
+// names the labels it generates, which must not clash with them.
+func TestGeneratedLabelsApart(t *testing.T) {
+	src := "function Main.main 0\nlabel ret.0\nlabel EQ_TRUE.0\nlabel EQ_FALSE.0\npush constant 1\npush constant 1\neq\ncall Main.main 0\ngoto ret.0\n"
+	for _, level := range optLevels {
+		func() {
+			defer func(l string) { optLevel = l }(optLevel)
+			optLevel = level
+			if _, err := translateText(t, map[string]string{"Main.vm": src}); err != nil {
+				t.Errorf("-%s: %v", level, err)
+			}
+		}()
+	}
+}
+
+// TestLabelNumbering translates a program twice in a row and with its
+// files in the other order, each function getting the same code, its
+// generated labels numbered the same.
+func TestLabelNumbering(t *testing.T) {
+	files := []string{"Main.vm", "Sys.vm"}
+	src := map[string]string{
+		"Main.vm": "function Main.main 0\npush constant 1\npush constant 2\nlt\ncall Main.f 1\nreturn\nfunction Main.f 0\npush argument 0\npush constant 0\neq\nreturn\n",
+		"Sys.vm":  "function Sys.init 0\ncall Main.main 0\npush constant 3\npush constant 3\ngt\ncall Main.f 1\nlabel END\ngoto END\n",
+	}
+	// functions splits the assembly by the function it is in
+	functions := func(lines []string) map[string][]string {
+		code, fn := map[string][]string{}, ""
+		for _, l := range lines {
+			if label, ok := asmLabel(strings.TrimSpace(l)); ok && !strings.Contains(label, "$") {
+				fn = label
+			}
+			code[fn] = append(code[fn], l)
+		}
+		return code
+	}
+	translateInOrder := func(order []string) map[string][]string {
+		fsys := memFS{}
+		opts := &translateOptions{Bootstrap: "off", Entry: "Sys.init"}
+		for _, name := range order {
+			opts.Inputs = append(opts.Inputs, fsys.add(name, []byte(src[name])))
+		}
+		tr, err := translate(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return functions(tr.Lines)
+	}
+	want := translateInOrder(files)
+	for _, order := range [][]string{files, {files[1], files[0]}} {
+		got := translateInOrder(order)
+		for _, fn := range []string{"Main.main", "Main.f", "Sys.init"} {
+			if !slices.Equal(got[fn], want[fn]) {
+				t.Errorf("%v: the code of %s changed:\n%s\nwant\n%s", order, fn, strings.Join(got[fn], "\n"), strings.Join(want[fn], "\n"))
+			}
+		}
+	}
+}
+
+// TestStaticInitPathPrefix checks that a static-init directive qualified
+// with a file name gives the statics the file uses with --static-prefix
+// path.
+func TestStaticInitPathPrefix(t *testing.T) {
+	defer func(ext bool, prefix string) { extendedMode, staticPrefixMode = ext, prefix }(extendedMode, staticPrefixMode)
+	extendedMode, staticPrefixMode = true, "path"
+	files := map[string]string{
+		"a/Util.vm": "function Util.f 0\nstatic-init Util.2 5\npush static 2\nreturn\n",
+		"b/Util.vm": "function Util.g 0\npush static 2\nreturn\n",
+	}
+	tr, err := translateText(t, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(tr.Lines, "@a.Util.2") || slices.Contains(tr.Lines, "@Util.2") {
+		t.Errorf("static-init Util.2 of a/Util.vm not stored in a.Util.2:\n%s", strings.Join(tr.Lines, "\n"))
+	}
+	files["Main.vm"] = "function Main.main 0\nstatic-init Util.2 5\nreturn\n"
+	if _, err := translateText(t, files); exitStatus(err) != exitSemantic {
+		t.Errorf("static-init Util.2 of Main.vm naming a/Util.vm and b/Util.vm: error %v, want exit status %d", err, exitSemantic)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// metadataFormat and metadataVersion identify the build metadata written
+// by --emit-metadata. Fields are only ever added within a version.
+const (
+	metadataFormat  = "hack-vm-build"
+	metadataVersion = 1
+)
+
+// buildMetadata describes a translation for the tools around it, editors
+// and build systems: what it read, in which order, what it wrote and with
+// which settings, and the symbols of the program.
+type buildMetadata struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	Translator buildInfo `json:"translator"`
+	// Inputs are the -s arguments, as given
+	Inputs []string `json:"inputs"`
+	// Sources are the files translated, in translation order
+	Sources []metadataSource `json:"sources"`
+	// Output is the absolute path of the program written
+	Output       string            `json:"output"`
+	Target       string            `json:"target"`
+	Emit         string            `json:"emit"`
+	OptLevel     string            `json:"opt_level"`
+	Extended     bool              `json:"extended"`
+	StaticPrefix string            `json:"static_prefix"`
+	Bootstrap    metadataBootstrap `json:"bootstrap"`
+	MemoryLayout memoryLayout      `json:"memory_layout"`
+	Scratch      []string          `json:"scratch"`
+	Symbols      metadataSymbols   `json:"symbols"`
+	Warnings     []string          `json:"warnings"`
+}
+
+type metadataSource struct {
+	File     string `json:"file"`
+	Commands int    `json:"commands"`
+}
+
+type metadataBootstrap struct {
+	// Mode is the --bootstrap flag, auto, on or off
+	Mode       string `json:"mode"`
+	Entry      string `json:"entry"`
+	EntryNArgs int    `json:"entry_nargs"`
+	// Emitted tells whether the program starts with the bootstrap code
+	Emitted bool `json:"emitted"`
+}
+
+// metadataSymbols are the functions, labels and static variables of the
+// program. Their addresses, in ROM for the functions and labels and in RAM
+// for the statics, are those of the Hack target, left out for the others.
+type metadataSymbols struct {
+	Functions []metadataSymbol `json:"functions"`
+	Labels    []metadataSymbol `json:"labels"`
+	Statics   []metadataSymbol `json:"statics"`
+}
+
+type metadataSymbol struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+	// Function is the function a label belongs to
+	Function string `json:"function,omitempty"`
+	// Locals is the number of locals of a function
+	Locals  *int `json:"locals,omitempty"`
+	Address *int `json:"address,omitempty"`
+}
+
+// newBuildMetadata describes the translation tr of opts, written to
+// output as emit for target.
+func newBuildMetadata(tr *translation, opts *translateOptions, output, target, emit string) (*buildMetadata, error) {
+	abs, err := filepath.Abs(output)
+	if err != nil {
+		return nil, err
+	}
+	m := &buildMetadata{
+		Format:       metadataFormat,
+		Version:      metadataVersion,
+		Translator:   readBuildInfo(),
+		Inputs:       append([]string{}, opts.Sources...),
+		Sources:      []metadataSource{},
+		Output:       abs,
+		Target:       target,
+		Emit:         emit,
+		OptLevel:     optLevel,
+		Extended:     extendedMode,
+		StaticPrefix: staticPrefixMode,
+		Bootstrap:    metadataBootstrap{Mode: opts.Bootstrap, Entry: opts.Entry, EntryNArgs: opts.EntryNArgs, Emitted: tr.Bootstrap != ""},
+		MemoryLayout: layout,
+		Scratch:      []string{},
+		Symbols:      metadataSymbols{Functions: []metadataSymbol{}, Labels: []metadataSymbol{}, Statics: []metadataSymbol{}},
+		Warnings:     append([]string{}, tr.Warnings...),
+	}
+	m.MemoryLayout.RAM = layout.RAMSize()
+	for n := range scratchRegisters {
+		m.Scratch = append(m.Scratch, scratch(n))
+	}
+	for _, sl := range tr.Commands {
+		if len(m.Sources) == 0 || m.Sources[len(m.Sources)-1].File != sl.File {
+			m.Sources = append(m.Sources, metadataSource{File: sl.File})
+		}
+		m.Sources[len(m.Sources)-1].Commands++
+	}
+
+	symbols := map[string]int{}
+	if target == "hack" && emit == "asm" {
+		prog, err := assembleHack(tr.Lines)
+		if err != nil {
+			return nil, err
+		}
+		symbols = prog.Symbols
+	}
+	address := func(name string) *int {
+		if addr, ok := symbols[name]; ok {
+			return &addr
+		}
+		return nil
+	}
+	fn := ""
+	seen := map[string]bool{}
+	for k, inst := range tr.Instructions {
+		sl := tr.Commands[k]
+		switch inst.CommandType {
+		case CommandTypeFunction:
+			fn = inst.Arg1
+			locals := inst.Arg2Val
+			m.Symbols.Functions = append(m.Symbols.Functions, metadataSymbol{Name: fn, File: sl.File, Line: sl.Line, Locals: &locals, Address: address(fn)})
+		case CommandTypeLabel:
+			m.Symbols.Labels = append(m.Symbols.Labels, metadataSymbol{Name: inst.Arg1, File: sl.File, Line: sl.Line, Function: fn, Address: address(inst.labelSymbol())})
+		}
+		if sym, ok := staticSymbol(inst); ok && !seen[sym] {
+			seen[sym] = true
+			m.Symbols.Statics = append(m.Symbols.Statics, metadataSymbol{Name: sym, File: sl.File, Line: sl.Line, Address: address(sym)})
+		}
+	}
+	return m, nil
+}
+
+// writeMetadata writes the build metadata of a translation to path.
+func writeMetadata(path string, tr *translation, opts *translateOptions, output, target, emit string) error {
+	m, err := newBuildMetadata(tr, opts, output, target, emit)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
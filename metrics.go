@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// functionMetric is the size and complexity of a function, or of the
+// commands before the first function.
+type functionMetric struct {
+	Name string
+	// Commands is the number of VM commands, the declaration included
+	Commands int
+	// Instructions is the number of Hack instructions generated for them,
+	// without the runtime subroutines the function may jump to
+	Instructions int
+	// Calls is the number of call commands
+	Calls int
+	// Nesting is the most spans from a goto or if-goto to its label
+	// covering one command, 2 for a loop in a loop or an if-else
+	Nesting int
+}
+
+// metricsOrders are the columns --metrics sorts by, "order" keeping the
+// order of the program.
+var metricsOrders = []string{"order", "name", "commands", "instructions", "calls", "nesting"}
+
+// functionMetrics measures every function of a translation, in order.
+// The second result is the number of instructions of the bootstrap and
+// runtime code, which belong to no function.
+func functionMetrics(tr *translation) ([]*functionMetric, int) {
+	metrics := []*functionMetric{}
+	of := make([]*functionMetric, len(tr.Instructions))
+	var cur *functionMetric
+	for k, inst := range tr.Instructions {
+		if inst.CommandType == CommandTypeStaticInit {
+			continue
+		}
+		switch {
+		case inst.CommandType == CommandTypeFunction:
+			cur = &functionMetric{Name: inst.Arg1}
+			metrics = append(metrics, cur)
+		case cur == nil:
+			cur = &functionMetric{Name: callerTopLevel}
+			metrics = append(metrics, cur)
+		}
+		of[k] = cur
+		cur.Commands++
+		if inst.CommandType == CommandTypeCall {
+			cur.Calls++
+		}
+	}
+	support := 0
+	for k, line := range tr.Lines {
+		if !isAsmInstruction(line) {
+			continue
+		}
+		if cmd := tr.Origin[k]; cmd >= 0 && of[cmd] != nil {
+			of[cmd].Instructions++
+		} else {
+			support++
+		}
+	}
+
+	// labels are local to their function: depth counts the spans covering
+	// each command, opened at the first end of a span and closed after
+	// its last
+	labels := map[*functionMetric]map[string]int{}
+	for k, inst := range tr.Instructions {
+		if inst.CommandType == CommandTypeLabel && of[k] != nil {
+			if labels[of[k]] == nil {
+				labels[of[k]] = map[string]int{}
+			}
+			if _, ok := labels[of[k]][inst.Arg1]; !ok {
+				labels[of[k]][inst.Arg1] = k
+			}
+		}
+	}
+	depth := make([]int, len(tr.Instructions)+1)
+	for k, inst := range tr.Instructions {
+		if inst.CommandType != CommandTypeGOTO && inst.CommandType != CommandTypeIf || of[k] == nil {
+			continue
+		}
+		if target, ok := labels[of[k]][inst.Arg1]; ok {
+			depth[min(k, target)]++
+			depth[max(k, target)+1]--
+		}
+	}
+	open := 0
+	for k := range tr.Instructions {
+		open += depth[k]
+		if of[k] != nil {
+			of[k].Nesting = max(of[k].Nesting, open)
+		}
+	}
+	return metrics, support
+}
+
+// metricsReport is the table of functionMetrics, sorted by one of
+// metricsOrders, the counts from the largest.
+func metricsReport(tr *translation, order string) []string {
+	metrics, support := functionMetrics(tr)
+	column := map[string]func(m *functionMetric) int{
+		"commands":     func(m *functionMetric) int { return m.Commands },
+		"instructions": func(m *functionMetric) int { return m.Instructions },
+		"calls":        func(m *functionMetric) int { return m.Calls },
+		"nesting":      func(m *functionMetric) int { return m.Nesting },
+	}
+	switch order {
+	case "order":
+	case "name":
+		slices.SortStableFunc(metrics, func(a, b *functionMetric) int { return strings.Compare(a.Name, b.Name) })
+	default:
+		value := column[order]
+		slices.SortStableFunc(metrics, func(a, b *functionMetric) int { return value(b) - value(a) })
+	}
+
+	rows := [][6]string{{"function", "commands", "instructions", "ROM", "calls", "nesting"}}
+	total := support
+	for _, m := range metrics {
+		rows = append(rows, [6]string{m.Name, fmt.Sprint(m.Commands), fmt.Sprint(m.Instructions), fmt.Sprintf("%.1f%%", float64(m.Instructions)*100/hackROMSize), fmt.Sprint(m.Calls), fmt.Sprint(m.Nesting)})
+		total += m.Instructions
+	}
+	widths := [6]int{}
+	for _, row := range rows {
+		for k := range widths {
+			widths[k] = max(widths[k], len(row[k]))
+		}
+	}
+	report := []string{"Function metrics:"}
+	for _, row := range rows {
+		report = append(report, strings.TrimRight(fmt.Sprintf("  %-*s  %*s  %*s  %*s  %*s  %*s", widths[0], row[0], widths[1], row[1], widths[2], row[2], widths[3], row[3], widths[4], row[4], widths[5], row[5]), " "))
+	}
+	report = append(report, fmt.Sprintf("Total: %s, %d of them bootstrap and runtime code, %.1f%% of the ROM", plural(total, "instruction"), support, float64(total)*100/hackROMSize))
+	return report
+}
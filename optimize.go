@@ -0,0 +1,559 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The optimization levels of the code generation, selected with -O0, -O1,
+// -Ospeed and -Osize. -Ospeed and -Osize pull apart: the ROM holds 32K
+// instructions, and a program close to it trades cycles for words.
+const (
+	// optNone generates every command with the sequence of the course
+	optNone = "O0"
+	// optBasic generates shorter sequences for the common commands, each
+	// as fast or faster than the one of O0
+	optBasic = "O1"
+	// optSpeed also generates the comparisons, the function prologues, call
+	// and return inline with the fewest cycles, whatever their size
+	optSpeed = "Ospeed"
+	// optSize also generates the comparisons, call and return as jumps to
+	// subroutines shared by the whole program and long prologues as
+	// loops, trading cycles for ROM
+	optSize = "Osize"
+)
+
+var optLevels = []string{optNone, optBasic, optSpeed, optSize}
+
+var optDescriptions = map[string]string{
+	optNone:  "generate every command with the sequence of the course (the default)",
+	optBasic: "generate shorter sequences for the common pushes, pops and neg",
+	optSpeed: "as -O1, plus faster inline eq, gt, lt, call and return and unrolled function prologues, for programs short of cycles",
+	optSize:  "as -O1, plus eq, gt, lt, call and return as jumps to shared subroutines when the program has them more than once and function prologues clearing their locals in a loop, for programs short of ROM",
+}
+
+// optLevelFlag is one of the -O flags, setting optLevel to its level when
+// given, the last one winning.
+type optLevelFlag string
+
+func (f optLevelFlag) String() string   { return "" }
+func (f optLevelFlag) IsBoolFlag() bool { return true }
+
+func (f optLevelFlag) Set(v string) error {
+	if v != "true" {
+		return fmt.Errorf("-%s takes no value", string(f))
+	}
+	optLevel = string(f)
+	return nil
+}
+
+func registerOptFlags(fs *flag.FlagSet) {
+	for _, level := range optLevels {
+		fs.Var(optLevelFlag(level), level, optDescriptions[level])
+	}
+}
+
+// parseOptLevels parses a comma separated list of optimization levels.
+func parseOptLevels(list string) ([]string, error) {
+	levels := []string{}
+	for _, l := range strings.Split(list, ",") {
+		l = strings.TrimPrefix(strings.TrimSpace(l), "-")
+		if !slices.Contains(optLevels, l) {
+			return nil, fmt.Errorf("unknown optimization level %q, expected one of %s", l, strings.Join(optLevels, ", "))
+		}
+		levels = append(levels, l)
+	}
+	return levels, nil
+}
+
+// genShort returns the code of the command at an optimization level above
+// O0, nil when it has no shorter form than the one of O0.
+func (i *Instruction) genShort() []string {
+	if removedCommands[i] {
+		return []string{}
+	}
+	if j, ok := threadedJumps[i]; ok {
+		return j.gen(i)
+	}
+	if code := i.superoptCode(false, false); code != nil {
+		return code
+	}
+	pushD := []string{"@SP", "AM=M+1", "A=A-1", "M=D"}
+	switch {
+	case i.CommandType == CommandTypePush:
+		switch i.SegmentType {
+		case SegmentTypeConstant:
+			if i.Arg2Val >= -1 && i.Arg2Val <= 1 {
+				// the ALU computes 0, 1 and -1 without loading them
+				return []string{"@SP", "AM=M+1", "A=A-1", fmt.Sprintf("M=%d", i.Arg2Val)}
+			}
+		case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+			if i.Arg2Val <= 2 {
+				return append(append([]string{"@" + i.SegmentType.ID()}, segmentOffset(i.Arg2Val)...), append([]string{"D=M"}, pushD...)...)
+			}
+		case SegmentTypeTemp:
+			return append([]string{fmt.Sprintf("@%d", layout.Temp+i.Arg2Val), "D=M"}, pushD...)
+		case SegmentTypePointer:
+			return append([]string{"@" + pointerSymbol(i.Arg2Val), "D=M"}, pushD...)
+		}
+	case i.CommandType == CommandTypePop:
+		popD := []string{"@SP", "AM=M-1", "D=M"}
+		switch i.SegmentType {
+		case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+			// walking A to the address beats computing it through a
+			// scratch register up to 5 words in
+			if i.Arg2Val <= 5 {
+				return append(append(append(popD, "@"+i.SegmentType.ID()), segmentOffset(i.Arg2Val)...), "M=D")
+			}
+		case SegmentTypeTemp:
+			return append(popD, fmt.Sprintf("@%d", layout.Temp+i.Arg2Val), "M=D")
+		}
+	case i.CommandType == CommandTypeArithmetic && i.ALType == ALTypeNeg:
+		return []string{"@SP", "A=M-1", "M=-M"}
+	}
+	switch {
+	case optLevel == optSpeed:
+		return i.genFast()
+	case optLevel != optSize:
+		return nil
+	case i.CommandType == CommandTypeFunction && i.Arg2Val > 2:
+		return i.genLoopedFunction()
+	case i.CommandType == CommandTypeFunction:
+		return i.genUnrolledFunction()
+	case !sharedCommands[sharedKey(i)]:
+		return nil
+	}
+	switch {
+	case i.CommandType == CommandTypeArithmetic:
+		// the return address goes in D, the subroutine saving it in the
+		// third scratch register
+		id := strings.ToUpper(i.ALType.String()) + "_RETURN"
+		retLabel := generatedLabel(id, nextLabelIndex(id))
+		usedRuntime[i.ALType] = true
+		return []string{"@" + retLabel, "D=A", "@" + runtimeLabel(i.ALType), "0;JMP", "(" + retLabel + ")"}
+	case i.CommandType == CommandTypeCall:
+		usedFrameRuntime = true
+		return genSharedCall(i.Arg1, i.Arg2Val)
+	case i.CommandType == CommandTypeReturn:
+		usedFrameRuntime = true
+		return []string{"@__VM_RETURN", "0;JMP"}
+	}
+	return nil
+}
+
+// threadedJump is how a goto or if-goto is generated after jump threading:
+// as a jump to Target, for an if-goto when the condition is false if
+// Inverted, and as no code at all if Dropped.
+type threadedJump struct {
+	Target   string
+	Inverted bool
+	Dropped  bool
+}
+
+// threadedJumps holds the jumps planJumps changed, by command.
+var threadedJumps = map[*Instruction]threadedJump{}
+
+// planJumps threads the jumps of the program for the levels above O0. A
+// goto or if-goto to a label followed by a goto jumps to the target of
+// that goto instead, down the chain, and the if-goto L1, goto L2, label L1
+// the Jack compiler emits for if and while becomes a single jump to L2
+// when the condition is false. Labels defined more than once are left as
+// they are.
+func planJumps(instructions []*Instruction) {
+	labels, defined := map[string]int{}, map[string]int{}
+	for k, i := range instructions {
+		if i.CommandType == CommandTypeLabel {
+			labels[i.labelSymbol()] = k
+			defined[i.labelSymbol()]++
+		}
+	}
+	// labelsFrom is the index of the first command after the labels at k
+	labelsFrom := func(k int) int {
+		for k < len(instructions) && instructions[k].CommandType == CommandTypeLabel {
+			k++
+		}
+		return k
+	}
+	// final follows the gotos from label to the label they end at, or to
+	// a label of the loop they make
+	final := func(label string) string {
+		seen := map[string]bool{}
+		for !seen[label] && defined[label] == 1 {
+			seen[label] = true
+			k := labelsFrom(labels[label])
+			if k == len(instructions) || instructions[k].CommandType != CommandTypeGOTO {
+				break
+			}
+			label = instructions[k].labelSymbol()
+		}
+		return label
+	}
+
+	threadedJumps = map[*Instruction]threadedJump{}
+	for k, i := range instructions {
+		if i.CommandType != CommandTypeGOTO && i.CommandType != CommandTypeIf {
+			continue
+		}
+		if _, ok := threadedJumps[i]; ok {
+			continue
+		}
+		if i.CommandType == CommandTypeIf && k+2 < len(instructions) && instructions[k+1].CommandType == CommandTypeGOTO && defined[i.labelSymbol()] == 1 {
+			// the label jumped to is among those right after the goto
+			if l := labels[i.labelSymbol()]; l >= k+2 && l < labelsFrom(k+2) {
+				g := instructions[k+1]
+				threadedJumps[i] = threadedJump{Target: final(g.labelSymbol()), Inverted: true}
+				threadedJumps[g] = threadedJump{Dropped: true}
+				continue
+			}
+		}
+		if target := final(i.labelSymbol()); target != i.labelSymbol() {
+			threadedJumps[i] = threadedJump{Target: target}
+		}
+	}
+}
+
+// removedCommands holds the commands planDeadCode leaves out of the code.
+var removedCommands = map[*Instruction]bool{}
+
+// planDeadCode leaves out of the code of the levels above O0 the blocks of
+// the control flow graph no path reaches, and the labels no jump goes to
+// once planJumps threaded them. A label defined more than once is kept,
+// with the block it is in.
+func planDeadCode(instructions []*Instruction) {
+	defined := map[string]int{}
+	for _, i := range instructions {
+		if i.CommandType == CommandTypeLabel {
+			defined[i.labelSymbol()]++
+		}
+	}
+	removedCommands = map[*Instruction]bool{}
+	for _, g := range buildCFGs(instructions) {
+		for _, b := range g.Blocks {
+			block := instructions[b.Start:b.End]
+			if b.Reachable || slices.ContainsFunc(block, func(i *Instruction) bool {
+				return i.CommandType == CommandTypeLabel && defined[i.labelSymbol()] > 1
+			}) {
+				continue
+			}
+			for _, i := range block {
+				removedCommands[i] = true
+			}
+		}
+	}
+	referenced := map[string]bool{}
+	for _, i := range instructions {
+		if removedCommands[i] || i.CommandType != CommandTypeGOTO && i.CommandType != CommandTypeIf {
+			continue
+		}
+		switch j, ok := threadedJumps[i]; {
+		case !ok:
+			referenced[i.labelSymbol()] = true
+		case !j.Dropped:
+			referenced[j.Target] = true
+		}
+	}
+	for _, i := range instructions {
+		if i.CommandType == CommandTypeLabel && defined[i.labelSymbol()] == 1 && !referenced[i.labelSymbol()] {
+			removedCommands[i] = true
+		}
+	}
+}
+
+func (j threadedJump) gen(i *Instruction) []string {
+	switch {
+	case j.Dropped:
+		return []string{}
+	case i.CommandType == CommandTypeGOTO:
+		return []string{"@" + j.Target, "0;JMP"}
+	}
+	jump := "D;JNE"
+	if j.Inverted {
+		jump = "D;JEQ"
+	}
+	return []string{"@SP", "AM=M-1", "D=M", "@" + j.Target, jump}
+}
+
+// sharedCommands holds the commands -Osize generates as jumps to shared
+// subroutines: those the program has at least twice, the subroutine then
+// costing less than the inline code it replaces.
+var sharedCommands = map[string]bool{}
+
+func planSharedCommands(instructions []*Instruction) {
+	counts := map[string]int{}
+	for _, i := range instructions {
+		if removedCommands[i] {
+			continue
+		}
+		if k := sharedKey(i); k != "" {
+			counts[k]++
+		}
+	}
+	sharedCommands = map[string]bool{}
+	for k, n := range counts {
+		sharedCommands[k] = n >= 2
+	}
+}
+
+// sharedKey is the kind of the commands sharing a subroutine at -Osize, ""
+// for the others.
+func sharedKey(i *Instruction) string {
+	switch {
+	case i.CommandType == CommandTypeCall, i.CommandType == CommandTypeReturn:
+		return i.CommandType.String()
+	case i.CommandType == CommandTypeArithmetic && (i.ALType == ALTypeEq || i.ALType == ALTypeGt || i.ALType == ALTypeLt):
+		return i.ALType.String()
+	}
+	return ""
+}
+
+// segmentOffset moves A from the segment pointer it addresses to the word
+// n of the segment.
+func segmentOffset(n int) []string {
+	if n == 0 {
+		return []string{"A=M"}
+	}
+	lines := []string{"A=M+1"}
+	for range n - 1 {
+		lines = append(lines, "A=A+1")
+	}
+	return lines
+}
+
+func pointerSymbol(n int) string {
+	if n == 0 {
+		return "THIS"
+	}
+	return "THAT"
+}
+
+// genSharedCall calls calleeFn through the __VM_CALL subroutine, passing
+// the callee in the first scratch register (R13 by default), the number
+// of arguments in the second and the return address in D.
+func genSharedCall(calleeFn string, calleeNArgs int) []string {
+	retAddrLabel := generatedLabel("ret", nextLabelIndex("ret"))
+	lines := []string{}
+	lines = append(lines, "@"+calleeFn)
+	lines = append(lines, "D=A")
+	lines = append(lines, "@"+scratch(0))
+	lines = append(lines, "M=D")
+	if calleeNArgs <= 1 {
+		lines = append(lines, "@"+scratch(1))
+		lines = append(lines, fmt.Sprintf("M=%d", calleeNArgs))
+	} else {
+		lines = append(lines, fmt.Sprintf("@%d", calleeNArgs))
+		lines = append(lines, "D=A")
+		lines = append(lines, "@"+scratch(1))
+		lines = append(lines, "M=D")
+	}
+	lines = append(lines, "@"+retAddrLabel)
+	lines = append(lines, "D=A")
+	lines = append(lines, "@__VM_CALL")
+	lines = append(lines, "0;JMP")
+	lines = append(lines, fmt.Sprintf("(%s)", retAddrLabel))
+	return lines
+}
+
+// genCallRuntime is the body of call shared by the calls of -Osize: it
+// saves the frame of the caller, sets ARG and LCL and jumps to the callee.
+func genCallRuntime() []string {
+	lines := []string{}
+	lines = append(lines, "/// runtime ; call")
+	lines = append(lines, "(__VM_CALL)")
+	lines = append(lines, "@SP")
+	lines = append(lines, "AM=M+1")
+	lines = append(lines, "A=A-1")
+	lines = append(lines, "M=D") // push the return address
+	for _, seg := range []SegmentType{SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat} {
+		lines = append(lines, "@"+seg.ID())
+		lines = append(lines, "D=M")
+		lines = append(lines, "@SP")
+		lines = append(lines, "AM=M+1")
+		lines = append(lines, "A=A-1")
+		lines = append(lines, "M=D")
+	}
+	lines = append(lines, "@"+scratch(1))
+	lines = append(lines, "D=M")
+	lines = append(lines, "@5")
+	lines = append(lines, "D=D+A")
+	lines = append(lines, "@SP")
+	lines = append(lines, "D=M-D")
+	lines = append(lines, "@ARG")
+	lines = append(lines, "M=D") // ARG = SP - 5 - nArgs
+	lines = append(lines, "@SP")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@LCL")
+	lines = append(lines, "M=D") // LCL = SP
+	lines = append(lines, "@"+scratch(0))
+	lines = append(lines, "A=M")
+	lines = append(lines, "0;JMP")
+	return lines
+}
+
+// genReturnRuntime is the body of return shared by the functions of
+// -Osize.
+func genReturnRuntime() []string {
+	lines := []string{}
+	lines = append(lines, "/// runtime ; return")
+	lines = append(lines, "(__VM_RETURN)")
+	lines = append(lines, (&Instruction{Line: "return"}).genReturn()...)
+	return lines
+}
+
+// genCompareRuntime is the subroutine of eq, gt or lt shared by the
+// comparisons of -Osize, jumping back to the address passed in D.
+func genCompareRuntime(al ALType) []string {
+	label := runtimeLabel(al)
+	jump := map[ALType]string{ALTypeEq: "D;JEQ", ALTypeGt: "D;JGT", ALTypeLt: "D;JLT"}[al]
+	lines := []string{}
+	lines = append(lines, "/// runtime ; "+al.String())
+	lines = append(lines, "("+label+")")
+	lines = append(lines, "@"+scratch(2))
+	lines = append(lines, "M=D")
+	lines = append(lines, "@SP")
+	lines = append(lines, "AM=M-1")
+	lines = append(lines, "D=M")
+	lines = append(lines, "A=A-1")
+	lines = append(lines, "D=M-D")
+	lines = append(lines, "M=-1") // true unless the jump is not taken
+	lines = append(lines, "@"+label+"_END")
+	lines = append(lines, jump)
+	lines = append(lines, "@SP")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "M=0")
+	lines = append(lines, "("+label+"_END)")
+	lines = append(lines, "@"+scratch(2))
+	lines = append(lines, "A=M")
+	lines = append(lines, "0;JMP")
+	return lines
+}
+
+// genFast returns the code of -Ospeed for the commands it has a faster
+// sequence of than -O1, nil for the others.
+func (i *Instruction) genFast() []string {
+	switch {
+	case i.CommandType == CommandTypeFunction:
+		return i.genUnrolledFunction()
+	case i.CommandType == CommandTypeCall:
+		return genFastCall(i.Arg1, i.Arg2Val)
+	case i.CommandType == CommandTypeReturn:
+		return genFastReturn()
+	case i.CommandType == CommandTypeArithmetic && sharedKey(i) != "":
+		// set the result to true before the jump, leaving false to the
+		// path not taking it
+		id := strings.ToUpper(i.ALType.String())
+		endLabel := generatedLabel(id+"_END", nextLabelIndex(id))
+		jump := map[ALType]string{ALTypeEq: "D;JEQ", ALTypeGt: "D;JGT", ALTypeLt: "D;JLT"}[i.ALType]
+		return []string{"@SP", "AM=M-1", "D=M", "A=A-1", "D=M-D", "M=-1", "@" + endLabel, jump, "@SP", "A=M-1", "M=0", "(" + endLabel + ")"}
+	}
+	return nil
+}
+
+// genUnrolledFunction enters the function, clearing its locals by walking
+// A over them and setting SP once.
+func (i *Instruction) genUnrolledFunction() []string {
+	currentFunctionName, labelCounts = i.Arg1, map[string]int{}
+	lines := []string{fmt.Sprintf("(%s)", i.Arg1)}
+	switch {
+	case i.Arg2Val == 1:
+		lines = append(lines, "@SP", "AM=M+1", "A=A-1", "M=0")
+	case i.Arg2Val > 1:
+		lines = append(lines, "@SP", "A=M", "M=0")
+		for range i.Arg2Val - 1 {
+			lines = append(lines, "A=A+1", "M=0")
+		}
+		lines = append(lines, "D=A+1", "@SP", "M=D")
+	}
+	return lines
+}
+
+// genLoopedFunction enters the function, clearing its locals in a loop of
+// a fixed size, for -Osize.
+func (i *Instruction) genLoopedFunction() []string {
+	currentFunctionName, labelCounts = i.Arg1, map[string]int{}
+	loopLabel := generatedLabel("LOCALS", nextLabelIndex("LOCALS"))
+	lines := []string{}
+	lines = append(lines, fmt.Sprintf("(%s)", i.Arg1))
+	lines = append(lines, fmt.Sprintf("@%d", i.Arg2Val))
+	lines = append(lines, "D=A")
+	lines = append(lines, "("+loopLabel+")")
+	lines = append(lines, "@SP")
+	lines = append(lines, "AM=M+1")
+	lines = append(lines, "A=A-1")
+	lines = append(lines, "M=0")
+	lines = append(lines, "@"+loopLabel)
+	lines = append(lines, "D=D-1;JGT")
+	return lines
+}
+
+// genFastCall is call for -Ospeed: the pushes increment SP as they store,
+// and LCL and ARG are computed from the address of the last one.
+func genFastCall(calleeFn string, calleeNArgs int) []string {
+	retAddrLabel := generatedLabel("ret", nextLabelIndex("ret"))
+	lines := []string{}
+	lines = append(lines, "@"+retAddrLabel)
+	lines = append(lines, "D=A")
+	lines = append(lines, "@SP")
+	lines = append(lines, "AM=M+1")
+	lines = append(lines, "A=A-1")
+	lines = append(lines, "M=D") // push the return address
+	for _, seg := range []SegmentType{SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat} {
+		lines = append(lines, "@"+seg.ID())
+		lines = append(lines, "D=M")
+		lines = append(lines, "@SP")
+		lines = append(lines, "AM=M+1")
+		lines = append(lines, "A=A-1")
+		lines = append(lines, "M=D")
+	}
+	lines = append(lines, "D=A+1")
+	lines = append(lines, "@LCL")
+	lines = append(lines, "M=D") // LCL = SP
+	lines = append(lines, fmt.Sprintf("@%d", 5+calleeNArgs))
+	lines = append(lines, "D=D-A")
+	lines = append(lines, "@ARG")
+	lines = append(lines, "M=D") // ARG = SP - 5 - nArgs
+	lines = append(lines, "@"+calleeFn)
+	lines = append(lines, "0;JMP")
+	lines = append(lines, fmt.Sprintf("(%s)", retAddrLabel))
+	return lines
+}
+
+// genFastReturn is return for -Ospeed, restoring the segments of the
+// caller through LCL itself rather than a copy of it in a scratch
+// register.
+func genFastReturn() []string {
+	lines := []string{}
+	lines = append(lines, "@LCL")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@5")
+	lines = append(lines, "A=D-A")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@"+scratch(1))
+	lines = append(lines, "M=D") // retAddr = RAM[LCL - 5]
+	lines = append(lines, "@SP")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@ARG")
+	lines = append(lines, "A=M")
+	lines = append(lines, "M=D") // RAM[ARG] = pop()
+	lines = append(lines, "D=A+1")
+	lines = append(lines, "@SP")
+	lines = append(lines, "M=D") // SP = ARG + 1
+	for _, seg := range []SegmentType{SegmentTypeThat, SegmentTypeThis, SegmentTypeArgument} {
+		lines = append(lines, "@LCL")
+		lines = append(lines, "AM=M-1")
+		lines = append(lines, "D=M")
+		lines = append(lines, "@"+seg.ID())
+		lines = append(lines, "M=D")
+	}
+	lines = append(lines, "@LCL")
+	lines = append(lines, "A=M-1")
+	lines = append(lines, "D=M")
+	lines = append(lines, "@LCL")
+	lines = append(lines, "M=D") // LCL last, as the others are read through it
+	lines = append(lines, "@"+scratch(1))
+	lines = append(lines, "A=M")
+	lines = append(lines, "0;JMP")
+	return lines
+}
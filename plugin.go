@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// pluginCommand is the command line of --plugin, the process claiming the
+// commands and segments the translator does not know.
+var pluginCommand string
+
+// The plugin protocol: the translator starts the plugin once and writes a
+// pluginRequest, one JSON object per line, on its stdin for every command
+// it does not know, reading a pluginResponse line from its stdout before
+// going on. The plugin exits when its stdin is closed.
+type pluginRequest struct {
+	// Command is the text of the command, stripped of its comment
+	Command string   `json:"command"`
+	Words   []string `json:"words"`
+	// File is the prefix of the static variables of the command's file,
+	// for code addressing them as File.index
+	File string `json:"file"`
+	// LabelPrefix is unique to the request, the labels of the code
+	// starting with it so they do not clash with any other
+	LabelPrefix string `json:"label_prefix"`
+	// Scratch are the registers the code is free to clobber
+	Scratch []string `json:"scratch"`
+}
+
+type pluginResponse struct {
+	// Claim is set when the plugin implements the command, the response
+	// being ignored otherwise and the command reported as invalid
+	Claim bool `json:"claim"`
+	// Asm is the Hack assembly of the command, run with the stack in RAM
+	// and falling through to the next command
+	Asm []string `json:"asm"`
+	// Pops and Pushes are the values the command takes off the stack and
+	// leaves on it, for the stack checks
+	Pops   int `json:"pops"`
+	Pushes int `json:"pushes"`
+	// Error rejects the command, as a parse error of its line
+	Error string `json:"error"`
+}
+
+// pluginCode is the assembly a plugin returned for a command it claimed.
+type pluginCode struct {
+	Asm          []string
+	Pops, Pushes int
+}
+
+// pluginProcess is the running plugin, started on the first request.
+type pluginProcess struct {
+	mu    sync.Mutex
+	in    io.WriteCloser
+	out   *bufio.Reader
+	count int // requests so far, numbering the label prefixes
+	err   error
+}
+
+var activePlugin pluginProcess
+
+// builtinCommands are the first words of the commands the translator
+// parses itself, the others going to the plugin.
+var builtinCommands = []string{
+	"push", "pop", "label", "goto", "if-goto", "function", "return", "call", "static-init", "import",
+	"add", "sub", "neg", "eq", "gt", "lt", "and", "or", "not", "shl", "shr", "mult", "div", "mod",
+}
+
+// isBuiltinCommand reports whether the translator parses the command
+// itself: a known command, pushing or popping a known segment.
+func isBuiltinCommand(words []string) bool {
+	cmd := strings.ToLower(words[0])
+	if !slices.Contains(builtinCommands, cmd) {
+		return false
+	}
+	if (cmd == "push" || cmd == "pop") && len(words) > 1 {
+		seg := strings.ToLower(words[1])
+		for st := SegmentTypeConstant; st <= SegmentTypeString; st++ {
+			if st.String() == seg {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// claim asks the plugin for the code of a command. ok is false when the
+// plugin leaves the command to the translator.
+func (p *pluginProcess) claim(fileName, line string, words []string) (code *pluginCode, ok bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.in == nil && p.err == nil {
+		p.err = p.start()
+	}
+	if p.err != nil {
+		return nil, false, p.err
+	}
+	p.count++
+	req := pluginRequest{
+		Command:     line,
+		Words:       words,
+		File:        fileName,
+		LabelPrefix: fmt.Sprintf("%s$PLUGIN$%d", fileName, p.count),
+		Scratch:     []string{},
+	}
+	for n := range scratchRegisters {
+		req.Scratch = append(req.Scratch, scratch(n))
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := p.in.Write(append(data, '\n')); err != nil {
+		p.err = fmt.Errorf("plugin %s: %w", pluginCommand, err)
+		return nil, false, p.err
+	}
+	reply, err := p.out.ReadBytes('\n')
+	if err != nil {
+		p.err = fmt.Errorf("plugin %s: no response: %w", pluginCommand, err)
+		return nil, false, p.err
+	}
+	var resp pluginResponse
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		p.err = fmt.Errorf("plugin %s: invalid response: %w", pluginCommand, err)
+		return nil, false, p.err
+	}
+	switch {
+	case resp.Error != "":
+		return nil, false, fmt.Errorf("%s", resp.Error)
+	case !resp.Claim:
+		return nil, false, nil
+	case resp.Pops < 0 || resp.Pushes < 0:
+		return nil, false, fmt.Errorf("plugin %s: negative stack effect of %s", pluginCommand, line)
+	}
+	return &pluginCode{Asm: resp.Asm, Pops: resp.Pops, Pushes: resp.Pushes}, true, nil
+}
+
+// start runs the plugin, its stderr going to ours.
+func (p *pluginProcess) start() error {
+	args := strings.Fields(pluginCommand)
+	if len(args) == 0 {
+		return fmt.Errorf("invalid plugin %q", pluginCommand)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting plugin %s: %w", pluginCommand, err)
+	}
+	p.in, p.out = in, bufio.NewReader(out)
+	return nil
+}
+
+// parsePluginCommand parses a command the translator does not know as one
+// the plugin claims, ok being false when there is no plugin or it does
+// not claim the command.
+func parsePluginCommand(index int, fileName, line string, toks []token) (inst *Instruction, ok bool, err error) {
+	words := make([]string, len(toks))
+	for k, t := range toks {
+		words[k] = t.Text
+	}
+	if pluginCommand == "" || isBuiltinCommand(words) {
+		return nil, false, nil
+	}
+	code, ok, err := activePlugin.claim(fileName, line, words)
+	if err != nil {
+		return nil, true, errAt(toks[0], "%s", err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return &Instruction{
+		FileName:    fileName,
+		Line:        line,
+		CommandType: CommandTypePlugin,
+		Arg1:        words[0],
+		Plugin:      code,
+		Index:       index,
+	}, true, nil
+}
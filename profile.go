@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// profileOptions are the flags profiling a command with pprof.
+type profileOptions struct {
+	CPU  string
+	Mem  string
+	HTTP string
+}
+
+// registerProfileFlags adds --cpuprofile and --memprofile to fs, and
+// --http-pprof for the commands serving an editor until it disconnects.
+func registerProfileFlags(fs *flag.FlagSet, listen bool) *profileOptions {
+	prof := &profileOptions{}
+	fs.StringVar(&prof.CPU, "cpuprofile", "", "write a CPU profile of the command to this file")
+	fs.StringVar(&prof.Mem, "memprofile", "", "write a heap profile to this file when the command ends")
+	if listen {
+		fs.StringVar(&prof.HTTP, "http-pprof", "", "serve the pprof endpoints on this address (e.g. localhost:6060) while running")
+	}
+	return prof
+}
+
+// start starts the profiles asked for, returning the function writing
+// them. Messages go to stderr, as stdout may carry a protocol.
+func (prof *profileOptions) start() (stop func()) {
+	if prof.HTTP != "" {
+		l, err := net.Listen("tcp", prof.HTTP)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error listening for pprof", err)
+			os.Exit(exitIO)
+		}
+		fmt.Fprintf(os.Stderr, "Serving pprof on http://%s/debug/pprof/\n", l.Addr())
+		go http.Serve(l, nil)
+	}
+	var cpuF *os.File
+	if prof.CPU != "" {
+		var err error
+		if cpuF, err = os.Create(prof.CPU); err == nil {
+			err = pprof.StartCPUProfile(cpuF)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error starting CPU profile", err)
+			os.Exit(exitIO)
+		}
+	}
+	return func() {
+		if cpuF != nil {
+			pprof.StopCPUProfile()
+			cpuF.Close()
+			cpuF = nil
+		}
+		if prof.Mem != "" {
+			runtime.GC()
+			f, err := os.Create(prof.Mem)
+			if err == nil {
+				err = pprof.Lookup("heap").WriteTo(f, 0)
+				f.Close()
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error writing heap profile", err)
+				os.Exit(exitIO)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// progressDelay is how long a translation runs before its progress is
+	// shown, so that small ones print nothing
+	progressDelay = 500 * time.Millisecond
+	progressWidth = 30
+)
+
+// progressReporter shows how far a translation is on stderr: a bar redrawn
+// in place on a terminal, a percentage line every second otherwise.
+type progressReporter struct {
+	out      io.Writer
+	tty      bool
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	stage    string
+	done     int
+	drawn    bool
+}
+
+// newProgressReporter returns the reporter of a --progress mode, nil when
+// nothing is to be shown: auto shows the bar when stderr is a terminal, on
+// also prints percentages when it is not.
+func newProgressReporter(mode string) (*progressReporter, error) {
+	fi, err := os.Stderr.Stat()
+	tty := err == nil && fi.Mode()&os.ModeCharDevice != 0
+	switch mode {
+	case "off":
+		return nil, nil
+	case "auto":
+		if !tty {
+			return nil, nil
+		}
+	case "on":
+	default:
+		return nil, fmt.Errorf("Invalid progress mode %q, expected auto, on or off", mode)
+	}
+	p := &progressReporter{out: os.Stderr, tty: tty, interval: time.Second, start: time.Now()}
+	if tty {
+		p.interval = 100 * time.Millisecond
+	}
+	return p, nil
+}
+
+// report is the Progress of translateOptions.
+func (p *progressReporter) report(stage string, done, total int) {
+	now := time.Now()
+	if now.Sub(p.start) < progressDelay || total == 0 {
+		return
+	}
+	if stage == p.stage && (done == p.done || done < total && now.Sub(p.last) < p.interval) {
+		return
+	}
+	p.stage, p.done, p.last = stage, done, now
+	pct := done * 100 / total
+	if !p.tty {
+		fmt.Fprintf(p.out, "%s %d%% (%d/%d)\n", stage, pct, done, total)
+		return
+	}
+	fill := done * progressWidth / total
+	bar := strings.Repeat("#", fill) + strings.Repeat(" ", progressWidth-fill)
+	fmt.Fprintf(p.out, "\r\x1b[K%-10s [%s] %3d%% %d/%d", stage, bar, pct, done, total)
+	p.drawn = true
+}
+
+// finish clears the bar, leaving the terminal to the messages.
+func (p *progressReporter) finish() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\x1b[K")
+		p.drawn = false
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// vmGen generates random well-formed VM programs: every pop has a value
+// to take, labels are reached with the stack height they were left with,
+// branches only jump forward and loops count down a local, and functions
+// only call the functions generated after them, so programs always halt.
+type vmGen struct {
+	r     *rand.Rand
+	ext   bool
+	class string
+	lines []string
+	// labels numbers the labels, which the class prefixes to keep them
+	// unique across files
+	labels int
+	// state of the function being generated
+	height  int
+	locals  int
+	args    int
+	counter int // the local counting loops down
+	depth   int
+	inLoop  bool
+	callees []genFunction
+}
+
+type genFunction struct {
+	Name          string
+	NArgs, Locals int
+}
+
+// propFile names the generated source, and so its static variables.
+const propFile = "Prop"
+
+// generateVMProgram returns the source of a random program made of
+// Sys.init and the functions it calls, ending in a halt loop.
+func generateVMProgram(r *rand.Rand, ext bool) []string {
+	return generateVMClass(r, ext, propFile, true)
+}
+
+// generateVMClass returns the source of a random class file: a few
+// functions, the first one Sys.init with init, which sets the this and
+// that pointers up and ends in a halt loop.
+func generateVMClass(r *rand.Rand, ext bool, class string, init bool) []string {
+	g := &vmGen{r: r, ext: ext, class: class}
+	fns := []genFunction{}
+	if init {
+		fns = append(fns, genFunction{Name: "Sys.init", Locals: r.IntN(3)})
+	}
+	for k := range 1 + r.IntN(4) {
+		fns = append(fns, genFunction{Name: fmt.Sprintf("%s.f%d", class, k+1), NArgs: r.IntN(3), Locals: r.IntN(3)})
+	}
+	for k, fn := range fns {
+		g.height, g.locals, g.args, g.counter, g.depth = 0, fn.Locals, fn.NArgs, fn.Locals, 0
+		g.callees = fns[k+1:]
+		// one more local counts the loops down
+		g.emit(fmt.Sprintf("function %s %d", fn.Name, fn.Locals+1))
+		if init && k == 0 {
+			g.emit("push constant 3000", "pop pointer 0", "push constant 3100", "pop pointer 1")
+		}
+		g.block(8 + r.IntN(20))
+		if init && k == 0 {
+			g.settle(0)
+			halt := g.label("HALT")
+			g.emit("label "+halt, "goto "+halt)
+			continue
+		}
+		g.settle(1)
+		g.emit("return")
+	}
+	return g.lines
+}
+
+func (g *vmGen) emit(lines ...string) {
+	g.lines = append(g.lines, lines...)
+}
+
+func (g *vmGen) label(name string) string {
+	g.labels++
+	return fmt.Sprintf("%s.%s%d", g.class, name, g.labels)
+}
+
+func (g *vmGen) block(n int) {
+	for range n {
+		g.command()
+	}
+}
+
+// command emits one random command or construct.
+func (g *vmGen) command() {
+	switch k := g.r.IntN(10); {
+	case k == 3 && g.height > 0:
+		g.pop()
+	case (k == 4 || k == 5) && g.height > 0:
+		g.arithmetic()
+	case k == 6 && g.depth < 2:
+		g.branch()
+	case k == 7 && g.depth < 2 && !g.inLoop:
+		g.loop()
+	case k == 8 && len(g.callees) > 0:
+		fn := g.callees[g.r.IntN(len(g.callees))]
+		for range fn.NArgs {
+			g.push()
+		}
+		g.emit(fmt.Sprintf("call %s %d", fn.Name, fn.NArgs))
+		g.height += 1 - fn.NArgs
+	default:
+		g.push()
+	}
+}
+
+func (g *vmGen) push() {
+	segs := []string{"constant", "constant", "constant", "temp", "static", "this", "that", "pointer"}
+	if g.locals > 0 {
+		segs = append(segs, "local")
+	}
+	if g.args > 0 {
+		segs = append(segs, "argument")
+	}
+	g.height++
+	seg := segs[g.r.IntN(len(segs))]
+	if seg == "constant" {
+		v := g.r.IntN(100)
+		if g.r.IntN(5) == 0 {
+			v = g.r.IntN(32768)
+		}
+		g.emit(fmt.Sprintf("push constant %d", v))
+		return
+	}
+	g.emit(fmt.Sprintf("push %s %d", seg, g.index(seg)))
+}
+
+func (g *vmGen) pop() {
+	segs := []string{"temp", "static", "this", "that"}
+	if g.locals > 0 {
+		segs = append(segs, "local")
+	}
+	if g.args > 0 {
+		segs = append(segs, "argument")
+	}
+	g.height--
+	seg := segs[g.r.IntN(len(segs))]
+	g.emit(fmt.Sprintf("pop %s %d", seg, g.index(seg)))
+}
+
+// index picks an index of seg, leaving the loop counter and the temp words
+// given to --scratch alone.
+func (g *vmGen) index(seg string) int {
+	switch seg {
+	case "local":
+		return g.r.IntN(g.locals)
+	case "argument":
+		return g.r.IntN(g.args)
+	case "pointer":
+		return g.r.IntN(2)
+	case "static":
+		return g.r.IntN(6)
+	}
+	n := g.r.IntN(8)
+	for isScratch(layout.Temp + n) {
+		n = g.r.IntN(8)
+	}
+	return n
+}
+
+func (g *vmGen) arithmetic() {
+	unary := []string{"neg", "not"}
+	binary := []string{"add", "sub", "and", "or", "eq", "gt", "lt"}
+	if g.ext {
+		unary = append(unary, "shl", "shr")
+		binary = append(binary, "mult", "div", "mod")
+	}
+	if g.height < 2 || g.r.IntN(4) == 0 {
+		g.emit(unary[g.r.IntN(len(unary))])
+		return
+	}
+	g.emit(binary[g.r.IntN(len(binary))])
+	g.height--
+}
+
+// settle pops or pushes until the stack has height values.
+func (g *vmGen) settle(height int) {
+	for g.height > height {
+		g.pop()
+	}
+	for g.height < height {
+		g.push()
+	}
+}
+
+// condition pushes a truth value.
+func (g *vmGen) condition() {
+	g.push()
+	g.push()
+	g.emit([]string{"eq", "gt", "lt"}[g.r.IntN(3)])
+	g.height--
+}
+
+// branch emits an if, or an if-else joined by a goto.
+func (g *vmGen) branch() {
+	base := g.height
+	g.depth++
+	defer func() { g.depth-- }()
+	g.condition()
+	then, end := g.label("THEN"), g.label("END")
+	g.emit("if-goto " + then)
+	g.height--
+	if g.r.IntN(2) == 0 {
+		g.block(1 + g.r.IntN(5))
+		g.settle(base)
+		g.emit("goto " + end)
+	}
+	g.emit("label " + then)
+	g.block(1 + g.r.IntN(5))
+	g.settle(base)
+	g.emit("label " + end)
+}
+
+// loop emits a loop running its body one to four times.
+func (g *vmGen) loop() {
+	base := g.height
+	g.depth++
+	g.inLoop = true
+	defer func() { g.depth--; g.inLoop = false }()
+	top := g.label("LOOP")
+	g.emit(fmt.Sprintf("push constant %d", 1+g.r.IntN(4)), fmt.Sprintf("pop local %d", g.counter), "label "+top)
+	g.block(1 + g.r.IntN(6))
+	g.settle(base)
+	g.emit(
+		fmt.Sprintf("push local %d", g.counter), "push constant 1", "sub", fmt.Sprintf("pop local %d", g.counter),
+		fmt.Sprintf("push local %d", g.counter), "if-goto "+top,
+	)
+}
+
+// propCheck runs a translation on the emulator and its commands on the
+// interpreter, returning the differences between their final states.
+func propCheck(tr *translation, maxCycles int) ([]string, error) {
+	prog, err := assembleHack(tr.Lines)
+	if err != nil {
+		return nil, fmt.Errorf("assembling: %w", err)
+	}
+	cpu := newHackCPU(prog)
+	for !cpu.Halted() {
+		if cpu.Cycles >= maxCycles {
+			return nil, fmt.Errorf("the assembly did not halt within %d cycles", maxCycles)
+		}
+		if err := cpu.Step(); err != nil {
+			return nil, fmt.Errorf("emulating: %w", err)
+		}
+	}
+	m, err := newVMInterpreter(tr.Instructions)
+	if err == nil {
+		// the values compared may be any words, their difference
+		// overflowing
+		m.WrapCompare = true
+	}
+	if err == nil && tr.Bootstrap != "" {
+		err = m.Bootstrap(tr.Bootstrap, tr.EntryNArgs)
+	}
+	for err == nil && !m.Halted() {
+		if m.Steps >= maxCycles {
+			return nil, fmt.Errorf("the interpreter did not halt within %d commands", maxCycles)
+		}
+		err = m.Step()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("interpreting command %d: %w", m.PC, err)
+	}
+
+	diffs := []string{}
+	check := func(what string, vm, asm int16) {
+		if vm != asm {
+			diffs = append(diffs, fmt.Sprintf("%s: %d interpreted, %d emulated", what, vm, asm))
+		}
+	}
+	for k, name := range []string{"SP", "LCL", "ARG", "THIS", "THAT"} {
+		check(name, m.RAM[k], cpu.RAM[k])
+	}
+	for k := range 8 {
+		if !isScratch(layout.Temp + k) {
+			check(fmt.Sprintf("temp %d", k), m.RAM[layout.Temp+k], cpu.RAM[layout.Temp+k])
+		}
+	}
+	for addr := layout.Stack; addr < m.sp(); addr++ {
+		if !m.RetSlots[addr] {
+			check(fmt.Sprintf("RAM[%d] (stack)", addr), m.RAM[addr], cpu.RAM[addr])
+		}
+	}
+	seen := map[string]bool{}
+	for _, inst := range tr.Instructions {
+		if sym, ok := staticSymbol(inst); ok && !seen[sym] {
+			seen[sym] = true
+			// a static only used by code left out has no address
+			if addr, ok := prog.Symbols[sym]; ok {
+				check(sym, m.Statics[sym], cpu.RAM[addr])
+			}
+		}
+	}
+	for addr := layout.Heap; addr < layout.HeapEnd(); addr++ {
+		check(fmt.Sprintf("RAM[%d]", addr), m.RAM[addr], cpu.RAM[addr])
+	}
+	return diffs, nil
+}
+
+// runPropTest implements the proptest subcommand, translating random
+// programs and checking the assembly ends in the state the interpreter
+// does.
+func runPropTest(args []string) {
+	fs := flag.NewFlagSet("proptest", flag.ExitOnError)
+	n := fs.Int("n", 100, "number of programs to generate")
+	seed := fs.Int64("seed", 0, "seed of the first program, the next ones counting up (defaults to the time)")
+	ext := fs.Bool("ext", false, "also generate the extended commands (shl, shr, mult, div, mod)")
+	keep := fs.String("keep", "", "write the programs that fail to this directory, as SEED/Prop.vm")
+	maxCycles := fs.Int("max-cycles", 10_000_000, "cycles (and interpreted commands) after which a program is considered not to halt")
+	registerOptFlags(fs)
+	registerScratchFlag(fs)
+	registerLayoutFlag(fs)
+	parseFlags(fs, args)
+	if *seed == 0 {
+		*seed = time.Now().UnixNano() % 1_000_000_000
+	}
+	extendedMode = *ext
+
+	dir, err := os.MkdirTemp("", "proptest")
+	if err != nil {
+		fmt.Println("Error creating temporary directory", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, propFile+".vm")
+
+	fmt.Printf("Testing %s from seed %d\n", plural(*n, "program"), *seed)
+	failed := 0
+	for k := range int64(*n) {
+		s := *seed + k
+		program := strings.Join(generateVMProgram(rand.New(rand.NewPCG(uint64(s), 0)), *ext), "\n") + "\n"
+		if err := os.WriteFile(src, []byte(program), 0644); err != nil {
+			fmt.Println("Error writing program", err)
+			os.Exit(1)
+		}
+		tr, err := translate(&translateOptions{Sources: stringsFlag{src}, Bootstrap: "on", Entry: "Sys.init"})
+		diffs := []string{}
+		if err == nil {
+			diffs, err = propCheck(tr, *maxCycles)
+		}
+		if err == nil && len(diffs) == 0 {
+			continue
+		}
+
+		failed++
+		fmt.Printf("FAIL seed %d:", s)
+		if err != nil {
+			fmt.Println("", err)
+		} else {
+			fmt.Println()
+			for _, d := range diffs[:min(len(diffs), 10)] {
+				fmt.Println("\t" + d)
+			}
+			if len(diffs) > 10 {
+				fmt.Printf("\t... %s more\n", plural(len(diffs)-10, "difference"))
+			}
+		}
+		if *keep != "" {
+			path := filepath.Join(*keep, fmt.Sprint(s), propFile+".vm")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+				err = os.WriteFile(path, []byte(program), 0644)
+			}
+			if err != nil {
+				fmt.Println("Error keeping program", err)
+				os.Exit(1)
+			}
+			fmt.Println("\tkept as", path)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%s of %d failed, rerun one with -n 1 -seed SEED\n", plural(failed, "program"), *n)
+		os.Exit(1)
+	}
+	fmt.Printf("All %s passed\n", plural(*n, "program"))
+}
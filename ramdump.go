@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ramSnapshot is the content of the files of run --dump-ram and
+// --load-ram: ranges of RAM words, and when dumped the cycle the run
+// ended at.
+type ramSnapshot struct {
+	Cycles int        `json:"cycles,omitempty"`
+	Ranges []ramRange `json:"ranges"`
+}
+
+type ramRange struct {
+	Start  int     `json:"start"`
+	Values []int16 `json:"values"`
+}
+
+// parseRAMAddress resolves a number or a symbol (SP, SCREEN, Main.0...)
+// to a RAM address.
+func parseRAMAddress(s string, symbols map[string]int) (int, error) {
+	addr, err := strconv.Atoi(s)
+	if err != nil {
+		v, ok := symbols[s]
+		if !ok {
+			return 0, fmt.Errorf("unknown address or symbol %q", s)
+		}
+		addr = v
+	}
+	if addr < 0 || addr >= layout.RAMSize() {
+		return 0, fmt.Errorf("address %d outside of RAM", addr)
+	}
+	return addr, nil
+}
+
+// parseRAMRanges parses the comma separated ranges of --dump-range, each an
+// address or FIRST-LAST, both included. No ranges is the whole RAM.
+func parseRAMRanges(spec string, symbols map[string]int) ([][2]int, error) {
+	if strings.TrimSpace(spec) == "" {
+		return [][2]int{{0, layout.RAMSize() - 1}}, nil
+	}
+	ranges := [][2]int{}
+	for _, part := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		a, err := parseRAMAddress(first, symbols)
+		if err != nil {
+			return nil, err
+		}
+		b := a
+		if isRange {
+			if b, err = parseRAMAddress(last, symbols); err != nil {
+				return nil, err
+			}
+		}
+		if b < a {
+			return nil, fmt.Errorf("empty range %q", part)
+		}
+		ranges = append(ranges, [2]int{a, b})
+	}
+	return ranges, nil
+}
+
+// dumpRAM writes the ranges of the RAM to path, a range a line.
+func dumpRAM(path string, cpu *hackCPU, ranges [][2]int) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "{\n  \"cycles\": %d,\n  \"ranges\": [", cpu.Cycles)
+	for k, r := range ranges {
+		data, err := json.Marshal(ramRange{r[0], cpu.RAM[r[0] : r[1]+1]})
+		if err != nil {
+			return err
+		}
+		if k > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n    ")
+		b.Write(data)
+	}
+	b.WriteString("\n  ]\n}\n")
+	return os.WriteFile(path, b.Bytes(), 0644)
+}
+
+// loadRAM sets the RAM words of the snapshot in path.
+func loadRAM(path string, ram []int16) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snap ramSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, r := range snap.Ranges {
+		if r.Start < 0 || r.Start+len(r.Values) > len(ram) {
+			return fmt.Errorf("%s: range %d-%d outside of RAM", path, r.Start, r.Start+len(r.Values)-1)
+		}
+		copy(ram[r.Start:], r.Values)
+	}
+	return nil
+}
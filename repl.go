@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// runREPL implements the repl subcommand, reading VM commands
+// interactively and printing the assembly generated for each along with
+// the simulated stack once it has run.
+func runREPL(args []string) {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	fs.BoolVar(&extendedMode, "ext", false, "accept the extended VM commands")
+	showStack := fs.Bool("stack", true, "run the commands on the emulator and print the stack after each one")
+	parseFlags(fs, args)
+
+	r := &replSession{out: os.Stdout, showStack: *showStack}
+	fmt.Println("Type VM commands, or :help for the list of REPL commands.")
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("vm> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		if r.exec(in.Text()) {
+			return
+		}
+	}
+}
+
+// replCycleLimit bounds the simulation of the commands entered so far,
+// which a goto looping back would otherwise run forever.
+const replCycleLimit = 1_000_000
+
+// replSession holds the commands entered so far. Every command is run by
+// simulating the whole program again from the start, so jumps to earlier
+// labels behave as they would in a translated file.
+type replSession struct {
+	out       io.Writer
+	showStack bool
+	asm       []string
+	commands  int
+	// function is the last function declared, scoping the labels after it
+	function string
+}
+
+// replSegments are the segment base addresses the simulation starts with,
+// as set up by the course test scripts.
+var replSegments = []struct {
+	Name string
+	Addr int
+}{{"SP", 256}, {"LCL", 300}, {"ARG", 400}, {"THIS", 3000}, {"THAT", 3010}}
+
+const replHelp = `Type a VM command (e.g. push constant 7) to see its assembly.
+REPL commands:
+  :stack          toggle running the commands and printing the stack
+  :segments       print the segment pointers and the first cells of each segment
+  :asm            print the assembly of every command entered so far
+  :reset          forget the commands entered so far
+  :quit           leave the REPL`
+
+// exec handles a line of input, returning true when the session is over.
+func (r *replSession) exec(line string) bool {
+	line = removeCommentsAndSpaces(line)
+	switch line {
+	case "":
+		return false
+	case ":quit", ":q":
+		return true
+	case ":help", ":h":
+		fmt.Fprintln(r.out, replHelp)
+		return false
+	case ":stack":
+		r.showStack = !r.showStack
+		fmt.Fprintln(r.out, "Stack display", map[bool]string{true: "on", false: "off"}[r.showStack])
+		return false
+	case ":asm":
+		fmt.Fprintln(r.out, strings.Join(r.asm, "\n"))
+		return false
+	case ":reset":
+		*r = replSession{out: r.out, showStack: r.showStack}
+		resetCodegenState()
+		fmt.Fprintln(r.out, "Cleared")
+		return false
+	case ":segments":
+		r.printSegments()
+		return false
+	}
+	if strings.HasPrefix(line, ":") {
+		fmt.Fprintf(r.out, "Unknown REPL command %s, type :help for the list\n", line)
+		return false
+	}
+
+	inst, err := parseInstruction(r.commands, "Repl", line)
+	if err != nil {
+		fmt.Fprintln(r.out, "Error:", err)
+		return false
+	}
+	if inst.CommandType == CommandTypeFunction {
+		r.function = inst.Arg1
+	}
+	inst.Function = r.function
+	asm, err := inst.GenAsm()
+	if err != nil {
+		fmt.Fprintln(r.out, "Error:", err)
+		return false
+	}
+	r.asm = append(r.asm, asm...)
+	r.commands++
+	for _, l := range asm {
+		fmt.Fprintln(r.out, "  "+l)
+	}
+	if r.showStack {
+		cpu, err := r.simulate()
+		if err != nil {
+			fmt.Fprintln(r.out, "Error:", err)
+			return false
+		}
+		sp := int(cpu.RAM[0])
+		if sp >= 256 && sp <= len(cpu.RAM) {
+			fmt.Fprintf(r.out, "stack: %v (SP=%d)\n", cpu.RAM[256:sp], sp)
+		} else {
+			fmt.Fprintf(r.out, "SP=%d is outside of the stack\n", sp)
+		}
+	}
+	return false
+}
+
+// simulate runs the commands entered so far from a fresh machine.
+func (r *replSession) simulate() (*hackCPU, error) {
+	lines := []string{}
+	for _, seg := range replSegments {
+		lines = append(lines, fmt.Sprintf("@%d", seg.Addr), "D=A", "@"+seg.Name, "M=D")
+	}
+	lines = append(lines, r.asm...)
+	lines = append(lines, genRuntime()...)
+	prog, err := assembleHack(lines)
+	if err != nil {
+		return nil, err
+	}
+	cpu := newHackCPU(prog)
+	for !cpu.Halted() {
+		if cpu.Cycles >= replCycleLimit {
+			return nil, fmt.Errorf("still running after %d cycles, a goto may loop forever", replCycleLimit)
+		}
+		if err := cpu.Step(); err != nil {
+			return nil, err
+		}
+	}
+	return cpu, nil
+}
+
+func (r *replSession) printSegments() {
+	cpu, err := r.simulate()
+	if err != nil {
+		fmt.Fprintln(r.out, "Error:", err)
+		return
+	}
+	for k, seg := range replSegments {
+		base := int(cpu.RAM[k])
+		if k == 0 {
+			fmt.Fprintf(r.out, "SP   = %d\n", base)
+			continue
+		}
+		cells := []int16{}
+		if base >= 0 && base+8 <= len(cpu.RAM) {
+			cells = cpu.RAM[base : base+8]
+		}
+		fmt.Fprintf(r.out, "%-4s = %d %v\n", seg.Name, base, cells)
+	}
+	fmt.Fprintf(r.out, "temp = %v\n", cpu.RAM[5:13])
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+)
+
+// isAsmInstruction reports whether an assembly line is an instruction
+// rather than a comment, a label or a blank line.
+func isAsmInstruction(line string) bool {
+	line = strings.TrimSpace(line)
+	return line != "" && !strings.HasPrefix(line, "//") && !strings.HasPrefix(line, "(")
+}
+
+type reportCommand struct {
+	Line         int
+	Text         string
+	Asm          string
+	Instructions int
+}
+
+type reportFile struct {
+	Name         string
+	Commands     []reportCommand
+	Instructions int
+}
+
+type reportData struct {
+	Title        string
+	Summary      string
+	Files        []*reportFile
+	Support      *reportFile // bootstrap and runtime code
+	Warnings     []string
+	Instructions int
+	CallGraph    template.HTML
+}
+
+// writeHTMLReport writes a static HTML page describing a translation:
+// every file with its commands and the assembly generated for each, the
+// instruction counts, the warnings and the call graph.
+func writeHTMLReport(path string, tr *translation) error {
+	data := reportData{Title: "Translation report", Warnings: tr.Warnings}
+	asm := make([][]string, len(tr.Commands))
+	support := &reportFile{Name: "Bootstrap and runtime code"}
+	var supportAsm []string
+	for k, line := range tr.Lines {
+		if cmd := tr.Origin[k]; cmd >= 0 {
+			asm[cmd] = append(asm[cmd], line)
+		} else {
+			supportAsm = append(supportAsm, line)
+		}
+	}
+	byName := map[string]*reportFile{}
+	for k, sl := range tr.Commands {
+		f := byName[sl.File]
+		if f == nil {
+			f = &reportFile{Name: sl.File}
+			byName[sl.File] = f
+			data.Files = append(data.Files, f)
+		}
+		c := reportCommand{Line: sl.Line, Text: sl.Text, Asm: strings.Join(asm[k], "\n")}
+		for _, l := range asm[k] {
+			if isAsmInstruction(l) {
+				c.Instructions++
+			}
+		}
+		f.Commands = append(f.Commands, c)
+		f.Instructions += c.Instructions
+		data.Instructions += c.Instructions
+	}
+	if len(supportAsm) > 0 {
+		c := reportCommand{Text: "(generated)", Asm: strings.Join(supportAsm, "\n")}
+		for _, l := range supportAsm {
+			if isAsmInstruction(l) {
+				c.Instructions++
+			}
+		}
+		support.Commands = []reportCommand{c}
+		support.Instructions = c.Instructions
+		data.Instructions += c.Instructions
+		data.Support = support
+	}
+	data.Summary = fmt.Sprintf("%s, %s in total.", plural(len(data.Files), "file"), plural(data.Instructions, "instruction"))
+	data.CallGraph = callGraphSVG(buildCallGraph(tr))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return reportTemplate.Execute(f, data)
+}
+
+// callGraphSVG draws the call graph as inline SVG, the functions laid out
+// in rows by their call depth from the callers nothing calls.
+func callGraphSVG(g *callGraph) template.HTML {
+	nodes := []string{}
+	seen := map[string]bool{}
+	add := func(n string) {
+		if !seen[n] {
+			seen[n] = true
+			nodes = append(nodes, n)
+		}
+	}
+	called := map[string]bool{}
+	for _, e := range g.Edges {
+		add(e.Caller)
+		add(e.Callee)
+		if e.Caller != e.Callee {
+			called[e.Callee] = true
+		}
+	}
+	for _, fn := range g.Functions {
+		add(fn)
+	}
+	if len(nodes) == 0 {
+		return template.HTML("<p>No functions.</p>")
+	}
+
+	// depth by breadth first search from the roots, unreached cycles last
+	depth := map[string]int{}
+	queue := []string{}
+	for _, n := range nodes {
+		if !called[n] {
+			depth[n] = 0
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, e := range g.Edges {
+			if _, ok := depth[e.Callee]; e.Caller == n && !ok {
+				depth[e.Callee] = depth[n] + 1
+				queue = append(queue, e.Callee)
+			}
+		}
+	}
+	rows := [][]string{}
+	for _, n := range nodes {
+		d, ok := depth[n]
+		if !ok {
+			d = len(rows)
+			depth[n] = d
+		}
+		for len(rows) <= d {
+			rows = append(rows, nil)
+		}
+		rows[d] = append(rows[d], n)
+	}
+
+	const boxW, boxH, gapX, gapY = 180, 36, 30, 70
+	width := 0
+	for _, r := range rows {
+		width = max(width, len(r)*(boxW+gapX))
+	}
+	pos := map[string][2]int{}
+	for d, r := range rows {
+		offset := (width - len(r)*(boxW+gapX)) / 2
+		for k, n := range r {
+			pos[n] = [2]int{offset + k*(boxW+gapX) + gapX/2, d*(boxH+gapY) + 10}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`, width, len(rows)*(boxH+gapY))
+	b.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto"><path d="M0,0L10,5L0,10z"/></marker></defs>`)
+	for _, e := range g.Edges {
+		from, to := pos[e.Caller], pos[e.Callee]
+		x1, y1 := from[0]+boxW/2, from[1]+boxH
+		x2, y2 := to[0]+boxW/2, to[1]
+		color := "#555"
+		if len(e.NArgs) > 1 {
+			color = "red"
+		}
+		label := plural(e.Count, "call")
+		if e.Caller == e.Callee {
+			// recursion loops around the right side of the box
+			x, y := from[0]+boxW, from[1]
+			fmt.Fprintf(&b, `<path d="M%d,%d c40,0 40,%d 0,%d" fill="none" stroke="%s" marker-end="url(#arrow)"/>`, x, y+8, boxH-16, boxH-16, color)
+			fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, x+34, y+boxH/2+4, template.HTMLEscapeString(label))
+			continue
+		}
+		if y2 <= y1 {
+			// call back up the rows
+			y1, y2 = from[1], to[1]+boxH
+		}
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s" marker-end="url(#arrow)"/>`, x1, y1, x2, y2, color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" fill="#333">%s</text>`, (x1+x2)/2+4, (y1+y2)/2, template.HTMLEscapeString(label))
+	}
+	for _, n := range nodes {
+		p := pos[n]
+		style := `fill="#eef" stroke="#336"`
+		switch {
+		case n == callerBootstrap || n == callerTopLevel:
+			style = `fill="#efe" stroke="#363"`
+		case !g.Defines(n):
+			style = `fill="#fff" stroke="#999" stroke-dasharray="4"`
+		}
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" rx="6" %s/>`, p[0], p[1], boxW, boxH, style)
+		name := n
+		// about the number of characters fitting in a box
+		if limit := boxW * 2 / 15; len(name) > limit {
+			name = name[:limit-1] + "…"
+		}
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle"><title>%s</title>%s</text>`,
+			p[0]+boxW/2, p[1]+boxH/2+4, template.HTMLEscapeString(n), template.HTMLEscapeString(name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { border-bottom: 1px solid #ddd; padding: 2px 8px; vertical-align: top; text-align: left; }
+td.n { color: #888; text-align: right; width: 3em; }
+pre { margin: 0; font-size: 90%; }
+code, pre { font-family: monospace; }
+summary { cursor: pointer; font-weight: bold; margin: 0.5em 0; }
+.warning { color: #a60; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Summary}}</p>
+{{if .Warnings}}<h2>Warnings</h2>
+<ul>{{range .Warnings}}<li class="warning">{{.}}</li>{{end}}</ul>{{end}}
+<h2>Call graph</h2>
+{{.CallGraph}}
+<h2>Sources</h2>
+{{range .Files}}{{template "file" .}}{{end}}
+{{with .Support}}{{template "file" .}}{{end}}
+</body>
+</html>
+{{define "file"}}<details>
+<summary>{{.Name}}: {{len .Commands}} commands, {{.Instructions}} instructions</summary>
+<table>
+<tr><th>Line</th><th>VM command</th><th>Instructions</th><th>Assembly</th></tr>
+{{range .Commands}}<tr><td class="n">{{if .Line}}{{.Line}}{{end}}</td><td><code>{{.Text}}</code></td><td class="n">{{.Instructions}}</td><td><pre>{{.Asm}}</pre></td></tr>
+{{end}}</table>
+</details>
+{{end}}`))
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// riscvBackend generates RISC-V assembly (RV32I, the base integer set)
+// running the program, the mapping of the stack machine to a real one:
+//
+//	int vm_run(int16_t *ram);
+//
+// vm_run follows the standard calling convention (ILP32). It runs the
+// program on the RAM it is given, layout.RAMSize() words laid out like the
+// Hack RAM as in the C target. It returns 0 when the program halts, 1 for
+// an access outside the RAM, 2 for a call or a jump to an undefined
+// target and 3 for a return to an unknown address.
+//
+// s0 holds the address of the RAM. The pointers stay in RAM[0..4] rather
+// than in registers, so that the RAM holds the state of the Hack program.
+// The return addresses pushed are the numbers of the return points, which
+// a table turns into code addresses.
+type riscvBackend struct{}
+
+func (riscvBackend) Ext() string { return ".s" }
+
+func (riscvBackend) Comment(text string) string { return "# " + text }
+
+// riscvRuntime holds the exits of vm_run and the subroutines of the
+// commands, called with jal. They clobber a0-a2, t0 and t3-t6 at most, t1
+// and t2 being left to return.
+func riscvRuntime() []string {
+	return []string{
+		".Lhalt:",
+		"\tli a0, 0",
+		".Lexit:",
+		"\tlw ra, 12(sp)",
+		"\tlw s0, 8(sp)",
+		"\taddi sp, sp, 16",
+		"\tret",
+		".Lfault_memory:",
+		"\tli a0, 1",
+		"\tj .Lexit",
+		".Lundefined:",
+		"\tli a0, 2",
+		"\tj .Lexit",
+		".Lbad_return:",
+		"\tli a0, 3",
+		"\tj .Lexit",
+		"",
+		"# .Lword turns the address t0 into a pointer to its word.",
+		".Lword:",
+		fmt.Sprintf("\tli t6, %d", layout.RAMSize()),
+		"\tbgeu t0, t6, .Lfault_memory",
+		"\tslli t0, t0, 1",
+		"\tadd t0, s0, t0",
+		"\tret",
+		"",
+		"# .Lpush pushes a0.",
+		".Lpush:",
+		"\tlhu t5, 0(s0)",
+		fmt.Sprintf("\tli t6, %d", layout.RAMSize()),
+		"\tbgeu t5, t6, .Lfault_memory",
+		"\tslli t6, t5, 1",
+		"\tadd t6, s0, t6",
+		"\tsh a0, 0(t6)",
+		"\taddi t5, t5, 1",
+		"\tsh t5, 0(s0)",
+		"\tret",
+		"",
+		"# .Lpop pops a0.",
+		".Lpop:",
+		"\tlhu t5, 0(s0)",
+		"\taddi t5, t5, -1",
+		"\tsh t5, 0(s0)",
+		fmt.Sprintf("\tli t6, %d", layout.RAMSize()),
+		"\tbgeu t5, t6, .Lfault_memory",
+		"\tslli t6, t5, 1",
+		"\tadd t6, s0, t6",
+		"\tlh a0, 0(t6)",
+		"\tret",
+		"",
+		"# .Lmult multiplies a0 by a1 by shifts and adds, RV32I having no mul.",
+		".Lmult:",
+		"\tli t5, 0",
+		"1:",
+		"\tbeqz a1, 3f",
+		"\tandi t6, a1, 1",
+		"\tbeqz t6, 2f",
+		"\tadd t5, t5, a0",
+		"2:",
+		"\tslli a0, a0, 1",
+		"\tsrli a1, a1, 1",
+		"\tj 1b",
+		"3:",
+		"\tmv a0, t5",
+		"\tret",
+		"",
+		"# .Ldivmod divides a0 by a1, the quotient in a0 and the remainder in",
+		"# a1, truncating like the runtime subroutines: by zero yields 0 and a0.",
+		".Ldivmod:",
+		"\tbnez a1, 1f",
+		"\tmv a1, a0",
+		"\tli a0, 0",
+		"\tret",
+		"1:",
+		"\txor t4, a0, a1",
+		"\tmv t3, a0",
+		"\tbgez a0, 2f",
+		"\tneg a0, a0",
+		"2:",
+		"\tbgez a1, 3f",
+		"\tneg a1, a1",
+		"3:",
+		"\tli t5, 0",
+		"\tli t6, 0",
+		"\tli t0, 32",
+		"4:",
+		"\tslli t6, t6, 1",
+		"\tsrli a2, a0, 31",
+		"\tor t6, t6, a2",
+		"\tslli a0, a0, 1",
+		"\tslli t5, t5, 1",
+		"\tbltu t6, a1, 5f",
+		"\tsub t6, t6, a1",
+		"\tori t5, t5, 1",
+		"5:",
+		"\taddi t0, t0, -1",
+		"\tbnez t0, 4b",
+		"\tbgez t4, 6f",
+		"\tneg t5, t5",
+		"6:",
+		"\tbgez t3, 7f",
+		"\tneg t6, t6",
+		"7:",
+		"\tmv a0, t5",
+		"\tmv a1, t6",
+		"\tret",
+	}
+}
+
+// riscvArithmetic are the instructions computing the arithmetic commands
+// from the top of the stack in a1 and the word below it in a0, unary ones
+// from a0, leaving the result in a0. The words are sign-extended, the
+// results truncated by the store pushing them.
+var riscvArithmetic = map[ALType][]string{
+	ALTypeAdd:  {"add a0, a0, a1"},
+	ALTypeSub:  {"sub a0, a0, a1"},
+	ALTypeAnd:  {"and a0, a0, a1"},
+	ALTypeOr:   {"or a0, a0, a1"},
+	ALTypeEq:   {"sub a0, a0, a1", "seqz a0, a0", "neg a0, a0"},
+	ALTypeGt:   {"slt a0, a1, a0", "neg a0, a0"},
+	ALTypeLt:   {"slt a0, a0, a1", "neg a0, a0"},
+	ALTypeNeg:  {"neg a0, a0"},
+	ALTypeNot:  {"not a0, a0"},
+	ALTypeShl:  {"slli a0, a0, 1"},
+	ALTypeShr:  {"srai a0, a0, 1"},
+	ALTypeMult: {"jal .Lmult"},
+	ALTypeDiv:  {"jal .Ldivmod"},
+	ALTypeMod:  {"jal .Ldivmod", "mv a0, a1"},
+}
+
+func (be riscvBackend) Generate(tr *translation) ([]string, error) {
+	pl := newProgramLabels(tr)
+	statics, err := staticAddresses(tr)
+	if err != nil {
+		return nil, err
+	}
+	body := []string{}
+	emit := func(format string, args ...any) {
+		body = append(body, "\t"+fmt.Sprintf(format, args...))
+	}
+	// word returns the operand of the RAM word at the constant address
+	// addr, an offset of s0 when it fits in an immediate
+	word := func(addr int) string {
+		if 2*addr < 2048 {
+			return fmt.Sprintf("%d(s0)", 2*addr)
+		}
+		emit("li t0, %d", 2*addr)
+		emit("add t0, s0, t0")
+		return "0(t0)"
+	}
+	// addImm adds the constant n to the register r
+	addImm := func(r string, n int) {
+		if n == 0 {
+			return
+		}
+		if n >= -2048 && n < 2048 {
+			emit("addi %s, %s, %d", r, r, n)
+			return
+		}
+		emit("li t3, %d", n)
+		emit("add %s, %s, t3", r, r)
+	}
+	returns := 0
+	call := func(fn string, nArgs int) {
+		if _, ok := pl.Functions[fn]; !ok {
+			emit("j .Lundefined")
+			return
+		}
+		emit("li a0, %d", returns)
+		emit("jal .Lpush")
+		for addr := 1; addr <= 4; addr++ {
+			emit("lh a0, %d(s0)", 2*addr)
+			emit("jal .Lpush")
+		}
+		emit("lhu t0, 0(s0)")
+		addImm("t0", -callFrameSize-nArgs)
+		emit("sh t0, 4(s0)")
+		emit("lh t0, 0(s0)")
+		emit("sh t0, 2(s0)")
+		emit("j .Lf%d", pl.Functions[fn])
+		body = append(body, fmt.Sprintf(".Lr%d:", returns))
+		returns++
+	}
+	usesReturn := false
+
+	inits := map[string]bool{}
+	for _, inst := range tr.Instructions {
+		if inst.CommandType == CommandTypeStaticInit && !inits[inst.Arg1] {
+			inits[inst.Arg1] = true
+			emit("%s", be.Comment(inst.Line))
+			emit("li a0, %d", int16(inst.Arg2Val))
+			emit("sh a0, %s", word(statics[inst.Arg1]))
+		}
+	}
+	if tr.Bootstrap != "" {
+		emit("li a0, %d", layout.Stack)
+		emit("sh a0, 0(s0)")
+		for range tr.EntryNArgs {
+			emit("li a0, 0")
+			emit("jal .Lpush")
+		}
+		emit("%s", be.Comment(fmt.Sprintf("call %s %d", tr.Bootstrap, tr.EntryNArgs)))
+		call(tr.Bootstrap, tr.EntryNArgs)
+		emit("j .Lhalt")
+	}
+
+	for k, inst := range tr.Instructions {
+		pos := tr.Commands[k].Pos()
+		switch inst.CommandType {
+		case CommandTypeStaticInit:
+			continue
+		case CommandTypeLabel:
+			if n, ok := pl.Labels[inst.labelSymbol()]; ok {
+				body = append(body, fmt.Sprintf(".Ll%d:", n))
+			}
+			continue
+		case CommandTypeFunction:
+			body = append(body, "")
+			if n, ok := pl.Functions[inst.Arg1]; ok {
+				body = append(body, be.Comment(inst.Line), fmt.Sprintf(".Lf%d:", n))
+			} else {
+				body = append(body, be.Comment(inst.Line+" (never called)"))
+			}
+			for range inst.Arg2Val {
+				emit("li a0, 0")
+				emit("jal .Lpush")
+			}
+			continue
+		}
+		emit("%s", be.Comment(inst.Line))
+		switch inst.CommandType {
+		case CommandTypeArithmetic:
+			ops, ok := riscvArithmetic[inst.ALType]
+			if !ok {
+				return nil, fmt.Errorf("%s: %s is not supported by the riscv32 target", pos, inst.ALType)
+			}
+			emit("jal .Lpop")
+			if _, unary := cUnary[inst.ALType]; !unary {
+				emit("mv a1, a0")
+				emit("jal .Lpop")
+			}
+			for _, op := range ops {
+				emit("%s", op)
+			}
+			emit("jal .Lpush")
+		case CommandTypePush, CommandTypePop:
+			if inst.CommandType == CommandTypePop {
+				emit("jal .Lpop")
+			}
+			operand := ""
+			switch inst.SegmentType {
+			case SegmentTypeConstant:
+				if inst.CommandType == CommandTypePop {
+					return nil, fmt.Errorf("%s: pop constant", pos)
+				}
+				emit("li a0, %d", int16(inst.Arg2Val))
+			case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+				emit("lhu t0, %d(s0)", 2*llvmSegmentRegs[inst.SegmentType])
+				addImm("t0", inst.Arg2Val)
+				emit("jal .Lword")
+				operand = "0(t0)"
+			case SegmentTypeTemp, SegmentTypePointer:
+				base, size := layout.Temp, 8
+				if inst.SegmentType == SegmentTypePointer {
+					base, size = 3, 2
+				}
+				if inst.Arg2Val >= size {
+					return nil, fmt.Errorf("%s: %s %d out of range", pos, inst.SegmentType, inst.Arg2Val)
+				}
+				operand = word(base + inst.Arg2Val)
+			case SegmentTypeStatic:
+				sym, _ := staticSymbol(inst)
+				operand = word(statics[sym])
+			default:
+				return nil, fmt.Errorf("%s: push %s is not supported by the riscv32 target", pos, inst.SegmentType)
+			}
+			switch {
+			case inst.CommandType == CommandTypePop:
+				emit("sh a0, %s", operand)
+			case operand != "":
+				emit("lh a0, %s", operand)
+				emit("jal .Lpush")
+			default:
+				emit("jal .Lpush")
+			}
+		case CommandTypeGOTO:
+			n, ok := pl.Labels[inst.labelSymbol()]
+			switch {
+			case endLoop(tr.Instructions, k):
+				emit("j .Lhalt")
+			case ok:
+				emit("j .Ll%d", n)
+			default:
+				emit("j .Lundefined")
+			}
+		case CommandTypeIf:
+			emit("jal .Lpop")
+			// the jump, unlike the branch, reaches anywhere in the program
+			emit("beqz a0, 1f")
+			if n, ok := pl.Labels[inst.labelSymbol()]; ok {
+				emit("j .Ll%d", n)
+			} else {
+				emit("j .Lundefined")
+			}
+			body = append(body, "1:")
+		case CommandTypeCall:
+			call(inst.Arg1, inst.Arg2Val)
+		case CommandTypeReturn:
+			usesReturn = true
+			emit("lhu t1, 2(s0)")
+			emit("addi t0, t1, %d", -callFrameSize)
+			emit("jal .Lword")
+			emit("lh t2, 0(t0)")
+			emit("jal .Lpop")
+			emit("lhu t0, 4(s0)")
+			emit("jal .Lword")
+			emit("sh a0, 0(t0)")
+			emit("lhu t0, 4(s0)")
+			emit("addi t0, t0, 1")
+			emit("sh t0, 0(s0)")
+			for k, seg := range []int{4, 3, 2, 1} {
+				emit("addi t0, t1, %d", -1-k)
+				emit("jal .Lword")
+				emit("lh a0, 0(t0)")
+				emit("sh a0, %d(s0)", 2*seg)
+			}
+			emit("j .Lreturn")
+		default:
+			return nil, fmt.Errorf("%s: %s is not supported by the riscv32 target", pos, inst.CommandType)
+		}
+	}
+	emit("j .Lhalt")
+	if usesReturn {
+		body = append(body, "", "# .Lreturn jumps to the return point numbered t2", ".Lreturn:")
+		emit("li t0, %d", returns)
+		emit("bgeu t2, t0, .Lbad_return")
+		emit("la t3, .Lreturns")
+		emit("slli t2, t2, 2")
+		emit("add t4, t3, t2")
+		emit("lw t4, 0(t4)")
+		emit("add t3, t3, t4")
+		emit("jr t3")
+		body = append(body, "\t.balign 4", ".Lreturns:")
+		for n := range returns {
+			emit(".word .Lr%d - .Lreturns", n)
+		}
+	}
+
+	lines := []string{
+		be.Comment("int vm_run(int16_t *ram) runs the program on ram, " + fmt.Sprint(layout.RAMSize()) + " words, returning 0 when it halts,"),
+		be.Comment("1 for an access outside of it, 2 for an undefined target, 3 for a bad return."),
+		"",
+		"\t.text",
+		"\t.globl vm_run",
+		"\t.type vm_run, @function",
+		"\t.balign 4",
+		"vm_run:",
+		"\taddi sp, sp, -16",
+		"\tsw ra, 12(sp)",
+		"\tsw s0, 8(sp)",
+		"\tmv s0, a0",
+	}
+	lines = append(lines, body...)
+	lines = append(lines, "")
+	lines = append(lines, riscvRuntime()...)
+	lines = append(lines, "\t.size vm_run, .-vm_run")
+	for k, l := range lines {
+		lines[k] = strings.TrimRight(l, " ")
+	}
+	return lines, nil
+}
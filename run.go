@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runRun implements the run subcommand, running the translation on the
+// emulator until it halts, headless or in a terminal UI.
+func runRun(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	opts := registerTranslateFlags(fs)
+	cycles := fs.Int("cycles", 0, "stop after this many cycles, for a program that does not halt (0 runs until it halts)")
+	maxCycles := fs.Int("max-cycles", 1_000_000_000, "abort a program still running after this many cycles as a runaway, printing its VM stack trace (0 for no limit, the default with --tui)")
+	screenshot := fs.String("screenshot", "", "write the screen to this PNG file when the run ends")
+	every := fs.Int("screenshot-every", 0, "also write the screen every N cycles, to numbered files named after --screenshot (out-0001.png, out-0002.png...)")
+	keys := fs.String("keys", "", "keyboard script played during the run: keys pressed one after the other (A, ENTER, LEFT...), KEY:DURATION holding one longer (RIGHT:2s), and durations waiting (500ms)")
+	keysFile := fs.String("keys-file", "", "file of timed keystrokes played during the run, a line each: the time it is pressed at and the key (1.5s ENTER, 2s LEFT:500ms)")
+	loadFile := fs.String("load-ram", "", "set the RAM words of this JSON snapshot, as --dump-ram writes them, before the run")
+	dumpFile := fs.String("dump-ram", "", "write the RAM to this JSON file when the run ends")
+	dumpRange := fs.String("dump-range", "", "comma separated addresses and FIRST-LAST ranges --dump-ram writes, numbers or symbols (e.g. 0-15,256-300,Main.0), the whole RAM by default")
+	var breaks stringsFlag
+	fs.Var(&breaks, "break", "pause at a function (Main.main) or a line (Foo.vm:27), printing the VM call stack, until Enter is pressed when stdin is a terminal, can be repeated")
+	tui := fs.Bool("tui", false, "show the screen, the registers, the VM command running and the RAM in the terminal as the program runs, the keys typed going to its keyboard")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: run [flags] -s source ...")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	if err := opts.validate(); err != nil {
+		fmt.Println(err)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *cycles < 0 || *maxCycles < 0 || *every < 0 || *every > 0 && *screenshot == "" || *keys != "" && *keysFile != "" || *dumpRange != "" && *dumpFile == "" {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if *tui {
+		given := false
+		fs.Visit(func(f *flag.Flag) { given = given || f.Name == "max-cycles" })
+		if !given {
+			*maxCycles = 0
+		}
+	}
+	script := &keyboardScript{}
+	var err error
+	if *keys != "" {
+		if script, err = parseKeyScript(*keys); err != nil {
+			fmt.Println("Error in the keyboard script", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if *keysFile != "" {
+		data, err := os.ReadFile(*keysFile)
+		if err != nil {
+			fmt.Println("Error reading the keyboard script", err)
+			os.Exit(exitIO)
+		}
+		if script, err = parseKeyFile(data); err != nil {
+			fmt.Printf("Error in the keyboard script %s: %s\n", *keysFile, err)
+			os.Exit(exitUsage)
+		}
+	}
+	tr, err := translate(opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitStatus(err))
+	}
+	for _, w := range tr.Warnings {
+		fmt.Println("Warning:", w)
+	}
+	dbg, err := newVMDebugger(tr)
+	if err != nil {
+		fmt.Println("Error", err)
+		os.Exit(exitInternal)
+	}
+	for _, b := range breaks {
+		if _, err := dbg.SetBreakpoint(b); err != nil {
+			fmt.Println("Invalid --break", b+":", err)
+			os.Exit(exitUsage)
+		}
+	}
+	dumpRanges, err := parseRAMRanges(*dumpRange, dbg.Prog.Symbols)
+	if err != nil {
+		fmt.Println("Invalid --dump-range", err)
+		os.Exit(exitUsage)
+	}
+
+	cpu := dbg.CPU
+	if *loadFile != "" {
+		if err := loadRAM(*loadFile, cpu.RAM); err != nil {
+			fmt.Println("Error loading RAM", err)
+			os.Exit(exitIO)
+		}
+	}
+	frames := 0
+	errRunaway := fmt.Errorf("the program did not halt within %s", plural(*maxCycles, "cycle"))
+	done := func() bool {
+		return cpu.Halted() || *cycles > 0 && cpu.Cycles >= *cycles
+	}
+	step := func() error {
+		if *maxCycles > 0 && cpu.Cycles >= *maxCycles {
+			return errRunaway
+		}
+		if err := dbg.Fault(); err != nil {
+			return err
+		}
+		script.apply(cpu)
+		if err := cpu.Step(); err != nil {
+			return err
+		}
+		if *every > 0 && cpu.Cycles%*every == 0 {
+			frames++
+			if err := writeScreenshot(numberedPath(*screenshot, frames), cpu.RAM); err != nil {
+				return fmt.Errorf("writing screenshot: %w", err)
+			}
+		}
+		return nil
+	}
+	var runErr error
+	if *tui {
+		t, err := newTerminalUI(dbg)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(exitUsage)
+		}
+		runErr = t.run(step, done)
+	} else {
+		// stty fails when stdin is not a terminal
+		_, err := stty("size")
+		interactive := len(breaks) > 0 && err == nil
+		in := bufio.NewScanner(os.Stdin)
+		for runErr == nil && !done() {
+			if runErr = step(); runErr != nil || !dbg.Breakpoints[cpu.PC] {
+				continue
+			}
+			fmt.Printf("Breakpoint after %d cycles, %s\n", cpu.Cycles, dbg.Location())
+			for _, line := range dbg.StackTrace() {
+				fmt.Println(" ", line)
+			}
+			if interactive {
+				fmt.Print("Press Enter to continue ")
+				if !in.Scan() {
+					fmt.Println()
+				}
+			}
+		}
+	}
+	switch {
+	case errors.Is(runErr, errRunaway):
+		fmt.Println("Aborted:", runErr)
+	case runErr != nil:
+		fmt.Printf("Error running program %s after %d cycles\n", runErr, cpu.Cycles)
+	case cpu.Halted():
+		fmt.Printf("Program halted after %d cycles\n", cpu.Cycles)
+	default:
+		fmt.Printf("Stopped after %d cycles\n", cpu.Cycles)
+	}
+	if runErr != nil {
+		// the call stack the program faulted or got stuck in
+		for _, line := range dbg.StackTrace() {
+			fmt.Println(" ", line)
+		}
+	}
+	if *screenshot != "" {
+		// the screen as the program left it, also when it failed
+		if err := writeScreenshot(*screenshot, cpu.RAM); err != nil {
+			fmt.Println("Error writing screenshot", err)
+			os.Exit(exitIO)
+		}
+		if frames > 0 {
+			fmt.Printf("Wrote %s and %s\n", *screenshot, plural(frames, "numbered screenshot"))
+		} else {
+			fmt.Println("Wrote", *screenshot)
+		}
+	}
+	if *dumpFile != "" {
+		if err := dumpRAM(*dumpFile, cpu, dumpRanges); err != nil {
+			fmt.Println("Error dumping RAM", err)
+			os.Exit(exitIO)
+		}
+		fmt.Println("Wrote", *dumpFile)
+	}
+	if runErr != nil {
+		os.Exit(1)
+	}
+}
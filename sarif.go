@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// sarifLog is a SARIF 2.1.0 log, the format GitHub code scanning and the
+// SARIF viewers of editors annotate sources with.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string       `json:"id"`
+	ShortDescription     sarifMessage `json:"shortDescription"`
+	DefaultConfiguration struct {
+		Level string `json:"level"`
+	} `json:"defaultConfiguration"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region sarifRegion `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// translatorRules are the diagnostics of the translator reported next to
+// the lint rules: the commands that do not parse, the files sharing their
+// static variables and, with --unused-suppressions, the vm:ignore comments
+// suppressing nothing.
+var translatorRules = []lintRule{
+	{Name: "parse-error", Doc: "a command that is not valid VM code"},
+	{Name: "static-collision", Doc: "files with the same name sharing their static variables"},
+	{Name: "unused-suppression", Doc: "vm:ignore comments suppressing no finding or naming unknown rules"},
+}
+
+// sarifURI is how a source is named in the log: relative to the working
+// directory, which is the root of the repository for code scanning, when
+// it is below it.
+func sarifURI(path string) string {
+	if rel, err := filepath.Rel(".", path); err == nil && !filepath.IsAbs(path) && !strings.HasPrefix(rel, "..") {
+		return (&url.URL{Path: filepath.ToSlash(rel)}).String()
+	}
+	return pathToURI(path)
+}
+
+// sarifLocationOf is the location of the command text of sl, narrowed to
+// the offending token when err is a tokenError. A line produced by a macro
+// is located at its invocation.
+func sarifLocationOf(sl sourceLine, err error) sarifLocation {
+	var loc sarifLocation
+	loc.PhysicalLocation.ArtifactLocation.URI = sarifURI(sl.File)
+	r := sarifRegion{StartLine: sl.Line}
+	if sl.Col > 0 && len(sl.Expansion) == 0 {
+		r.StartColumn, r.EndColumn = sl.Col, sl.Col+len(sl.Text)
+		var te *tokenError
+		if errors.As(err, &te) {
+			r.StartColumn = sl.Col + te.Col - 1
+		}
+	}
+	loc.PhysicalLocation.Region = r
+	return loc
+}
+
+// lintSARIF reports the parse errors, the lint findings and the static
+// variable collisions of a program as a SARIF log.
+func lintSARIF(prog *lintProgram, parseErrs []lineError, findings []lintFinding) sarifLog {
+	driver := sarifDriver{Name: "vmlint", Version: readBuildInfo().Version}
+	index := map[string]int{}
+	for _, r := range append(append([]lintRule{}, lintRules...), translatorRules...) {
+		rule := sarifRule{ID: r.Name, ShortDescription: sarifMessage{r.Doc}}
+		rule.DefaultConfiguration.Level = "warning"
+		if r.Name == "parse-error" {
+			rule.DefaultConfiguration.Level = "error"
+		}
+		index[r.Name] = len(driver.Rules)
+		driver.Rules = append(driver.Rules, rule)
+	}
+	results := []sarifResult{}
+	add := func(rule, msg string, sl sourceLine, err error) {
+		for _, e := range sl.Expansion {
+			msg += " (in expansion of " + e + ")"
+		}
+		results = append(results, sarifResult{
+			RuleID: rule, RuleIndex: index[rule], Level: driver.Rules[index[rule]].DefaultConfiguration.Level,
+			Message: sarifMessage{msg}, Locations: []sarifLocation{sarifLocationOf(sl, err)},
+		})
+	}
+	for _, e := range parseErrs {
+		add("parse-error", e.Err.Error(), e.Line, e.Err)
+	}
+	for _, f := range findings {
+		add(f.Rule, f.Msg, prog.Lines[f.Index], nil)
+	}
+	for _, c := range findStaticCollisions(prog.Lines, prog.Instructions) {
+		for _, sl := range c.Lines[1:] {
+			add("static-collision", c.String(), sl, nil)
+		}
+	}
+	return sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{{Tool: sarifTool{driver}, Results: results}},
+	}
+}
+
+func writeSARIF(w io.Writer, log sarifLog) error {
+	data, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// scratchRegisters are the registers the generated code keeps its
+// temporaries in, R13, R14 and R15 unless --scratch gives others: the
+// address pop computes and the frame return walks down, the return
+// address of return, and the return address of the shared subroutines.
+var scratchRegisters = []int{13, 14, 15}
+
+// scratchNeeded is the number of scratch registers the code generation
+// uses at once, in the shared call of -Osize: the callee, the number of
+// arguments and the return address of the subroutine.
+const scratchNeeded = 3
+
+// scratch is the symbol of the scratch register n.
+func scratch(n int) string {
+	return fmt.Sprintf("R%d", scratchRegisters[n])
+}
+
+// scratchFlag is the --scratch flag, setting scratchRegisters.
+type scratchFlag struct{}
+
+func (scratchFlag) String() string {
+	names := []string{}
+	for n := range scratchRegisters {
+		names = append(names, scratch(n))
+	}
+	return strings.Join(names, ",")
+}
+
+func (scratchFlag) Set(v string) error {
+	regs, err := parseScratch(v)
+	if err != nil {
+		return err
+	}
+	scratchRegisters = regs
+	return nil
+}
+
+func registerScratchFlag(fs *flag.FlagSet) {
+	fs.Var(scratchFlag{}, "scratch", fmt.Sprintf("the %d registers the generated code keeps its temporaries in, comma separated or a range (e.g. R5-R7), for hand-written code or course extensions reserving R13-R15", scratchNeeded))
+}
+
+// parseScratch parses the registers of --scratch: R5 to R15, or their
+// numbers, and FIRST-LAST ranges of them. The pointers SP to THAT are not
+// free, and the temp words are only as long as the program leaves them
+// alone, which checkScratch sees to.
+func parseScratch(spec string) ([]int, error) {
+	reg := func(s string) (int, error) {
+		s = strings.TrimSpace(s)
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "R"))
+		switch {
+		case err != nil || n < 0 || n > 15:
+			return 0, fmt.Errorf("%q is not a register, expected R5 to R15", s)
+		case n <= 4:
+			return 0, fmt.Errorf("R%d is %s, not free for the generated code", n, []string{"SP", "LCL", "ARG", "THIS", "THAT"}[n])
+		}
+		return n, nil
+	}
+	regs := []int{}
+	for _, item := range strings.Split(spec, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		a, err := reg(first)
+		if err != nil {
+			return nil, err
+		}
+		b := a
+		if isRange {
+			if b, err = reg(last); err != nil {
+				return nil, err
+			}
+			if b < a {
+				return nil, fmt.Errorf("empty range %s", strings.TrimSpace(item))
+			}
+		}
+		for n := a; n <= b; n++ {
+			if slices.Contains(regs, n) {
+				return nil, fmt.Errorf("R%d given twice", n)
+			}
+			regs = append(regs, n)
+		}
+	}
+	if len(regs) != scratchNeeded {
+		return nil, fmt.Errorf("the generated code needs %d scratch registers, got %d", scratchNeeded, len(regs))
+	}
+	return regs, nil
+}
+
+// checkScratch fails on a command using a word of temp given to
+// --scratch, which the generated code would overwrite.
+func checkScratch(instructions []*Instruction) (int, error) {
+	for k, i := range instructions {
+		if (i.CommandType == CommandTypePush || i.CommandType == CommandTypePop) && i.SegmentType == SegmentTypeTemp && slices.Contains(scratchRegisters, layout.Temp+i.Arg2Val) {
+			return k, fmt.Errorf("temp %d is R%d, a --scratch register", i.Arg2Val, layout.Temp+i.Arg2Val)
+		}
+	}
+	return -1, nil
+}
+
+// isScratch tells whether the RAM word at addr is a scratch register.
+func isScratch(addr int) bool {
+	return slices.Contains(scratchRegisters, addr)
+}
+
+// defaultScratch renames the scratch registers of generated code to R13,
+// R14 and R15, the registers the idioms of the decompiler use.
+func defaultScratch(lines []string) []string {
+	if slices.Equal(scratchRegisters, []int{13, 14, 15}) {
+		return lines
+	}
+	names := map[string]string{}
+	for n := range scratchRegisters {
+		names["@"+scratch(n)] = fmt.Sprintf("@R%d", 13+n)
+	}
+	renamed := make([]string, len(lines))
+	for k, l := range lines {
+		if name, ok := names[strings.TrimSpace(l)]; ok {
+			l = name
+		}
+		renamed[k] = l
+	}
+	return renamed
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The memory-mapped screen of the Hack computer, at the screen address of
+// the memory layout: 256 rows of 512 pixels, each row 32 words, the least
+// significant bit of a word its leftmost pixel.
+const (
+	screenWidth  = 512
+	screenHeight = 256
+)
+
+// screenPixel reports whether the pixel at x, y of the screen is black.
+func screenPixel(ram []int16, x, y int) bool {
+	return uint16(ram[layout.Screen+y*screenWidth/16+x/16])>>(x%16)&1 == 1
+}
+
+// screenImage renders the screen held in ram, black on white.
+func screenImage(ram []int16) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, screenWidth, screenHeight), color.Palette{color.White, color.Black})
+	for y := range screenHeight {
+		for x := range screenWidth {
+			if screenPixel(ram, x, y) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+// writeScreenshot writes the screen held in ram to a PNG file.
+func writeScreenshot(path string, ram []int16) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, screenImage(ram)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// numberedPath is the path of the nth of a series of files named after
+// path: out.png gives out-0001.png, out-0002.png...
+func numberedPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(path, ext), n, ext)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// serveRequest is the JSON body of POST /translate: the sources, by file
+// name, and the translation flags.
+type serveRequest struct {
+	Files map[string]string `json:"files"`
+	// Source is a single file, named Name (Main.vm by default), for the
+	// clients sending one file
+	Source     string `json:"source,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Bootstrap  string `json:"bootstrap,omitempty"`
+	Entry      string `json:"entry,omitempty"`
+	EntryNArgs int    `json:"entry_nargs,omitempty"`
+	Ext        bool   `json:"ext,omitempty"`
+	WithOS     bool   `json:"with_os,omitempty"`
+	// Progress, when set, is told how far the translation is, as the
+	// Progress of translateOptions
+	Progress func(stage string, done, total int) `json:"-"`
+}
+
+// serveDiagnostic is an error or a warning of a translation, with the
+// position it is about when it is about a line.
+type serveDiagnostic struct {
+	Severity string `json:"severity"` // error or warning
+	Message  string `json:"message"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Col      int    `json:"col,omitempty"`
+}
+
+// serveResponse is the result of a translation, also returned when it
+// fails: OK is false then, and ExitStatus the status the translator
+// would have exited with.
+type serveResponse struct {
+	OK          bool              `json:"ok"`
+	ExitStatus  int               `json:"exit_status"`
+	Asm         string            `json:"asm,omitempty"`
+	Diagnostics []serveDiagnostic `json:"diagnostics"`
+	Stats       *translationStats `json:"stats,omitempty"`
+}
+
+// serveMaxFiles bounds the files of a request.
+const serveMaxFiles = 256
+
+// translator is the state of the server.
+type translator struct {
+	mu       sync.Mutex
+	maxBytes int64
+	origin   string
+}
+
+// parseServeRequest reads a request as JSON, or as the text of a single
+// file with the flags in the query (?name=Main.vm&bootstrap=off&ext=1).
+func parseServeRequest(r *http.Request) (*serveRequest, error) {
+	req := &serveRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(req); err != nil {
+			return nil, fmt.Errorf("invalid request: %w", err)
+		}
+	} else {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		q := r.URL.Query()
+		req.Source, req.Name = string(data), q.Get("name")
+		req.Bootstrap, req.Entry = q.Get("bootstrap"), q.Get("entry")
+		req.Ext, _ = strconv.ParseBool(q.Get("ext"))
+		req.WithOS, _ = strconv.ParseBool(q.Get("with_os"))
+		if n := q.Get("entry_nargs"); n != "" {
+			if req.EntryNArgs, err = strconv.Atoi(n); err != nil {
+				return nil, fmt.Errorf("invalid entry_nargs %q", n)
+			}
+		}
+	}
+	if err := req.normalize(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// normalize adds the single file of r to its files and checks their
+// names.
+func (r *serveRequest) normalize() error {
+	if r.Files == nil {
+		r.Files = map[string]string{}
+	}
+	if r.Source != "" || len(r.Files) == 0 {
+		r.Files[cmp.Or(r.Name, "Main.vm")] = r.Source
+	}
+	if len(r.Files) > serveMaxFiles {
+		return fmt.Errorf("too many files, at most %d", serveMaxFiles)
+	}
+	for name := range r.Files {
+		if name != filepath.Base(name) || filepath.Ext(name) != ".vm" || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("invalid file name %q, expected a name like Main.vm", name)
+		}
+	}
+	return nil
+}
+
+// translateRequest translates the files of req like -s would, from
+// memory.
+func translateRequest(req *serveRequest) *serveResponse {
+	res, _ := translateProgram(req)
+	return res
+}
+
+// translateProgram translates the files of req, also returning the
+// translation when it succeeds.
+func translateProgram(req *serveRequest) (*serveResponse, *translation) {
+	opts := &translateOptions{
+		Bootstrap:  cmp.Or(req.Bootstrap, "auto"),
+		Entry:      cmp.Or(req.Entry, "Sys.init"),
+		EntryNArgs: req.EntryNArgs,
+		WithOS:     req.WithOS,
+		Progress:   req.Progress,
+	}
+	fsys := memFS{}
+	for _, name := range slices.Sorted(maps.Keys(req.Files)) {
+		opts.Inputs = append(opts.Inputs, fsys.add(name, []byte(req.Files[name])))
+	}
+
+	savedExt, savedPrefix := extendedMode, staticPrefixMode
+	defer func() { extendedMode, staticPrefixMode = savedExt, savedPrefix }()
+	extendedMode, staticPrefixMode = req.Ext, "file"
+
+	res := &serveResponse{Diagnostics: []serveDiagnostic{}}
+	if err := opts.validate(); err != nil {
+		res.ExitStatus = exitUsage
+		res.Diagnostics = append(res.Diagnostics, serveDiagnostic{Severity: "error", Message: err.Error()})
+		return res, nil
+	}
+	tr, err := translate(opts)
+	if err != nil {
+		d := serveDiagnostic{Severity: "error", Message: err.Error()}
+		var se *statusError
+		if errors.As(err, &se) && se.Source != nil {
+			d.File, d.Line = se.Source.Line.File, se.Source.Line.Line
+			d.Col = max(se.Source.Line.Col, 1) + max(se.Source.Col, 1) - 1
+		}
+		res.ExitStatus = exitStatus(err)
+		res.Diagnostics = append(res.Diagnostics, d)
+		return res, nil
+	}
+	for _, w := range tr.Warnings {
+		res.Diagnostics = append(res.Diagnostics, serveDiagnostic{Severity: "warning", Message: w})
+	}
+	st := newTranslationStats(tr)
+	res.OK, res.Stats = true, &st
+	res.Asm = strings.Join(tr.Lines, "\n") + "\n"
+	return res, tr
+}
+
+// translate translates req, one request at a time as the code generation
+// keeps its state in globals.
+func (t *translator) translate(req *serveRequest) *serveResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return translateRequest(req)
+}
+
+func (t *translator) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (t *translator) handleTranslate(w http.ResponseWriter, r *http.Request) {
+	if t.origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", t.origin)
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		t.writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, t.maxBytes)
+	req, err := parseServeRequest(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if mbe := (*http.MaxBytesError)(nil); errors.As(err, &mbe) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		t.writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	res := t.translate(req)
+	logger.Debug("Translated request", "files", len(req.Files), "ok", res.OK, "remote", r.RemoteAddr)
+	t.writeJSON(w, http.StatusOK, res)
+}
+
+// runServe implements the serve subcommand, an HTTP service translating
+// the sources posted to it, the backend of a browser playground.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	maxBytes := fs.Int64("max-bytes", 1<<20, "largest request body accepted")
+	origin := fs.String("allow-origin", "", "origin allowed to call the service from a browser (e.g. https://playground.example or *)")
+	logLevel := fs.String("log-level", "info", "least severe messages printed: debug (a line per request), info, warn or error")
+	logFormat := fs.String("log-format", "text", "how messages are printed: text or json")
+	grpc := fs.Bool("grpc", false, "also serve the gRPC service of api/vmtranslator.proto on --addr, over HTTP/2 without TLS")
+	prof := registerProfileFlags(fs, true)
+	parseFlags(fs, args)
+	var err error
+	if logger, err = newLogger(ioStdout{}, *logLevel, *logFormat); err != nil {
+		fmt.Println(err)
+		os.Exit(exitUsage)
+	}
+
+	t := &translator{maxBytes: *maxBytes, origin: *origin}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/translate", t.handleTranslate)
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		t.writeJSON(w, http.StatusOK, readBuildInfo())
+	})
+	if prof.HTTP != "" && prof.HTTP == *addr {
+		fmt.Println("Serve pprof on another address than", *addr)
+		os.Exit(exitUsage)
+	}
+	// an interrupt stops the server, letting the requests in progress end
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := &http.Server{Addr: *addr, Handler: mux}
+	if *grpc {
+		mux.HandleFunc("POST "+grpcService+"{method}", t.handleGRPC)
+		srv.Protocols = &http.Protocols{}
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+		close(shutdown)
+	}()
+
+	stopProfiles := prof.start()
+	logger.Info("Serving the translator", "addr", "http://"+*addr+"/translate")
+	if *grpc {
+		logger.Info("Serving the gRPC service", "addr", *addr, "service", strings.Trim(grpcService, "/"))
+	}
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Error("Error serving", "err", err)
+		os.Exit(exitIO)
+	}
+	<-shutdown
+	stopProfiles()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// asmPart is a run of the generated assembly written to its own file by
+// --split-output.
+type asmPart struct {
+	Name  string
+	Lines []string
+}
+
+// splitAsm splits the assembly of a translation into the bootstrap code,
+// the code of every function (and of the commands before the first one)
+// and the runtime subroutines, in output order.
+func splitAsm(tr *translation) []asmPart {
+	parts := []asmPart{}
+	current := ""
+	seenCommand := false
+	fn := callerTopLevel
+	for k, line := range tr.Lines {
+		name := "runtime"
+		startsFunction := false
+		if cmd := tr.Origin[k]; cmd >= 0 {
+			seenCommand = true
+			inst := tr.Instructions[cmd]
+			if inst.CommandType == CommandTypeFunction && (k == 0 || tr.Origin[k-1] != cmd) {
+				fn = inst.Arg1
+				startsFunction = true
+			}
+			name = fn
+		} else if !seenCommand {
+			name = "bootstrap"
+		}
+		// a function starts a new part even when its name repeats
+		if name != current || startsFunction {
+			parts = append(parts, asmPart{Name: name})
+			current = name
+		}
+		parts[len(parts)-1].Lines = append(parts[len(parts)-1].Lines, line)
+	}
+	return parts
+}
+
+// partFileName names the file of the nth part, numbered to sort in output
+// order.
+func partFileName(n int, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ' ' || r == '(' || r == ')' {
+			return '_'
+		}
+		return r
+	}, strings.Trim(name, "()"))
+	return fmt.Sprintf("%03d_%s.asm", n, name)
+}
+
+// writeSplitOutput writes every part of the assembly to its own file in
+// dir, along with link.sh concatenating them back into the whole program.
+func writeSplitOutput(dir string, tr *translation, program string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	script := []string{
+		"#!/bin/sh",
+		"# Concatenates the parts back into the translated program, by default",
+		"# " + program + " next to this script.",
+		"set -e",
+		`cd "$(dirname "$0")"`,
+		"cat \\",
+	}
+	for n, p := range splitAsm(tr) {
+		name := partFileName(n, p.Name)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strings.Join(p.Lines, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+		script = append(script, fmt.Sprintf("\t'%s' \\", name))
+	}
+	script = append(script, fmt.Sprintf("\t> \"${1:-%s}\"", program))
+	return os.WriteFile(filepath.Join(dir, "link.sh"), []byte(strings.Join(script, "\n")+"\n"), 0755)
+}
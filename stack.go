@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// stackEffect returns how many values a command pops off the stack and
+// how many it pushes. return is left out: it replaces the whole frame.
+func stackEffect(inst *Instruction) (pops, pushes int) {
+	switch inst.CommandType {
+	case CommandTypePush:
+		return 0, 1
+	case CommandTypePop, CommandTypeIf:
+		return 1, 0
+	case CommandTypeCall:
+		return inst.Arg2Val, 1
+	case CommandTypePlugin:
+		return inst.Plugin.Pops, inst.Plugin.Pushes
+	case CommandTypeArithmetic:
+		switch inst.ALType {
+		case ALTypeNeg, ALTypeNot, ALTypeShl, ALTypeShr:
+			return 1, 1
+		}
+		return 2, 1
+	}
+	return 0, 0
+}
+
+// callFrameSize is the number of words call saves on the stack: the
+// return address, LCL, ARG, THIS and THAT.
+const callFrameSize = 5
+
+// callSite is a call made with Height values on the working stack,
+// including the arguments.
+type callSite struct {
+	Index  int
+	Callee string
+	Height int
+}
+
+// stackUsage is the stack use of a function on its own: the deepest its
+// working stack gets and the calls it makes.
+type stackUsage struct {
+	MaxHeight int
+	Calls     []callSite
+	// Unbounded is set when the working stack grows on every iteration of
+	// a loop, describing where
+	Unbounded string
+	// Heights is the height of the working stack before every block,
+	// unreachedHeight for the blocks never reached
+	Heights []int
+}
+
+// unreachedHeight is the height recorded for the blocks never reached.
+const unreachedHeight = math.MinInt
+
+// analyzeStackUsage follows the paths through the blocks of g to find out
+// how high its working stack, above the locals, gets.
+func analyzeStackUsage(lines []sourceLine, instructions []*Instruction, g *functionCFG) *stackUsage {
+	u := &stackUsage{Heights: make([]int, len(g.Blocks))}
+	if len(g.Blocks) == 0 {
+		return u
+	}
+	for k := range u.Heights {
+		u.Heights[k] = unreachedHeight
+	}
+	// highest stack each call, or push string, is reached with
+	sites := map[int]int{}
+	updates := make([]int, len(g.Blocks))
+	u.Heights[0] = 0
+	work := []int{0}
+	for len(work) > 0 {
+		id := work[0]
+		work = work[1:]
+		b := g.Blocks[id]
+		h := u.Heights[id]
+		for i := b.Start; i < b.End; i++ {
+			inst := instructions[i]
+			if inst.CommandType == CommandTypeReturn {
+				break
+			}
+			if old, ok := sites[i]; !ok || h > old {
+				sites[i] = h
+			}
+			pops, pushes := stackEffect(inst)
+			h += pushes - pops
+			u.MaxHeight = max(u.MaxHeight, h)
+		}
+		for _, s := range b.Succs {
+			if h <= u.Heights[s] {
+				continue
+			}
+			updates[s]++
+			if u.Heights[s] != unreachedHeight && updates[s] > len(g.Blocks)+1 {
+				u.Unbounded = fmt.Sprintf("the stack grows on every iteration of the loop at %s", lines[g.Blocks[s].Start].Pos())
+				return u
+			}
+			u.Heights[s] = h
+			work = append(work, s)
+		}
+	}
+	for i := g.Start; i < g.End; i++ {
+		h, ok := sites[i]
+		inst := instructions[i]
+		switch {
+		case !ok:
+		case inst.CommandType == CommandTypeCall:
+			u.Calls = append(u.Calls, callSite{i, inst.Arg1, h})
+		case inst.CommandType == CommandTypePush && inst.SegmentType == SegmentTypeString && stringsViaOS:
+			// built with String.new(length), then String.appendChar(s, c)
+			u.Calls = append(u.Calls, callSite{i, "String.new", h + 1}, callSite{i, "String.appendChar", h + 2})
+		}
+	}
+	return u
+}
+
+// stackDepth is the stack use of a function including the functions it
+// calls, in words above the arguments it is called with.
+type stackDepth struct {
+	Words int
+	// Unbounded explains why the depth has no bound, "" when it has one
+	Unbounded string
+	// Uncounted are the functions called without being defined, whose
+	// stack use is not included
+	Uncounted []string
+}
+
+// stackDepthAnalysis computes the stack depth of every function of a
+// translation.
+type stackDepthAnalysis struct {
+	lines        []sourceLine
+	instructions []*Instruction
+	cfgs         map[string]*functionCFG
+	nLocals      map[string]int
+	depth        map[string]*stackDepth
+	active       []string
+}
+
+func newStackDepthAnalysis(lines []sourceLine, instructions []*Instruction, cfgs []*functionCFG) *stackDepthAnalysis {
+	a := &stackDepthAnalysis{
+		lines:        lines,
+		instructions: instructions,
+		cfgs:         map[string]*functionCFG{},
+		nLocals:      map[string]int{},
+		depth:        map[string]*stackDepth{},
+	}
+	for _, g := range cfgs {
+		if _, ok := a.cfgs[g.Function]; ok {
+			continue
+		}
+		a.cfgs[g.Function] = g
+		if g.Function != "" {
+			a.nLocals[g.Function] = instructions[g.Start].Arg2Val
+		}
+	}
+	return a
+}
+
+// Depth returns the stack depth of fn ("" for the top-level code): its
+// locals, working stack and the frames of the calls it makes.
+func (a *stackDepthAnalysis) Depth(fn string) *stackDepth {
+	if d, ok := a.depth[fn]; ok {
+		return d
+	}
+	for k, f := range a.active {
+		if f == fn {
+			cycle := append(append([]string{}, a.active[k:]...), fn)
+			return &stackDepth{Unbounded: "recursive: " + strings.Join(cycle, " -> ")}
+		}
+	}
+	g, ok := a.cfgs[fn]
+	if !ok {
+		return &stackDepth{Uncounted: []string{fn}}
+	}
+	a.active = append(a.active, fn)
+	defer func() { a.active = a.active[:len(a.active)-1] }()
+
+	u := analyzeStackUsage(a.lines, a.instructions, g)
+	d := &stackDepth{Words: u.MaxHeight, Unbounded: u.Unbounded}
+	for _, c := range u.Calls {
+		cd := a.Depth(c.Callee)
+		d.Uncounted = appendMissing(d.Uncounted, cd.Uncounted...)
+		if cd.Unbounded != "" && d.Unbounded == "" {
+			d.Unbounded = cd.Unbounded
+		}
+		d.Words = max(d.Words, c.Height+callFrameSize+cd.Words)
+	}
+	d.Words += a.nLocals[fn]
+	// a recursive result depends on the functions being analyzed, so it is
+	// only final once the whole cycle is
+	if d.Unbounded == "" || !strings.HasPrefix(d.Unbounded, "recursive") || len(a.active) == 1 {
+		a.depth[fn] = d
+	}
+	return d
+}
+
+func appendMissing(s []string, values ...string) []string {
+	for _, v := range values {
+		if !slices.Contains(s, v) {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// stackDepthReport describes the stack depth of every function and of the
+// whole program, started by the bootstrap code or from its first command,
+// warning when the stack could reach the heap or run out of the RAM.
+func stackDepthReport(tr *translation) []string {
+	cfgs := buildCFGs(tr.Instructions)
+	if len(cfgs) == 0 {
+		return nil
+	}
+	a := newStackDepthAnalysis(tr.Commands, tr.Instructions, cfgs)
+	describe := func(d *stackDepth) string {
+		if d.Unbounded != "" {
+			return "unbounded (" + d.Unbounded + ")"
+		}
+		s := plural(d.Words, "word")
+		if len(d.Uncounted) > 0 {
+			s += ", not counting " + strings.Join(d.Uncounted, ", ")
+		}
+		return s
+	}
+
+	report := []string{"Stack depth per function (words above its arguments):"}
+	width := 0
+	for _, g := range cfgs {
+		width = max(width, len(cfgName(g)))
+	}
+	for _, g := range cfgs {
+		report = append(report, fmt.Sprintf("  %-*s  %s", width, cfgName(g), describe(a.Depth(g.Function))))
+	}
+
+	var total *stackDepth
+	from := ""
+	if tr.Bootstrap != "" {
+		// the bootstrap pushes the arguments and calls the entry function
+		d := a.Depth(tr.Bootstrap)
+		total = &stackDepth{Words: tr.EntryNArgs + callFrameSize + d.Words, Unbounded: d.Unbounded, Uncounted: d.Uncounted}
+		from = " from the bootstrap call of " + tr.Bootstrap
+	} else {
+		total = a.Depth(cfgs[0].Function)
+		from = " from " + cfgName(cfgs[0])
+	}
+	report = append(report, fmt.Sprintf("Maximum stack depth%s: %s", from, describe(total)))
+	switch {
+	case total.Unbounded != "":
+		report = append(report, fmt.Sprintf("Warning: the stack depth has no static bound, it may reach the heap at RAM[%d]", layout.Heap))
+	case layout.Stack+total.Words > layout.RAMSize():
+		report = append(report, fmt.Sprintf("Warning: the stack may run out of the RAM of %d words, SP going up to %d", layout.RAMSize(), layout.Stack+total.Words))
+	case layout.Stack+total.Words > layout.Heap:
+		report = append(report, fmt.Sprintf("Warning: the stack may reach the heap at RAM[%d], SP going up to %d", layout.Heap, layout.Stack+total.Words))
+	default:
+		report = append(report, fmt.Sprintf("SP stays at or below %d", layout.Stack+total.Words))
+	}
+	return report
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stackCached is set while the code generated above O0 keeps the top of
+// the VM stack in D rather than in RAM, SP not counting it. The commands
+// of a basic block pass the value on to each other, and it is stored
+// before the first command needing the whole stack in RAM: a label, a
+// jump, a call, a return, a shared subroutine...
+var stackCached bool
+
+// genCached returns the code of a command taking the top of the stack
+// from D or leaving it there, nil for a command needing the stack in RAM.
+func (i *Instruction) genCached() []string {
+	if removedCommands[i] {
+		// no code, the value stays in D
+		return []string{}
+	}
+	if i.CommandType == CommandTypePush {
+		load := i.superoptCode(false, true)
+		if load == nil {
+			load = i.genLoadD()
+		}
+		if load == nil {
+			return nil
+		}
+		lines := genSpill()
+		stackCached = true
+		return append(lines, load...)
+	}
+	if !stackCached {
+		return nil
+	}
+	switch i.CommandType {
+	case CommandTypePop:
+		store := i.superoptCode(true, false)
+		if store == nil {
+			store = i.genStoreD()
+		}
+		if store != nil {
+			stackCached = false
+		}
+		return store
+	case CommandTypeIf:
+		target, jump := i.labelSymbol(), "D;JNE"
+		if j, ok := threadedJumps[i]; ok {
+			target = j.Target
+			if j.Inverted {
+				jump = "D;JEQ"
+			}
+		}
+		stackCached = false
+		return []string{"@" + target, jump}
+	case CommandTypeArithmetic:
+		if code := i.superoptCode(true, true); code != nil {
+			return code
+		}
+		// D is y, x is on the top of the stack in RAM
+		switch i.ALType {
+		case ALTypeAdd:
+			return []string{"@SP", "AM=M-1", "D=D+M"}
+		case ALTypeSub:
+			return []string{"@SP", "AM=M-1", "D=M-D"}
+		case ALTypeAnd:
+			return []string{"@SP", "AM=M-1", "D=D&M"}
+		case ALTypeOr:
+			return []string{"@SP", "AM=M-1", "D=D|M"}
+		case ALTypeNeg:
+			return []string{"D=-D"}
+		case ALTypeNot:
+			return []string{"D=!D"}
+		case ALTypeEq, ALTypeGt, ALTypeLt:
+			if optLevel == optSize && sharedCommands[sharedKey(i)] {
+				return nil
+			}
+			id := strings.ToUpper(i.ALType.String())
+			n := nextLabelIndex(id)
+			trueLabel, endLabel := generatedLabel(id+"_TRUE", n), generatedLabel(id+"_END", n)
+			jump := map[ALType]string{ALTypeEq: "D;JEQ", ALTypeGt: "D;JGT", ALTypeLt: "D;JLT"}[i.ALType]
+			return []string{"@SP", "AM=M-1", "D=M-D", "@" + trueLabel, jump, "D=0", "@" + endLabel, "0;JMP", "(" + trueLabel + ")", "D=-1", "(" + endLabel + ")"}
+		}
+	}
+	return nil
+}
+
+// genSpill stores the top of the stack kept in D, if it is.
+func genSpill() []string {
+	if !stackCached {
+		return nil
+	}
+	stackCached = false
+	return []string{"@SP", "AM=M+1", "A=A-1", "M=D"}
+}
+
+// genLoadD sets D to the value a push pushes, nil for push string.
+func (i *Instruction) genLoadD() []string {
+	n := i.Arg2Val
+	switch i.SegmentType {
+	case SegmentTypeConstant:
+		if n >= -1 && n <= 1 {
+			return []string{fmt.Sprintf("D=%d", n)}
+		}
+		return genLoadConstant(n)
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		if n <= 2 {
+			return append(append([]string{"@" + i.SegmentType.ID()}, segmentOffset(n)...), "D=M")
+		}
+		return []string{fmt.Sprintf("@%d", n), "D=A", "@" + i.SegmentType.ID(), "A=D+M", "D=M"}
+	case SegmentTypeTemp:
+		return []string{fmt.Sprintf("@%d", layout.Temp+n), "D=M"}
+	case SegmentTypePointer:
+		return []string{"@" + pointerSymbol(n), "D=M"}
+	case SegmentTypeStatic:
+		return []string{fmt.Sprintf("@%s.%d", i.FileName, n), "D=M"}
+	}
+	return nil
+}
+
+// genStoreD stores D where a pop pops to, nil for the words of a segment
+// too far in to walk A to.
+func (i *Instruction) genStoreD() []string {
+	n := i.Arg2Val
+	switch i.SegmentType {
+	case SegmentTypeConstant:
+		// pop constant drops the value
+		return []string{}
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		if n <= 5 {
+			return append(append([]string{"@" + i.SegmentType.ID()}, segmentOffset(n)...), "M=D")
+		}
+	case SegmentTypeTemp:
+		return []string{fmt.Sprintf("@%d", layout.Temp+n), "M=D"}
+	case SegmentTypePointer:
+		return []string{"@" + pointerSymbol(n), "M=D"}
+	case SegmentTypeStatic:
+		return []string{fmt.Sprintf("@%s.%d", i.FileName, n), "M=D"}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// staticSymbol returns the symbol of the static variable a command uses,
+// if any. The symbols of static-init directives are already qualified.
+func staticSymbol(inst *Instruction) (string, bool) {
+	switch {
+	case inst.CommandType == CommandTypeStaticInit:
+		return inst.Arg1, true
+	case inst.SegmentType == SegmentTypeStatic && (inst.CommandType == CommandTypePush || inst.CommandType == CommandTypePop):
+		return fmt.Sprintf("%s.%d", inst.FileName, inst.Arg2Val), true
+	}
+	return "", false
+}
+
+// staticCollision is a prefix of static variables shared by several
+// files, like a/Util.vm and b/Util.vm, which would read and write each
+// other's statics.
+type staticCollision struct {
+	Prefix string
+	// Lines are the first static command of each file, in source order
+	Lines []sourceLine
+}
+
+func findStaticCollisions(lines []sourceLine, instructions []*Instruction) []staticCollision {
+	files := map[string][]sourceLine{}
+	prefixes := []string{}
+	for i, inst := range instructions {
+		if inst.CommandType == CommandTypeStaticInit {
+			// it may name the statics of another file on purpose
+			continue
+		}
+		if _, ok := staticSymbol(inst); !ok {
+			continue
+		}
+		if len(files[inst.FileName]) == 0 {
+			prefixes = append(prefixes, inst.FileName)
+		}
+		if !slices.ContainsFunc(files[inst.FileName], func(sl sourceLine) bool { return sameSource(sl.File, lines[i].File) }) {
+			files[inst.FileName] = append(files[inst.FileName], lines[i])
+		}
+	}
+	collisions := []staticCollision{}
+	for _, prefix := range prefixes {
+		if len(files[prefix]) > 1 {
+			collisions = append(collisions, staticCollision{prefix, files[prefix]})
+		}
+	}
+	return collisions
+}
+
+// String is the warning about the collision.
+func (c staticCollision) String() string {
+	paths := []string{}
+	for _, sl := range c.Lines {
+		paths = append(paths, sl.File)
+	}
+	hint := ", use --static-prefix path to keep them apart"
+	if staticPrefixMode == "path" {
+		hint = ", rename one of them"
+	}
+	return fmt.Sprintf("%s share the static variables %s.N%s", strings.Join(paths, " and "), c.Prefix, hint)
+}
+
+// staticCollisions warns about the files sharing the prefix of their
+// static variables.
+func staticCollisions(lines []sourceLine, instructions []*Instruction) []string {
+	warnings := []string{}
+	for _, c := range findStaticCollisions(lines, instructions) {
+		warnings = append(warnings, c.String())
+	}
+	return warnings
+}
+
+// qualifyStaticInits names the statics of the static-init directives
+// qualified with the name of a file as --static-prefix path names the
+// statics of that file: static-init Util.2 is a.Util.2 when the program
+// has a/Util.vm, the file of the directive first. It fails on a directive
+// naming several other files.
+func qualifyStaticInits(lines []sourceLine, instructions []*Instruction) (int, error) {
+	if staticPrefixMode != "path" {
+		return -1, nil
+	}
+	seen, prefixes, byName := map[string]bool{}, map[string]bool{}, map[string][]string{}
+	for _, sl := range lines {
+		if seen[sl.File] {
+			continue
+		}
+		seen[sl.File] = true
+		if prefix := sl.StaticPrefix(); !prefixes[prefix] {
+			prefixes[prefix] = true
+			byName[sl.FileName()] = append(byName[sl.FileName()], prefix)
+		}
+	}
+	for k, inst := range instructions {
+		if inst.CommandType != CommandTypeStaticInit {
+			continue
+		}
+		dot := strings.LastIndex(inst.Arg1, ".")
+		name, index := inst.Arg1[:dot], inst.Arg1[dot:]
+		files := byName[name]
+		switch {
+		case prefixes[name]:
+			// already a prefix of the program
+		case name == lines[k].FileName():
+			inst.Arg1 = inst.FileName + index
+		case len(files) == 1:
+			inst.Arg1 = files[0] + index
+		case len(files) > 1:
+			return k, fmt.Errorf("static-init %s names the statics of %s, qualify it with the path of one of them", inst.Arg1, strings.Join(files, " and "))
+		}
+	}
+	return -1, nil
+}
+
+func hasSource(paths []string, path string) bool {
+	return slices.ContainsFunc(paths, func(p string) bool { return sameSource(p, path) })
+}
+
+// staticsReport is the static allocation map of a translation: the static
+// variables of every prefix and the RAM addresses the assembler gives them.
+func staticsReport(tr *translation) ([]string, error) {
+	prog, err := assembleHack(tr.Lines)
+	if err != nil {
+		return nil, fmt.Errorf("assembling the translation: %w", err)
+	}
+	type staticGroup struct {
+		files   []string
+		indexes []int
+	}
+	groups := map[string]*staticGroup{}
+	prefixes := []string{}
+	for i, inst := range tr.Instructions {
+		sym, ok := staticSymbol(inst)
+		if !ok {
+			continue
+		}
+		if _, ok := prog.Symbols[sym]; !ok {
+			// only used by code the optimizations left out
+			continue
+		}
+		dot := strings.LastIndex(sym, ".")
+		prefix := sym[:dot]
+		n, _ := strconv.Atoi(sym[dot+1:])
+		g, ok := groups[prefix]
+		if !ok {
+			g = &staticGroup{}
+			groups[prefix] = g
+			prefixes = append(prefixes, prefix)
+		}
+		if inst.CommandType != CommandTypeStaticInit && !hasSource(g.files, tr.Commands[i].File) {
+			g.files = append(g.files, tr.Commands[i].File)
+		}
+		if !slices.Contains(g.indexes, n) {
+			g.indexes = append(g.indexes, n)
+		}
+	}
+	sort.Strings(prefixes)
+
+	report := []string{"Static variables:"}
+	total, lowest, highest := 0, -1, -1
+	for _, prefix := range prefixes {
+		g := groups[prefix]
+		sort.Ints(g.indexes)
+		cells := []string{}
+		for _, n := range g.indexes {
+			sym := fmt.Sprintf("%s.%d", prefix, n)
+			addr := prog.Symbols[sym]
+			cells = append(cells, fmt.Sprintf("%s=RAM[%d]", sym, addr))
+			if lowest < 0 || addr < lowest {
+				lowest = addr
+			}
+			highest = max(highest, addr)
+		}
+		total += len(g.indexes)
+		files := strings.Join(g.files, ", ")
+		if files == "" {
+			files = "static-init only"
+		}
+		report = append(report, fmt.Sprintf("  %s (%s): %s", prefix, files, plural(len(g.indexes), "static")))
+		report = append(report, "    "+strings.Join(cells, " "))
+	}
+	switch {
+	case total == 0:
+		report = append(report, "  none")
+	default:
+		report = append(report, fmt.Sprintf("Total: %s in RAM[%d..%d]", plural(total, "static"), lowest, highest))
+		if highest >= layout.Stack {
+			report = append(report, fmt.Sprintf("Warning: variables reach RAM[%d], past the static segment RAM[%d..%d], overlapping the stack", highest, layout.Static, layout.Stack-1))
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// superoptPattern is a VM command the superoptimizer searches the shortest
+// code of, with the top of the stack in D before it when InD and left in D
+// after it when OutD, as the stack caching of the levels above O0 has it.
+// The command names its operand {seg}, the pointer of a segment, or
+// {addr}, an address of temp, pointer or static.
+type superoptPattern struct {
+	Command string `json:"command"`
+	InD     bool   `json:"in_d,omitempty"`
+	OutD    bool   `json:"out_d,omitempty"`
+}
+
+func (p superoptPattern) String() string {
+	switch {
+	case p.InD && p.OutD:
+		return p.Command + " (top in D)"
+	case p.InD:
+		return p.Command + " (from D)"
+	case p.OutD:
+		return p.Command + " (to D)"
+	}
+	return p.Command
+}
+
+// superoptPatterns are the patterns the code generation looks up: the
+// arithmetic commands on the stack and with the top in D, the pushes
+// loading D and the pops, from the stack and from D.
+func superoptPatterns() []superoptPattern {
+	patterns := []superoptPattern{}
+	for _, al := range []string{"add", "sub", "and", "or", "neg", "not"} {
+		patterns = append(patterns, superoptPattern{Command: al}, superoptPattern{Command: al, InD: true, OutD: true})
+	}
+	pushes := []string{"push constant 0", "push constant 1", "push constant -1", "push {addr}"}
+	pops := []string{"pop {addr}"}
+	for n := range 3 {
+		pushes = append(pushes, fmt.Sprintf("push {seg} %d", n))
+		pops = append(pops, fmt.Sprintf("pop {seg} %d", n))
+	}
+	for _, c := range pushes {
+		patterns = append(patterns, superoptPattern{Command: c, OutD: true})
+	}
+	for _, c := range pops {
+		patterns = append(patterns, superoptPattern{Command: c}, superoptPattern{Command: c, InD: true})
+	}
+	return patterns
+}
+
+// superoptInstance is a command a pattern stands for and the symbol its
+// operand is.
+type superoptInstance struct {
+	Source string
+	Symbol string
+}
+
+// instances are the commands the code of a pattern is searched and proved
+// with: every segment for {seg}, and static, temp and pointer, at both
+// ends, for {addr}. Code holding for them all cannot make use of the
+// address its operand has.
+func (p superoptPattern) instances() []superoptInstance {
+	var operands [][2]string
+	switch {
+	case strings.Contains(p.Command, "{seg}"):
+		operands = [][2]string{{"local", "LCL"}, {"argument", "ARG"}, {"this", "THIS"}, {"that", "THAT"}}
+	case strings.Contains(p.Command, "{addr}"):
+		operands = [][2]string{{"static 0", verifyFile + ".0"}, {"temp 0", "5"}, {"temp 7", "12"}, {"pointer 0", "THIS"}, {"pointer 1", "THAT"}}
+	default:
+		return []superoptInstance{{Source: p.Command}}
+	}
+	instances := []superoptInstance{}
+	for _, o := range operands {
+		src := strings.NewReplacer("{seg}", o[0], "{addr}", o[0]).Replace(p.Command)
+		instances = append(instances, superoptInstance{src, o[1]})
+	}
+	return instances
+}
+
+// withOperand replaces the operand of the code of a pattern by symbol.
+func withOperand(code []string, symbol string) []string {
+	r := strings.NewReplacer("{seg}", symbol, "{addr}", symbol)
+	lines := make([]string, len(code))
+	for k, l := range code {
+		lines[k] = r.Replace(l)
+	}
+	return lines
+}
+
+// superoptKey is the pattern of a command and its operand, "" for the
+// commands without one.
+func superoptKey(i *Instruction) (string, string) {
+	switch i.CommandType {
+	case CommandTypeArithmetic:
+		switch i.ALType {
+		case ALTypeAdd, ALTypeSub, ALTypeAnd, ALTypeOr, ALTypeNeg, ALTypeNot:
+			return i.ALType.String(), ""
+		}
+	case CommandTypePush, CommandTypePop:
+		verb := "push"
+		if i.CommandType == CommandTypePop {
+			verb = "pop"
+		}
+		switch i.SegmentType {
+		case SegmentTypeConstant:
+			if i.CommandType == CommandTypePush {
+				return fmt.Sprintf("push constant %d", i.Arg2Val), ""
+			}
+		case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+			return fmt.Sprintf("%s {seg} %d", verb, i.Arg2Val), i.SegmentType.ID()
+		case SegmentTypeTemp:
+			return verb + " {addr}", strconv.Itoa(layout.Temp + i.Arg2Val)
+		case SegmentTypePointer:
+			return verb + " {addr}", pointerSymbol(i.Arg2Val)
+		case SegmentTypeStatic:
+			return verb + " {addr}", fmt.Sprintf("%s.%d", i.FileName, i.Arg2Val)
+		}
+	}
+	return "", ""
+}
+
+// superoptEntry is the result of the search for a pattern: the shortest
+// code, no shorter one existing over the instructions searched, or none
+// when the pattern takes more than MaxLength instructions.
+type superoptEntry struct {
+	superoptPattern
+	Code      []string `json:"code,omitempty"`
+	MaxLength int      `json:"max_length"`
+	Tried     int      `json:"candidates_tried"`
+}
+
+// superoptTable is what the superopt subcommand writes: the entries and how
+// they were found and proved.
+type superoptTable struct {
+	Provenance struct {
+		GeneratedBy string `json:"generated_by"`
+		MaxLength   int    `json:"max_length"`
+		Vectors     int    `json:"test_vectors"`
+		Seed        int64  `json:"seed"`
+		Alphabet    string `json:"alphabet"`
+		Proof       string `json:"proof"`
+	} `json:"provenance"`
+	Entries []superoptEntry `json:"entries"`
+}
+
+// superoptJSON is the table shipped with the translator, as superopt
+// generated it.
+//
+//go:embed superopt.json
+var superoptJSON []byte
+
+var superoptCodes = func() map[superoptPattern][]string {
+	var t superoptTable
+	if err := json.Unmarshal(superoptJSON, &t); err != nil {
+		panic("superopt.json: " + err.Error())
+	}
+	codes := map[superoptPattern][]string{}
+	for _, e := range t.Entries {
+		if e.Code != nil {
+			codes[e.superoptPattern] = e.Code
+		}
+	}
+	return codes
+}()
+
+// superoptCode returns the code of the table for the command, the top of
+// the stack in D before it if inD and after it if outD, nil when the table
+// has none.
+func (i *Instruction) superoptCode(inD, outD bool) []string {
+	key, operand := superoptKey(i)
+	code, ok := superoptCodes[superoptPattern{key, inD, outD}]
+	if !ok {
+		return nil
+	}
+	return withOperand(code, operand)
+}
+
+// The concrete machine of the search: a small RAM laid out as the VM lays
+// out the Hack RAM, the segments and the stack apart.
+const (
+	soRAMSize   = 128
+	soStackBase = 80
+)
+
+// soOp is an instruction of the search alphabet.
+type soOp struct {
+	text  string
+	addr  bool
+	value []int16 // of an A-instruction, by test vector
+	eval  func(a, d, m int16) int16
+	readM bool
+	destA bool
+	destD bool
+	destM bool
+}
+
+// soSearch searches the code of a pattern, running the candidates on test
+// vectors, states with random words, and deduplicating the candidates
+// leaving the same states.
+type soSearch struct {
+	pattern superoptPattern
+	ops     []soOp
+	spill   []soOp
+	// the state of the candidate, by test vector
+	ram  [][soRAMSize]int16
+	a, d []int16
+	// hash of the RAM, hashCmp of the words compared with the expected
+	// state
+	hash, hashCmp uint64
+	// the expected final state, by test vector, and the words compared
+	want     [][soRAMSize]int16
+	wantSP   []int16
+	wantHash uint64
+	seen     map[uint64]int
+	code     []string
+	tried    int
+	found    []string
+}
+
+func soMix(v, addr int, val int16) uint64 {
+	x := uint64(v)<<40 | uint64(addr)<<16 | uint64(uint16(val))
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// write stores val at addr of the vector v, keeping the hashes.
+func (s *soSearch) write(v, addr int, val int16) {
+	old := s.ram[v][addr]
+	h := soMix(v, addr, old) ^ soMix(v, addr, val)
+	s.hash ^= h
+	if addr < int(s.wantSP[v]) && (addr < 13 || addr > 15) {
+		s.hashCmp ^= h
+	}
+	s.ram[v][addr] = val
+}
+
+// soUndo is what an instruction changed, to be restored.
+type soUndo struct {
+	a, d  []int16
+	addrs []int
+	olds  []int16
+}
+
+// step runs op on every test vector, false when it addresses a word out of
+// the RAM.
+func (s *soSearch) step(op soOp, u *soUndo) bool {
+	u.a, u.d, u.addrs, u.olds = slices.Clone(s.a), slices.Clone(s.d), u.addrs[:0], u.olds[:0]
+	for v := range s.ram {
+		if op.addr {
+			s.a[v] = op.value[v]
+			continue
+		}
+		a := int(s.a[v])
+		if (op.readM || op.destM) && (a < 0 || a >= soRAMSize) {
+			s.undo(u)
+			return false
+		}
+		var m int16
+		if op.readM {
+			m = s.ram[v][a]
+		}
+		r := op.eval(s.a[v], s.d[v], m)
+		if op.destM {
+			u.addrs, u.olds = append(u.addrs, v*soRAMSize+a), append(u.olds, s.ram[v][a])
+			s.write(v, a, r)
+		}
+		if op.destA {
+			s.a[v] = r
+		}
+		if op.destD {
+			s.d[v] = r
+		}
+	}
+	return true
+}
+
+func (s *soSearch) undo(u *soUndo) {
+	for k := len(u.addrs) - 1; k >= 0; k-- {
+		s.write(u.addrs[k]/soRAMSize, u.addrs[k]%soRAMSize, u.olds[k])
+	}
+	copy(s.a, u.a)
+	copy(s.d, u.d)
+}
+
+func (s *soSearch) stateHash() uint64 {
+	h := s.hash
+	for v := range s.a {
+		h ^= soMix(v, 1<<20, s.a[v]) ^ soMix(v, 1<<21, s.d[v])
+	}
+	return h
+}
+
+// matches tells whether the candidate, spilling D when the pattern leaves
+// the top there, ends in the expected state on every test vector.
+func (s *soSearch) matches() bool {
+	undos := make([]soUndo, len(s.spill))
+	n := 0
+	ok := true
+	for ; n < len(s.spill) && ok; n++ {
+		ok = s.step(s.spill[n], &undos[n])
+	}
+	if !ok {
+		n--
+	}
+	if ok && s.hashCmp == s.wantHash {
+		for v := range s.ram {
+			for addr := range int(s.wantSP[v]) {
+				if (addr < 13 || addr > 15) && s.ram[v][addr] != s.want[v][addr] {
+					ok = false
+				}
+			}
+		}
+	} else {
+		ok = false
+	}
+	for n--; n >= 0; n-- {
+		s.undo(&undos[n])
+	}
+	return ok
+}
+
+// dfs extends the candidate up to length instructions, recording the
+// first one proved equivalent to the pattern. A state reached before with
+// as many instructions or fewer is not explored again, its continuations
+// having been tried, which holds as every candidate is tested and not
+// only those of length instructions.
+func (s *soSearch) dfs(depth, length int) bool {
+	h := s.stateHash()
+	if d, ok := s.seen[h]; ok && d <= depth {
+		return false
+	}
+	s.seen[h] = depth
+	if depth > 0 {
+		s.tried++
+		// the test vectors agree, symbolic execution decides
+		if s.matches() && proveSuperopt(s.pattern, s.code) == nil {
+			s.found = slices.Clone(s.code)
+			return true
+		}
+	}
+	if depth == length {
+		return false
+	}
+	u := &soUndo{}
+	for _, op := range s.ops {
+		// an A-instruction loads A for the next one
+		if op.addr && (depth == length-1 || depth > 0 && strings.HasPrefix(s.code[depth-1], "@")) {
+			continue
+		}
+		if !s.step(op, u) {
+			continue
+		}
+		s.code = append(s.code, op.text)
+		found := s.dfs(depth+1, length)
+		s.code = s.code[:depth]
+		s.undo(u)
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// soAlphabet is the instructions of the search: the A-instructions of SP
+// and the operand of the command, and every C-instruction of the standard
+// ALU storing its result, without a jump.
+func soAlphabet(symbols map[string][]int16) []soOp {
+	ops := []soOp{}
+	for _, sym := range slices.Sorted(maps.Keys(symbols)) {
+		ops = append(ops, soOp{text: "@" + sym, addr: true, value: symbols[sym]})
+	}
+	// in the order of the table of the Hack specification, the plainer
+	// code coming first among the equally short
+	comps := []string{
+		"0", "1", "-1", "D", "A", "!D", "!A", "-D", "-A", "D+1", "A+1", "D-1", "A-1", "D+A", "D-A", "A-D", "D&A", "D|A",
+		"M", "!M", "-M", "M+1", "M-1", "D+M", "D-M", "M-D", "D&M", "D|M",
+	}
+	for _, c := range comps {
+		for _, dest := range []string{"M", "D", "MD", "A", "AM", "AD", "AMD"} {
+			ops = append(ops, soCOp(dest+"="+c))
+		}
+	}
+	return ops
+}
+
+func soCOp(text string) soOp {
+	dest, comp, _ := strings.Cut(text, "=")
+	return soOp{
+		text: text, eval: hackComps[comp].Eval, readM: strings.Contains(comp, "M"),
+		destA: strings.Contains(dest, "A"), destD: strings.Contains(dest, "D"), destM: strings.Contains(dest, "M"),
+	}
+}
+
+// newSoSearch prepares the search of the code of a pattern: the test
+// vectors, each running one of the instances of the pattern in turn, and
+// the states the O0 code of the instance leaves them in.
+func newSoSearch(p superoptPattern, vectors int, seed int64) (*soSearch, error) {
+	instances := p.instances()
+	refs := [][]string{}
+	level := optLevel
+	defer func() { optLevel = level }()
+	optLevel = optNone
+	for _, in := range instances {
+		inst, err := parseSuperoptInstance(in)
+		if err != nil {
+			return nil, err
+		}
+		resetCodegenState()
+		ref, err := inst.GenAsm()
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	stackCached = true
+	spill := genSpill()
+
+	s := &soSearch{pattern: p}
+	rng := rand.New(rand.NewSource(seed))
+	// the values of the A-instructions, by test vector
+	symbols := map[string][]int16{"SP": nil}
+	for _, ph := range []string{"{seg}", "{addr}"} {
+		if strings.Contains(p.Command, ph) {
+			symbols[ph] = nil
+		}
+	}
+	for v := range vectors {
+		in := instances[v%len(instances)]
+		var ram [soRAMSize]int16
+		for k := range ram {
+			ram[k] = int16(rng.Intn(1 << 16))
+		}
+		for k, slot := range rng.Perm(4) {
+			ram[1+k] = int16(24 + 12*slot + rng.Intn(3))
+		}
+		sp := int16(soStackBase + 2 + rng.Intn(20))
+		values := newHackSymbols()
+		values[verifyFile+".0"] = 16 + rng.Intn(8)
+		operand, err := strconv.Atoi(in.Symbol)
+		if err != nil {
+			operand = values[in.Symbol]
+		}
+		for sym := range symbols {
+			if sym == "SP" {
+				symbols[sym] = append(symbols[sym], 0)
+			} else {
+				symbols[sym] = append(symbols[sym], int16(operand))
+			}
+		}
+		// the O0 code runs with the whole stack in RAM
+		want, a, d := ram, int16(rng.Intn(1<<16)), int16(rng.Intn(1<<16))
+		want[0] = sp
+		if p.InD {
+			want[sp], want[0] = d, sp+1
+		}
+		ram[0] = sp
+		if err := soRun(refs[v%len(refs)], &want, values); err != nil {
+			return nil, fmt.Errorf("the O0 code of %s: %w", in.Source, err)
+		}
+		s.ram, s.want, s.wantSP = append(s.ram, ram), append(s.want, want), append(s.wantSP, want[0])
+		s.a, s.d = append(s.a, a), append(s.d, d)
+	}
+	for v, ram := range s.ram {
+		for addr, val := range ram {
+			s.hash ^= soMix(v, addr, val)
+			if addr < int(s.wantSP[v]) && (addr < 13 || addr > 15) {
+				s.hashCmp ^= soMix(v, addr, val)
+				s.wantHash ^= soMix(v, addr, s.want[v][addr])
+			}
+		}
+	}
+	s.ops = soAlphabet(symbols)
+	if p.OutD {
+		for _, l := range spill {
+			if sym, ok := strings.CutPrefix(l, "@"); ok {
+				s.spill = append(s.spill, soOp{text: l, addr: true, value: symbols[sym]})
+			} else {
+				s.spill = append(s.spill, soCOp(l))
+			}
+		}
+	}
+	return s, nil
+}
+
+// parseSuperoptInstance parses the command of an instance, negative
+// constants included.
+func parseSuperoptInstance(in superoptInstance) (*Instruction, error) {
+	ext := extendedMode
+	extendedMode = true
+	defer func() { extendedMode = ext }()
+	return parseInstruction(0, verifyFile, in.Source)
+}
+
+// soRun runs code without jumps on the RAM of a test vector.
+func soRun(lines []string, ram *[soRAMSize]int16, symbols map[string]int) error {
+	prog, err := assembleHack(lines)
+	if err != nil {
+		return err
+	}
+	var a, d int16
+	for _, in := range prog.ROM {
+		if in.Address {
+			sym := strings.TrimPrefix(strings.TrimSpace(lines[in.Line]), "@")
+			if v, ok := symbols[sym]; ok {
+				in.Value = int16(v)
+			}
+			a = in.Value
+			continue
+		}
+		if in.Jump != "" {
+			return fmt.Errorf("jump in %s", lines[in.Line])
+		}
+		if (in.readM || in.destM) && (a < 0 || a >= soRAMSize) {
+			return fmt.Errorf("address %d out of the RAM of the search", a)
+		}
+		r := in.eval(a, d, ram[a])
+		if in.destM {
+			ram[a] = r
+		}
+		if in.destA {
+			a = r
+		}
+		if in.destD {
+			d = r
+		}
+	}
+	return nil
+}
+
+// search finds the shortest code of the pattern, trying the lengths up to
+// maxLength in turn.
+func (s *soSearch) search(maxLength int) superoptEntry {
+	e := superoptEntry{superoptPattern: s.pattern, MaxLength: maxLength}
+	for length := 1; length <= maxLength; length++ {
+		s.seen = map[uint64]int{}
+		if s.dfs(0, length) {
+			e.MaxLength, e.Code = length, s.found
+			break
+		}
+	}
+	e.Tried = s.tried
+	return e
+}
+
+// proveSuperopt proves the code of a pattern equivalent to every instance
+// of it.
+func proveSuperopt(p superoptPattern, code []string) error {
+	for _, in := range p.instances() {
+		inst, err := parseSuperoptInstance(in)
+		if err != nil {
+			return err
+		}
+		lines := withOperand(code, in.Symbol)
+		if p.OutD {
+			stackCached = true
+			lines = append(lines, genSpill()...)
+		}
+		prog, err := newSymProgram(lines, []int{0}, len(lines))
+		if err != nil {
+			return err
+		}
+		diffs, err := prog.check([]*Instruction{inst}, p.InD)
+		if err == nil && len(diffs) > 0 {
+			err = fmt.Errorf("%s: %s", in.Source, strings.Join(diffs, "; "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSuperopt implements the superopt subcommand, searching the shortest
+// code of the patterns of superoptPatterns exhaustively and writing the
+// table the code generation of the levels above O0 takes their code from.
+// Every candidate agreeing with the O0 code on the test vectors is proved
+// by symbolic execution, as verify-codegen does, before it is kept.
+func runSuperopt(args []string) {
+	fs := flag.NewFlagSet("superopt", flag.ExitOnError)
+	maxLength := fs.Int("max-length", 4, "longest code searched, each instruction more multiplying the time taken by 10 to 20")
+	vectors := fs.Int("vectors", 8, "random states the candidates are run on before they are proved")
+	seed := fs.Int64("seed", 1, "seed of the test vectors")
+	out := fs.String("o", "superopt.json", "table written")
+	check := fs.Bool("check", false, "prove the table shipped with the translator instead of searching")
+	parseFlags(fs, args)
+	if *maxLength < 1 || *vectors < 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *check {
+		var t superoptTable
+		if err := json.Unmarshal(superoptJSON, &t); err != nil {
+			fmt.Println("Error reading the table", err)
+			os.Exit(exitInternal)
+		}
+		failed := 0
+		for _, e := range t.Entries {
+			if e.Code == nil {
+				continue
+			}
+			if err := proveSuperopt(e.superoptPattern, e.Code); err != nil {
+				fmt.Printf("FAIL %s: %s\n", e.superoptPattern, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("All %d entries of the table of %s proved\n", len(superoptCodes), t.Provenance.GeneratedBy)
+		return
+	}
+
+	var t superoptTable
+	t.Provenance.GeneratedBy = "superopt of " + readBuildInfo().String()
+	t.Provenance.MaxLength, t.Provenance.Vectors, t.Provenance.Seed = *maxLength, *vectors, *seed
+	t.Provenance.Alphabet = "the A-instructions @SP and @operand, every computation of the standard ALU with every destination, no jumps"
+	t.Provenance.Proof = "symbolic execution against the VM command, as verify-codegen"
+	for _, p := range superoptPatterns() {
+		s, err := newSoSearch(p, *vectors, *seed)
+		if err != nil {
+			fmt.Println("Error", err)
+			os.Exit(exitInternal)
+		}
+		e := s.search(*maxLength)
+		if e.Code != nil {
+			fmt.Printf("%s: %s, %s (%s)\n", p, plural(len(e.Code), "instruction"), strings.Join(e.Code, " "), plural(e.Tried, "candidate"))
+		} else {
+			fmt.Printf("%s: none up to %s (%s)\n", p, plural(*maxLength, "instruction"), plural(e.Tried, "candidate"))
+		}
+		t.Entries = append(t.Entries, e)
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		fmt.Println("Error", err)
+		os.Exit(exitInternal)
+	}
+	if err := os.WriteFile(*out, append(data, '\n'), 0o644); err != nil {
+		fmt.Println("Error writing the table", err)
+		os.Exit(exitIO)
+	}
+	fmt.Println("Wrote", *out)
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// symTerm is a symbolic 16-bit word: a constant plus a linear combination
+// of atoms, modulo 2^16. Atoms are the words of the initial state, the
+// results the model does not reduce (x&y, x|y, x>>1) and the truth of the
+// comparisons of the VM, worth 0 or 1. Negation and ! stay linear, !x
+// being -x-1 in two's complement.
+type symTerm struct {
+	c     uint16
+	atoms map[string]uint16
+}
+
+func symConst(v int) symTerm { return symTerm{c: uint16(v)} }
+
+func symAtom(name string) symTerm { return symTerm{atoms: map[string]uint16{name: 1}} }
+
+func (t symTerm) add(u symTerm) symTerm {
+	r := symTerm{c: t.c + u.c, atoms: maps.Clone(t.atoms)}
+	for a, k := range u.atoms {
+		if r.atoms == nil {
+			r.atoms = map[string]uint16{}
+		}
+		if r.atoms[a] += k; r.atoms[a] == 0 {
+			delete(r.atoms, a)
+		}
+	}
+	return r
+}
+
+func (t symTerm) neg() symTerm {
+	r := symTerm{c: -t.c, atoms: map[string]uint16{}}
+	for a, k := range t.atoms {
+		r.atoms[a] = -k
+	}
+	return r
+}
+
+func (t symTerm) sub(u symTerm) symTerm { return t.add(u.neg()) }
+
+func (t symTerm) not() symTerm { return t.neg().add(symConst(-1)) }
+
+// constant returns the value of a term without atoms.
+func (t symTerm) constant() (int16, bool) {
+	return int16(t.c), len(t.atoms) == 0
+}
+
+// String is the canonical form of the term, equal for equal terms.
+func (t symTerm) String() string {
+	parts := []string{}
+	for _, a := range slices.Sorted(maps.Keys(t.atoms)) {
+		switch k := int16(t.atoms[a]); k {
+		case 1:
+			parts = append(parts, a)
+		case -1:
+			parts = append(parts, "-"+a)
+		default:
+			parts = append(parts, fmt.Sprintf("%d*%s", k, a))
+		}
+	}
+	if t.c != 0 || len(parts) == 0 {
+		parts = append(parts, strconv.Itoa(int(int16(t.c))))
+	}
+	return strings.Join(parts, "+")
+}
+
+// symOp is x&y, x|y or x>>1 (y unused), folded when the operands are
+// constants and an atom otherwise.
+func symOp(op string, x, y symTerm) symTerm {
+	a, aok := x.constant()
+	b, bok := y.constant()
+	switch {
+	case op == ">>" && aok:
+		return symConst(int(a >> 1))
+	case op == ">>":
+		return symAtom("(" + x.String() + ">>1)")
+	case aok && bok && op == "&":
+		return symConst(int(a & b))
+	case aok && bok:
+		return symConst(int(a | b))
+	case bok && (b == 0 || b == -1):
+		x, y, a, aok = y, x, b, bok
+	}
+	switch {
+	case aok && (a == 0) == (op == "&"):
+		// x&0 and x|-1
+		return symConst(int(a))
+	case aok && (a == 0 || a == -1):
+		return y
+	}
+	operands := []string{x.String(), y.String()}
+	slices.Sort(operands)
+	return symAtom("(" + operands[0] + op + operands[1] + ")")
+}
+
+// symComps evaluates the computations of the Hack ALU on terms.
+var symComps = map[string]func(a, d, m symTerm) symTerm{
+	"0":   func(a, d, m symTerm) symTerm { return symConst(0) },
+	"1":   func(a, d, m symTerm) symTerm { return symConst(1) },
+	"-1":  func(a, d, m symTerm) symTerm { return symConst(-1) },
+	"D":   func(a, d, m symTerm) symTerm { return d },
+	"A":   func(a, d, m symTerm) symTerm { return a },
+	"M":   func(a, d, m symTerm) symTerm { return m },
+	"!D":  func(a, d, m symTerm) symTerm { return d.not() },
+	"!A":  func(a, d, m symTerm) symTerm { return a.not() },
+	"!M":  func(a, d, m symTerm) symTerm { return m.not() },
+	"-D":  func(a, d, m symTerm) symTerm { return d.neg() },
+	"-A":  func(a, d, m symTerm) symTerm { return a.neg() },
+	"-M":  func(a, d, m symTerm) symTerm { return m.neg() },
+	"D+1": func(a, d, m symTerm) symTerm { return d.add(symConst(1)) },
+	"A+1": func(a, d, m symTerm) symTerm { return a.add(symConst(1)) },
+	"M+1": func(a, d, m symTerm) symTerm { return m.add(symConst(1)) },
+	"D-1": func(a, d, m symTerm) symTerm { return d.sub(symConst(1)) },
+	"A-1": func(a, d, m symTerm) symTerm { return a.sub(symConst(1)) },
+	"M-1": func(a, d, m symTerm) symTerm { return m.sub(symConst(1)) },
+	"D+A": func(a, d, m symTerm) symTerm { return d.add(a) },
+	"D+M": func(a, d, m symTerm) symTerm { return d.add(m) },
+	"D-A": func(a, d, m symTerm) symTerm { return d.sub(a) },
+	"D-M": func(a, d, m symTerm) symTerm { return d.sub(m) },
+	"A-D": func(a, d, m symTerm) symTerm { return a.sub(d) },
+	"M-D": func(a, d, m symTerm) symTerm { return m.sub(d) },
+	"D&A": func(a, d, m symTerm) symTerm { return symOp("&", d, a) },
+	"D&M": func(a, d, m symTerm) symTerm { return symOp("&", d, m) },
+	"D|A": func(a, d, m symTerm) symTerm { return symOp("|", d, a) },
+	"D|M": func(a, d, m symTerm) symTerm { return symOp("|", d, m) },
+	"A<<": func(a, d, m symTerm) symTerm { return a.add(a) },
+	"D<<": func(a, d, m symTerm) symTerm { return d.add(d) },
+	"M<<": func(a, d, m symTerm) symTerm { return m.add(m) },
+	"A>>": func(a, d, m symTerm) symTerm { return symOp(">>", a, a) },
+	"D>>": func(a, d, m symTerm) symTerm { return symOp(">>", d, d) },
+	"M>>": func(a, d, m symTerm) symTerm { return symOp(">>", m, m) },
+}
+
+// signSet is the signs a word may have, as a 16-bit signed value.
+type signSet int
+
+const (
+	signNeg signSet = 1 << iota
+	signZero
+	signPos
+	signAny = signNeg | signZero | signPos
+)
+
+var jumpSigns = map[string]signSet{
+	"JGT": signPos, "JEQ": signZero, "JGE": signZero | signPos, "JLT": signNeg,
+	"JNE": signNeg | signPos, "JLE": signNeg | signZero, "JMP": signAny,
+}
+
+// symCond is the condition of a comparison atom: the signs of a term.
+type symCond struct {
+	t     symTerm
+	signs signSet
+}
+
+// symState is the state of a path of the symbolic execution: the registers,
+// the RAM words written, by address, and the signs of the terms the jumps
+// taken or not taken on the path tell.
+type symState struct {
+	pc    int
+	a, d  symTerm
+	mem   map[string][2]symTerm
+	facts map[string]signSet
+}
+
+func newSymState() *symState {
+	return &symState{a: symAtom("A0"), d: symAtom("D0"), mem: map[string][2]symTerm{}, facts: map[string]signSet{}}
+}
+
+func (s *symState) clone() *symState {
+	c := *s
+	c.mem, c.facts = maps.Clone(s.mem), maps.Clone(s.facts)
+	return &c
+}
+
+// read is the word at addr, an atom naming it when it is not written. The
+// model takes words at different addresses to be different, which holds
+// when the segments do not overlap, as the VM lays them out.
+func (s *symState) read(addr symTerm) symTerm {
+	if w, ok := s.mem[addr.String()]; ok {
+		return w[1]
+	}
+	return symAtom("RAM[" + addr.String() + "]")
+}
+
+func (s *symState) write(addr, v symTerm) {
+	s.mem[addr.String()] = [2]symTerm{addr, v}
+}
+
+func (s *symState) signs(t symTerm) signSet {
+	if v, ok := t.constant(); ok {
+		switch {
+		case v < 0:
+			return signNeg
+		case v == 0:
+			return signZero
+		}
+		return signPos
+	}
+	if f, ok := s.facts[t.String()]; ok {
+		return f
+	}
+	return signAny
+}
+
+// resolve replaces the comparison atoms of t the facts of the path decide
+// by their truth.
+func (s *symState) resolve(t symTerm, conds map[string]symCond) symTerm {
+	r := symTerm{c: t.c}
+	for a, k := range t.atoms {
+		if c, ok := conds[a]; ok {
+			switch sg := s.signs(c.t); {
+			case sg&c.signs == sg:
+				r = r.add(symTerm{c: k})
+				continue
+			case sg&c.signs == 0:
+				continue
+			}
+		}
+		r = r.add(symTerm{atoms: map[string]uint16{a: k}})
+	}
+	return r
+}
+
+// symExit is how a path leaves the code checked: falling through its end
+// when Target is nil, or jumping to the address Target.
+type symExit struct {
+	state  *symState
+	Target *symTerm
+}
+
+// symProgram is assembled code run symbolically: the code of the commands
+// checked, whose end is at End, followed by the runtime subroutines.
+type symProgram struct {
+	prog   *hackProgram
+	lines  []string
+	labels map[string]bool
+	End    int
+	// Starts is the address of the code of every command
+	Starts []int
+}
+
+// symbol is the value of an A-instruction symbol: a predefined address, a
+// label of the code, or an atom for the static variables and the labels
+// of other code.
+func (p *symProgram) symbol(name string) symTerm {
+	if v, err := strconv.Atoi(name); err == nil {
+		return symConst(v)
+	}
+	if v, ok := newHackSymbols()[name]; ok {
+		return symConst(v)
+	}
+	if p.labels[name] {
+		return symConst(p.prog.Symbols[name])
+	}
+	return symAtom("&" + name)
+}
+
+// run executes the code from init along every path, forking at the jumps
+// whose condition the path does not decide.
+func (p *symProgram) run(init *symState) ([]symExit, error) {
+	exits := []symExit{}
+	work := []*symState{init}
+	steps := 0
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		for s != nil {
+			if steps++; steps > 100_000 {
+				return nil, fmt.Errorf("the code runs too long, a loop on a symbolic value")
+			}
+			if s.pc == p.End {
+				exits = append(exits, symExit{state: s})
+				break
+			}
+			if s.pc < 0 || s.pc >= len(p.prog.ROM) {
+				return nil, fmt.Errorf("jump to address %d", s.pc)
+			}
+			in := p.prog.ROM[s.pc]
+			if in.Address {
+				s.a = p.symbol(strings.TrimPrefix(strings.TrimSpace(strings.Split(p.lines[in.Line], "//")[0]), "@"))
+				s.pc++
+				continue
+			}
+			var m symTerm
+			if in.readM {
+				m = s.read(s.a)
+			}
+			r := symComps[in.Comp](s.a, s.d, m)
+			target := s.a
+			if in.destM {
+				s.write(s.a, r)
+			}
+			if in.destA {
+				s.a = r
+			}
+			if in.destD {
+				s.d = r
+			}
+			sg := s.signs(r)
+			taken, notTaken := sg&jumpSigns[in.Jump], sg&^jumpSigns[in.Jump]
+			var jumper *symState
+			switch {
+			case taken != 0 && notTaken != 0:
+				jumper = s.clone()
+				jumper.facts[r.String()] = taken
+				s.facts[r.String()] = notTaken
+			case taken != 0:
+				jumper, s = s, nil
+			}
+			if s != nil {
+				s.pc++
+			}
+			if jumper == nil {
+				continue
+			}
+			if addr, ok := target.constant(); ok {
+				jumper.pc = int(uint16(addr))
+				work = append(work, jumper)
+			} else {
+				exits = append(exits, symExit{state: jumper, Target: &target})
+			}
+		}
+	}
+	return exits, nil
+}
+
+// symVM runs VM commands on a symbolic state along the path of the code
+// it is checked against, following the VM specification. eq is the sign
+// of x - y being zero, gt and lt its being positive and negative, as the
+// code of the course computes them.
+type symVM struct {
+	p     *symProgram
+	insts []*Instruction
+	conds map[string]symCond
+}
+
+func (vm *symVM) push(s *symState, v symTerm) {
+	sp := s.read(symConst(0))
+	s.write(sp, v)
+	s.write(symConst(0), sp.add(symConst(1)))
+}
+
+// pop pops a value, its comparisons decided by the path replaced by their
+// truth.
+func (vm *symVM) pop(s *symState) symTerm {
+	sp := s.read(symConst(0)).sub(symConst(1))
+	s.write(symConst(0), sp)
+	return s.resolve(s.read(sp), vm.conds)
+}
+
+// address is the address of the word of a segment a push or pop uses.
+func (vm *symVM) address(s *symState, i *Instruction) symTerm {
+	n := symConst(i.Arg2Val)
+	switch i.SegmentType {
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		return s.read(vm.p.symbol(i.SegmentType.ID())).add(n)
+	case SegmentTypeTemp:
+		return symConst(layout.Temp + i.Arg2Val)
+	case SegmentTypePointer:
+		return symConst(3 + i.Arg2Val)
+	}
+	return vm.p.symbol(fmt.Sprintf("%s.%d", i.FileName, i.Arg2Val))
+}
+
+// run runs the commands from s until they end or jump out of them.
+func (vm *symVM) run(s *symState) (*symExit, error) {
+	labels := map[string]int{}
+	for k, i := range vm.insts {
+		if i.CommandType == CommandTypeLabel {
+			labels[i.labelSymbol()] = k
+		}
+	}
+	jump := func(label string) (int, *symExit) {
+		if k, ok := labels[label]; ok {
+			return k, nil
+		}
+		t := vm.p.symbol(label)
+		return 0, &symExit{state: s, Target: &t}
+	}
+	for k := 0; k < len(vm.insts); k++ {
+		i := vm.insts[k]
+		switch i.CommandType {
+		case CommandTypePush:
+			if i.SegmentType == SegmentTypeConstant {
+				vm.push(s, symConst(i.Arg2Val))
+			} else {
+				vm.push(s, s.read(vm.address(s, i)))
+			}
+		case CommandTypePop:
+			v := vm.pop(s)
+			if i.SegmentType != SegmentTypeConstant {
+				s.write(vm.address(s, i), v)
+			}
+		case CommandTypeArithmetic:
+			y := vm.pop(s)
+			switch i.ALType {
+			case ALTypeNeg:
+				vm.push(s, y.neg())
+				continue
+			case ALTypeNot:
+				vm.push(s, y.not())
+				continue
+			case ALTypeShl:
+				vm.push(s, y.add(y))
+				continue
+			case ALTypeShr:
+				vm.push(s, symOp(">>", y, y))
+				continue
+			}
+			x := vm.pop(s)
+			switch i.ALType {
+			case ALTypeAdd:
+				vm.push(s, x.add(y))
+			case ALTypeSub:
+				vm.push(s, x.sub(y))
+			case ALTypeAnd:
+				vm.push(s, symOp("&", x, y))
+			case ALTypeOr:
+				vm.push(s, symOp("|", x, y))
+			case ALTypeEq, ALTypeGt, ALTypeLt:
+				c := symCond{x.sub(y), map[ALType]signSet{ALTypeEq: signZero, ALTypeGt: signPos, ALTypeLt: signNeg}[i.ALType]}
+				name := fmt.Sprintf("[%s %s 0]", c.t, map[ALType]string{ALTypeEq: "==", ALTypeGt: ">", ALTypeLt: "<"}[i.ALType])
+				vm.conds[name] = c
+				// true is -1
+				vm.push(s, symAtom(name).neg())
+			default:
+				return nil, fmt.Errorf("%s is not modelled", i.ALType)
+			}
+		case CommandTypeLabel:
+		case CommandTypeGOTO:
+			next, exit := jump(i.labelSymbol())
+			if exit != nil {
+				return exit, nil
+			}
+			k = next
+		case CommandTypeIf:
+			v := vm.pop(s)
+			switch sg := s.signs(v); {
+			case sg == signZero:
+			case sg&signZero == 0:
+				next, exit := jump(i.labelSymbol())
+				if exit != nil {
+					return exit, nil
+				}
+				k = next
+			default:
+				return nil, fmt.Errorf("%s: the path does not decide whether %s is true", i.Line, v)
+			}
+		case CommandTypeFunction:
+			for range i.Arg2Val {
+				vm.push(s, symConst(0))
+			}
+		case CommandTypeCall:
+			sp := s.read(symConst(0))
+			ret := vm.p.End
+			if k+1 < len(vm.p.Starts) {
+				ret = vm.p.Starts[k+1]
+			}
+			vm.push(s, symConst(ret))
+			for _, seg := range []SegmentType{SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat} {
+				vm.push(s, s.read(vm.p.symbol(seg.ID())))
+			}
+			s.write(symConst(2), sp.sub(symConst(i.Arg2Val)))
+			s.write(symConst(1), sp.add(symConst(callFrameSize)))
+			_, exit := jump(i.Arg1)
+			return exit, nil
+		case CommandTypeReturn:
+			frame := s.read(symConst(1))
+			ret := s.read(frame.sub(symConst(5)))
+			arg := s.read(symConst(2))
+			s.write(arg, vm.pop(s))
+			s.write(symConst(0), arg.add(symConst(1)))
+			for n, seg := range []SegmentType{SegmentTypeThat, SegmentTypeThis, SegmentTypeArgument, SegmentTypeLocal} {
+				s.write(vm.p.symbol(seg.ID()), s.read(frame.sub(symConst(n+1))))
+			}
+			return &symExit{state: s, Target: &ret}, nil
+		default:
+			return nil, fmt.Errorf("%s is not modelled", i.CommandType)
+		}
+	}
+	return &symExit{state: s}, nil
+}
+
+// genSymProgram translates VM commands at the current optimization level
+// as translate does, the stack starting cached in D if cached, and
+// assembles them with the runtime subroutines they use.
+func genSymProgram(src []string, cached bool) (*symProgram, []*Instruction, error) {
+	resetCodegenState()
+	insts := []*Instruction{}
+	for k, line := range src {
+		i, err := parseInstruction(k, verifyFile, line)
+		if err != nil {
+			return nil, nil, err
+		}
+		insts = append(insts, i)
+	}
+	scopeLabels(insts)
+	if optLevel != optNone {
+		planJumps(insts)
+		planDeadCode(insts)
+	}
+	if optLevel == optSize {
+		planSharedCommands(insts)
+	}
+	stackCached = cached
+	lines, firstLines := []string{}, []int{}
+	for _, i := range insts {
+		asm, err := i.GenAsm()
+		if err != nil {
+			return nil, nil, err
+		}
+		firstLines = append(firstLines, len(lines))
+		lines = append(lines, asm...)
+	}
+	lines = append(lines, genSpill()...)
+	endLine := len(lines)
+	lines = append(lines, genRuntime()...)
+	p, err := newSymProgram(lines, firstLines, endLine)
+	return p, insts, err
+}
+
+// newSymProgram assembles code to run symbolically, the code of the
+// commands starting at the lines firstLines and ending at endLine.
+func newSymProgram(lines []string, firstLines []int, endLine int) (*symProgram, error) {
+	prog, err := assembleHack(lines)
+	if err != nil {
+		return nil, err
+	}
+	p := &symProgram{prog: prog, lines: lines, labels: map[string]bool{}}
+	for _, l := range lines {
+		if strings.HasPrefix(l, "(") {
+			p.labels[strings.Trim(l, "()")] = true
+		}
+	}
+	// the address of the first instruction at or after a line
+	addrOf := func(line int) int {
+		n, _ := slices.BinarySearchFunc(prog.ROM, line, func(in hackInstruction, l int) int { return in.Line - l })
+		return n
+	}
+	for _, l := range firstLines {
+		p.Starts = append(p.Starts, addrOf(l))
+	}
+	p.End = addrOf(endLine)
+	return p, nil
+}
+
+// verifyFile is the file the checked commands come from, naming their
+// static variables.
+const verifyFile = "Verify"
+
+// checkCodegen proves that the code of VM commands at the current level,
+// run symbolically from any state, ends as the commands do on every path:
+// leaving by the same jump, with the same RAM apart from the scratch
+// registers and the words above the stack. It returns the differences
+// found.
+func checkCodegen(src []string, cached bool) ([]string, error) {
+	p, insts, err := genSymProgram(src, cached)
+	if err != nil {
+		return nil, err
+	}
+	return p.check(insts, cached)
+}
+
+// check proves the code equivalent to the commands insts, as checkCodegen
+// does, the top of the stack starting in D if cached.
+func (p *symProgram) check(insts []*Instruction, cached bool) ([]string, error) {
+	init := newSymState()
+	exits, err := p.run(init.clone())
+	if err != nil {
+		return nil, err
+	}
+	diffs := []string{}
+	for _, e := range exits {
+		vm := &symVM{p: p, insts: insts, conds: map[string]symCond{}}
+		s := init.clone()
+		s.facts = maps.Clone(e.state.facts)
+		if cached {
+			// the value in D is the top of the stack
+			sp := s.read(symConst(0))
+			s.write(sp, init.d)
+			s.write(symConst(0), sp.add(symConst(1)))
+		}
+		want, err := vm.run(s)
+		if err != nil {
+			return nil, err
+		}
+		path := ""
+		for _, k := range slices.Sorted(maps.Keys(e.state.facts)) {
+			path += fmt.Sprintf(" %s%s", k, map[signSet]string{signNeg: "<0", signZero: "==0", signPos: ">0", signNeg | signZero: "<=0", signZero | signPos: ">=0", signNeg | signPos: "!=0"}[e.state.facts[k]])
+		}
+		if path != "" {
+			path = ", when" + path
+		}
+		target := func(x *symExit) string {
+			if x.Target == nil {
+				return "falls through"
+			}
+			return "jumps to " + x.state.resolve(*x.Target, vm.conds).String()
+		}
+		if got, exp := target(&e), target(want); got != exp {
+			diffs = append(diffs, fmt.Sprintf("the code %s, the VM %s%s", got, exp, path))
+		}
+		sp := want.state.read(symConst(0))
+		keys := map[string]symTerm{}
+		for _, st := range []*symState{e.state, want.state} {
+			for k, w := range st.mem {
+				keys[k] = w[0]
+			}
+		}
+		for _, k := range slices.Sorted(maps.Keys(keys)) {
+			addr := keys[k]
+			if v, ok := addr.constant(); ok && isScratch(int(v)) {
+				continue
+			}
+			if above, ok := addr.sub(sp).constant(); ok && above >= 0 {
+				// above the stack
+				continue
+			}
+			got, exp := e.state.resolve(e.state.read(addr), vm.conds), e.state.resolve(want.state.read(addr), vm.conds)
+			if got.String() != exp.String() {
+				diffs = append(diffs, fmt.Sprintf("RAM[%s] is %s, the VM leaves %s%s", k, got, exp, path))
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// verifyCases are the commands and sequences of commands verify-codegen
+// checks: every command with the operands the code generation treats
+// apart, and the sequences the optimizations rewrite together.
+func verifyCases(ext bool) [][]string {
+	cases := [][]string{}
+	one := func(lines ...string) {
+		for _, l := range lines {
+			cases = append(cases, []string{l})
+		}
+	}
+	constants := []int{0, 1, 2, 17, 32767}
+	if ext {
+		// negative constants are an extension
+		constants = append(constants, -1, -2, -32768)
+	}
+	for _, v := range constants {
+		one(fmt.Sprintf("push constant %d", v))
+	}
+	for _, seg := range []string{"local", "argument", "this", "that"} {
+		for _, n := range []int{0, 1, 2, 3, 5, 6, 9} {
+			one(fmt.Sprintf("push %s %d", seg, n), fmt.Sprintf("pop %s %d", seg, n))
+		}
+	}
+	for _, n := range []int{0, 3, 7} {
+		if !isScratch(layout.Temp + n) {
+			one(fmt.Sprintf("push temp %d", n), fmt.Sprintf("pop temp %d", n))
+		}
+	}
+	for _, n := range []int{0, 1} {
+		one(fmt.Sprintf("push pointer %d", n), fmt.Sprintf("pop pointer %d", n))
+	}
+	one("push static 0", "pop static 3")
+	one("add", "sub", "neg", "eq", "gt", "lt", "and", "or", "not")
+	if ext {
+		one("shl", "shr")
+	}
+	one("label L", "goto L", "if-goto L", "return")
+	for n := range 5 {
+		one(fmt.Sprintf("function Verify.f %d", n))
+	}
+	for n := range 3 {
+		one(fmt.Sprintf("call Verify.f %d", n))
+	}
+	seqs := []string{
+		"push local 0; push constant 1; add; pop local 0",
+		"push constant 7; push constant 8; sub; neg; not; pop temp 2",
+		"push static 1; pop pointer 1; push that 0; pop this 6",
+		"push argument 0; push argument 1; lt; if-goto L1; push constant 1; pop temp 0; label L1",
+		"push this 1; push that 2; eq; push constant 5; push local 7; eq; and; pop static 0",
+		"push local 1; push local 2; gt; push local 3; push local 4; gt; or; if-goto END",
+		"if-goto L1; goto L2; label L1; push constant 1; pop temp 0; label L2",
+		"goto L1; label L1; goto L2; label L2; goto L3",
+		"push constant 3; goto L1; push constant 4; label L1; pop temp 1",
+		"push constant 3; push constant 4; call Verify.g 2; call Verify.h 0",
+		"push local 0; return; return",
+	}
+	for _, s := range seqs {
+		cases = append(cases, strings.Split(s, "; "))
+	}
+	return cases
+}
+
+// runVerifyCodegen implements the verify-codegen subcommand, proving the
+// code generation of every level equivalent to the VM specification on
+// the commands of verifyCases.
+func runVerifyCodegen(args []string) {
+	fs := flag.NewFlagSet("verify-codegen", flag.ExitOnError)
+	levelList := fs.String("levels", strings.Join(optLevels, ","), "comma separated optimization levels to check")
+	ext := fs.Bool("ext", false, "also check the extended shl and shr")
+	registerScratchFlag(fs)
+	registerLayoutFlag(fs)
+	registerTemplatesFlag(fs)
+	verbose := fs.Bool("v", false, "list every check")
+	parseFlags(fs, args)
+	levels, err := parseOptLevels(*levelList)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(exitUsage)
+	}
+	extendedMode = *ext
+
+	checks, failed := 0, 0
+	for _, level := range levels {
+		optLevel = level
+		for _, src := range verifyCases(*ext) {
+			for _, cached := range []bool{false, true} {
+				if cached && level == optNone {
+					continue
+				}
+				name := fmt.Sprintf("-%s %s", level, strings.Join(src, "; "))
+				if cached {
+					name += " (top of the stack in D)"
+				}
+				checks++
+				diffs, err := checkCodegen(src, cached)
+				switch {
+				case err != nil:
+					diffs = []string{err.Error()}
+				case len(diffs) == 0:
+					if *verbose {
+						fmt.Println("ok", name)
+					}
+					continue
+				}
+				failed++
+				fmt.Println("FAIL", name)
+				for _, d := range diffs {
+					fmt.Println("\t" + d)
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%s of %d failed\n", plural(failed, "check"), checks)
+		os.Exit(1)
+	}
+	fmt.Printf("All %s proved equivalent to the VM (mult, div, mod and push string are not checked)\n", plural(checks, "check"))
+}
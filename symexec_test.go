@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestCodegenEquivalence runs the checks of verify-codegen at every level,
+// guarding every rule of the code generation and of the optimizer.
+func TestCodegenEquivalence(t *testing.T) {
+	defer func(level string, ext bool) { optLevel, extendedMode = level, ext }(optLevel, extendedMode)
+	for _, ext := range []bool{false, true} {
+		extendedMode = ext
+		for _, level := range optLevels {
+			optLevel = level
+			for _, src := range verifyCases(ext) {
+				for _, cached := range []bool{false, true} {
+					if cached && level == optNone {
+						continue
+					}
+					name := fmt.Sprintf("-%s %s (cached %v)", level, strings.Join(src, "; "), cached)
+					diffs, err := checkCodegen(src, cached)
+					if err != nil {
+						t.Errorf("%s: %v", name, err)
+					}
+					for _, d := range diffs {
+						t.Errorf("%s: %s", name, d)
+					}
+				}
+			}
+		}
+	}
+}
+
+// TestCodegenCheckFails checks the checker itself, on code that is not
+// the code of the commands it is checked against.
+func TestCodegenCheckFails(t *testing.T) {
+	defer func(level string) { optLevel = level }(optLevel)
+	tests := []struct {
+		code, vm []string
+	}{
+		{[]string{"sub"}, []string{"add"}},
+		{[]string{"push constant 1"}, []string{"push constant 2"}},
+		{[]string{"pop local 0"}, []string{"pop argument 0"}},
+		{[]string{"lt"}, []string{"gt"}},
+		{[]string{"label L", "goto L"}, []string{"label L", "if-goto L"}},
+	}
+	for _, level := range optLevels {
+		optLevel = level
+		for _, tt := range tests {
+			p, _, err := genSymProgram(tt.code, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, insts, err := genSymProgram(tt.vm, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffs, err := p.check(insts, false)
+			if err == nil && len(diffs) == 0 {
+				t.Errorf("-%s: the code of %q proved equivalent to %q", level, tt.code, tt.vm)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// codegenTemplates are the templates of --codegen-templates, replacing the
+// -O0 code of the commands they are named after, by templateKey.
+var codegenTemplates = map[string]*template.Template{}
+
+// templatesDir is the directory of --codegen-templates, templatesChecked
+// set once checkTemplates proved its templates.
+var (
+	templatesDir     string
+	templatesChecked bool
+)
+
+// templateKeys are the names of the templates, a file NAME.tmpl each: the
+// push and pop of every segment but string, the arithmetic commands and
+// the others, if-goto spelt if_goto.
+func templateKeys() []string {
+	keys := []string{}
+	for st := SegmentTypeConstant; st < SegmentTypeString; st++ {
+		keys = append(keys, "push_"+st.String(), "pop_"+st.String())
+	}
+	for al := ALTypeAdd; al <= ALTypeMod; al++ {
+		keys = append(keys, al.String())
+	}
+	return append(keys, "label", "goto", "if_goto", "function", "call", "return")
+}
+
+// templateKey is the name of the template of a command, "" for the
+// commands templates cannot replace.
+func (i *Instruction) templateKey() string {
+	switch i.CommandType {
+	case CommandTypePush, CommandTypePop:
+		if i.SegmentType == SegmentTypeString {
+			return ""
+		}
+		return i.CommandType.String() + "_" + i.SegmentType.String()
+	case CommandTypeArithmetic:
+		return i.ALType.String()
+	case CommandTypeLabel, CommandTypeGOTO, CommandTypeIf, CommandTypeFunction, CommandTypeCall, CommandTypeReturn:
+		return strings.ReplaceAll(i.CommandType.String(), "-", "_")
+	}
+	return ""
+}
+
+// templateData is what a template is executed with.
+type templateData struct {
+	// Command is the text of the command
+	Command string
+	// Segment is the symbol of the pointer of local, argument, this and
+	// that: LCL, ARG, THIS or THAT
+	Segment string
+	// Index is the index of push and pop, the number of locals of
+	// function and of arguments of call
+	Index int
+	// Address is the word a push or pop of static, temp or pointer uses:
+	// the symbol of the static variable, the address of the temp word,
+	// THIS or THAT
+	Address string
+	// Name is the label of label, goto and if-goto, the function of
+	// function and call
+	Name string
+}
+
+// templateFuncs are the functions of the templates. label KIND is a label
+// unique to the command, the same for the same KIND within it, and
+// scratch N the Nth scratch register.
+func templateFuncs(labels map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"label": func(kind string) string {
+			if _, ok := labels[kind]; !ok {
+				labels[kind] = generatedLabel(kind, nextLabelIndex(kind))
+			}
+			return labels[kind]
+		},
+		"scratch": func(n int) (string, error) {
+			if n < 0 || n >= scratchNeeded {
+				return "", fmt.Errorf("scratch %d out of range, there are %d scratch registers", n, scratchNeeded)
+			}
+			return scratch(n), nil
+		},
+	}
+}
+
+// templateCode is the code of a command its template generates, ok being
+// false when it has none.
+func (i *Instruction) templateCode() (lines []string, ok bool, err error) {
+	t := codegenTemplates[i.templateKey()]
+	if t == nil || optLevel != optNone {
+		return nil, false, nil
+	}
+	data := templateData{Command: i.Line, Index: i.Arg2Val, Name: i.Arg1}
+	switch i.SegmentType {
+	case SegmentTypeLocal, SegmentTypeArgument, SegmentTypeThis, SegmentTypeThat:
+		data.Segment = i.SegmentType.ID()
+	case SegmentTypeStatic:
+		data.Address, _ = staticSymbol(i)
+	case SegmentTypeTemp:
+		data.Address = strconv.Itoa(layout.Temp + i.Arg2Val)
+	case SegmentTypePointer:
+		data.Address = pointerSymbol(i.Arg2Val)
+	}
+	if i.CommandType != CommandTypePush && i.CommandType != CommandTypePop {
+		data.Segment, data.Address = "", ""
+	}
+	if i.CommandType == CommandTypeFunction {
+		// the generated labels of the function start with its name, as
+		// genFunction does
+		currentFunctionName, labelCounts = i.Arg1, map[string]int{}
+	}
+	var sb strings.Builder
+	if err := t.Funcs(templateFuncs(map[string]string{})).Execute(&sb, data); err != nil {
+		return nil, true, err
+	}
+	for _, line := range strings.Split(sb.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, true, nil
+}
+
+// templatesFlag is the --codegen-templates flag, reading the templates of
+// a directory.
+type templatesFlag struct{}
+
+func (templatesFlag) String() string { return templatesDir }
+
+func (templatesFlag) Set(dir string) error {
+	templates, err := loadTemplates(dir)
+	if err != nil {
+		return err
+	}
+	templatesDir, codegenTemplates, templatesChecked = dir, templates, false
+	return nil
+}
+
+func registerTemplatesFlag(fs *flag.FlagSet) {
+	fs.Var(templatesFlag{}, "codegen-templates", "directory of text/template files replacing the -O0 code of the commands they are named after (e.g. push_constant.tmpl, call.tmpl), proved equivalent to the VM before they are used")
+}
+
+// loadTemplates parses the .tmpl files of dir, every one named after a
+// key of templateKeys.
+func loadTemplates(dir string) (map[string]*template.Template, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		if _, err := os.Stat(dir); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no .tmpl files in %s", dir)
+	}
+	keys := templateKeys()
+	templates := map[string]*template.Template{}
+	for _, path := range paths {
+		key := strings.TrimSuffix(filepath.Base(path), ".tmpl")
+		if !slices.Contains(keys, key) {
+			return nil, fmt.Errorf("%s: no command named %s, expected one of %s", path, key, strings.Join(keys, ", "))
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(filepath.Base(path)).Option("missingkey=error").Funcs(templateFuncs(nil)).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		templates[key] = t
+	}
+	return templates, nil
+}
+
+// checkTemplates proves the templates equivalent to the VM on the cases
+// of verify-codegen using the commands they replace, like verify-codegen
+// does, before the first translation with them. The templates of mult,
+// div and mod are not checked.
+func checkTemplates() error {
+	if len(codegenTemplates) == 0 || templatesChecked {
+		return nil
+	}
+	defer resetCodegenState()
+	for _, src := range verifyCases(extendedMode) {
+		uses := []string{}
+		for k, line := range src {
+			inst, err := parseInstruction(k, verifyFile, line)
+			if err != nil {
+				return err
+			}
+			if key := inst.templateKey(); codegenTemplates[key] != nil && !slices.Contains(uses, key+".tmpl") {
+				uses = append(uses, key+".tmpl")
+			}
+		}
+		if len(uses) == 0 {
+			continue
+		}
+		diffs, err := checkCodegen(src, false)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", strings.Join(uses, ", "), strings.Join(src, "; "), err)
+		}
+		if len(diffs) > 0 {
+			return fmt.Errorf("%s: %s differs from the VM: %s", strings.Join(uses, ", "), strings.Join(src, "; "), strings.Join(diffs, "; "))
+		}
+	}
+	templatesChecked = true
+	return nil
+}
@@ -0,0 +1,54 @@
+// push constant 3
+@3
+D=A
+@SP
+AM=M+1
+A=A-1
+M=D
+// pop static 0
+@SP
+AM=M-1
+D=M
+@Main.0
+M=D
+// label LOOP
+(LOOP)
+// push static 0
+@Main.0
+D=M
+@SP
+AM=M+1
+A=A-1
+M=D
+// push constant 1
+@1
+D=A
+@SP
+AM=M+1
+A=A-1
+M=D
+// sub
+@SP
+AM=M-1
+D=M
+A=A-1
+M=M-D
+// pop static 0
+@SP
+AM=M-1
+D=M
+@Main.0
+M=D
+// push static 0
+@Main.0
+D=M
+@SP
+AM=M+1
+A=A-1
+M=D
+// if-goto LOOP
+@SP
+AM=M-1
+D=M
+@LOOP
+D;JNE
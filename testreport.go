@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// testSuite is a group of test results, reported as JUnit XML or TAP for
+// CI systems to show.
+type testSuite struct {
+	Name  string
+	Cases []testCase
+}
+
+// testCase is the result of a test.
+type testCase struct {
+	Class   string // what is tested, e.g. the project or the test folder
+	Name    string
+	Elapsed time.Duration
+	// Failure is why the test failed, "" when it passed
+	Failure string
+	// Details are the output of a failed test: a diff, diagnostics
+	Details string
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",cdata"`
+}
+
+func junitTime(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// writeJUnit writes the suites as JUnit XML, as read by GitLab, the test
+// summaries of GitHub Actions and most CI dashboards.
+func writeJUnit(w io.Writer, suites []testSuite) error {
+	report := junitSuites{}
+	total := time.Duration(0)
+	for _, s := range suites {
+		js := junitSuite{Name: s.Name, Tests: len(s.Cases)}
+		elapsed := time.Duration(0)
+		for _, c := range s.Cases {
+			jc := junitCase{Name: c.Name, Classname: c.Class, Time: junitTime(c.Elapsed)}
+			if c.Failure != "" {
+				js.Failures++
+				jc.Failure = &junitFailure{Message: c.Failure, Text: c.Details}
+			}
+			elapsed += c.Elapsed
+			js.Cases = append(js.Cases, jc)
+		}
+		js.Time = junitTime(elapsed)
+		report.Tests += js.Tests
+		report.Failures += js.Failures
+		total += elapsed
+		report.Suites = append(report.Suites, js)
+	}
+	report.Time = junitTime(total)
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, data)
+	return err
+}
+
+// writeTAP writes the suites as a TAP version 13 stream, the failures
+// described by a YAML block. A test is described by its class and name,
+// after the name of its suite when there are several.
+func writeTAP(w io.Writer, suites []testSuite) error {
+	var b strings.Builder
+	n := 0
+	for _, s := range suites {
+		n += len(s.Cases)
+	}
+	fmt.Fprintf(&b, "TAP version 13\n1..%d\n", n)
+	k := 0
+	for _, s := range suites {
+		for _, c := range s.Cases {
+			k++
+			status := "ok"
+			if c.Failure != "" {
+				status = "not ok"
+			}
+			parts := []string{c.Class, c.Name}
+			if len(suites) > 1 {
+				parts = append([]string{s.Name}, parts...)
+			}
+			parts = slices.DeleteFunc(parts, func(p string) bool { return p == "" })
+			name := strings.Join(parts, ": ")
+			fmt.Fprintf(&b, "%s %d - %s\n", status, k, strings.ReplaceAll(name, "#", `\#`))
+			if c.Failure == "" {
+				continue
+			}
+			b.WriteString("  ---\n")
+			fmt.Fprintf(&b, "  message: %s\n", strconv.Quote(c.Failure))
+			if c.Details != "" {
+				b.WriteString("  details: |\n")
+				for _, l := range strings.Split(strings.TrimRight(c.Details, "\n"), "\n") {
+					b.WriteString("    " + l + "\n")
+				}
+			}
+			b.WriteString("  ...\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeTestReport writes the suites in format, junit or tap.
+func writeTestReport(w io.Writer, format string, suites []testSuite) error {
+	if format == "tap" {
+		return writeTAP(w, suites)
+	}
+	return writeJUnit(w, suites)
+}
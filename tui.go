@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// tuiFrame is how often the terminal UI is redrawn
+	tuiFrame = time.Second / 30
+	// tuiKeyHold is how long a key typed in the terminal UI stays pressed
+	// in the keyboard register, as terminals do not tell when a key is
+	// released
+	tuiKeyHold    = 150 * time.Millisecond
+	tuiPanelWidth = 32
+	tuiRowWords   = 8
+)
+
+// hackKeyCode is the code the keyboard register holds while the key of a
+// character typed in a terminal is pressed, 0 for the keys the Hack
+// keyboard does not have.
+func hackKeyCode(key string) int16 {
+	switch key {
+	case "\r", "\n":
+		return 128
+	case "\x7f", "\b":
+		return 129
+	case "\x1b[D":
+		return 130
+	case "\x1b[A":
+		return 131
+	case "\x1b[C":
+		return 132
+	case "\x1b[B":
+		return 133
+	case "\x1b[H", "\x1b[1~":
+		return 134
+	case "\x1b[F", "\x1b[4~":
+		return 135
+	case "\x1b[2~":
+		return 138
+	case "\x1b[3~":
+		return 139
+	case "\x1b":
+		return 140
+	case "\x1bOP", "\x1bOQ", "\x1bOR", "\x1bOS":
+		return 141 + int16(key[2]-'P')
+	}
+	if len(key) == 1 && key[0] >= ' ' && key[0] <= '~' {
+		return int16(key[0])
+	}
+	return 0
+}
+
+// splitKeys splits what a read from the terminal returned into keys: a
+// character, or an escape sequence of the arrows, function keys...
+func splitKeys(b []byte) []string {
+	keys := []string{}
+	for len(b) > 0 {
+		n := 1
+		if b[0] == 0x1b && len(b) > 2 && (b[1] == '[' || b[1] == 'O') {
+			n = 2
+			for n < len(b) && !(b[n] >= 'A' && b[n] <= 'Z' || b[n] == '~') {
+				n++
+			}
+			n = min(n+1, len(b))
+		}
+		keys = append(keys, string(b[:n]))
+		b = b[n:]
+	}
+	return keys
+}
+
+// stty runs stty on the terminal of stdin.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminalUI shows a running program in the terminal: its screen drawn
+// with Braille characters, its registers, the VM command it runs and a
+// window of its RAM.
+type terminalUI struct {
+	dbg *vmDebugger
+	// scale is the number of screen pixels a Braille dot stands for,
+	// across and down
+	scale      int
+	rows, cols int
+	// memAddr is the first address of the memory inspector
+	memAddr int
+	paused  bool
+	// breakpoint is set while paused at a breakpoint
+	breakpoint bool
+	// command is the last VM command run, -1 before the first
+	command int
+	// pressed is set while a key typed is held in the keyboard register,
+	// since keyAt
+	pressed bool
+	keyAt   time.Time
+}
+
+func newTerminalUI(dbg *vmDebugger) (*terminalUI, error) {
+	fi, err := os.Stdout.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil, errors.New("--tui needs a terminal")
+	}
+	size, err := stty("size")
+	if err != nil {
+		return nil, fmt.Errorf("--tui needs a terminal: %w", err)
+	}
+	t := &terminalUI{dbg: dbg, memAddr: layout.Stack, command: -1}
+	if _, err := fmt.Sscan(size, &t.rows, &t.cols); err != nil {
+		return nil, fmt.Errorf("reading the terminal size %q: %w", size, err)
+	}
+	for t.scale = 1; t.scale <= 8; t.scale *= 2 {
+		w, h := t.screenSize()
+		if w+2+tuiPanelWidth <= t.cols && h+2+4 <= t.rows {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("the terminal is too small (%d×%d) for --tui", t.cols, t.rows)
+}
+
+// screenSize is the size of the screen in characters.
+func (t *terminalUI) screenSize() (w, h int) {
+	return screenWidth / (2 * t.scale), screenHeight / (4 * t.scale)
+}
+
+// run steps the program until done reports it is over, drawing it as it
+// goes, and until the user then presses a key. Ctrl-C stops it at any
+// time.
+func (t *terminalUI) run(step func() error, done func() bool) error {
+	saved, err := stty("-g")
+	if err != nil {
+		return err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return err
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		stty(saved)
+	}()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	keys := make(chan string, 64)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				return
+			}
+			for _, k := range splitKeys(buf[:n]) {
+				keys <- k
+			}
+		}
+	}()
+
+	cpu := t.dbg.CPU
+	var runErr error
+	for {
+		over := runErr != nil || done()
+		deadline := time.Now().Add(tuiFrame)
+		for !over && !t.paused && time.Now().Before(deadline) {
+			for range 4096 {
+				if runErr = step(); runErr != nil || done() {
+					over = true
+					break
+				}
+				if cmd := t.dbg.CommandAt(cpu.PC); cmd >= 0 {
+					t.command = cmd
+				}
+				if t.dbg.Breakpoints[cpu.PC] {
+					t.paused, t.breakpoint = true, true
+					break
+				}
+			}
+		}
+		if t.pressed && time.Since(t.keyAt) > tuiKeyHold {
+			cpu.RAM[layout.Keyboard], t.pressed = 0, false
+		}
+		t.draw(over, runErr)
+		timer := time.NewTimer(max(time.Until(deadline), 0))
+		select {
+		case <-interrupt:
+			timer.Stop()
+			return runErr
+		case k := <-keys:
+			timer.Stop()
+			if over {
+				return runErr
+			}
+			t.key(k)
+		case <-timer.C:
+		}
+		for len(keys) > 0 && !over {
+			t.key(<-keys)
+		}
+	}
+}
+
+// key handles a key typed: Tab pauses, Page Up and Down scroll the memory
+// inspector, the others are pressed on the Hack keyboard.
+func (t *terminalUI) key(k string) {
+	_, h := t.screenSize()
+	page := (t.rows - h - 4) * tuiRowWords
+	switch k {
+	case "\t":
+		t.paused, t.breakpoint = !t.paused, false
+	case "\x1b[5~":
+		t.memAddr = max(t.memAddr-page, 0)
+	case "\x1b[6~":
+		t.memAddr = min(t.memAddr+page, (layout.RAMSize()-1)/tuiRowWords*tuiRowWords)
+	default:
+		if code := hackKeyCode(k); code != 0 {
+			t.dbg.CPU.RAM[layout.Keyboard] = code
+			t.pressed, t.keyAt = true, time.Now()
+		}
+	}
+}
+
+func (t *terminalUI) draw(over bool, runErr error) {
+	cpu := t.dbg.CPU
+	ram := cpu.RAM
+	state := "running"
+	switch {
+	case runErr != nil:
+		state = "failed, press a key"
+	case over && cpu.Halted():
+		state = "halted, press a key"
+	case over:
+		state = "stopped, press a key"
+	case t.breakpoint:
+		state = "paused at a breakpoint"
+	case t.paused:
+		state = "paused"
+	}
+	panel := []string{
+		fmt.Sprintf("cycles %d", cpu.Cycles),
+		state,
+		"",
+		fmt.Sprintf("PC %-6d A %-6d D %d", cpu.PC, cpu.A, cpu.D),
+		fmt.Sprintf("SP %-6d LCL %d", ram[0], ram[1]),
+		fmt.Sprintf("ARG %-5d THIS %d", ram[2], ram[3]),
+		fmt.Sprintf("THAT %-4d KBD %d", ram[4], ram[layout.Keyboard]),
+		"",
+	}
+	if t.command >= 0 {
+		sl := t.dbg.Tr.Commands[t.command]
+		panel = append(panel, t.dbg.Function[t.command], sl.Pos(), "  "+sl.Text)
+	}
+	if runErr != nil {
+		panel = append(panel, "", runErr.Error())
+	}
+	if t.paused || over {
+		// the call stack, the calls made by the calling frames
+		panel = append(panel, "")
+		for _, f := range t.dbg.Frames() {
+			where := ""
+			if f.Command >= 0 {
+				sl := t.dbg.Tr.Commands[f.Command]
+				where = fmt.Sprintf(" %s:%d", filepath.Base(sl.File), sl.Line)
+			}
+			panel = append(panel, "in "+frameName(f)+where)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	line := func(s string) {
+		b.WriteString(s + "\x1b[K\n")
+	}
+	w, h := t.screenSize()
+	panelAt := func(k int) string {
+		if k >= len(panel) {
+			return ""
+		}
+		s := []rune(panel[k])
+		return "  " + string(s[:min(len(s), tuiPanelWidth-2)])
+	}
+	line("┌" + strings.Repeat("─", w) + "┐" + panelAt(0))
+	for row := range h {
+		var r strings.Builder
+		for col := range w {
+			r.WriteRune(t.brailleAt(ram, col, row))
+		}
+		line("│" + r.String() + "│" + panelAt(row+1))
+	}
+	line("└" + strings.Repeat("─", w) + "┘" + panelAt(h+1))
+	for k := range t.rows - h - 4 {
+		addr := t.memAddr + k*tuiRowWords
+		if addr >= layout.RAMSize() {
+			line("")
+			continue
+		}
+		cells := []string{fmt.Sprintf("%5d:", addr)}
+		for a := addr; a < min(addr+tuiRowWords, layout.RAMSize()); a++ {
+			cell := fmt.Sprintf("%7s", strconv.Itoa(int(ram[a])))
+			if a == int(ram[0]) {
+				// the top of the stack
+				cell = "\x1b[7m" + cell + "\x1b[0m"
+			}
+			cells = append(cells, cell)
+		}
+		line(strings.Join(cells, ""))
+	}
+	b.WriteString("Tab pause  PgUp/PgDn memory  Ctrl-C quit  other keys go to the keyboard\x1b[K")
+	fmt.Print(b.String())
+}
+
+// brailleAt is the Braille character drawing the screen at col, row of
+// the screen in characters, a dot set when any pixel it stands for is.
+func (t *terminalUI) brailleAt(ram []int16, col, row int) rune {
+	// the bit of every dot of a Braille cell, by column then row
+	dots := [2][4]rune{{0x01, 0x02, 0x04, 0x40}, {0x08, 0x10, 0x20, 0x80}}
+	r := rune(0x2800)
+	for dx := range 2 {
+		for dy := range 4 {
+			x0, y0 := (col*2+dx)*t.scale, (row*4+dy)*t.scale
+		block:
+			for y := y0; y < y0+t.scale; y++ {
+				for x := x0; x < x0+t.scale; x++ {
+					if screenPixel(ram, x, y) {
+						r |= dots[dx][dy]
+						break block
+					}
+				}
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"runtime/debug"
+)
+
+// version, commit and buildDate describe the build, set by the release
+// build with -ldflags "-X main.version=v1.2.0 -X main.commit=... -X
+// main.buildDate=...". Left empty, they are read from the build info the
+// go command stamps the binary with.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// pseudoVersionRe matches the version the go command makes up for a
+// commit without a tag, like v0.0.0-20260102150405-0123456789ab, which only
+// repeats the commit and its time.
+var pseudoVersionRe = regexp.MustCompile(`^v\d+\.\d+\.\d+-(.+\.)?\d{14}-[0-9a-f]{12}(\+dirty)?$`)
+
+// buildInfo is what the version subcommand prints.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"` // of the build, or of the commit when not set
+	Modified  bool   `json:"modified"`       // built from a tree with uncommitted changes
+	GoVersion string `json:"go_version"`
+}
+
+func readBuildInfo() buildInfo {
+	bi := buildInfo{Version: version, Commit: commit, Date: buildDate}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		bi.GoVersion = info.GoVersion
+		if bi.Version == "" && info.Main.Version != "" && !pseudoVersionRe.MatchString(info.Main.Version) {
+			bi.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && bi.Commit == "":
+				bi.Commit = s.Value
+			case s.Key == "vcs.time" && bi.Date == "":
+				bi.Date = s.Value
+			case s.Key == "vcs.modified":
+				bi.Modified = s.Value == "true"
+			}
+		}
+	}
+	if bi.Version == "" {
+		bi.Version = "(devel)"
+	}
+	return bi
+}
+
+// String is the one line version written in the header of the generated
+// assembly.
+func (bi buildInfo) String() string {
+	s := "vmtranslator " + bi.Version
+	if bi.Commit != "" {
+		c := bi.Commit[:min(len(bi.Commit), 12)]
+		if bi.Modified {
+			c += "+dirty"
+		}
+		s += " (" + c
+		if bi.Date != "" {
+			s += ", " + bi.Date
+		}
+		s += ")"
+	} else if bi.Date != "" {
+		s += " (" + bi.Date + ")"
+	}
+	return s
+}
+
+// printVersion implements the version subcommand and the --version flag.
+func printVersion() {
+	bi := readBuildInfo()
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	fmt.Println("vmtranslator", bi.Version)
+	c := unknown(bi.Commit)
+	if bi.Modified {
+		c += " (modified)"
+	}
+	fmt.Println("commit:", c)
+	fmt.Println("built:", unknown(bi.Date))
+	fmt.Println("go:", unknown(bi.GoVersion))
+}
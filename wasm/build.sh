@@ -0,0 +1,33 @@
+#!/bin/bash
+
+# Build the translator for the browser: vmtranslator.wasm and the
+# wasm_exec.js loading it, next to index.html, in the output directory
+# (this directory by default). Serve it with any static file server.
+set -e
+
+here=$(cd "$(dirname "$0")" && pwd)
+out=${1:-$here}
+mkdir -p "$out"
+out=$(cd "$out" && pwd)
+
+# the translator is a single main package built from its files, so the
+# js entry point is linked in next to them in a directory of its own
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+for f in "$here"/../*.go; do
+    case "$f" in *_test.go) continue ;; esac
+    ln -s "$f" "$work/"
+done
+cp -r "$here/../os" "$work/os" # embedded, which does not follow links
+cp "$here/../superopt.json" "$here/../go.mod" "$work/"
+ln -s "$here/main_js.go" "$work/"
+
+(cd "$work" && GOOS=js GOARCH=wasm go build -trimpath -o "$out/vmtranslator.wasm" .)
+
+goroot=$(go env GOROOT)
+exec_js="$goroot/lib/wasm/wasm_exec.js"
+[ -f "$exec_js" ] || exec_js="$goroot/misc/wasm/wasm_exec.js"
+cp "$exec_js" "$out/"
+[ "$out" = "$here" ] || cp "$here/index.html" "$out/"
+
+echo "Built $out/vmtranslator.wasm"
@@ -0,0 +1,84 @@
+//go:build js && wasm
+
+// The js/wasm build of the translator, built with the sources of the
+// translator by build.sh, its directory keeping it out of the package of
+// the parent directory.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"syscall/js"
+)
+
+func init() {
+	platformMain = runWasm
+}
+
+// runWasm exports the translator to JavaScript as the vmtranslator global
+// and keeps the program running for the page to call it:
+//
+//	vmtranslator.translate({"Main.vm": "...", "Sys.vm": "..."}, {ext: true})
+//	vmtranslator.translate("push constant 7\n...")
+//	vmtranslator.version()
+//
+// translate returns the object POST /translate of the serve subcommand
+// answers with: {ok, exit_status, asm, diagnostics, stats}. Its options
+// are the other fields of that request: bootstrap, entry, entry_nargs,
+// ext and with_os.
+func runWasm() {
+	api := js.Global().Get("Object").New()
+	api.Set("translate", js.FuncOf(jsTranslate))
+	api.Set("version", js.FuncOf(func(js.Value, []js.Value) any {
+		return toJSValue(readBuildInfo())
+	}))
+	js.Global().Set("vmtranslator", api)
+	select {}
+}
+
+// jsTranslate implements vmtranslator.translate(sources, options).
+func jsTranslate(_ js.Value, args []js.Value) (result any) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = toJSValue(&serveResponse{ExitStatus: exitInternal, Diagnostics: []serveDiagnostic{{
+				Severity: "error",
+				Message:  fmt.Sprintf("Internal error: %v\n%s", r, debug.Stack()),
+			}}})
+		}
+	}()
+	req := &serveRequest{}
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		if err := json.Unmarshal([]byte(js.Global().Get("JSON").Call("stringify", args[1]).String()), req); err != nil {
+			return jsUsageError(fmt.Errorf("invalid options: %w", err))
+		}
+	}
+	switch {
+	case len(args) == 0:
+	case args[0].Type() == js.TypeString:
+		req.Source = args[0].String()
+	case args[0].Type() == js.TypeObject:
+		if err := json.Unmarshal([]byte(js.Global().Get("JSON").Call("stringify", args[0]).String()), &req.Files); err != nil {
+			return jsUsageError(fmt.Errorf("invalid sources, expected the text of each file by name: %w", err))
+		}
+	default:
+		return jsUsageError(fmt.Errorf("invalid sources, expected a string or an object"))
+	}
+	if err := req.normalize(); err != nil {
+		return jsUsageError(err)
+	}
+	return toJSValue(translateRequest(req))
+}
+
+func jsUsageError(err error) js.Value {
+	return toJSValue(&serveResponse{ExitStatus: exitUsage, Diagnostics: []serveDiagnostic{{Severity: "error", Message: err.Error()}}})
+}
+
+// toJSValue converts v to a JavaScript object through its JSON.
+func toJSValue(v any) js.Value {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return js.Global().Get("JSON").Call("parse", string(data))
+}